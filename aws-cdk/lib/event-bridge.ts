@@ -8,6 +8,8 @@ import * as cloudtrail from "@aws-cdk/aws-cloudtrail"
 import * as path from "path"
 import { Duration } from "@aws-cdk/core"
 import * as iam from "@aws-cdk/aws-iam"
+import * as iot from "@aws-cdk/aws-iot"
+import * as iotActions from "@aws-cdk/aws-iot-actions"
 
 export interface ILamassuEventBridge {
   outboundSQSQueue: IQueue,
@@ -100,5 +102,21 @@ export class LamassuEventBridge extends cdk.Construct {
         eventName: ["UpdateCACertificate"]
       }
     })
+
+    // Shadow documents are forwarded as CloudEvents so the connector can clear the desired
+    // flags of the actions devices report as completed.
+    const shadowDocumentsSql = (topic: string, shadowName: string) => iot.IotSql.fromStringAsVer20160323(
+      `SELECT '1.0' AS specversion, newuuid() AS id, 'aws/iot-rule' AS source, 'io.lamassu.iotcore.thing.shadow.update' AS type, 'application/json' AS datacontenttype, topic(3) AS thingname, ${shadowName} AS shadowname, current AS data FROM '${topic}'`
+    )
+
+    new iot.TopicRule(this, "IotCoreClassicShadowDocumentsMonitor", {
+      sql: shadowDocumentsSql("$aws/things/+/shadow/update/documents", "''"),
+      actions: [new iotActions.SqsQueueAction(config.outboundSQSQueue)]
+    })
+
+    new iot.TopicRule(this, "IotCoreNamedShadowDocumentsMonitor", {
+      sql: shadowDocumentsSql("$aws/things/+/shadow/name/+/update/documents", "topic(6)"),
+      actions: [new iotActions.SqsQueueAction(config.outboundSQSQueue)]
+    })
   }
 }
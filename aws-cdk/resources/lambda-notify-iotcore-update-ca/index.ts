@@ -20,11 +20,13 @@ export const handler = async (event: any) => {
       source: "aws/cloud-trail",
       time: new Date().toString(),
       specversion: "1.0",
+      ...correlationIdFromUserAgent(event.detail.userAgent),
       data: {
         ca_id: certificateId,
         ca_name: caCert.subject.commonName,
         ca_serial_number: chunk(caCert.serialNumber, 2).join("-"),
-        status: newStatus
+        status: newStatus,
+        actor: actorFromCloudTrail(event.detail)
       }
     })
     try {
@@ -49,3 +51,29 @@ function chunk(str: string, n: number) {
 
   return ret
 }
+
+// The status changes made by the Lamassu AWS connector carry a correlation ID in their user
+// agent, which is handed back so that the connector ignores its own changes.
+function correlationIdFromUserAgent(userAgent: string | undefined) {
+  const match = /lamassu-aws-connector-change\/([0-9a-f-]+)/.exec(userAgent || "")
+  return match ? { correlationid: match[1] } : {}
+}
+
+// Who made the change, used by the connector to describe the revocations in Lamassu.
+function actorFromCloudTrail(detail: any) {
+  const userIdentity = detail.userIdentity || {}
+  // Changes made by AWS services, e.g. Device Defender mitigation actions, have the service
+  // name as source IP address.
+  const sourceService = /\.amazonaws\.com$/.test(detail.sourceIPAddress || "") ? detail.sourceIPAddress : undefined
+  return {
+    type: userIdentity.type,
+    arn: userIdentity.arn,
+    principal_id: userIdentity.principalId,
+    account_id: userIdentity.accountId,
+    invoked_by: userIdentity.invokedBy || sourceService,
+    source_ip: detail.sourceIPAddress,
+    user_agent: detail.userAgent,
+    event_time: detail.eventTime,
+    event_id: detail.eventID
+  }
+}
@@ -30,6 +30,7 @@ export const handler = async (event: any) => {
     source: "aws/cloud-trail",
     time: new Date().toString(),
     specversion: "1.0",
+    ...correlationIdFromUserAgent(event.detail.userAgent),
     data: {
       ca_id: describeCertResponse.certificateDescription!.caCertificateId,
       ca_name: caCert.subject.commonName,
@@ -38,7 +39,8 @@ export const handler = async (event: any) => {
       serial_number: chunk(cert.serialNumber, 2).join("-"),
 
       device_id: deviceID,
-      status: newStatus
+      status: newStatus,
+      actor: actorFromCloudTrail(event.detail)
     }
   })
   try {
@@ -60,3 +62,29 @@ function chunk (str: string, n: number) {
 
   return ret
 }
+
+// The status changes made by the Lamassu AWS connector carry a correlation ID in their user
+// agent, which is handed back so that the connector ignores its own changes.
+function correlationIdFromUserAgent (userAgent: string | undefined) {
+  const match = /lamassu-aws-connector-change\/([0-9a-f-]+)/.exec(userAgent || "")
+  return match ? { correlationid: match[1] } : {}
+}
+
+// Who made the change, used by the connector to describe the revocations in Lamassu.
+function actorFromCloudTrail (detail: any) {
+  const userIdentity = detail.userIdentity || {}
+  // Changes made by AWS services, e.g. Device Defender mitigation actions, have the service
+  // name as source IP address.
+  const sourceService = /\.amazonaws\.com$/.test(detail.sourceIPAddress || "") ? detail.sourceIPAddress : undefined
+  return {
+    type: userIdentity.type,
+    arn: userIdentity.arn,
+    principal_id: userIdentity.principalId,
+    account_id: userIdentity.accountId,
+    invoked_by: userIdentity.invokedBy || sourceService,
+    source_ip: detail.sourceIPAddress,
+    user_agent: detail.userAgent,
+    event_time: detail.eventTime,
+    event_id: detail.eventID
+  }
+}
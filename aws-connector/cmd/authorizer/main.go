@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	awsIot "github.com/aws/aws-sdk-go/service/iot"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/lamassuiot/aws-connector/pkg/authorizer"
+	"github.com/lamassuiot/aws-connector/pkg/server/config"
+	lamassucaclient "github.com/lamassuiot/lamassuiot/pkg/ca/client"
+	lamassudevmanager "github.com/lamassuiot/lamassuiot/pkg/device-manager/client"
+	clientUtils "github.com/lamassuiot/lamassuiot/pkg/utils/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// The custom authorizer Lambda. Built as the bootstrap of a provided.al2 function:
+//
+//	CGO_ENABLED=0 GOOS=linux go build -mod=vendor -o bootstrap ./cmd/authorizer
+func main() {
+	log.SetFormatter(&log.JSONFormatter{})
+
+	var config config.AuthorizerConfig
+	err := envconfig.Process("", &config)
+	if err != nil {
+		log.Fatal("Could not process configuration: ", err)
+	}
+
+	caClient, err := lamassucaclient.NewLamassuCAClient(clientConfiguration(config.LamassuCAAddress, config.LamassuCACertFile, config.LamassuCAInsecureSkipVerify, config))
+	if err != nil {
+		log.Fatal("Could not create LamassuCA client: ", err)
+	}
+
+	devManagerClient, err := lamassudevmanager.NewLamassuDeviceManagerClient(clientConfiguration(config.LamassuDeviceManagerAddress, config.LamassuDeviceManagerCertFile, config.LamassuDeviceManagerInsecureSkipVerify, config))
+	if err != nil {
+		log.Fatal("Could not create Device Manager client: ", err)
+	}
+
+	sess := session.Must(session.NewSession())
+	cas := authorizer.NewAWSCASource(awsIot.New(sess), config.AuthorizerCACacheTTL)
+
+	a := authorizer.NewAuthorizer(cas, caClient, devManagerClient, authorizer.Options{
+		Audience:         config.AuthorizerAudience,
+		MaxTokenLifetime: config.AuthorizerMaxTokenLifetime,
+		RefreshAfter:     config.AuthorizerRefreshAfter,
+	})
+
+	err = authorizer.StartLambda(a)
+	if err != nil {
+		log.Fatal("Authorizer stopped: ", err)
+	}
+}
+
+// clientConfiguration authenticates with the certificate of the authorizer to the Lamassu
+// services served over https.
+func clientConfiguration(address string, caCertFile string, insecure bool, config config.AuthorizerConfig) clientUtils.BaseClientConfigurationuration {
+	parsedURL, err := url.Parse(address)
+	if err != nil {
+		log.Fatal("Could not parse URL: ", err)
+	}
+
+	if !strings.HasPrefix(address, "https") {
+		return clientUtils.BaseClientConfigurationuration{
+			URL:        parsedURL,
+			AuthMethod: clientUtils.AuthMethodNone,
+		}
+	}
+
+	return clientUtils.BaseClientConfigurationuration{
+		URL:        parsedURL,
+		AuthMethod: clientUtils.AuthMethodMutualTLS,
+		AuthMethodConfig: &clientUtils.MutualTLSConfig{
+			ClientCert: config.CertFile,
+			ClientKey:  config.KeyFile,
+		},
+		CACertificate: caCertFile,
+		Insecure:      insecure,
+	}
+}
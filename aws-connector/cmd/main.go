@@ -1,25 +1,34 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
+	metrics "github.com/armon/go-metrics"
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+
+	"github.com/lamassuiot/aws-connector/pkg/server/api/errors"
 	"github.com/lamassuiot/aws-connector/pkg/server/api/service"
 	"github.com/lamassuiot/aws-connector/pkg/server/api/transport"
 	"github.com/lamassuiot/aws-connector/pkg/server/config"
+	"github.com/lamassuiot/aws-connector/pkg/server/store"
 	"github.com/lamassuiot/aws-connector/pkg/server/store/db"
 	lamassucaclient "github.com/lamassuiot/lamassuiot/pkg/ca/client"
 	"github.com/lamassuiot/lamassuiot/pkg/cloud-provider/server/api/discovery"
-	cloudprovidertransport "github.com/lamassuiot/lamassuiot/pkg/cloud-provider/server/api/transport"
 	lamassudevmanager "github.com/lamassuiot/lamassuiot/pkg/device-manager/client"
 	lamassudmsclient "github.com/lamassuiot/lamassuiot/pkg/dms-manager/client"
 	clientUtils "github.com/lamassuiot/lamassuiot/pkg/utils/client"
 	"github.com/lamassuiot/lamassuiot/pkg/utils/server"
+	"github.com/robfig/cron/v3"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -146,30 +155,200 @@ func main() {
 	}
 	log.Info(fmt.Sprintf("Service liveness information registered to Consul. ID: %s", connectorID))
 
-	dbStore, err := db.NewInMemoryDB()
+	var dbStore store.DB
+	switch config.StoreBackend {
+	case "badger":
+		dbStore, err = db.NewPersistentDB(config.ConnectorPersistenceDir)
+	case "sqlite":
+		path := config.StoreSQLitePath
+		if path == "" {
+			path = filepath.Join(config.ConnectorPersistenceDir, "connector.db")
+		}
+		dbStore, err = db.NewSQLiteDB(path)
+	case "postgres":
+		dbStore, err = db.NewPostgresDB(config.StorePostgresDSN)
+	default:
+		err = fmt.Errorf("unknown store backend %q", config.StoreBackend)
+	}
+	if err != nil {
+		log.Fatal("Could not open the persistent DB: ", err)
+	}
+
+	reconcileRules, err := api.ParseReconcileRules(config.ReconcilerRules)
+	if err != nil {
+		log.Fatal("Could not parse reconciler rules: ", err)
+	}
+
+	operatingMode := api.OperatingMode(config.OperatingMode)
+	if operatingMode != api.OperatingModeOrchestrated && operatingMode != api.OperatingModeEventDriven {
+		log.Fatal(fmt.Sprintf("Unknown operating mode %q", config.OperatingMode))
+	}
+
+	caStatusSyncAction, err := api.ParseCAStatusSyncAction(config.CAStatusSyncAction)
+	if err != nil {
+		log.Fatal("Could not parse the CA status sync action: ", err)
+	}
+
+	revocationReasonRules, err := api.ParseRevocationReasonRules(config.AWSRevocationReasonRules)
+	if err != nil {
+		log.Fatal("Could not parse the AWS revocation reason rules: ", err)
+	}
+
+	eventRoutingRules := []api.EventRoutingRule{}
+	if config.EventRoutingRulesFile != "" {
+		rules, err := os.ReadFile(config.EventRoutingRulesFile)
+		if err != nil {
+			log.Fatal("Could not read event routing rules: ", err)
+		}
+		eventRoutingRules, err = api.ParseEventRoutingRules(rules)
+		if err != nil {
+			log.Fatal("Could not parse event routing rules: ", err)
+		}
+	}
+
+	inmemSink := metrics.NewInmemSink(10*time.Second, time.Minute)
+	_, err = metrics.NewGlobal(metrics.DefaultConfig(config.ServiceName), inmemSink)
 	if err != nil {
-		log.Fatal("Could not create InMemory DB: ", err)
+		log.Fatal("Could not create metrics sink: ", err)
 	}
 
-	svc, err := service.NewAwsConnectorService(connectorID, caClient, dmsClient, devManagerClient, dbStore, config.AWSDefaultRegion, config.AWSAccessKeyID, config.AWSSecretAccessKey, config.AWSSqsOutboundQueueName)
+	svc, err := service.NewAwsConnectorService(connectorID, caClient, dmsClient, devManagerClient, dbStore, config.AWSDefaultRegion, config.AWSAccessKeyID, config.AWSSecretAccessKey, config.AWSSqsOutboundQueueName, service.Options{
+		ShadowUpdateWorkers:         config.AWSShadowUpdateWorkers,
+		ShadowUpdateRate:            config.AWSShadowUpdateRate,
+		ReconcileRules:              reconcileRules,
+		DryRun:                      config.DryRun,
+		ConfigurationCacheTTL:       config.ConfigurationCacheTTL,
+		DeviceConfigurationCacheTTL: config.DeviceConfigurationCacheTTL,
+		OutboxMaxAttempts:           config.OutboxMaxAttempts,
+		EventRoutingRules:           eventRoutingRules,
+		OperatingMode:               operatingMode,
+		CAStatusSyncAction:          caStatusSyncAction,
+		StatusChangeEchoTTL:         config.StatusChangeEchoTTL,
+		RevocationReasonRules:       revocationReasonRules,
+		CertificateRenewalWindow:    config.CertificateRenewalWindow,
+		CAExpiryWarningWindow:       config.CAExpiryWarningWindow,
+		DMSThingGroups:              config.DMSThingGroups,
+		DMSThingGroupRoot:           config.DMSThingGroupRoot,
+	})
 	if err != nil {
 		log.Fatal("Could not create AWS Connector Service: ", err)
 	}
 
 	svc = service.LoggingMiddleware()(svc)
 
-	mainServer.AddHttpHandler("/v1/", http.StripPrefix("/v1", cloudprovidertransport.MakeHTTPHandler(svc)))
-	// transport.MakeSQSHandler(svc, config.AWSSqsInboundQueueName)
-	mainServer.AddAmqpConsumer(config.ServiceName, []string{"#"}, transport.MakeAmqpHandler(svc))
+	if operatingMode == api.OperatingModeEventDriven {
+		log.Info("Event driven mode enabled: Lamassu CA, certificate and DMS events are synced to AWS by the connector")
+	}
+
+	if config.DryRun {
+		log.Warn("Dry run mode enabled: mutating AWS calls will be recorded but not made")
+	}
+
+	mainServer.AddHttpHandler("/v1/", http.StripPrefix("/v1", transport.MakeCacheRefreshHandler(transport.MakeDryRunHandler(transport.MakeHTTPHandler(svc), config.DryRun))))
+	if config.AWSSqsInboundEnabled {
+		if config.AWSSqsInboundQueueName == "" {
+			log.Fatal("AWS_SQS_INBOUND_QUEUE_NAME is required when the inbound queue is enabled")
+		}
+		transport.MakeSQSHandler(svc, config.AWSSqsInboundQueueName)
+	}
+	eventIngestionAuth := transport.EventIngestionAuth{
+		APIKey:     config.HTTPEventsAPIKey,
+		HMACSecret: config.HTTPEventsHMACSecret,
+	}
+	if eventIngestionAuth.Enabled() {
+		mainServer.AddHttpHandler("/v1/events", transport.MakeDryRunHandler(transport.MakeCloudEventsHandler(svc, eventIngestionAuth), config.DryRun))
+	} else if !config.AWSSqsInboundEnabled {
+		log.Warn("No inbound SQS queue nor HTTP events credentials are configured: AWS events will not be received")
+	}
+	mainServer.AddAmqpConsumer(config.ServiceName, []string{"#"}, transport.MakeAmqpHandler(svc, config.ForwardUnknownLamassuEvents))
+	mainServer.AddHttpFuncHandler("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		summary, err := inmemSink.DisplayMetrics(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(summary)
+	})
+
+	if config.ReconcilerSchedule != "" {
+		reconciler := cron.New()
+		_, err = reconciler.AddFunc(config.ReconcilerSchedule, func() {
+			_, err := svc.Reconcile(context.Background(), &api.ReconcileInput{})
+			if err != nil {
+				logScheduledRunError("Reconciliation failed: ", err)
+			}
+		})
+		if err != nil {
+			log.Fatal("Could not schedule the reconciler: ", err)
+		}
+		reconciler.Start()
+	}
+
+	if config.RevocationEnforcementSchedule != "" {
+		revocationEnforcer := cron.New()
+		_, err = revocationEnforcer.AddFunc(config.RevocationEnforcementSchedule, func() {
+			_, err := svc.EnforceRevocations(context.Background(), &api.EnforceRevocationsInput{})
+			if err != nil {
+				logScheduledRunError("Revocation enforcement failed: ", err)
+			}
+		})
+		if err != nil {
+			log.Fatal("Could not schedule the revocation enforcement: ", err)
+		}
+		revocationEnforcer.Start()
+	}
+
+	if config.ExpiryMonitorSchedule != "" {
+		expiryMonitor := cron.New()
+		_, err = expiryMonitor.AddFunc(config.ExpiryMonitorSchedule, func() {
+			_, err := svc.MonitorExpiry(context.Background(), &api.MonitorExpiryInput{})
+			if err != nil {
+				logScheduledRunError("Expiry check failed: ", err)
+			}
+		})
+		if err != nil {
+			log.Fatal("Could not schedule the expiry checks: ", err)
+		}
+		expiryMonitor.Start()
+	}
+
+	if config.DMSThingGroups && config.DMSThingGroupSchedule != "" {
+		thingGroupSync := cron.New()
+		_, err = thingGroupSync.AddFunc(config.DMSThingGroupSchedule, func() {
+			_, err := svc.SyncDMSThingGroups(context.Background(), &api.SyncDMSThingGroupsInput{})
+			if err != nil {
+				logScheduledRunError("Thing group sync failed: ", err)
+			}
+		})
+		if err != nil {
+			log.Fatal("Could not schedule the thing group sync: ", err)
+		}
+		thingGroupSync.Start()
+	}
 
 	errs := make(chan error)
 	go func() {
-		c := make(chan os.Signal)
+		c := make(chan os.Signal, 1)
 		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 		errs <- fmt.Errorf("%s", <-c)
 	}()
 
 	mainServer.Run()
-	forever := make(chan struct{})
-	<-forever
+	log.Info("Shutting down: ", <-errs)
+
+	err = dbStore.Close()
+	if err != nil {
+		log.Error("Could not close the persistent DB: ", err)
+	}
+}
+
+// logScheduledRunError logs the error of a scheduled job. Every replica schedules the jobs and
+// the first one to start runs them, so the others finding them running are not warned about.
+func logScheduledRunError(message string, err error) {
+	if genericErr, ok := err.(*errors.GenericError); ok && genericErr.StatusCode == http.StatusConflict {
+		log.Debug(message, err)
+		return
+	}
+	log.Warn(message, err)
 }
@@ -0,0 +1,355 @@
+// Package authorizer implements an AWS IoT custom authorizer backed by Lamassu, for the
+// devices that connect with tokens instead of their certificate, e.g. MQTT over WebSocket.
+// The decision only depends on the interfaces it is given, so that it can be exercised
+// without AWS or Lamassu.
+package authorizer
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lamassuiot/aws-connector/pkg/server/utils"
+	caApi "github.com/lamassuiot/lamassuiot/pkg/ca/common/api"
+	devApi "github.com/lamassuiot/lamassuiot/pkg/device-manager/common/api"
+)
+
+// Request is the event AWS IoT sends to a custom authorizer.
+type Request struct {
+	// Token is set when the authorizer has a token key name and the client sends it.
+	Token              string             `json:"token"`
+	SignatureVerified  bool               `json:"signatureVerified"`
+	Protocols          []string           `json:"protocols"`
+	ProtocolData       ProtocolData       `json:"protocolData"`
+	ConnectionMetadata ConnectionMetadata `json:"connectionMetadata"`
+}
+
+type ProtocolData struct {
+	TLS  *TLSData  `json:"tls,omitempty"`
+	HTTP *HTTPData `json:"http,omitempty"`
+	MQTT *MQTTData `json:"mqtt,omitempty"`
+}
+
+type TLSData struct {
+	ServerName string `json:"serverName"`
+}
+
+type HTTPData struct {
+	Headers     map[string]string `json:"headers"`
+	QueryString string            `json:"queryString"`
+}
+
+type MQTTData struct {
+	Username string `json:"username"`
+	// Password is base64 encoded.
+	Password string `json:"password"`
+	ClientID string `json:"clientId"`
+}
+
+type ConnectionMetadata struct {
+	ID string `json:"id"`
+}
+
+// Response is the answer of a custom authorizer to AWS IoT.
+type Response struct {
+	IsAuthenticated          bool     `json:"isAuthenticated"`
+	PrincipalID              string   `json:"principalId,omitempty"`
+	DisconnectAfterInSeconds int      `json:"disconnectAfterInSeconds,omitempty"`
+	RefreshAfterInSeconds    int      `json:"refreshAfterInSeconds,omitempty"`
+	PolicyDocuments          []string `json:"policyDocuments,omitempty"`
+}
+
+// Deny is the response to the connections that are not authorized.
+var Deny = Response{IsAuthenticated: false}
+
+// CA is a Lamassu CA registered in AWS by the connector, with the policy of its devices.
+type CA struct {
+	Name           string
+	Certificate    *x509.Certificate
+	PolicyDocument string
+}
+
+// CASource lists the CAs whose devices may connect.
+type CASource interface {
+	ListCAs(ctx context.Context) ([]CA, error)
+}
+
+// CAClient and DeviceManagerClient are the parts of the Lamassu clients the authorizer uses.
+type CAClient interface {
+	GetCAByName(ctx context.Context, input *caApi.GetCAByNameInput) (*caApi.GetCAByNameOutput, error)
+	GetCertificateBySerialNumber(ctx context.Context, input *caApi.GetCertificateBySerialNumberInput) (*caApi.GetCertificateBySerialNumberOutput, error)
+}
+
+type DeviceManagerClient interface {
+	GetDeviceById(ctx context.Context, deviceId string) (*devApi.GetDeviceByIdOutput, error)
+}
+
+type Options struct {
+	// Audience is required in the aud claim of the tokens when not empty.
+	Audience string
+	// MaxTokenLifetime rejects the tokens expiring further in the future, when not 0.
+	MaxTokenLifetime time.Duration
+	// RefreshAfter is how often AWS IoT asks again for the policy of a connection.
+	RefreshAfter time.Duration
+	// Now replaces the clock, time.Now when nil.
+	Now func() time.Time
+}
+
+// Connections are refreshed and disconnected within the bounds accepted by AWS IoT.
+const (
+	minConnectionSeconds = 300
+	maxConnectionSeconds = 86400
+)
+
+type Authorizer struct {
+	cas              CASource
+	caClient         CAClient
+	devManagerClient DeviceManagerClient
+	options          Options
+}
+
+func NewAuthorizer(cas CASource, caClient CAClient, devManagerClient DeviceManagerClient, options Options) *Authorizer {
+	if options.Now == nil {
+		options.Now = time.Now
+	}
+	return &Authorizer{
+		cas:              cas,
+		caClient:         caClient,
+		devManagerClient: devManagerClient,
+		options:          options,
+	}
+}
+
+// Decision is the outcome of an authorization, Reason explains why it was denied.
+type Decision struct {
+	Response Response
+	DeviceID string
+	CAName   string
+	Reason   string
+}
+
+func (d Decision) Allowed() bool {
+	return d.Response.IsAuthenticated
+}
+
+// Authorize decides whether a connection is allowed. The device must present a token signed
+// with the key of a certificate issued by one of the CAs of the source, and active in
+// Lamassu, as its CA and the device itself. Errors reaching Lamassu or AWS deny the
+// connection.
+func (a *Authorizer) Authorize(ctx context.Context, request Request) Decision {
+	now := a.options.Now()
+
+	raw, err := requestToken(request)
+	if err != nil {
+		return denied(err.Error())
+	}
+	token, err := ParseToken(raw)
+	if err != nil {
+		return denied(err.Error())
+	}
+	err = token.Claims.validAt(now, a.options.MaxTokenLifetime)
+	if err != nil {
+		return denied(err.Error())
+	}
+	if a.options.Audience != "" && !token.Claims.hasAudience(a.options.Audience) {
+		return denied("the token is not meant for this authorizer")
+	}
+
+	deviceID := token.Certificate.Subject.CommonName
+	if token.Claims.Subject != deviceID {
+		return denied(fmt.Sprintf("the token subject %q is not the device of the certificate %q", token.Claims.Subject, deviceID))
+	}
+	err = validDeviceID(deviceID)
+	if err != nil {
+		return denied(err.Error())
+	}
+
+	cas, err := a.cas.ListCAs(ctx)
+	if err != nil {
+		return denied("could not list the CAs: " + err.Error())
+	}
+	ca, err := issuingCA(cas, token.Certificate, now)
+	if err != nil {
+		decision := denied(err.Error())
+		decision.DeviceID = deviceID
+		return decision
+	}
+
+	decision := a.checkLamassuStatus(ctx, ca, token.Certificate, deviceID)
+	if decision.Reason != "" {
+		return decision
+	}
+	if ca.PolicyDocument == "" {
+		decision.Reason = fmt.Sprintf("CA %s has no policy", ca.Name)
+		return decision
+	}
+
+	expiresAt := time.Unix(token.Claims.ExpiresAt, 0)
+	if token.Certificate.NotAfter.Before(expiresAt) {
+		expiresAt = token.Certificate.NotAfter
+	}
+
+	decision.Response = Response{
+		IsAuthenticated:          true,
+		PrincipalID:              principalID(deviceID),
+		DisconnectAfterInSeconds: boundSeconds(expiresAt.Sub(now)),
+		RefreshAfterInSeconds:    boundSeconds(a.options.RefreshAfter),
+		PolicyDocuments:          []string{devicePolicy(ca.PolicyDocument, deviceID)},
+	}
+	return decision
+}
+
+func (a *Authorizer) checkLamassuStatus(ctx context.Context, ca *CA, certificate *x509.Certificate, deviceID string) Decision {
+	decision := Decision{
+		Response: Deny,
+		DeviceID: deviceID,
+		CAName:   ca.Name,
+	}
+
+	lamassuCA, err := a.caClient.GetCAByName(ctx, &caApi.GetCAByNameInput{
+		CAType: caApi.CATypePKI,
+		CAName: ca.Name,
+	})
+	if err != nil {
+		decision.Reason = fmt.Sprintf("could not read CA %s: %s", ca.Name, err)
+		return decision
+	}
+	if !isUsable(lamassuCA.Status) {
+		decision.Reason = fmt.Sprintf("CA %s is %s", ca.Name, lamassuCA.Status)
+		return decision
+	}
+
+	serialNumber := utils.InsertNth(utils.ToHexInt(certificate.SerialNumber), 2)
+	lamassuCertificate, err := a.caClient.GetCertificateBySerialNumber(ctx, &caApi.GetCertificateBySerialNumberInput{
+		CAType:                  caApi.CATypePKI,
+		CAName:                  ca.Name,
+		CertificateSerialNumber: serialNumber,
+	})
+	if err != nil {
+		decision.Reason = fmt.Sprintf("could not read certificate %s: %s", serialNumber, err)
+		return decision
+	}
+	if !isUsable(lamassuCertificate.Status) {
+		decision.Reason = fmt.Sprintf("certificate %s is %s", serialNumber, lamassuCertificate.Status)
+		return decision
+	}
+
+	device, err := a.devManagerClient.GetDeviceById(ctx, deviceID)
+	if err != nil {
+		decision.Reason = fmt.Sprintf("could not read device %s: %s", deviceID, err)
+		return decision
+	}
+	if device.Status == devApi.DeviceStatusDecommissioned {
+		decision.Reason = fmt.Sprintf("device %s is decommissioned", deviceID)
+		return decision
+	}
+
+	return decision
+}
+
+func denied(reason string) Decision {
+	return Decision{
+		Response: Deny,
+		Reason:   reason,
+	}
+}
+
+// requestToken takes the token from the token key of the authorizer, falling back to the
+// MQTT password.
+func requestToken(request Request) (string, error) {
+	if request.Token != "" {
+		return request.Token, nil
+	}
+	if request.ProtocolData.MQTT != nil && request.ProtocolData.MQTT.Password != "" {
+		password, err := base64.StdEncoding.DecodeString(request.ProtocolData.MQTT.Password)
+		if err != nil {
+			return "", errors.New("malformed MQTT password")
+		}
+		return string(password), nil
+	}
+	return "", errors.New("no token")
+}
+
+func issuingCA(cas []CA, certificate *x509.Certificate, now time.Time) (*CA, error) {
+	for i, ca := range cas {
+		if ca.Certificate == nil {
+			continue
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.Certificate)
+		_, err := certificate.Verify(x509.VerifyOptions{
+			Roots:       roots,
+			CurrentTime: now,
+			KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err == nil {
+			return &cas[i], nil
+		}
+	}
+	return nil, fmt.Errorf("the certificate of %s is not valid for any CA", certificate.Subject.CommonName)
+}
+
+func isUsable(status caApi.CertificateStatus) bool {
+	return status == caApi.StatusActive || status == caApi.StatusAboutToExpire
+}
+
+func (c TokenClaims) hasAudience(expected string) bool {
+	for _, aud := range c.Audience {
+		if aud == expected {
+			return true
+		}
+	}
+	return false
+}
+
+// validDeviceID checks that the device ID is a valid thing name, whose characters can be
+// written into a policy document as they are: neither JSON syntax nor policy wildcards.
+func validDeviceID(deviceID string) error {
+	if deviceID == "" || len(deviceID) > 128 {
+		return fmt.Errorf("the device ID %q is not a valid thing name", deviceID)
+	}
+	for _, r := range deviceID {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == ':' || r == '_' || r == '-') {
+			return fmt.Errorf("the device ID %q is not a valid thing name", deviceID)
+		}
+	}
+	return nil
+}
+
+// devicePolicy resolves the policy variables of the CA policy that AWS IoT cannot resolve
+// for custom authorizers, as the connection has neither a thing nor a certificate.
+func devicePolicy(policyDocument string, deviceID string) string {
+	return strings.NewReplacer(
+		"${iot:Connection.Thing.ThingName}", deviceID,
+		"${iot:Certificate.Subject.CommonName}", deviceID,
+	).Replace(policyDocument)
+}
+
+// principalID keeps the characters of the device ID accepted by AWS IoT.
+func principalID(deviceID string) string {
+	principal := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, deviceID)
+	if len(principal) > 128 {
+		principal = principal[:128]
+	}
+	return principal
+}
+
+func boundSeconds(d time.Duration) int {
+	seconds := int(d.Seconds())
+	if seconds < minConnectionSeconds {
+		return minConnectionSeconds
+	}
+	if seconds > maxConnectionSeconds {
+		return maxConnectionSeconds
+	}
+	return seconds
+}
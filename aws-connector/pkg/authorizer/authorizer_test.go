@@ -0,0 +1,481 @@
+package authorizer
+
+import (
+	"context"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/aws-connector/pkg/server/utils"
+	caApi "github.com/lamassuiot/lamassuiot/pkg/ca/common/api"
+	devApi "github.com/lamassuiot/lamassuiot/pkg/device-manager/common/api"
+)
+
+type fakeCASource struct {
+	cas []CA
+	err error
+}
+
+func (s *fakeCASource) ListCAs(ctx context.Context) ([]CA, error) {
+	return s.cas, s.err
+}
+
+// fakeCAClient answers with the statuses of the CAs by name and of the certificates by serial
+// number, and with an error for the others.
+type fakeCAClient struct {
+	cas          map[string]caApi.CertificateStatus
+	certificates map[string]caApi.CertificateStatus
+}
+
+func (c *fakeCAClient) GetCAByName(ctx context.Context, input *caApi.GetCAByNameInput) (*caApi.GetCAByNameOutput, error) {
+	status, ok := c.cas[input.CAName]
+	if !ok {
+		return nil, fmt.Errorf("CA %s not found", input.CAName)
+	}
+	output := &caApi.GetCAByNameOutput{}
+	output.CAName = input.CAName
+	output.Status = status
+	return output, nil
+}
+
+func (c *fakeCAClient) GetCertificateBySerialNumber(ctx context.Context, input *caApi.GetCertificateBySerialNumberInput) (*caApi.GetCertificateBySerialNumberOutput, error) {
+	status, ok := c.certificates[input.CertificateSerialNumber]
+	if !ok {
+		return nil, fmt.Errorf("certificate %s not found", input.CertificateSerialNumber)
+	}
+	output := &caApi.GetCertificateBySerialNumberOutput{}
+	output.CAName = input.CAName
+	output.SerialNumber = input.CertificateSerialNumber
+	output.Status = status
+	return output, nil
+}
+
+type fakeDeviceManagerClient struct {
+	devices map[string]devApi.DeviceStatus
+}
+
+func (c *fakeDeviceManagerClient) GetDeviceById(ctx context.Context, deviceId string) (*devApi.GetDeviceByIdOutput, error) {
+	status, ok := c.devices[deviceId]
+	if !ok {
+		return nil, fmt.Errorf("device %s not found", deviceId)
+	}
+	output := &devApi.GetDeviceByIdOutput{}
+	output.ID = deviceId
+	output.Status = status
+	return output, nil
+}
+
+const testPolicy = `{"Statement":[{"Effect":"Allow","Action":"iot:Connect","Resource":"arn:aws:iot:eu-west-1:123456789012:client/${iot:Connection.Thing.ThingName}"},{"Effect":"Allow","Action":"iot:Publish","Resource":"arn:aws:iot:eu-west-1:123456789012:topic/${iot:Certificate.Subject.CommonName}/${iot:ClientId}"}]}`
+
+// authorizerFixture is a device of ca-1 allowed to connect, which the test cases change.
+type authorizerFixture struct {
+	cas              *fakeCASource
+	caClient         *fakeCAClient
+	devManagerClient *fakeDeviceManagerClient
+	request          Request
+}
+
+func TestAuthorize(t *testing.T) {
+	ca, caKey := newTestCA(t, "ca-1")
+	otherCA, _ := newTestCA(t, "ca-2")
+	unregisteredCA, unregisteredCAKey := newTestCA(t, "ca-3")
+	key := newECDSAKey(t, elliptic.P256())
+	certificate := newTestCertificate(t, "device-1", key, ca, caKey, testNow.Add(365*24*time.Hour))
+	serialNumber := utils.InsertNth(utils.ToHexInt(certificate.SerialNumber), 2)
+
+	claims := func(change func(c *TokenClaims)) TokenClaims {
+		c := TokenClaims{
+			Subject:   "device-1",
+			Audience:  audience{"lamassu"},
+			ExpiresAt: testNow.Add(30 * time.Minute).Unix(),
+		}
+		if change != nil {
+			change(&c)
+		}
+		return c
+	}
+	token := signToken(t, "ES256", key, certificate, claims(nil))
+	tokenRequest := func(token string) Request {
+		return Request{Token: token}
+	}
+
+	testCases := []struct {
+		name  string
+		setup func(f *authorizerFixture)
+		// wantReason is part of the reason of the denial, the connection is allowed when empty.
+		wantReason string
+		// wantDisconnectAfter is checked for the allowed connections.
+		wantDisconnectAfter int
+	}{
+		{
+			name:                "allowed",
+			wantDisconnectAfter: 1800,
+		},
+		{
+			name: "token in the MQTT password",
+			setup: func(f *authorizerFixture) {
+				f.request = Request{ProtocolData: ProtocolData{MQTT: &MQTTData{
+					Username: "device-1",
+					Password: base64.StdEncoding.EncodeToString([]byte(token)),
+				}}}
+			},
+			wantDisconnectAfter: 1800,
+		},
+		{
+			name: "about to expire CA and certificate",
+			setup: func(f *authorizerFixture) {
+				f.caClient.cas["ca-1"] = caApi.StatusAboutToExpire
+				f.caClient.certificates[serialNumber] = caApi.StatusAboutToExpire
+			},
+			wantDisconnectAfter: 1800,
+		},
+		{
+			name: "disconnected when the certificate expires",
+			setup: func(f *authorizerFixture) {
+				expiring := newTestCertificate(t, "device-1", key, ca, caKey, testNow.Add(10*time.Minute))
+				f.request = tokenRequest(signToken(t, "ES256", key, expiring, claims(nil)))
+			},
+			wantDisconnectAfter: 600,
+		},
+		{
+			name: "disconnected within the bounds of AWS IoT",
+			setup: func(f *authorizerFixture) {
+				f.request = tokenRequest(signToken(t, "ES256", key, certificate, claims(func(c *TokenClaims) {
+					c.ExpiresAt = testNow.Add(time.Minute).Unix()
+				})))
+			},
+			wantDisconnectAfter: minConnectionSeconds,
+		},
+		{
+			name: "no token",
+			setup: func(f *authorizerFixture) {
+				f.request = Request{}
+			},
+			wantReason: "no token",
+		},
+		{
+			name: "MQTT password not base64",
+			setup: func(f *authorizerFixture) {
+				f.request = Request{ProtocolData: ProtocolData{MQTT: &MQTTData{Password: "***"}}}
+			},
+			wantReason: "malformed MQTT password",
+		},
+		{
+			name: "bad signature",
+			setup: func(f *authorizerFixture) {
+				f.request = tokenRequest(signToken(t, "ES256", newECDSAKey(t, elliptic.P256()), certificate, claims(nil)))
+			},
+			wantReason: "invalid token signature",
+		},
+		{
+			name: "algorithm not matching the key",
+			setup: func(f *authorizerFixture) {
+				parts := strings.Split(token, ".")
+				header := encodeSegment(t, tokenHeader{Algorithm: "RS256", X5C: []string{base64.StdEncoding.EncodeToString(certificate.Raw)}})
+				f.request = tokenRequest(header + "." + parts[1] + "." + parts[2])
+			},
+			wantReason: "invalid token signature",
+		},
+		{
+			name: "expired token",
+			setup: func(f *authorizerFixture) {
+				f.request = tokenRequest(signToken(t, "ES256", key, certificate, claims(func(c *TokenClaims) {
+					c.ExpiresAt = testNow.Add(-time.Second).Unix()
+				})))
+			},
+			wantReason: "expired",
+		},
+		{
+			name: "token over the maximum lifetime",
+			setup: func(f *authorizerFixture) {
+				f.request = tokenRequest(signToken(t, "ES256", key, certificate, claims(func(c *TokenClaims) {
+					c.ExpiresAt = testNow.Add(2 * time.Hour).Unix()
+				})))
+			},
+			wantReason: "expires in more than",
+		},
+		{
+			name: "token for another audience",
+			setup: func(f *authorizerFixture) {
+				f.request = tokenRequest(signToken(t, "ES256", key, certificate, claims(func(c *TokenClaims) {
+					c.Audience = audience{"other"}
+				})))
+			},
+			wantReason: "not meant for this authorizer",
+		},
+		{
+			name: "token for another device",
+			setup: func(f *authorizerFixture) {
+				f.request = tokenRequest(signToken(t, "ES256", key, certificate, claims(func(c *TokenClaims) {
+					c.Subject = "device-2"
+				})))
+			},
+			wantReason: "is not the device of the certificate",
+		},
+		{
+			name: "device ID injecting into the policy",
+			setup: func(f *authorizerFixture) {
+				deviceID := `device-1","Resource":"*`
+				injecting := newTestCertificate(t, deviceID, key, ca, caKey, testNow.Add(time.Hour))
+				f.request = tokenRequest(signToken(t, "ES256", key, injecting, claims(func(c *TokenClaims) {
+					c.Subject = deviceID
+				})))
+			},
+			wantReason: "is not a valid thing name",
+		},
+		{
+			name: "certificate of a CA not registered in AWS",
+			setup: func(f *authorizerFixture) {
+				foreign := newTestCertificate(t, "device-1", key, unregisteredCA, unregisteredCAKey, testNow.Add(time.Hour))
+				f.request = tokenRequest(signToken(t, "ES256", key, foreign, claims(nil)))
+			},
+			wantReason: "is not valid for any CA",
+		},
+		{
+			name: "CAs not listed",
+			setup: func(f *authorizerFixture) {
+				f.cas.err = errors.New("throttled")
+			},
+			wantReason: "could not list the CAs: throttled",
+		},
+		{
+			name: "revoked CA",
+			setup: func(f *authorizerFixture) {
+				f.caClient.cas["ca-1"] = caApi.StatusRevoked
+			},
+			wantReason: "CA ca-1 is REVOKED",
+		},
+		{
+			name: "CA unknown to Lamassu",
+			setup: func(f *authorizerFixture) {
+				delete(f.caClient.cas, "ca-1")
+			},
+			wantReason: "could not read CA ca-1",
+		},
+		{
+			name: "revoked certificate",
+			setup: func(f *authorizerFixture) {
+				f.caClient.certificates[serialNumber] = caApi.StatusRevoked
+			},
+			wantReason: fmt.Sprintf("certificate %s is REVOKED", serialNumber),
+		},
+		{
+			name: "expired certificate in Lamassu",
+			setup: func(f *authorizerFixture) {
+				f.caClient.certificates[serialNumber] = caApi.StatusExpired
+			},
+			wantReason: fmt.Sprintf("certificate %s is EXPIRED", serialNumber),
+		},
+		{
+			name: "certificate unknown to Lamassu",
+			setup: func(f *authorizerFixture) {
+				delete(f.caClient.certificates, serialNumber)
+			},
+			wantReason: "could not read certificate",
+		},
+		{
+			name: "decommissioned device",
+			setup: func(f *authorizerFixture) {
+				f.devManagerClient.devices["device-1"] = devApi.DeviceStatusDecommissioned
+			},
+			wantReason: "device device-1 is decommissioned",
+		},
+		{
+			name: "device unknown to Lamassu",
+			setup: func(f *authorizerFixture) {
+				delete(f.devManagerClient.devices, "device-1")
+			},
+			wantReason: "could not read device device-1",
+		},
+		{
+			name: "CA without policy",
+			setup: func(f *authorizerFixture) {
+				f.cas.cas[1].PolicyDocument = ""
+			},
+			wantReason: "CA ca-1 has no policy",
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			f := &authorizerFixture{
+				cas: &fakeCASource{cas: []CA{
+					{Name: "ca-2", Certificate: otherCA},
+					{Name: "ca-1", Certificate: ca, PolicyDocument: testPolicy},
+				}},
+				caClient: &fakeCAClient{
+					cas:          map[string]caApi.CertificateStatus{"ca-1": caApi.StatusActive, "ca-2": caApi.StatusActive},
+					certificates: map[string]caApi.CertificateStatus{serialNumber: caApi.StatusActive},
+				},
+				devManagerClient: &fakeDeviceManagerClient{
+					devices: map[string]devApi.DeviceStatus{"device-1": devApi.DeviceStatusFullyProvisioned},
+				},
+				request: tokenRequest(token),
+			}
+			if tc.setup != nil {
+				tc.setup(f)
+			}
+
+			a := NewAuthorizer(f.cas, f.caClient, f.devManagerClient, Options{
+				Audience:         "lamassu",
+				MaxTokenLifetime: time.Hour,
+				RefreshAfter:     10 * time.Minute,
+				Now:              func() time.Time { return testNow },
+			})
+			decision := a.Authorize(context.Background(), f.request)
+
+			if tc.wantReason != "" {
+				if decision.Allowed() {
+					t.Fatalf("Authorize() allowed the connection, want denied: %s", tc.wantReason)
+				}
+				if !strings.Contains(decision.Reason, tc.wantReason) {
+					t.Errorf("Authorize() reason = %q, want %q", decision.Reason, tc.wantReason)
+				}
+				if decision.Response.PrincipalID != "" || len(decision.Response.PolicyDocuments) != 0 {
+					t.Errorf("Authorize() denied with a principal or a policy: %+v", decision.Response)
+				}
+				return
+			}
+
+			if !decision.Allowed() {
+				t.Fatalf("Authorize() denied the connection: %s", decision.Reason)
+			}
+			if decision.DeviceID != "device-1" || decision.CAName != "ca-1" {
+				t.Errorf("Authorize() device = %s, CA = %s", decision.DeviceID, decision.CAName)
+			}
+			response := decision.Response
+			if response.PrincipalID != "device1" {
+				t.Errorf("Authorize() principal = %s, want device1", response.PrincipalID)
+			}
+			if response.DisconnectAfterInSeconds != tc.wantDisconnectAfter {
+				t.Errorf("Authorize() disconnects after %d seconds, want %d", response.DisconnectAfterInSeconds, tc.wantDisconnectAfter)
+			}
+			if response.RefreshAfterInSeconds != 600 {
+				t.Errorf("Authorize() refreshes after %d seconds, want 600", response.RefreshAfterInSeconds)
+			}
+			if len(response.PolicyDocuments) != 1 || response.PolicyDocuments[0] != devicePolicy(testPolicy, "device-1") {
+				t.Errorf("Authorize() policies = %v", response.PolicyDocuments)
+			}
+		})
+	}
+}
+
+func TestIssuingCA(t *testing.T) {
+	ca, caKey := newTestCA(t, "ca-1")
+	otherCA, _ := newTestCA(t, "ca-2")
+	key := newECDSAKey(t, elliptic.P256())
+	certificate := newTestCertificate(t, "device-1", key, ca, caKey, testNow.Add(time.Hour))
+	expired := newTestCertificate(t, "device-1", key, ca, caKey, testNow.Add(-time.Minute))
+
+	testCases := []struct {
+		name        string
+		cas         []CA
+		certificate *x509.Certificate
+		wantCA      string
+	}{
+		{name: "issuing CA", cas: []CA{{Name: "ca-2", Certificate: otherCA}, {Name: "ca-1", Certificate: ca}}, certificate: certificate, wantCA: "ca-1"},
+		{name: "CA without certificate", cas: []CA{{Name: "ca-0"}, {Name: "ca-1", Certificate: ca}}, certificate: certificate, wantCA: "ca-1"},
+		{name: "wrong CA", cas: []CA{{Name: "ca-2", Certificate: otherCA}}, certificate: certificate},
+		{name: "no CA", cas: []CA{}, certificate: certificate},
+		{name: "expired certificate", cas: []CA{{Name: "ca-1", Certificate: ca}}, certificate: expired},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			issuer, err := issuingCA(tc.cas, tc.certificate, testNow)
+			if tc.wantCA == "" {
+				if err == nil {
+					t.Errorf("issuingCA() = %s, want an error", issuer.Name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("issuingCA() error = %s", err)
+			}
+			if issuer.Name != tc.wantCA {
+				t.Errorf("issuingCA() = %s, want %s", issuer.Name, tc.wantCA)
+			}
+		})
+	}
+}
+
+func TestValidDeviceID(t *testing.T) {
+	testCases := []struct {
+		deviceID string
+		wantErr  bool
+	}{
+		{deviceID: "device-1"},
+		{deviceID: "slot:device_1"},
+		{deviceID: strings.Repeat("d", 128)},
+		{deviceID: "", wantErr: true},
+		{deviceID: strings.Repeat("d", 129), wantErr: true},
+		{deviceID: `device"1`, wantErr: true},
+		{deviceID: `device\1`, wantErr: true},
+		{deviceID: "device*", wantErr: true},
+		{deviceID: "device?", wantErr: true},
+		{deviceID: "device/1", wantErr: true},
+		{deviceID: "device 1", wantErr: true},
+		{deviceID: "dévice", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.deviceID, func(t *testing.T) {
+			err := validDeviceID(tc.deviceID)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("validDeviceID(%q) = %v, want error %t", tc.deviceID, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestDevicePolicy(t *testing.T) {
+	testCases := []struct {
+		name     string
+		policy   string
+		deviceID string
+		want     string
+	}{
+		{
+			name:     "thing name",
+			policy:   `client/${iot:Connection.Thing.ThingName}`,
+			deviceID: "device-1",
+			want:     `client/device-1`,
+		},
+		{
+			name:     "common name",
+			policy:   `topic/${iot:Certificate.Subject.CommonName}/data`,
+			deviceID: "device-1",
+			want:     `topic/device-1/data`,
+		},
+		{
+			name:     "variables resolved by AWS IoT",
+			policy:   `client/${iot:ClientId} topic/${iot:Connection.Thing.ThingName}/${iot:Connection.Thing.ThingName}`,
+			deviceID: "device-1",
+			want:     `client/${iot:ClientId} topic/device-1/device-1`,
+		},
+		{
+			name:     "no variables",
+			policy:   `client/*`,
+			deviceID: "device-1",
+			want:     `client/*`,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got := devicePolicy(tc.policy, tc.deviceID)
+			if got != tc.want {
+				t.Errorf("devicePolicy() = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package authorizer
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awsIot "github.com/aws/aws-sdk-go/service/iot"
+	"github.com/aws/aws-sdk-go/service/iot/iotiface"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+)
+
+// AWSCASource lists the CAs registered in AWS by the connector, identified by their
+// lamassuCAName tag, with the policy of their provisioning template. Only the CAs active in
+// AWS are listed. The list is cached, as every connection is authorized.
+type AWSCASource struct {
+	awsIotSvc iotiface.IoTAPI
+	ttl       time.Duration
+
+	mutex     sync.Mutex
+	cas       []CA
+	expiresAt time.Time
+}
+
+func NewAWSCASource(awsIotSvc iotiface.IoTAPI, ttl time.Duration) *AWSCASource {
+	return &AWSCASource{
+		awsIotSvc: awsIotSvc,
+		ttl:       ttl,
+	}
+}
+
+func (s *AWSCASource) ListCAs(ctx context.Context) ([]CA, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.cas != nil && time.Now().Before(s.expiresAt) {
+		return s.cas, nil
+	}
+
+	cas, err := s.listCAs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.cas = cas
+	s.expiresAt = time.Now().Add(s.ttl)
+	return cas, nil
+}
+
+func (s *AWSCASource) listCAs(ctx context.Context) ([]CA, error) {
+	awsCAs := []*awsIot.CACertificate{}
+	err := s.awsIotSvc.ListCACertificatesPagesWithContext(ctx, &awsIot.ListCACertificatesInput{}, func(page *awsIot.ListCACertificatesOutput, lastPage bool) bool {
+		for _, ca := range page.Certificates {
+			if aws.StringValue(ca.Status) == awsIot.CACertificateStatusActive {
+				awsCAs = append(awsCAs, ca)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cas := []CA{}
+	for _, awsCA := range awsCAs {
+		tagsResponse, err := s.awsIotSvc.ListTagsForResourceWithContext(ctx, &awsIot.ListTagsForResourceInput{
+			ResourceArn: awsCA.CertificateArn,
+		})
+		if err != nil {
+			return nil, err
+		}
+		nameTagIdx := slices.IndexFunc(tagsResponse.Tags, func(tag *awsIot.Tag) bool {
+			return aws.StringValue(tag.Key) == "lamassuCAName"
+		})
+		if nameTagIdx == -1 {
+			continue
+		}
+
+		ca, err := s.describeCA(ctx, aws.StringValue(tagsResponse.Tags[nameTagIdx].Value), aws.StringValue(awsCA.CertificateId))
+		if err != nil {
+			return nil, err
+		}
+		cas = append(cas, *ca)
+	}
+
+	return cas, nil
+}
+
+func (s *AWSCASource) describeCA(ctx context.Context, caName string, certificateID string) (*CA, error) {
+	description, err := s.awsIotSvc.DescribeCACertificateWithContext(ctx, &awsIot.DescribeCACertificateInput{
+		CertificateId: aws.String(certificateID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if description.CertificateDescription == nil {
+		return nil, fmt.Errorf("AWS CA %s has no description", certificateID)
+	}
+
+	block, _ := pem.Decode([]byte(aws.StringValue(description.CertificateDescription.CertificatePem)))
+	if block == nil {
+		return nil, fmt.Errorf("AWS CA %s has no certificate", certificateID)
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	ca := &CA{
+		Name:        caName,
+		Certificate: certificate,
+	}
+	if description.RegistrationConfig == nil || description.RegistrationConfig.TemplateName == nil {
+		log.Warn(fmt.Sprintf("CA %s has no provisioning template, its devices are denied", caName))
+		return ca, nil
+	}
+
+	template, err := s.awsIotSvc.DescribeProvisioningTemplateWithContext(ctx, &awsIot.DescribeProvisioningTemplateInput{
+		TemplateName: description.RegistrationConfig.TemplateName,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var parsedTemplate struct {
+		Resources struct {
+			Policy struct {
+				Properties struct {
+					PolicyName string `json:"PolicyName"`
+				} `json:"Properties"`
+			} `json:"policy"`
+		} `json:"Resources"`
+	}
+	err = json.Unmarshal([]byte(aws.StringValue(template.TemplateBody)), &parsedTemplate)
+	if err != nil {
+		return nil, err
+	}
+	policyName := parsedTemplate.Resources.Policy.Properties.PolicyName
+	if policyName == "" {
+		return ca, nil
+	}
+
+	policy, err := s.awsIotSvc.GetPolicyWithContext(ctx, &awsIot.GetPolicyInput{
+		PolicyName: aws.String(policyName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	ca.PolicyDocument = aws.StringValue(policy.PolicyDocument)
+
+	return ca, nil
+}
@@ -0,0 +1,143 @@
+package authorizer
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awsIot "github.com/aws/aws-sdk-go/service/iot"
+	"github.com/aws/aws-sdk-go/service/iot/iotiface"
+)
+
+// fakeIoT serves the CAs registered in AWS, by ID, with their tags, templates and policies.
+// The other calls of the API are not implemented.
+type fakeIoT struct {
+	iotiface.IoTAPI
+
+	cas       []*awsIot.CACertificateDescription
+	tags      map[string][]*awsIot.Tag
+	templates map[string]string
+	policies  map[string]string
+
+	listCalls int
+}
+
+func (f *fakeIoT) ListCACertificatesPagesWithContext(ctx aws.Context, input *awsIot.ListCACertificatesInput, fn func(*awsIot.ListCACertificatesOutput, bool) bool, opts ...request.Option) error {
+	f.listCalls++
+	page := &awsIot.ListCACertificatesOutput{}
+	for _, ca := range f.cas {
+		page.Certificates = append(page.Certificates, &awsIot.CACertificate{
+			CertificateArn: ca.CertificateArn,
+			CertificateId:  ca.CertificateId,
+			Status:         ca.Status,
+		})
+	}
+	fn(page, true)
+	return nil
+}
+
+func (f *fakeIoT) ListTagsForResourceWithContext(ctx aws.Context, input *awsIot.ListTagsForResourceInput, opts ...request.Option) (*awsIot.ListTagsForResourceOutput, error) {
+	return &awsIot.ListTagsForResourceOutput{Tags: f.tags[aws.StringValue(input.ResourceArn)]}, nil
+}
+
+func (f *fakeIoT) DescribeCACertificateWithContext(ctx aws.Context, input *awsIot.DescribeCACertificateInput, opts ...request.Option) (*awsIot.DescribeCACertificateOutput, error) {
+	for _, ca := range f.cas {
+		if aws.StringValue(ca.CertificateId) == aws.StringValue(input.CertificateId) {
+			output := &awsIot.DescribeCACertificateOutput{CertificateDescription: ca}
+			if template, ok := f.templates[aws.StringValue(ca.CertificateId)]; ok {
+				output.RegistrationConfig = &awsIot.RegistrationConfig{TemplateName: aws.String(template)}
+			}
+			return output, nil
+		}
+	}
+	return nil, fmt.Errorf("CA %s not found", aws.StringValue(input.CertificateId))
+}
+
+func (f *fakeIoT) DescribeProvisioningTemplateWithContext(ctx aws.Context, input *awsIot.DescribeProvisioningTemplateInput, opts ...request.Option) (*awsIot.DescribeProvisioningTemplateOutput, error) {
+	body := fmt.Sprintf(`{"Resources": {"policy": {"Type": "AWS::IoT::Policy", "Properties": {"PolicyName": "%s-policy"}}}}`, aws.StringValue(input.TemplateName))
+	return &awsIot.DescribeProvisioningTemplateOutput{TemplateBody: aws.String(body)}, nil
+}
+
+func (f *fakeIoT) GetPolicyWithContext(ctx aws.Context, input *awsIot.GetPolicyInput, opts ...request.Option) (*awsIot.GetPolicyOutput, error) {
+	policy, ok := f.policies[aws.StringValue(input.PolicyName)]
+	if !ok {
+		return nil, fmt.Errorf("policy %s not found", aws.StringValue(input.PolicyName))
+	}
+	return &awsIot.GetPolicyOutput{PolicyDocument: aws.String(policy)}, nil
+}
+
+func TestAWSCASourceListsTheActiveCAsOfTheConnector(t *testing.T) {
+	awsCA := func(id string, status string, name string) *awsIot.CACertificateDescription {
+		certificate, _ := newTestCA(t, name)
+		return &awsIot.CACertificateDescription{
+			CertificateArn: aws.String("arn:aws:iot:eu-west-1:123456789012:cacert/" + id),
+			CertificateId:  aws.String(id),
+			CertificatePem: aws.String(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}))),
+			Status:         aws.String(status),
+		}
+	}
+	nameTag := func(name string) []*awsIot.Tag {
+		return []*awsIot.Tag{{Key: aws.String("lamassuCAName"), Value: aws.String(name)}}
+	}
+
+	iot := &fakeIoT{
+		cas: []*awsIot.CACertificateDescription{
+			awsCA("1", awsIot.CACertificateStatusActive, "ca-1"),
+			awsCA("2", awsIot.CACertificateStatusInactive, "ca-2"),
+			awsCA("3", awsIot.CACertificateStatusActive, "operator-ca"),
+			awsCA("4", awsIot.CACertificateStatusActive, "ca-4"),
+		},
+		tags: map[string][]*awsIot.Tag{
+			"arn:aws:iot:eu-west-1:123456789012:cacert/1": nameTag("ca-1"),
+			"arn:aws:iot:eu-west-1:123456789012:cacert/2": nameTag("ca-2"),
+			"arn:aws:iot:eu-west-1:123456789012:cacert/4": nameTag("ca-4"),
+		},
+		templates: map[string]string{"1": "ca-1-template"},
+		policies:  map[string]string{"ca-1-template-policy": testPolicy},
+	}
+	source := NewAWSCASource(iot, time.Hour)
+
+	cas, err := source.ListCAs(context.Background())
+	if err != nil {
+		t.Fatalf("ListCAs() error = %s", err)
+	}
+	if len(cas) != 2 {
+		t.Fatalf("ListCAs() = %d CAs, want ca-1 and ca-4", len(cas))
+	}
+	if cas[0].Name != "ca-1" || cas[0].PolicyDocument != testPolicy || cas[0].Certificate.Subject.CommonName != "ca-1" {
+		t.Errorf("ListCAs() CA = %s with policy %q", cas[0].Name, cas[0].PolicyDocument)
+	}
+	if cas[1].Name != "ca-4" || cas[1].PolicyDocument != "" {
+		t.Errorf("ListCAs() CA = %s with policy %q, want ca-4 without policy", cas[1].Name, cas[1].PolicyDocument)
+	}
+
+	_, err = source.ListCAs(context.Background())
+	if err != nil {
+		t.Fatalf("ListCAs() error = %s", err)
+	}
+	if iot.listCalls != 1 {
+		t.Errorf("the CAs were listed %d times in AWS, want them cached", iot.listCalls)
+	}
+}
+
+func TestAWSCASourceDoesNotCacheErrors(t *testing.T) {
+	iot := &fakeIoT{
+		cas:  []*awsIot.CACertificateDescription{{CertificateArn: aws.String("arn"), CertificateId: aws.String("1"), Status: aws.String(awsIot.CACertificateStatusActive)}},
+		tags: map[string][]*awsIot.Tag{"arn": {{Key: aws.String("lamassuCAName"), Value: aws.String("ca-1")}}},
+	}
+	source := NewAWSCASource(iot, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		_, err := source.ListCAs(context.Background())
+		if err == nil {
+			t.Fatalf("ListCAs() listed a CA without certificate")
+		}
+	}
+	if iot.listCalls != 2 {
+		t.Errorf("the CAs were listed %d times in AWS, want the failed list retried", iot.listCalls)
+	}
+}
@@ -0,0 +1,108 @@
+package authorizer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The Lambda runtime API is spoken directly instead of through aws-lambda-go, which is not a
+// dependency of the connector: the module is built from its vendor directory, and the
+// authorizer only needs the invocation loop of the API (next, response and error), with a
+// single event type. Initialization errors are not posted to the API, the process exits and
+// Lambda reports the failed initialization with its logs. A later move to aws-lambda-go only
+// replaces StartLambda, the invocations are handled by handleInvocation.
+const lambdaRuntimeAPIVersion = "2018-06-01"
+
+// lambdaDefaultTimeout bounds the invocations the runtime gives no deadline for.
+const lambdaDefaultTimeout = 5 * time.Second
+
+// StartLambda serves the invocations of the function with the authorizer, until the runtime
+// stops the function. It must run as the bootstrap of a custom runtime, e.g. provided.al2.
+func StartLambda(a *Authorizer) error {
+	runtimeAPI := os.Getenv("AWS_LAMBDA_RUNTIME_API")
+	if runtimeAPI == "" {
+		return fmt.Errorf("AWS_LAMBDA_RUNTIME_API is not set, the authorizer must run in Lambda")
+	}
+	baseURL := "http://" + runtimeAPI + "/" + lambdaRuntimeAPIVersion + "/runtime/invocation/"
+	client := &http.Client{}
+
+	for {
+		response, err := client.Get(baseURL + "next")
+		if err != nil {
+			return err
+		}
+		payload, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		requestID := response.Header.Get("Lambda-Runtime-Aws-Request-Id")
+		deadline, err := strconv.ParseInt(response.Header.Get("Lambda-Runtime-Deadline-Ms"), 10, 64)
+		if err != nil {
+			deadline = time.Now().Add(lambdaDefaultTimeout).UnixMilli()
+		}
+		ctx, cancel := context.WithDeadline(context.Background(), time.UnixMilli(deadline))
+
+		result, err := a.handleInvocation(ctx, payload)
+		cancel()
+		if err != nil {
+			log.Error("Invalid authorizer request: ", err)
+			result, _ = json.Marshal(map[string]string{
+				"errorMessage": err.Error(),
+				"errorType":    "InvalidRequest",
+			})
+			err = post(client, baseURL+requestID+"/error", result)
+		} else {
+			err = post(client, baseURL+requestID+"/response", result)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (a *Authorizer) handleInvocation(ctx context.Context, payload []byte) ([]byte, error) {
+	var request Request
+	err := json.Unmarshal(payload, &request)
+	if err != nil {
+		return nil, err
+	}
+
+	decision := a.Authorize(ctx, request)
+	logEntry := log.WithFields(log.Fields{
+		"connection_id": request.ConnectionMetadata.ID,
+		"device_id":     decision.DeviceID,
+		"ca_name":       decision.CAName,
+		"protocols":     request.Protocols,
+	})
+	if decision.Allowed() {
+		logEntry.Info("connection authorized")
+	} else {
+		logEntry.Warn("connection denied: ", decision.Reason)
+	}
+
+	return json.Marshal(decision.Response)
+}
+
+func post(client *http.Client, url string, body []byte) error {
+	response, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("the Lambda runtime answered %s", response.Status)
+	}
+	return nil
+}
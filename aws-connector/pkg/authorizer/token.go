@@ -0,0 +1,201 @@
+package authorizer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Token is a JWS signed by the device with the key of its Lamassu certificate, which is
+// carried in the x5c header. The signature proves that the device holds the key, something
+// a certificate alone cannot prove over MQTT or WebSocket credentials.
+type Token struct {
+	Certificate *x509.Certificate
+	Claims      TokenClaims
+}
+
+type TokenClaims struct {
+	// Subject is the ID of the device, the common name of its certificate.
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+}
+
+// audience accepts both forms of the aud claim, a string or a list of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+type tokenHeader struct {
+	Algorithm string   `json:"alg"`
+	X5C       []string `json:"x5c"`
+}
+
+var errMalformedToken = errors.New("malformed token")
+
+// ParseToken decodes a token and verifies its signature against the certificate it carries.
+// The certificate itself is not checked.
+func ParseToken(raw string) (*Token, error) {
+	parts := strings.Split(strings.TrimSpace(raw), ".")
+	if len(parts) != 3 {
+		return nil, errMalformedToken
+	}
+
+	var header tokenHeader
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, err
+	}
+	if len(header.X5C) == 0 {
+		return nil, errors.New("the token does not carry a certificate")
+	}
+	der, err := base64.StdEncoding.DecodeString(header.X5C[0])
+	if err != nil {
+		return nil, errMalformedToken
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token certificate: %w", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errMalformedToken
+	}
+	err = verifySignature(header.Algorithm, certificate.PublicKey, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims TokenClaims
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Token{
+		Certificate: certificate,
+		Claims:      claims,
+	}, nil
+}
+
+func decodeSegment(segment string, value interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errMalformedToken
+	}
+	if json.Unmarshal(decoded, value) != nil {
+		return errMalformedToken
+	}
+	return nil
+}
+
+func verifySignature(algorithm string, publicKey crypto.PublicKey, signed []byte, signature []byte) error {
+	invalid := errors.New("invalid token signature")
+
+	switch algorithm {
+	case "RS256", "PS256":
+		key, ok := publicKey.(*rsa.PublicKey)
+		if !ok {
+			return invalid
+		}
+		digest := sha256.Sum256(signed)
+		if algorithm == "PS256" {
+			err := rsa.VerifyPSS(key, crypto.SHA256, digest[:], signature, nil)
+			if err != nil {
+				return invalid
+			}
+			return nil
+		}
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return invalid
+		}
+		return nil
+
+	case "ES256", "ES384":
+		key, ok := publicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return invalid
+		}
+		var digest []byte
+		if algorithm == "ES256" {
+			if key.Curve != elliptic.P256() {
+				return invalid
+			}
+			sum := sha256.Sum256(signed)
+			digest = sum[:]
+		} else {
+			if key.Curve != elliptic.P384() {
+				return invalid
+			}
+			sum := sha512.Sum384(signed)
+			digest = sum[:]
+		}
+		// JWS signatures are the concatenation of r and s, not the ASN.1 encoding.
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return invalid
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return invalid
+		}
+		return nil
+
+	case "EdDSA":
+		key, ok := publicKey.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(key, signed, signature) {
+			return invalid
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported token algorithm %q", algorithm)
+	}
+}
+
+// validAt checks the time claims of the token. Tokens must expire, and within maxLifetime.
+func (c TokenClaims) validAt(now time.Time, maxLifetime time.Duration) error {
+	if c.ExpiresAt == 0 {
+		return errors.New("the token does not expire")
+	}
+	expiresAt := time.Unix(c.ExpiresAt, 0)
+	if !now.Before(expiresAt) {
+		return errors.New("the token has expired")
+	}
+	if maxLifetime > 0 && expiresAt.Sub(now) > maxLifetime {
+		return fmt.Errorf("the token expires in more than %s", maxLifetime)
+	}
+	if c.NotBefore != 0 && now.Before(time.Unix(c.NotBefore, 0)) {
+		return errors.New("the token is not valid yet")
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package authorizer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testNow = time.Unix(1700000000, 0)
+
+func newECDSAKey(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate the key: %s", err)
+	}
+	return key
+}
+
+// newTestCA creates a self-signed CA, valid around testNow.
+func newTestCA(t *testing.T, name string) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+
+	key := newECDSAKey(t, elliptic.P256())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             testNow.Add(-time.Hour),
+		NotAfter:              testNow.Add(10 * 365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("could not create the CA: %s", err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("could not parse the CA: %s", err)
+	}
+	return certificate, key
+}
+
+// newTestCertificate issues a device certificate for the public key of key.
+func newTestCertificate(t *testing.T, commonName string, key crypto.Signer, ca *x509.Certificate, caKey crypto.Signer, notAfter time.Time) *x509.Certificate {
+	t.Helper()
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(0x1a2b3c),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    testNow.Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatalf("could not create the certificate: %s", err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("could not parse the certificate: %s", err)
+	}
+	return certificate
+}
+
+// signJWS signs the signing input of a token as a JWS of the algorithm would.
+func signJWS(t *testing.T, algorithm string, key crypto.Signer, signed []byte) []byte {
+	t.Helper()
+
+	var signature []byte
+	var err error
+	switch algorithm {
+	case "RS256":
+		digest := sha256.Sum256(signed)
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+	case "PS256":
+		digest := sha256.Sum256(signed)
+		signature, err = rsa.SignPSS(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:], nil)
+	case "ES256", "ES384":
+		var digest []byte
+		if algorithm == "ES256" {
+			sum := sha256.Sum256(signed)
+			digest = sum[:]
+		} else {
+			sum := sha512.Sum384(signed)
+			digest = sum[:]
+		}
+		ecKey := key.(*ecdsa.PrivateKey)
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, ecKey, digest)
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		if err == nil {
+			r.FillBytes(signature[:size])
+			s.FillBytes(signature[size:])
+		}
+	case "EdDSA":
+		signature = ed25519.Sign(key.(ed25519.PrivateKey), signed)
+	default:
+		t.Fatalf("cannot sign with %s", algorithm)
+	}
+	if err != nil {
+		t.Fatalf("could not sign: %s", err)
+	}
+	return signature
+}
+
+func encodeSegment(t *testing.T, value interface{}) string {
+	t.Helper()
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatalf("could not encode the segment: %s", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signToken creates a token carrying certificate, signed with key.
+func signToken(t *testing.T, algorithm string, key crypto.Signer, certificate *x509.Certificate, claims TokenClaims) string {
+	t.Helper()
+
+	header := encodeSegment(t, tokenHeader{
+		Algorithm: algorithm,
+		X5C:       []string{base64.StdEncoding.EncodeToString(certificate.Raw)},
+	})
+	payload := encodeSegment(t, claims)
+	signature := signJWS(t, algorithm, key, []byte(header+"."+payload))
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifySignature(t *testing.T) {
+	signed := []byte("header.payload")
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate the key: %s", err)
+	}
+	p256Key := newECDSAKey(t, elliptic.P256())
+	p384Key := newECDSAKey(t, elliptic.P384())
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate the key: %s", err)
+	}
+
+	es256 := signJWS(t, "ES256", p256Key, signed)
+	tampered := append([]byte{}, es256...)
+	tampered[0] ^= 0xff
+
+	testCases := []struct {
+		name      string
+		algorithm string
+		publicKey crypto.PublicKey
+		signature []byte
+		wantErr   bool
+	}{
+		{name: "RS256", algorithm: "RS256", publicKey: rsaKey.Public(), signature: signJWS(t, "RS256", rsaKey, signed)},
+		{name: "PS256", algorithm: "PS256", publicKey: rsaKey.Public(), signature: signJWS(t, "PS256", rsaKey, signed)},
+		{name: "ES256", algorithm: "ES256", publicKey: p256Key.Public(), signature: es256},
+		{name: "ES384", algorithm: "ES384", publicKey: p384Key.Public(), signature: signJWS(t, "ES384", p384Key, signed)},
+		{name: "EdDSA", algorithm: "EdDSA", publicKey: ed25519Key.Public(), signature: signJWS(t, "EdDSA", ed25519Key, signed)},
+		{name: "bad signature", algorithm: "ES256", publicKey: p256Key.Public(), signature: tampered, wantErr: true},
+		{name: "signature of another key", algorithm: "ES256", publicKey: newECDSAKey(t, elliptic.P256()).Public(), signature: es256, wantErr: true},
+		{name: "PKCS1 signature verified as PSS", algorithm: "PS256", publicKey: rsaKey.Public(), signature: signJWS(t, "RS256", rsaKey, signed), wantErr: true},
+		{name: "RSA algorithm with an EC key", algorithm: "RS256", publicKey: p256Key.Public(), signature: es256, wantErr: true},
+		{name: "EC algorithm with an RSA key", algorithm: "ES256", publicKey: rsaKey.Public(), signature: signJWS(t, "RS256", rsaKey, signed), wantErr: true},
+		{name: "ES384 with a P-256 key", algorithm: "ES384", publicKey: p256Key.Public(), signature: es256, wantErr: true},
+		{name: "ES256 with a P-384 key", algorithm: "ES256", publicKey: p384Key.Public(), signature: signJWS(t, "ES384", p384Key, signed), wantErr: true},
+		{name: "ASN.1 length signature", algorithm: "ES256", publicKey: p256Key.Public(), signature: es256[:63], wantErr: true},
+		{name: "EdDSA with an EC key", algorithm: "EdDSA", publicKey: p256Key.Public(), signature: es256, wantErr: true},
+		{name: "none", algorithm: "none", publicKey: p256Key.Public(), signature: []byte{}, wantErr: true},
+		{name: "HMAC", algorithm: "HS256", publicKey: p256Key.Public(), signature: es256, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := verifySignature(tc.algorithm, tc.publicKey, signed, tc.signature)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("verifySignature() error = %v, want error %t", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseToken(t *testing.T) {
+	ca, caKey := newTestCA(t, "ca-1")
+	key := newECDSAKey(t, elliptic.P256())
+	certificate := newTestCertificate(t, "device-1", key, ca, caKey, testNow.Add(time.Hour))
+	claims := TokenClaims{
+		Subject:   "device-1",
+		Audience:  audience{"lamassu"},
+		ExpiresAt: testNow.Add(time.Minute).Unix(),
+	}
+	token := signToken(t, "ES256", key, certificate, claims)
+	parts := strings.Split(token, ".")
+
+	testCases := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "valid", token: token},
+		{name: "surrounded by spaces", token: " " + token + "\n"},
+		{name: "two segments", token: parts[0] + "." + parts[1], wantErr: true},
+		{name: "header not JSON", token: base64.RawURLEncoding.EncodeToString([]byte("{")) + "." + parts[1] + "." + parts[2], wantErr: true},
+		{name: "no certificate", token: encodeSegment(t, tokenHeader{Algorithm: "ES256"}) + "." + parts[1] + "." + parts[2], wantErr: true},
+		{name: "certificate not DER", token: encodeSegment(t, tokenHeader{Algorithm: "ES256", X5C: []string{"bm90IGEgY2VydGlmaWNhdGU="}}) + "." + parts[1] + "." + parts[2], wantErr: true},
+		{name: "tampered claims", token: parts[0] + "." + encodeSegment(t, TokenClaims{Subject: "device-2", ExpiresAt: claims.ExpiresAt}) + "." + parts[2], wantErr: true},
+		{name: "signed with another key", token: signToken(t, "ES256", newECDSAKey(t, elliptic.P256()), certificate, claims), wantErr: true},
+		{name: "algorithm of the header changed", token: encodeSegment(t, tokenHeader{Algorithm: "ES384", X5C: []string{base64.StdEncoding.EncodeToString(certificate.Raw)}}) + "." + parts[1] + "." + parts[2], wantErr: true},
+		{name: "signature not base64url", token: parts[0] + "." + parts[1] + ".***", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			parsed, err := ParseToken(tc.token)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("ParseToken() error = %v, want error %t", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if parsed.Claims.Subject != "device-1" || parsed.Claims.ExpiresAt != claims.ExpiresAt || !parsed.Claims.hasAudience("lamassu") {
+				t.Errorf("ParseToken() claims = %+v", parsed.Claims)
+			}
+			if !parsed.Certificate.Equal(certificate) {
+				t.Errorf("ParseToken() did not return the certificate of the token")
+			}
+		})
+	}
+}
+
+func TestAudienceAcceptsAStringOrAList(t *testing.T) {
+	for _, data := range []string{`{"aud": "lamassu"}`, `{"aud": ["other", "lamassu"]}`} {
+		var claims TokenClaims
+		err := json.Unmarshal([]byte(data), &claims)
+		if err != nil {
+			t.Fatalf("could not decode %s: %s", data, err)
+		}
+		if !claims.hasAudience("lamassu") {
+			t.Errorf("%s does not have the lamassu audience: %v", data, claims.Audience)
+		}
+	}
+}
+
+func TestValidAt(t *testing.T) {
+	testCases := []struct {
+		name        string
+		claims      TokenClaims
+		maxLifetime time.Duration
+		wantErr     bool
+	}{
+		{name: "valid", claims: TokenClaims{ExpiresAt: testNow.Add(time.Minute).Unix()}, maxLifetime: time.Hour},
+		{name: "no lifetime limit", claims: TokenClaims{ExpiresAt: testNow.Add(48 * time.Hour).Unix()}},
+		{name: "expires at the limit", claims: TokenClaims{ExpiresAt: testNow.Add(time.Hour).Unix()}, maxLifetime: time.Hour},
+		{name: "valid from now", claims: TokenClaims{ExpiresAt: testNow.Add(time.Minute).Unix(), NotBefore: testNow.Unix()}},
+		{name: "does not expire", claims: TokenClaims{}, wantErr: true},
+		{name: "expires now", claims: TokenClaims{ExpiresAt: testNow.Unix()}, wantErr: true},
+		{name: "expired", claims: TokenClaims{ExpiresAt: testNow.Add(-time.Minute).Unix()}, wantErr: true},
+		{name: "over the lifetime", claims: TokenClaims{ExpiresAt: testNow.Add(time.Hour + time.Second).Unix()}, maxLifetime: time.Hour, wantErr: true},
+		{name: "not valid yet", claims: TokenClaims{ExpiresAt: testNow.Add(time.Minute).Unix(), NotBefore: testNow.Add(time.Second).Unix()}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.claims.validAt(testNow, tc.maxLifetime)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("validAt() error = %v, want error %t", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -1,9 +1,26 @@
 package api
 
+import "time"
+
+// OperatingMode selects who keeps AWS in sync with Lamassu.
+type OperatingMode string
+
+const (
+	// In orchestrated mode the Lamassu cloud provider service calls the connector API.
+	OperatingModeOrchestrated OperatingMode = "orchestrated"
+	// In event driven mode the connector acts on the Lamassu events it receives.
+	OperatingModeEventDriven OperatingMode = "event-driven"
+)
+
 type HandleUpdateCertificateStatusInput struct {
-	CaName       string
-	SerialNumber string
-	Status       string
+	CaName        string
+	SerialNumber  string
+	CertificateID string
+	Status        string
+	// CorrelationID identifies the status change when it was made by the connector.
+	CorrelationID string
+	// Actor is who changed the status, when reported by the event.
+	Actor *AWSActor
 }
 
 type HandleUpdateCAStatusInput struct {
@@ -11,13 +28,26 @@ type HandleUpdateCAStatusInput struct {
 	CaSerialNumber string
 	CaID           string
 	Status         string
+	// EventID and EventSource identify the event that reported the change.
+	EventID     string
+	EventSource string
+	// CorrelationID identifies the status change when it was made by the connector.
+	CorrelationID string
+	// Actor is who changed the status, when reported by the event.
+	Actor *AWSActor
+}
+
+type HandleUpdateThingShadowInput struct {
+	ThingName  string
+	ShadowName string
+	Document   DeviceShadowDocument
 }
 
 type DeviceShadow struct {
 }
 
 type ShadowIssuer struct {
-	Url string `json:"url"`
+	Url string `json:"url,omitempty"`
 }
 
 type ShadowCaCerts struct {
@@ -31,14 +61,16 @@ type ShadowDevo struct {
 	Update bool `json:"update"`
 }
 type ShadowSlots struct {
-	Devo ShadowDevo `json:"devo"`
+	Devo *ShadowDevo `json:"devo,omitempty"`
 }
 
+// Desired only holds the sections that are being changed. Sections left as nil are not
+// sent to AWS so the values already present in the shadow are preserved.
 type Desired struct {
-	CaCerts      ShadowCaCerts      `json:"ca_certs"`
-	Issuer       ShadowIssuer       `json:"issuer"`
-	IdentityCert ShadowIdentityCert `json:"identity_cert"`
-	Slots        ShadowSlots        `json:"slots"`
+	CaCerts      *ShadowCaCerts      `json:"ca_certs,omitempty"`
+	Issuer       *ShadowIssuer       `json:"issuer,omitempty"`
+	IdentityCert *ShadowIdentityCert `json:"identity_cert,omitempty"`
+	Slots        *ShadowSlots        `json:"slots,omitempty"`
 }
 
 type StatePayload struct {
@@ -47,4 +79,49 @@ type StatePayload struct {
 
 type DeviceShadowPayload struct {
 	State StatePayload `json:"state"`
+	// Version makes the update conditional. AWS rejects the update with a conflict if the
+	// shadow has been modified since that version was read. Zero means unconditional.
+	Version int64 `json:"version,omitempty"`
+}
+
+// DeviceShadowState is the state section of a shadow document. Devices acknowledge an
+// action by reporting the same section and flag the connector requested in the desired state.
+type DeviceShadowState struct {
+	Desired  Desired `json:"desired"`
+	Reported Desired `json:"reported"`
+}
+
+type DeviceShadowDocument struct {
+	State   DeviceShadowState `json:"state"`
+	Version int64             `json:"version"`
+}
+
+type ShadowAction string
+
+const (
+	ShadowActionUpdateCACerts      ShadowAction = "UPDATE_CACERTS"
+	ShadowActionRotateIdentityCert ShadowAction = "ROTATE_IDENTITY_CERT"
+	ShadowActionUpdateDevoSlot     ShadowAction = "UPDATE_DEVO_SLOT"
+)
+
+type ShadowActionCompletion struct {
+	Action        ShadowAction `json:"action"`
+	ShadowVersion int64        `json:"shadow_version"`
+	CompletedAt   time.Time    `json:"completed_at"`
+}
+
+// IdentityJobDocument is the document of the IoT Jobs used to request identity actions. Its
+// state carries the same desired keys the shadow delivery channel would set.
+type IdentityJobDocument struct {
+	Operation string       `json:"operation"`
+	Action    ShadowAction `json:"action"`
+	State     StatePayload `json:"state"`
+}
+
+// PlannedAWSCall is a mutating AWS call that was not made because the connector runs in dry
+// run mode.
+type PlannedAWSCall struct {
+	Service   string      `json:"service"`
+	Operation string      `json:"operation"`
+	Input     interface{} `json:"input"`
 }
@@ -0,0 +1,44 @@
+package api
+
+import "time"
+
+// CABundleSchemaVersion is increased whenever the layout of CABundle changes.
+const CABundleSchemaVersion = 1
+
+// CABundle is the JSON representation of the CA certificates of a DMS. Version is increased
+// every time the set of certificates changes.
+type CABundle struct {
+	SchemaVersion int                   `json:"schema_version"`
+	Version       int                   `json:"version"`
+	DMSName       string                `json:"dms_name"`
+	Hash          string                `json:"hash"`
+	GeneratedAt   time.Time             `json:"generated_at"`
+	Certificates  []CABundleCertificate `json:"certificates"`
+}
+
+type CABundleCertificate struct {
+	Subject           string    `json:"subject"`
+	SerialNumber      string    `json:"serial_number"`
+	FingerprintSHA256 string    `json:"fingerprint_sha256"`
+	NotBefore         time.Time `json:"not_before"`
+	NotAfter          time.Time `json:"not_after"`
+	Certificate       string    `json:"certificate"`
+}
+
+// CABundleState records the last CA bundle published for a DMS.
+type CABundleState struct {
+	DMSName     string         `json:"dms_name"`
+	Hash        string         `json:"hash"`
+	Version     int            `json:"version"`
+	Format      CABundleFormat `json:"format"`
+	PublishedAt time.Time      `json:"published_at"`
+}
+
+//------------------------------------------------------
+
+type DeleteDMSCABundleInput struct {
+	DMSName string
+}
+
+type DeleteDMSCABundleOutput struct {
+}
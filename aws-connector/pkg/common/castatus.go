@@ -0,0 +1,27 @@
+package api
+
+import "fmt"
+
+// CAStatusSyncAction is what the connector does when the status of a CA is changed in AWS and
+// no longer matches Lamassu.
+type CAStatusSyncAction string
+
+const (
+	// The change is only logged.
+	CAStatusSyncActionIgnore CAStatusSyncAction = "IGNORE"
+	// The drift is flagged until the CA is back in sync, and listed in the drift report.
+	CAStatusSyncActionReport CAStatusSyncAction = "REPORT"
+	// A CA deactivated in AWS is revoked in Lamassu.
+	CAStatusSyncActionRevoke CAStatusSyncAction = "REVOKE"
+	// The AWS status is set back to match Lamassu.
+	CAStatusSyncActionRevert CAStatusSyncAction = "REVERT"
+)
+
+func ParseCAStatusSyncAction(action string) (CAStatusSyncAction, error) {
+	switch CAStatusSyncAction(action) {
+	case CAStatusSyncActionIgnore, CAStatusSyncActionReport, CAStatusSyncActionRevoke, CAStatusSyncActionRevert:
+		return CAStatusSyncAction(action), nil
+	default:
+		return "", fmt.Errorf("unknown CA status sync action %s", action)
+	}
+}
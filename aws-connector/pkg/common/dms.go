@@ -0,0 +1,111 @@
+package api
+
+import (
+	"time"
+
+	dmsApi "github.com/lamassuiot/lamassuiot/pkg/dms-manager/common/api"
+)
+
+// DMSAWSSettings complements the AWS specification Lamassu keeps for a DMS with the
+// settings only the connector needs.
+type DMSAWSSettings struct {
+	DMSName         string          `json:"dms_name"`
+	ShadowName      string          `json:"shadow_name"`
+	DeliveryChannel DeliveryChannel `json:"delivery_channel"`
+	// ThingGroup, if set, is targeted by the jobs addressed to every device of the DMS. It is
+	// also the thing group the devices of the DMS are kept in, instead of one named after the
+	// DMS.
+	ThingGroup     string         `json:"thing_group,omitempty"`
+	CABundleFormat CABundleFormat `json:"ca_bundle_format"`
+	// Policies are the names of the IoT policies attached to the thing group of the DMS.
+	Policies []string `json:"policies,omitempty"`
+}
+
+// CABundleFormat is the format of the retained message holding the CA certificates of a DMS.
+type CABundleFormat string
+
+const (
+	CABundleFormatPEM  CABundleFormat = "PEM"
+	CABundleFormatJSON CABundleFormat = "JSON"
+)
+
+// DeliveryChannel is the mechanism used to request identity actions from devices.
+type DeliveryChannel string
+
+const (
+	DeliveryChannelShadow DeliveryChannel = "SHADOW"
+	DeliveryChannelJobs   DeliveryChannel = "JOBS"
+)
+
+// ShadowLocation identifies the shadow holding the Lamassu state of the devices of a DMS.
+type ShadowLocation struct {
+	Type dmsApi.ShadowType `json:"type"`
+	Name string            `json:"name,omitempty"`
+}
+
+type ShadowMigrationStatus string
+
+const (
+	ShadowMigrationStatusRunning   ShadowMigrationStatus = "RUNNING"
+	ShadowMigrationStatusCompleted ShadowMigrationStatus = "COMPLETED"
+	ShadowMigrationStatusFailed    ShadowMigrationStatus = "FAILED"
+)
+
+type ShadowMigration struct {
+	DMSName         string                `json:"dms_name"`
+	From            ShadowLocation        `json:"from"`
+	To              ShadowLocation        `json:"to"`
+	Status          ShadowMigrationStatus `json:"status"`
+	StartedAt       time.Time             `json:"started_at"`
+	FinishedAt      *time.Time            `json:"finished_at,omitempty"`
+	MigratedDevices int                   `json:"migrated_devices"`
+	FailedDevices   []string              `json:"failed_devices"`
+	// Owner is the connector replica running the migration.
+	Owner string `json:"owner,omitempty"`
+}
+
+//------------------------------------------------------
+
+type GetDMSAWSSettingsInput struct {
+	DMSName string
+}
+
+type GetDMSAWSSettingsOutput struct {
+	DMSAWSSettings
+}
+
+//------------------------------------------------------
+
+// UpdateDMSAWSSettingsInput changes the settings that are not nil, the others are kept.
+type UpdateDMSAWSSettingsInput struct {
+	DMSName         string
+	ShadowName      *string
+	DeliveryChannel *DeliveryChannel
+	ThingGroup      *string
+	CABundleFormat  *CABundleFormat
+	Policies        *[]string
+}
+
+type UpdateDMSAWSSettingsOutput struct {
+	DMSAWSSettings
+}
+
+//------------------------------------------------------
+
+type MigrateDMSShadowsInput struct {
+	DMSName string
+}
+
+type MigrateDMSShadowsOutput struct {
+	ShadowMigration
+}
+
+//------------------------------------------------------
+
+type GetDMSShadowMigrationInput struct {
+	DMSName string
+}
+
+type GetDMSShadowMigrationOutput struct {
+	ShadowMigration
+}
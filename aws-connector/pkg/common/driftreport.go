@@ -0,0 +1,31 @@
+package api
+
+import "time"
+
+// DriftReportEntry is a drift detected by the reconciler, the report lists the same kinds.
+type DriftReportEntry struct {
+	Kind     DriftKind `json:"kind"`
+	Resource string    `json:"resource"`
+	// LamassuState and AWSState describe the resource on each side, empty if it is missing.
+	LamassuState string `json:"lamassu_state"`
+	AWSState     string `json:"aws_state"`
+	Detail       string `json:"detail"`
+}
+
+type DriftReport struct {
+	GeneratedAt time.Time          `json:"generated_at"`
+	Entries     []DriftReportEntry `json:"entries"`
+	// Flagged lists the drifts reported by the events from AWS that are not resolved yet.
+	Flagged []FlaggedDrift `json:"flagged"`
+	// Errors lists the checks that could not be completed, the report is partial if any.
+	Errors []string `json:"errors"`
+}
+
+//------------------------------------------------------
+
+type GetDriftReportInput struct {
+}
+
+type GetDriftReportOutput struct {
+	DriftReport
+}
@@ -0,0 +1,71 @@
+package api
+
+import "time"
+
+// ExpiryAction is what the expiry monitor does about a certificate registered in AWS.
+type ExpiryAction string
+
+const (
+	// ExpiryActionReenroll asks the device to re-enroll before its certificate expires.
+	ExpiryActionReenroll ExpiryAction = "REENROLL"
+	// ExpiryActionDeactivate deactivates an expired certificate in AWS.
+	ExpiryActionDeactivate ExpiryAction = "DEACTIVATE"
+)
+
+// ExpiringCertificate is a device certificate active in AWS that expires within the renewal
+// window, or has already expired.
+type ExpiringCertificate struct {
+	CAName string `json:"ca_name"`
+	// SerialNumber is empty for the certificates unknown to Lamassu.
+	SerialNumber     string       `json:"serial_number,omitempty"`
+	AWSCertificateID string       `json:"aws_certificate_id"`
+	NotAfter         time.Time    `json:"not_after"`
+	Action           ExpiryAction `json:"action"`
+	// DeviceIDs are the things the certificate is attached to, asked to re-enroll.
+	DeviceIDs []string `json:"device_ids,omitempty"`
+	Done      bool     `json:"done"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// ExpiringCA is a CA registered in AWS that expires within the warning window, or has
+// already expired.
+type ExpiringCA struct {
+	CAName           string    `json:"ca_name"`
+	AWSCertificateID string    `json:"aws_certificate_id"`
+	NotAfter         time.Time `json:"not_after"`
+	Expired          bool      `json:"expired"`
+}
+
+type ExpiryReport struct {
+	ID         string     `json:"id"`
+	DryRun     bool       `json:"dry_run"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// CAs and Certificates count what was checked.
+	CAs          int                   `json:"cas"`
+	Certificates int                   `json:"certificates"`
+	ExpiringCAs  []ExpiringCA          `json:"expiring_cas"`
+	Expiring     []ExpiringCertificate `json:"expiring"`
+	// Errors lists the CAs and certificates that could not be checked.
+	Errors []string `json:"errors"`
+}
+
+// CertificateExpiryNotice records that the devices using a certificate were asked to
+// re-enroll, so that they are asked only once.
+type CertificateExpiryNotice struct {
+	AWSCertificateID string    `json:"aws_certificate_id"`
+	DeviceIDs        []string  `json:"device_ids"`
+	NotAfter         time.Time `json:"not_after"`
+	NotifiedAt       time.Time `json:"notified_at"`
+}
+
+//------------------------------------------------------
+
+type MonitorExpiryInput struct {
+	// DryRun finds the expiring certificates without acting on them.
+	DryRun bool
+}
+
+type MonitorExpiryOutput struct {
+	ExpiryReport
+}
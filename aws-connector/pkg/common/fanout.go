@@ -0,0 +1,55 @@
+package api
+
+import (
+	"fmt"
+	"time"
+)
+
+type ShadowFanOutStatus string
+
+const (
+	ShadowFanOutStatusRunning   ShadowFanOutStatus = "RUNNING"
+	ShadowFanOutStatusCompleted ShadowFanOutStatus = "COMPLETED"
+	ShadowFanOutStatusFailed    ShadowFanOutStatus = "FAILED"
+)
+
+type ShadowFanOutFailure struct {
+	DeviceID string `json:"device_id"`
+	Error    string `json:"error"`
+}
+
+// ShadowFanOutReport summarizes a run updating the shadow of every device of a DMS. Only the
+// failed devices are listed, the others are counted.
+type ShadowFanOutReport struct {
+	ID         string                `json:"id"`
+	DMSName    string                `json:"dms_name"`
+	Action     ShadowAction          `json:"action"`
+	Status     ShadowFanOutStatus    `json:"status"`
+	Error      string                `json:"error,omitempty"`
+	StartedAt  time.Time             `json:"started_at"`
+	FinishedAt *time.Time            `json:"finished_at,omitempty"`
+	Succeeded  int                   `json:"succeeded"`
+	Failed     []ShadowFanOutFailure `json:"failed"`
+	Skipped    int                   `json:"skipped"`
+}
+
+// Err describes why a finished run did not reach every device, nil when it did.
+func (r ShadowFanOutReport) Err() error {
+	if r.Status == ShadowFanOutStatusFailed {
+		return fmt.Errorf("fan-out %s of DMS %s failed: %s", r.ID, r.DMSName, r.Error)
+	}
+	if len(r.Failed) > 0 {
+		return fmt.Errorf("fan-out %s of DMS %s failed for %d devices, e.g. %s: %s", r.ID, r.DMSName, len(r.Failed), r.Failed[0].DeviceID, r.Failed[0].Error)
+	}
+	return nil
+}
+
+//------------------------------------------------------
+
+type GetShadowFanOutReportsInput struct {
+	DMSName string
+}
+
+type GetShadowFanOutReportsOutput struct {
+	Reports []ShadowFanOutReport `json:"reports"`
+}
@@ -0,0 +1,82 @@
+package api
+
+import "time"
+
+type FleetImportStatus string
+
+const (
+	FleetImportStatusRunning   FleetImportStatus = "RUNNING"
+	FleetImportStatusCompleted FleetImportStatus = "COMPLETED"
+	FleetImportStatusFailed    FleetImportStatus = "FAILED"
+)
+
+// FleetImportCounters counts the outcome of the resources processed by an import. Resources
+// imported by a previous run are counted as already imported, which makes imports safe to
+// run again.
+type FleetImportCounters struct {
+	Imported        int `json:"imported"`
+	AlreadyImported int `json:"already_imported"`
+	Skipped         int `json:"skipped"`
+	Failed          int `json:"failed"`
+}
+
+type FleetImportIssueStatus string
+
+const (
+	FleetImportIssueSkipped FleetImportIssueStatus = "SKIPPED"
+	FleetImportIssueFailed  FleetImportIssueStatus = "FAILED"
+)
+
+// FleetImportIssue describes a resource that was not imported. Successful imports are only
+// counted, so the report of a large fleet stays small.
+type FleetImportIssue struct {
+	ResourceType string                 `json:"resource_type"`
+	Resource     string                 `json:"resource"`
+	Status       FleetImportIssueStatus `json:"status"`
+	Detail       string                 `json:"detail"`
+}
+
+type FleetImport struct {
+	ID         string              `json:"id"`
+	DMSName    string              `json:"dms_name"`
+	Status     FleetImportStatus   `json:"status"`
+	Error      string              `json:"error,omitempty"`
+	StartedAt  time.Time           `json:"started_at"`
+	FinishedAt *time.Time          `json:"finished_at,omitempty"`
+	TotalCAs   int                 `json:"total_cas"`
+	CAs        FleetImportCounters `json:"cas"`
+	Things     FleetImportCounters `json:"things"`
+	Issues     []FleetImportIssue  `json:"issues"`
+	// Owner is the connector replica running the import.
+	Owner string `json:"owner,omitempty"`
+}
+
+//------------------------------------------------------
+
+type ImportFleetInput struct {
+	// DMSName is the DMS the imported devices are created in.
+	DMSName string
+}
+
+type ImportFleetOutput struct {
+	FleetImport
+}
+
+//------------------------------------------------------
+
+type GetFleetImportInput struct {
+	ImportID string
+}
+
+type GetFleetImportOutput struct {
+	FleetImport
+}
+
+//------------------------------------------------------
+
+type GetFleetImportsInput struct {
+}
+
+type GetFleetImportsOutput struct {
+	Imports []FleetImport `json:"imports"`
+}
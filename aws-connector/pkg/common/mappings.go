@@ -0,0 +1,16 @@
+package api
+
+// AWSCAMapping links a Lamassu CA with the AWS CA certificate registered for it.
+type AWSCAMapping struct {
+	CAName            string `json:"ca_name"`
+	AWSCertificateID  string `json:"aws_certificate_id"`
+	AWSCertificateArn string `json:"aws_certificate_arn"`
+}
+
+// CertificateMapping links a certificate issued by a Lamassu CA with its AWS certificate.
+type CertificateMapping struct {
+	CAName            string `json:"ca_name"`
+	SerialNumber      string `json:"serial_number"`
+	AWSCertificateID  string `json:"aws_certificate_id"`
+	AWSCertificateArn string `json:"aws_certificate_arn"`
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type OutboxEntryStatus string
+
+const (
+	// Pending entries are waiting to be delivered, or to be retried after a failed attempt.
+	OutboxEntryStatusPending OutboxEntryStatus = "PENDING"
+	// Failed entries ran out of attempts and are only retried on request. They hold the
+	// following entries back until they are retried or deleted.
+	OutboxEntryStatusFailed OutboxEntryStatus = "FAILED"
+)
+
+// OutboxEntry is a Lamassu event waiting to be delivered to its destination. Entries are
+// delivered in the order of their ID and removed once delivered.
+type OutboxEntry struct {
+	ID            uint64            `json:"id"`
+	EventID       string            `json:"event_id"`
+	EventType     string            `json:"event_type"`
+	Destination   EventDestination  `json:"destination"`
+	Payload       json.RawMessage   `json:"payload"`
+	Status        OutboxEntryStatus `json:"status"`
+	Attempts      int               `json:"attempts"`
+	LastError     string            `json:"last_error,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+	NextAttemptAt time.Time         `json:"next_attempt_at"`
+}
+
+//------------------------------------------------------
+
+type GetOutboxEntriesInput struct {
+	// Status filters the entries, every undelivered entry is returned when empty.
+	Status OutboxEntryStatus
+}
+
+type GetOutboxEntriesOutput struct {
+	Entries []OutboxEntry `json:"entries"`
+}
+
+//------------------------------------------------------
+
+type RetryOutboxEntryInput struct {
+	ID uint64
+}
+
+type RetryOutboxEntryOutput struct {
+	OutboxEntry
+}
+
+//------------------------------------------------------
+
+type DeleteOutboxEntryInput struct {
+	ID uint64
+}
+
+type DeleteOutboxEntryOutput struct {
+	OutboxEntry
+}
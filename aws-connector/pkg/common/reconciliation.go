@@ -0,0 +1,173 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DriftKind identifies a kind of difference between Lamassu and AWS IoT.
+type DriftKind string
+
+const (
+	// An AWS CA is tagged with a Lamassu CA that does not exist anymore.
+	DriftCAMissingInLamassu DriftKind = "CA_MISSING_IN_LAMASSU"
+	// A Lamassu CA is revoked or expired but still active in AWS.
+	DriftCAStatus DriftKind = "CA_STATUS"
+	// A Lamassu CA is active but was deactivated in AWS.
+	DriftCAInactiveInAWS DriftKind = "CA_INACTIVE_IN_AWS"
+	// An active Lamassu CA is not registered in AWS.
+	DriftCAMissingInAWS DriftKind = "CA_MISSING_IN_AWS"
+	// A certificate is revoked in Lamassu but not in AWS.
+	DriftCertificateStatus DriftKind = "CERTIFICATE_STATUS"
+	// A certificate was revoked in AWS but is still valid in Lamassu.
+	DriftCertificateRevokedInAWS DriftKind = "CERTIFICATE_REVOKED_IN_AWS"
+	// A certificate is valid in Lamassu but was deactivated in AWS.
+	DriftCertificateInactiveInAWS DriftKind = "CERTIFICATE_INACTIVE_IN_AWS"
+	// A certificate registered in AWS under a Lamassu CA is unknown to Lamassu.
+	DriftCertificateMissingInLamassu DriftKind = "CERTIFICATE_MISSING_IN_LAMASSU"
+	// A revoked certificate is still attached to a thing.
+	DriftRevokedCertificateAttached DriftKind = "REVOKED_CERTIFICATE_ATTACHED"
+	// The retained CA bundle of a DMS does not match its CA certificates.
+	DriftCABundleOutdated DriftKind = "CA_BUNDLE_OUTDATED"
+	// A revoked or rejected DMS still has a retained CA bundle.
+	DriftCABundleStale DriftKind = "CA_BUNDLE_STALE"
+	// The policy referenced by the provisioning template of a CA is missing or not the
+	// latest one created for the CA.
+	DriftPolicyOutdated DriftKind = "POLICY_OUTDATED"
+	// The provisioning template of a CA is missing, disabled or differs from the template
+	// created by the connector.
+	DriftTemplateOutdated DriftKind = "TEMPLATE_OUTDATED"
+	// A provisioned Lamassu device has no thing in AWS.
+	DriftDeviceWithoutThing DriftKind = "DEVICE_WITHOUT_THING"
+	// A thing managed by the connector has no Lamassu device.
+	DriftThingWithoutDevice DriftKind = "THING_WITHOUT_DEVICE"
+)
+
+var DriftKinds = []DriftKind{
+	DriftCAMissingInLamassu,
+	DriftCAStatus,
+	DriftCAInactiveInAWS,
+	DriftCAMissingInAWS,
+	DriftCertificateStatus,
+	DriftCertificateRevokedInAWS,
+	DriftCertificateInactiveInAWS,
+	DriftCertificateMissingInLamassu,
+	DriftRevokedCertificateAttached,
+	DriftCABundleOutdated,
+	DriftCABundleStale,
+	DriftPolicyOutdated,
+	DriftTemplateOutdated,
+	DriftDeviceWithoutThing,
+	DriftThingWithoutDevice,
+}
+
+// reportOnlyDriftKinds have no correction: CAs are registered and provisioning templates
+// created when requested through the connector API, the things of a device are created when
+// it enrolls and the connector does not delete things.
+var reportOnlyDriftKinds = map[DriftKind]bool{
+	DriftCAMissingInAWS:     true,
+	DriftPolicyOutdated:     true,
+	DriftTemplateOutdated:   true,
+	DriftDeviceWithoutThing: true,
+	DriftThingWithoutDevice: true,
+}
+
+// ReconcileAction is what the reconciler does with a kind of drift.
+type ReconcileAction string
+
+const (
+	ReconcileActionConverge ReconcileAction = "CONVERGE"
+	ReconcileActionReport   ReconcileAction = "REPORT"
+)
+
+// DefaultReconcileRules only reports every drift, corrections have to be enabled kind by
+// kind once the drifts have been reviewed.
+func DefaultReconcileRules() map[DriftKind]ReconcileAction {
+	rules := map[DriftKind]ReconcileAction{}
+	for _, kind := range DriftKinds {
+		rules[kind] = ReconcileActionReport
+	}
+	return rules
+}
+
+// ParseReconcileRules overrides the default rules with a comma separated list of
+// KIND=ACTION pairs, e.g. "CA_MISSING_IN_LAMASSU=CONVERGE,CA_BUNDLE_STALE=REPORT".
+func ParseReconcileRules(rules string) (map[DriftKind]ReconcileAction, error) {
+	parsed := DefaultReconcileRules()
+	for _, rule := range strings.Split(rules, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		kind, action, found := strings.Cut(rule, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid reconcile rule %s", rule)
+		}
+		if _, ok := parsed[DriftKind(kind)]; !ok {
+			return nil, fmt.Errorf("unknown drift kind %s", kind)
+		}
+		if ReconcileAction(action) != ReconcileActionConverge && ReconcileAction(action) != ReconcileActionReport {
+			return nil, fmt.Errorf("unknown reconcile action %s", action)
+		}
+		if ReconcileAction(action) == ReconcileActionConverge && reportOnlyDriftKinds[DriftKind(kind)] {
+			return nil, fmt.Errorf("drift kind %s can only be reported", kind)
+		}
+
+		parsed[DriftKind(kind)] = ReconcileAction(action)
+	}
+	return parsed, nil
+}
+
+type Drift struct {
+	Kind     DriftKind `json:"kind"`
+	Resource string    `json:"resource"`
+	// LamassuState and AWSState describe the resource on each side, empty if it is missing.
+	LamassuState string          `json:"lamassu_state,omitempty"`
+	AWSState     string          `json:"aws_state,omitempty"`
+	Detail       string          `json:"detail"`
+	Action       ReconcileAction `json:"action"`
+	Corrected    bool            `json:"corrected"`
+	Error        string          `json:"error,omitempty"`
+}
+
+// FlaggedDrift is a drift reported by an event from AWS. It stays flagged until the resource
+// is back in sync, which the reconciler or a later event notices.
+type FlaggedDrift struct {
+	Drift
+	FlaggedAt   time.Time `json:"flagged_at"`
+	EventID     string    `json:"event_id"`
+	EventSource string    `json:"event_source"`
+	Actor       *AWSActor `json:"actor,omitempty"`
+}
+
+type ReconciliationReport struct {
+	ID         string     `json:"id"`
+	DryRun     bool       `json:"dry_run"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Drifts     []Drift    `json:"drifts"`
+	// Errors lists the checks that could not be completed.
+	Errors []string `json:"errors"`
+}
+
+//------------------------------------------------------
+
+type ReconcileInput struct {
+	// DryRun detects the drifts without correcting any of them.
+	DryRun bool
+}
+
+type ReconcileOutput struct {
+	ReconciliationReport
+}
+
+//------------------------------------------------------
+
+type GetReconciliationReportInput struct {
+}
+
+type GetReconciliationReportOutput struct {
+	ReconciliationReport
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWSActor is who made a change in AWS, as recorded by CloudTrail.
+type AWSActor struct {
+	// Type is the CloudTrail identity type, e.g. IAMUser, AssumedRole, Root or AWSService.
+	Type        string `json:"type,omitempty"`
+	ARN         string `json:"arn,omitempty"`
+	PrincipalID string `json:"principal_id,omitempty"`
+	AccountID   string `json:"account_id,omitempty"`
+	// InvokedBy is the AWS service that made the change on behalf of the identity, e.g.
+	// iot.amazonaws.com for the Device Defender mitigation actions.
+	InvokedBy string    `json:"invoked_by,omitempty"`
+	SourceIP  string    `json:"source_ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	EventTime time.Time `json:"event_time"`
+	// EventID is the ID of the CloudTrail event.
+	EventID string `json:"event_id,omitempty"`
+}
+
+// Name is the most specific identification of the actor.
+func (a AWSActor) Name() string {
+	switch {
+	case a.InvokedBy != "" && a.ARN != "":
+		return a.ARN + " through " + a.InvokedBy
+	case a.InvokedBy != "":
+		return a.InvokedBy
+	case a.ARN != "":
+		return a.ARN
+	case a.PrincipalID != "":
+		return a.PrincipalID
+	default:
+		return a.Type
+	}
+}
+
+// RevocationReason is a CRLReason code of RFC 5280.
+type RevocationReason int
+
+const (
+	RevocationReasonUnspecified          RevocationReason = 0
+	RevocationReasonKeyCompromise        RevocationReason = 1
+	RevocationReasonCACompromise         RevocationReason = 2
+	RevocationReasonAffiliationChanged   RevocationReason = 3
+	RevocationReasonSuperseded           RevocationReason = 4
+	RevocationReasonCessationOfOperation RevocationReason = 5
+	RevocationReasonCertificateHold      RevocationReason = 6
+	RevocationReasonRemoveFromCRL        RevocationReason = 8
+	RevocationReasonPrivilegeWithdrawn   RevocationReason = 9
+	RevocationReasonAACompromise         RevocationReason = 10
+)
+
+var revocationReasonNames = map[RevocationReason]string{
+	RevocationReasonUnspecified:          "unspecified",
+	RevocationReasonKeyCompromise:        "keyCompromise",
+	RevocationReasonCACompromise:         "cACompromise",
+	RevocationReasonAffiliationChanged:   "affiliationChanged",
+	RevocationReasonSuperseded:           "superseded",
+	RevocationReasonCessationOfOperation: "cessationOfOperation",
+	RevocationReasonCertificateHold:      "certificateHold",
+	RevocationReasonRemoveFromCRL:        "removeFromCRL",
+	RevocationReasonPrivilegeWithdrawn:   "privilegeWithdrawn",
+	RevocationReasonAACompromise:         "aACompromise",
+}
+
+func (r RevocationReason) String() string {
+	if name, ok := revocationReasonNames[r]; ok {
+		return name
+	}
+	return strconv.Itoa(int(r))
+}
+
+// ParseRevocationReason accepts the RFC 5280 name of a reason, in any case, or its code.
+func ParseRevocationReason(reason string) (RevocationReason, error) {
+	for code, name := range revocationReasonNames {
+		if strings.EqualFold(reason, name) || reason == strconv.Itoa(int(code)) {
+			return code, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown revocation reason %s", reason)
+}
+
+// RevocationReasonRule gives the reason of the revocations made by the matching actors.
+// Match is a CloudTrail identity type, the AWS service invoking the change (a name ending in
+// .amazonaws.com), an identity ARN, which may end with * to match a prefix, or * to match
+// every actor.
+type RevocationReasonRule struct {
+	Match  string
+	Reason RevocationReason
+}
+
+func (r RevocationReasonRule) matches(actor AWSActor) bool {
+	switch {
+	case r.Match == "*":
+		return true
+	case strings.HasSuffix(r.Match, ".amazonaws.com"):
+		return actor.InvokedBy == r.Match
+	case strings.HasPrefix(r.Match, "arn:"):
+		if strings.HasSuffix(r.Match, "*") {
+			return strings.HasPrefix(actor.ARN, strings.TrimSuffix(r.Match, "*"))
+		}
+		return actor.ARN == r.Match
+	default:
+		return actor.Type == r.Match
+	}
+}
+
+// ParseRevocationReasonRules parses a comma separated list of MATCH=REASON pairs, applied in
+// order.
+func ParseRevocationReasonRules(rules string) ([]RevocationReasonRule, error) {
+	parsed := []RevocationReasonRule{}
+	for _, rule := range strings.Split(rules, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		match, reason, found := strings.Cut(rule, "=")
+		if !found || match == "" {
+			return nil, fmt.Errorf("invalid revocation reason rule %s", rule)
+		}
+		code, err := ParseRevocationReason(reason)
+		if err != nil {
+			return nil, err
+		}
+
+		parsed = append(parsed, RevocationReasonRule{Match: match, Reason: code})
+	}
+	return parsed, nil
+}
+
+// RevocationReasonFor returns the reason of the first rule matching the actor, or
+// unspecified.
+func RevocationReasonFor(rules []RevocationReasonRule, actor AWSActor) RevocationReason {
+	for _, rule := range rules {
+		if rule.matches(actor) {
+			return rule.Reason
+		}
+	}
+	return RevocationReasonUnspecified
+}
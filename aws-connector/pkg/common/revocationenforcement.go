@@ -0,0 +1,42 @@
+package api
+
+import "time"
+
+// EnforcedRevocation is a certificate revoked in Lamassu that was still usable in AWS.
+type EnforcedRevocation struct {
+	CAName           string `json:"ca_name"`
+	SerialNumber     string `json:"serial_number"`
+	AWSCertificateID string `json:"aws_certificate_id"`
+	// AWSStatus is the status of the AWS certificate before it was revoked.
+	AWSStatus string `json:"aws_status"`
+	// RevokedAt is when the certificate was revoked in Lamassu, and Latency how long it
+	// remained usable in AWS afterwards. Both are empty when Lamassu does not report it.
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	Latency   string     `json:"latency,omitempty"`
+	Revoked   bool       `json:"revoked"`
+	Error     string     `json:"error,omitempty"`
+}
+
+type RevocationEnforcementReport struct {
+	ID         string     `json:"id"`
+	DryRun     bool       `json:"dry_run"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// CAs and RevokedCertificates count what was checked.
+	CAs                 int                  `json:"cas"`
+	RevokedCertificates int                  `json:"revoked_certificates"`
+	Enforced            []EnforcedRevocation `json:"enforced"`
+	// Errors lists the CAs that could not be checked.
+	Errors []string `json:"errors"`
+}
+
+//------------------------------------------------------
+
+type EnforceRevocationsInput struct {
+	// DryRun finds the certificates to revoke without revoking them.
+	DryRun bool
+}
+
+type EnforceRevocationsOutput struct {
+	RevocationEnforcementReport
+}
@@ -0,0 +1,207 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// EventRoutingAction is what the connector does with a Lamassu event.
+type EventRoutingAction string
+
+const (
+	// Dropped events are not forwarded. Every event is handled by the connector, so DROP is
+	// the same as LOCAL.
+	EventRoutingActionDrop EventRoutingAction = "DROP"
+	// Forwarded events are handled by the connector and delivered to a destination.
+	EventRoutingActionForward EventRoutingAction = "FORWARD"
+	// Local events are only handled by the connector.
+	EventRoutingActionLocal EventRoutingAction = "LOCAL"
+)
+
+type EventDestinationType string
+
+const (
+	EventDestinationSQS      EventDestinationType = "SQS"
+	EventDestinationIoTTopic EventDestinationType = "IOT_TOPIC"
+)
+
+// EventDestination is where a forwarded event is delivered. The target of an SQS destination
+// is a queue name or URL, the outbound queue when empty. The target of an IoT destination is
+// an MQTT topic.
+type EventDestination struct {
+	Type   EventDestinationType `json:"type"`
+	Target string               `json:"target,omitempty"`
+}
+
+// EventMatch selects events by their type, source and data fields. Patterns may use * as a
+// wildcard, and data fields are addressed by their dotted path in the event data. Empty
+// criteria match every event.
+type EventMatch struct {
+	Type   string            `json:"type,omitempty"`
+	Source string            `json:"source,omitempty"`
+	Data   map[string]string `json:"data,omitempty"`
+}
+
+type EventRoutingRule struct {
+	Name        string             `json:"name"`
+	Match       EventMatch         `json:"match"`
+	Action      EventRoutingAction `json:"action"`
+	Destination *EventDestination  `json:"destination,omitempty"`
+}
+
+// EventRoute is the outcome of the routing rules for an event. Rule is nil when no rule
+// matched and the default route was taken.
+type EventRoute struct {
+	Rule        *EventRoutingRule  `json:"rule,omitempty"`
+	Action      EventRoutingAction `json:"action"`
+	Destination *EventDestination  `json:"destination,omitempty"`
+}
+
+// DefaultEventRoute forwards the events no rule matched to the outbound queue.
+func DefaultEventRoute() EventRoute {
+	return EventRoute{
+		Action: EventRoutingActionForward,
+		Destination: &EventDestination{
+			Type: EventDestinationSQS,
+		},
+	}
+}
+
+// ParseEventRoutingRules decodes and validates a JSON list of routing rules.
+func ParseEventRoutingRules(rules []byte) ([]EventRoutingRule, error) {
+	parsed := []EventRoutingRule{}
+	err := json.Unmarshal(rules, &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid event routing rules: %w", err)
+	}
+
+	for i, rule := range parsed {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+
+		switch rule.Action {
+		case EventRoutingActionDrop, EventRoutingActionLocal:
+			if rule.Destination != nil {
+				return nil, fmt.Errorf("event routing rule %s: a destination is only allowed for %s", name, EventRoutingActionForward)
+			}
+		case EventRoutingActionForward:
+			if rule.Destination == nil {
+				return nil, fmt.Errorf("event routing rule %s: a destination is required", name)
+			}
+			switch rule.Destination.Type {
+			case EventDestinationSQS:
+			case EventDestinationIoTTopic:
+				if rule.Destination.Target == "" {
+					return nil, fmt.Errorf("event routing rule %s: the IoT topic is required", name)
+				}
+			default:
+				return nil, fmt.Errorf("event routing rule %s: unknown destination type %s", name, rule.Destination.Type)
+			}
+		default:
+			return nil, fmt.Errorf("event routing rule %s: unknown action %s", name, rule.Action)
+		}
+	}
+
+	return parsed, nil
+}
+
+// RouteEvent applies the first rule matching the event, or the default route.
+func RouteEvent(rules []EventRoutingRule, eventType string, source string, data []byte) EventRoute {
+	// Events whose data is not JSON only match the rules without data criteria.
+	var decoded interface{}
+	json.Unmarshal(data, &decoded)
+
+	for i := range rules {
+		rule := rules[i]
+		if rule.Match.matches(eventType, source, decoded) {
+			return EventRoute{
+				Rule:        &rule,
+				Action:      rule.Action,
+				Destination: rule.Destination,
+			}
+		}
+	}
+
+	return DefaultEventRoute()
+}
+
+func (m EventMatch) matches(eventType string, source string, data interface{}) bool {
+	if m.Type != "" && !matchPattern(m.Type, eventType) {
+		return false
+	}
+	if m.Source != "" && !matchPattern(m.Source, source) {
+		return false
+	}
+
+	for path, pattern := range m.Data {
+		value, ok := dataField(data, path)
+		if !ok || !matchPattern(pattern, value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// dataField returns the value at the dotted path of the event data, formatted as a string.
+func dataField(data interface{}, path string) (string, bool) {
+	value := data
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		value, ok = object[key]
+		if !ok {
+			return "", false
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case nil, map[string]interface{}, []interface{}:
+		return "", false
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+// matchPattern matches value against a pattern where * stands for any sequence of characters.
+func matchPattern(pattern string, value string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == value
+	}
+
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(value, part)
+		if i < 0 {
+			return false
+		}
+		value = value[i+len(part):]
+	}
+
+	return len(value) >= len(last) && strings.HasSuffix(value, last)
+}
+
+//------------------------------------------------------
+
+type TestEventRoutingInput struct {
+	Type   string
+	Source string
+	Data   []byte
+}
+
+type TestEventRoutingOutput struct {
+	EventRoute
+}
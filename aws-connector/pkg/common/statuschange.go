@@ -0,0 +1,26 @@
+package api
+
+import "time"
+
+// StatusChangeResource is the kind of AWS resource whose status the connector changes.
+type StatusChangeResource string
+
+const (
+	StatusChangeResourceCA          StatusChangeResource = "CA"
+	StatusChangeResourceCertificate StatusChangeResource = "CERTIFICATE"
+)
+
+// StatusChangeUserAgentPrefix is appended to the user agent of the status changes made by
+// the connector, followed by the correlation ID of the change. CloudTrail records the user
+// agent, so the Lambdas reporting the change can hand the ID back to the connector.
+const StatusChangeUserAgentPrefix = "lamassu-aws-connector-change/"
+
+// PendingStatusChange is a status change made by the connector in AWS whose event has not
+// come back to the connector yet.
+type PendingStatusChange struct {
+	CorrelationID    string               `json:"correlation_id"`
+	Resource         StatusChangeResource `json:"resource"`
+	AWSCertificateID string               `json:"aws_certificate_id"`
+	Status           string               `json:"status"`
+	CreatedAt        time.Time            `json:"created_at"`
+}
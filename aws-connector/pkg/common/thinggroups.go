@@ -0,0 +1,48 @@
+package api
+
+import "time"
+
+// ThingGroupOwnership records what the connector did to a thing group, so that it only undoes
+// its own changes: things are only removed from the groups it created, and only the policies
+// it attached are detached.
+type ThingGroupOwnership struct {
+	ThingGroup string `json:"thing_group"`
+	Created    bool   `json:"created"`
+	// AttachedPolicies are the policies the connector attached to the group.
+	AttachedPolicies []string `json:"attached_policies"`
+}
+
+// ThingGroupMove is a thing that was not in the thing group of the DMS of its device.
+type ThingGroupMove struct {
+	ThingName  string `json:"thing_name"`
+	DMSName    string `json:"dms_name"`
+	ThingGroup string `json:"thing_group"`
+	// RemovedFrom are the thing groups of other DMSs the thing was in.
+	RemovedFrom []string `json:"removed_from,omitempty"`
+	Moved       bool     `json:"moved"`
+	Error       string   `json:"error,omitempty"`
+}
+
+type DMSThingGroupSyncReport struct {
+	ID         string     `json:"id"`
+	DryRun     bool       `json:"dry_run"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// DMSs and Devices count what was checked.
+	DMSs    int              `json:"dmss"`
+	Devices int              `json:"devices"`
+	Moves   []ThingGroupMove `json:"moves"`
+	// Errors lists the DMSs that could not be checked.
+	Errors []string `json:"errors"`
+}
+
+//------------------------------------------------------
+
+type SyncDMSThingGroupsInput struct {
+	// DryRun finds the things to move without moving them.
+	DryRun bool
+}
+
+type SyncDMSThingGroupsOutput struct {
+	DMSThingGroupSyncReport
+}
@@ -0,0 +1,202 @@
+package events
+
+import (
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	caApi "github.com/lamassuiot/lamassuiot/pkg/ca/common/api"
+	dmsApi "github.com/lamassuiot/lamassuiot/pkg/dms-manager/common/api"
+)
+
+// Events published by the Lamassu services and forwarded by the connector to AWS.
+const (
+	TypeCACreate               = "io.lamassuiot.ca.create"
+	TypeCAImport               = "io.lamassuiot.ca.import"
+	TypeCAUpdate               = "io.lamassuiot.ca.update"
+	TypeCARevoke               = "io.lamassuiot.ca.revoke"
+	TypeCertificateSign        = "io.lamassuiot.certificate.sign"
+	TypeCertificateUpdate      = "io.lamassuiot.certificate.update"
+	TypeCertificateRevoke      = "io.lamassuiot.certificate.revoke"
+	TypeDMSCreate              = "io.lamassuiot.dms.create"
+	TypeDMSUpdate              = "io.lamassuiot.dms.update"
+	TypeDMSUpdateStatus        = "io.lamassuiot.dms.update-status"
+	TypeDMSUpdateAuthorizedCAs = "io.lamassuiot.dms.update-authorizedcas"
+)
+
+// Events sent by the AWS resources to the inbound queue of the connector.
+const (
+	TypeAWSCertificateStatusUpdate = "io.lamassu.iotcore.cert.status.update"
+	TypeAWSCAStatusUpdate          = "io.lamassu.iotcore.ca.status.update"
+	TypeAWSThingShadowUpdate       = "io.lamassu.iotcore.thing.shadow.update"
+)
+
+// Extensions of the shadow update events identifying the shadow.
+const (
+	ExtensionThingName  = "thingname"
+	ExtensionShadowName = "shadowname"
+)
+
+// ExtensionCorrelationID is set on the status update events caused by a change made by the
+// connector, to the correlation ID of the change.
+const ExtensionCorrelationID = "correlationid"
+
+// The version 1 payloads of the Lamassu events are the serialized outputs of the services.
+type (
+	CAV1          = caApi.CACertificateSerialized
+	CertificateV1 = caApi.CertificateSerialized
+	DMSV1         = dmsApi.DeviceManufacturingServiceSerialized
+)
+
+type SignedCertificateV1 struct {
+	Certificate   string `json:"certificate"`
+	CACertificate string `json:"ca_certificate"`
+}
+
+// CertificateStatusUpdateV1 reports a certificate status changed in AWS, e.g. through the
+// console.
+type CertificateStatusUpdateV1 struct {
+	CAID           string `json:"ca_id"`
+	CAName         string `json:"ca_name"`
+	CASerialNumber string `json:"ca_serial_number"`
+	CertificateID  string `json:"certificate_id"`
+	SerialNumber   string `json:"serial_number"`
+	DeviceID       string `json:"device_id"`
+	Status         string `json:"status"`
+	// Actor is who changed the status, as recorded by CloudTrail.
+	Actor *api.AWSActor `json:"actor,omitempty"`
+}
+
+// CAStatusUpdateV1 reports a CA status changed in AWS.
+type CAStatusUpdateV1 struct {
+	CAID           string `json:"ca_id"`
+	CAName         string `json:"ca_name"`
+	CASerialNumber string `json:"ca_serial_number"`
+	Status         string `json:"status"`
+	// Actor is who changed the status, as recorded by CloudTrail.
+	Actor *api.AWSActor `json:"actor,omitempty"`
+}
+
+// ThingShadowUpdateV1 is the current shadow document after an update. The shadow is named by
+// the thingname and shadowname extensions.
+type ThingShadowUpdateV1 = api.DeviceShadowDocument
+
+const caV1Schema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "Lamassu CA",
+	"type": "object",
+	"required": ["name", "status"],
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"status": {"type": "string", "enum": ["ACTIVE", "EXPIRED", "REVOKED", "ABOUT_TO_EXPIRE"]},
+		"certificate": {"type": "string"},
+		"serial_number": {"type": "string"},
+		"issuance_duration": {"type": "integer"}
+	}
+}`
+
+const certificateV1Schema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "Lamassu certificate",
+	"type": "object",
+	"required": ["name", "status", "serial_number"],
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"status": {"type": "string", "enum": ["ACTIVE", "EXPIRED", "REVOKED", "ABOUT_TO_EXPIRE"]},
+		"certificate": {"type": "string"},
+		"serial_number": {"type": "string", "minLength": 1},
+		"subject": {
+			"type": "object",
+			"properties": {
+				"common_name": {"type": "string"}
+			}
+		}
+	}
+}`
+
+const signedCertificateV1Schema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "Lamassu signed certificate",
+	"type": "object",
+	"required": ["certificate"],
+	"properties": {
+		"certificate": {"type": "string"},
+		"ca_certificate": {"type": "string"}
+	}
+}`
+
+const dmsV1Schema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "Lamassu DMS",
+	"type": "object",
+	"required": ["name", "status"],
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"status": {"type": "string", "enum": ["PENDING_APPROVAL", "REJECTED", "APPROVED", "EXPIRED", "REVOKED"]},
+		"cloud_dms": {"type": "boolean"},
+		"aws": {"type": "object"},
+		"creation_timestamp": {"type": "integer"}
+	}
+}`
+
+// awsActorSchema is the schema of the actor of the AWS status updates, as recorded by
+// CloudTrail.
+const awsActorSchema = `{
+	"type": "object",
+	"properties": {
+		"type": {"type": "string"},
+		"arn": {"type": "string"},
+		"principal_id": {"type": "string"},
+		"account_id": {"type": "string"},
+		"invoked_by": {"type": "string"},
+		"source_ip": {"type": "string"},
+		"user_agent": {"type": "string"},
+		"event_time": {"type": "string"},
+		"event_id": {"type": "string"}
+	}
+}`
+
+const certificateStatusUpdateV1Schema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "AWS certificate status update",
+	"type": "object",
+	"required": ["ca_name", "serial_number", "status"],
+	"properties": {
+		"ca_id": {"type": "string"},
+		"ca_name": {"type": "string", "minLength": 1},
+		"ca_serial_number": {"type": "string"},
+		"certificate_id": {"type": "string"},
+		"serial_number": {"type": "string", "minLength": 1},
+		"device_id": {"type": "string"},
+		"status": {"type": "string", "enum": ["ACTIVE", "INACTIVE", "REVOKED", "PENDING_TRANSFER", "REGISTER_INACTIVE", "PENDING_ACTIVATION"]},
+		"actor": ` + awsActorSchema + `
+	}
+}`
+
+const caStatusUpdateV1Schema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "AWS CA status update",
+	"type": "object",
+	"required": ["ca_name", "status"],
+	"properties": {
+		"ca_id": {"type": "string"},
+		"ca_name": {"type": "string", "minLength": 1},
+		"ca_serial_number": {"type": "string"},
+		"status": {"type": "string", "enum": ["ACTIVE", "INACTIVE"]},
+		"actor": ` + awsActorSchema + `
+	}
+}`
+
+const thingShadowUpdateV1Schema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "AWS thing shadow update",
+	"type": "object",
+	"required": ["state", "version"],
+	"properties": {
+		"state": {
+			"type": "object",
+			"properties": {
+				"desired": {"type": "object"},
+				"reported": {"type": "object"}
+			}
+		},
+		"version": {"type": "integer", "minimum": 0}
+	}
+}`
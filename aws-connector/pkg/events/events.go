@@ -0,0 +1,219 @@
+// Package events defines the CloudEvents produced and consumed by the connector, with their
+// versioned data structs and the JSON schemas their data is validated against.
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	metrics "github.com/armon/go-metrics"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/types"
+)
+
+// Direction tells who produces an event.
+type Direction string
+
+const (
+	// Lamassu events are received from RabbitMQ and forwarded to AWS.
+	DirectionLamassuToAWS Direction = "lamassu-to-aws"
+	// AWS events are received from the inbound SQS queue.
+	DirectionAWSToLamassu Direction = "aws-to-lamassu"
+)
+
+// Definition describes a version of an event type. The version of an event is selected by
+// its dataschema attribute, events without one are of version 1.
+type Definition struct {
+	Type      string    `json:"type"`
+	Version   int       `json:"version"`
+	Direction Direction `json:"direction"`
+	// Extensions are the CloudEvents extensions the event must carry.
+	Extensions []string `json:"extensions,omitempty"`
+	// Schema is the JSON schema of the event data.
+	Schema json.RawMessage `json:"schema"`
+
+	newData  func() interface{}
+	compiled *schema
+}
+
+// DataSchema is the dataschema attribute selecting the definition.
+func (d Definition) DataSchema() string {
+	return SchemaURI(d.Type, d.Version)
+}
+
+// SchemaURI identifies the schema of a version of an event type.
+func SchemaURI(eventType string, version int) string {
+	return fmt.Sprintf("urn:lamassu:events:%s:v%d", eventType, version)
+}
+
+var registry = map[string]map[int]*Definition{}
+
+func init() {
+	definitions := []Definition{
+		{Type: TypeCACreate, Version: 1, Direction: DirectionLamassuToAWS, Schema: json.RawMessage(caV1Schema), newData: func() interface{} { return &CAV1{} }},
+		{Type: TypeCAImport, Version: 1, Direction: DirectionLamassuToAWS, Schema: json.RawMessage(caV1Schema), newData: func() interface{} { return &CAV1{} }},
+		{Type: TypeCAUpdate, Version: 1, Direction: DirectionLamassuToAWS, Schema: json.RawMessage(caV1Schema), newData: func() interface{} { return &CAV1{} }},
+		{Type: TypeCARevoke, Version: 1, Direction: DirectionLamassuToAWS, Schema: json.RawMessage(caV1Schema), newData: func() interface{} { return &CAV1{} }},
+		{Type: TypeCertificateSign, Version: 1, Direction: DirectionLamassuToAWS, Schema: json.RawMessage(signedCertificateV1Schema), newData: func() interface{} { return &SignedCertificateV1{} }},
+		{Type: TypeCertificateUpdate, Version: 1, Direction: DirectionLamassuToAWS, Schema: json.RawMessage(certificateV1Schema), newData: func() interface{} { return &CertificateV1{} }},
+		{Type: TypeCertificateRevoke, Version: 1, Direction: DirectionLamassuToAWS, Schema: json.RawMessage(certificateV1Schema), newData: func() interface{} { return &CertificateV1{} }},
+		{Type: TypeDMSCreate, Version: 1, Direction: DirectionLamassuToAWS, Schema: json.RawMessage(dmsV1Schema), newData: func() interface{} { return &DMSV1{} }},
+		{Type: TypeDMSUpdate, Version: 1, Direction: DirectionLamassuToAWS, Schema: json.RawMessage(dmsV1Schema), newData: func() interface{} { return &DMSV1{} }},
+		{Type: TypeDMSUpdateStatus, Version: 1, Direction: DirectionLamassuToAWS, Schema: json.RawMessage(dmsV1Schema), newData: func() interface{} { return &DMSV1{} }},
+		{Type: TypeDMSUpdateAuthorizedCAs, Version: 1, Direction: DirectionLamassuToAWS, Schema: json.RawMessage(dmsV1Schema), newData: func() interface{} { return &DMSV1{} }},
+		{Type: TypeAWSCertificateStatusUpdate, Version: 1, Direction: DirectionAWSToLamassu, Schema: json.RawMessage(certificateStatusUpdateV1Schema), newData: func() interface{} { return &CertificateStatusUpdateV1{} }},
+		{Type: TypeAWSCAStatusUpdate, Version: 1, Direction: DirectionAWSToLamassu, Schema: json.RawMessage(caStatusUpdateV1Schema), newData: func() interface{} { return &CAStatusUpdateV1{} }},
+		{Type: TypeAWSThingShadowUpdate, Version: 1, Direction: DirectionAWSToLamassu, Extensions: []string{ExtensionThingName}, Schema: json.RawMessage(thingShadowUpdateV1Schema), newData: func() interface{} { return &ThingShadowUpdateV1{} }},
+	}
+
+	for i := range definitions {
+		register(definitions[i])
+	}
+}
+
+func register(definition Definition) {
+	compiled, err := compileSchema(string(definition.Schema))
+	if err != nil {
+		panic(fmt.Sprintf("invalid schema of event %s v%d: %s", definition.Type, definition.Version, err))
+	}
+	definition.compiled = compiled
+
+	if registry[definition.Type] == nil {
+		registry[definition.Type] = map[int]*Definition{}
+	}
+	registry[definition.Type][definition.Version] = &definition
+}
+
+// Definitions returns every registered event definition, ordered by type and version.
+func Definitions() []Definition {
+	definitions := []Definition{}
+	for _, versions := range registry {
+		for _, definition := range versions {
+			definitions = append(definitions, *definition)
+		}
+	}
+
+	sort.Slice(definitions, func(i, j int) bool {
+		if definitions[i].Type != definitions[j].Type {
+			return definitions[i].Type < definitions[j].Type
+		}
+		return definitions[i].Version < definitions[j].Version
+	})
+	return definitions
+}
+
+// Registered tells whether an event type has a definition.
+func Registered(eventType string) bool {
+	_, ok := registry[eventType]
+	return ok
+}
+
+// Lookup returns the definition of an event, given its type and dataschema attribute.
+func Lookup(eventType string, dataSchema string) (*Definition, error) {
+	versions, ok := registry[eventType]
+	if !ok {
+		return nil, &UnknownEventTypeError{Type: eventType}
+	}
+
+	if dataSchema == "" {
+		dataSchema = SchemaURI(eventType, 1)
+	}
+	for _, definition := range versions {
+		if definition.DataSchema() == dataSchema {
+			return definition, nil
+		}
+	}
+	return nil, &InvalidEventError{Type: eventType, Reason: "unsupported_schema", Violations: []string{fmt.Sprintf("unsupported dataschema %s", dataSchema)}}
+}
+
+// Decode validates an event received from direction and returns its data, a pointer to the
+// data struct of its definition. Accepted and rejected events are counted in the
+// events.accepted and events.rejected metrics.
+func Decode(event cloudevents.Event, direction Direction) (interface{}, error) {
+	data, err := decode(event, direction)
+
+	labels := []metrics.Label{{Name: "type", Value: event.Type()}, {Name: "direction", Value: string(direction)}}
+	if err != nil {
+		reason := "invalid_data"
+		switch e := err.(type) {
+		case *UnknownEventTypeError:
+			reason = "unknown_type"
+		case *InvalidEventError:
+			reason = e.Reason
+		}
+		metrics.IncrCounterWithLabels([]string{"events", "rejected"}, 1, append(labels, metrics.Label{Name: "reason", Value: reason}))
+		return nil, err
+	}
+
+	metrics.IncrCounterWithLabels([]string{"events", "accepted"}, 1, labels)
+	return data, nil
+}
+
+// Validate checks an event received from direction without decoding its data.
+func Validate(event cloudevents.Event, direction Direction) error {
+	_, err := Decode(event, direction)
+	return err
+}
+
+func decode(event cloudevents.Event, direction Direction) (interface{}, error) {
+	err := event.Validate()
+	if err != nil {
+		return nil, &InvalidEventError{Type: event.Type(), Reason: "invalid_envelope", Violations: []string{err.Error()}}
+	}
+
+	definition, err := Lookup(event.Type(), event.DataSchema())
+	if err != nil {
+		return nil, err
+	}
+	if definition.Direction != direction {
+		return nil, &InvalidEventError{Type: event.Type(), Reason: "wrong_direction", Violations: []string{fmt.Sprintf("%s events are not accepted from %s", definition.Direction, direction)}}
+	}
+
+	violations := []string{}
+	for _, extension := range definition.Extensions {
+		value, err := types.ToString(event.Extensions()[extension])
+		if err != nil || value == "" {
+			violations = append(violations, fmt.Sprintf("the %s extension is required", extension))
+		}
+	}
+
+	var decoded interface{}
+	err = json.Unmarshal(event.Data(), &decoded)
+	if err != nil {
+		violations = append(violations, fmt.Sprintf("data: %s", err))
+	} else {
+		violations = append(violations, definition.compiled.validate(decoded, "data")...)
+	}
+	if len(violations) > 0 {
+		return nil, &InvalidEventError{Type: event.Type(), Reason: "invalid_data", Violations: violations}
+	}
+
+	data := definition.newData()
+	err = json.Unmarshal(event.Data(), data)
+	if err != nil {
+		return nil, &InvalidEventError{Type: event.Type(), Reason: "invalid_data", Violations: []string{fmt.Sprintf("data: %s", err)}}
+	}
+	return data, nil
+}
+
+type UnknownEventTypeError struct {
+	Type string
+}
+
+func (e *UnknownEventTypeError) Error() string {
+	return fmt.Sprintf("unknown event type %q", e.Type)
+}
+
+type InvalidEventError struct {
+	Type string
+	// Reason is a short code of the failed check: invalid_envelope, unsupported_schema,
+	// wrong_direction or invalid_data.
+	Reason     string
+	Violations []string
+}
+
+func (e *InvalidEventError) Error() string {
+	return fmt.Sprintf("invalid %s event: %s", e.Type, strings.Join(e.Violations, "; "))
+}
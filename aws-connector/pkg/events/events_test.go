@@ -0,0 +1,165 @@
+package events
+
+import (
+	"testing"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+)
+
+func newTestEvent(t *testing.T, eventType string, data string) cloudevents.Event {
+	t.Helper()
+
+	event := cloudevents.NewEvent()
+	event.SetID("1")
+	event.SetSource("test")
+	event.SetType(eventType)
+	err := event.SetData(cloudevents.ApplicationJSON, []byte(data))
+	if err != nil {
+		t.Fatalf("could not set the event data: %s", err)
+	}
+	return event
+}
+
+func TestDecode(t *testing.T) {
+	const certificateStatus = `{"ca_name": "ca", "serial_number": "01", "status": "REVOKED"}`
+
+	testCases := []struct {
+		name       string
+		event      func(t *testing.T) cloudevents.Event
+		direction  Direction
+		wantReason string
+	}{
+		{
+			name: "valid",
+			event: func(t *testing.T) cloudevents.Event {
+				return newTestEvent(t, TypeAWSCertificateStatusUpdate, certificateStatus)
+			},
+			direction: DirectionAWSToLamassu,
+		},
+		{
+			name: "valid with dataschema",
+			event: func(t *testing.T) cloudevents.Event {
+				event := newTestEvent(t, TypeAWSCertificateStatusUpdate, certificateStatus)
+				event.SetDataSchema(SchemaURI(TypeAWSCertificateStatusUpdate, 1))
+				return event
+			},
+			direction: DirectionAWSToLamassu,
+		},
+		{
+			name: "invalid envelope",
+			event: func(t *testing.T) cloudevents.Event {
+				event := newTestEvent(t, TypeAWSCertificateStatusUpdate, certificateStatus)
+				event.SetSource("")
+				return event
+			},
+			direction:  DirectionAWSToLamassu,
+			wantReason: "invalid_envelope",
+		},
+		{
+			name: "unknown type",
+			event: func(t *testing.T) cloudevents.Event {
+				return newTestEvent(t, "io.lamassuiot.unknown", `{}`)
+			},
+			direction:  DirectionLamassuToAWS,
+			wantReason: "unknown_type",
+		},
+		{
+			name: "unsupported dataschema",
+			event: func(t *testing.T) cloudevents.Event {
+				event := newTestEvent(t, TypeAWSCertificateStatusUpdate, certificateStatus)
+				event.SetDataSchema(SchemaURI(TypeAWSCertificateStatusUpdate, 99))
+				return event
+			},
+			direction:  DirectionAWSToLamassu,
+			wantReason: "unsupported_schema",
+		},
+		{
+			name: "wrong direction",
+			event: func(t *testing.T) cloudevents.Event {
+				return newTestEvent(t, TypeAWSCertificateStatusUpdate, certificateStatus)
+			},
+			direction:  DirectionLamassuToAWS,
+			wantReason: "wrong_direction",
+		},
+		{
+			name: "data not matching the schema",
+			event: func(t *testing.T) cloudevents.Event {
+				return newTestEvent(t, TypeAWSCertificateStatusUpdate, `{"ca_name": "ca", "status": "DELETED"}`)
+			},
+			direction:  DirectionAWSToLamassu,
+			wantReason: "invalid_data",
+		},
+		{
+			name: "data not JSON",
+			event: func(t *testing.T) cloudevents.Event {
+				event := cloudevents.NewEvent()
+				event.SetID("1")
+				event.SetSource("test")
+				event.SetType(TypeAWSCertificateStatusUpdate)
+				event.DataEncoded = []byte(`{"ca_name":`)
+				return event
+			},
+			direction:  DirectionAWSToLamassu,
+			wantReason: "invalid_data",
+		},
+		{
+			name: "invalid actor",
+			event: func(t *testing.T) cloudevents.Event {
+				return newTestEvent(t, TypeAWSCAStatusUpdate, `{"ca_name": "ca", "status": "INACTIVE", "actor": {"arn": 1}}`)
+			},
+			direction:  DirectionAWSToLamassu,
+			wantReason: "invalid_data",
+		},
+		{
+			name: "missing extension",
+			event: func(t *testing.T) cloudevents.Event {
+				return newTestEvent(t, TypeAWSThingShadowUpdate, `{}`)
+			},
+			direction:  DirectionAWSToLamassu,
+			wantReason: "invalid_data",
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := Decode(tc.event(t), tc.direction)
+
+			if tc.wantReason == "" {
+				if err != nil {
+					t.Fatalf("Decode() error = %s", err)
+				}
+				status, ok := data.(*CertificateStatusUpdateV1)
+				if !ok {
+					t.Fatalf("Decode() = %T, want *CertificateStatusUpdateV1", data)
+				}
+				if status.CAName != "ca" || status.SerialNumber != "01" || status.Status != "REVOKED" {
+					t.Errorf("Decode() = %+v", status)
+				}
+				return
+			}
+
+			reason := ""
+			switch e := err.(type) {
+			case *UnknownEventTypeError:
+				reason = "unknown_type"
+			case *InvalidEventError:
+				reason = e.Reason
+			default:
+				t.Fatalf("Decode() error = %v, want a rejection", err)
+			}
+			if reason != tc.wantReason {
+				t.Errorf("Decode() rejected the event as %s (%s), want %s", reason, err, tc.wantReason)
+			}
+		})
+	}
+}
+
+func TestRegistered(t *testing.T) {
+	if !Registered(TypeCACreate) {
+		t.Errorf("Registered(%q) = false", TypeCACreate)
+	}
+	if Registered("io.lamassuiot.unknown") {
+		t.Errorf("Registered(%q) = true", "io.lamassuiot.unknown")
+	}
+}
@@ -0,0 +1,144 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// schema is the subset of JSON Schema used by the event schemas. Compiling a schema with any
+// other keyword fails, so that no constraint is silently ignored.
+type schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	ID                   string             `json:"$id,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Properties           map[string]*schema `json:"properties,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	Items                *schema            `json:"items,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+}
+
+func compileSchema(document string) (*schema, error) {
+	decoder := json.NewDecoder(strings.NewReader(document))
+	decoder.DisallowUnknownFields()
+
+	compiled := &schema{}
+	err := decoder.Decode(compiled)
+	if err != nil {
+		return nil, err
+	}
+	return compiled, nil
+}
+
+// validate returns the violations of the schema by a decoded JSON value, each prefixed by
+// the path of the offending value.
+func (s *schema) validate(value interface{}, path string) []string {
+	if s.Type != "" && !hasJSONType(value, s.Type) {
+		return []string{fmt.Sprintf("%s: must be of type %s, got %s", path, s.Type, jsonType(value))}
+	}
+
+	violations := []string{}
+	if len(s.Enum) > 0 && !inEnum(value, s.Enum) {
+		violations = append(violations, fmt.Sprintf("%s: must be one of %s", path, formatEnum(s.Enum)))
+	}
+
+	switch v := value.(type) {
+	case string:
+		if s.MinLength != nil && len([]rune(v)) < *s.MinLength {
+			violations = append(violations, fmt.Sprintf("%s: must have at least %d characters", path, *s.MinLength))
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			violations = append(violations, fmt.Sprintf("%s: must be at least %v", path, *s.Minimum))
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				violations = append(violations, s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				violations = append(violations, fmt.Sprintf("%s: %s is required", path, name))
+			}
+		}
+
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			property, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					violations = append(violations, fmt.Sprintf("%s: %s is not allowed", path, name))
+				}
+				continue
+			}
+			violations = append(violations, property.validate(v[name], path+"."+name)...)
+		}
+	}
+
+	return violations
+}
+
+func hasJSONType(value interface{}, expected string) bool {
+	actual := jsonType(value)
+	if expected == "number" {
+		return actual == "number" || actual == "integer"
+	}
+	return actual == expected
+}
+
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+func inEnum(value interface{}, enum []interface{}) bool {
+	encoded, _ := json.Marshal(value)
+	for _, allowed := range enum {
+		encodedAllowed, _ := json.Marshal(allowed)
+		if bytes.Equal(encoded, encodedAllowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatEnum(enum []interface{}) string {
+	values := make([]string, len(enum))
+	for i, allowed := range enum {
+		encoded, _ := json.Marshal(allowed)
+		values[i] = string(encoded)
+	}
+	return strings.Join(values, ", ")
+}
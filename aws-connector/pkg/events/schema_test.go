@@ -0,0 +1,190 @@
+package events
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const testSchema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"$id": "urn:test",
+	"title": "test",
+	"description": "every supported keyword",
+	"type": "object",
+	"required": ["name", "status"],
+	"additionalProperties": false,
+	"properties": {
+		"name": {"type": "string", "minLength": 2},
+		"status": {"type": "string", "enum": ["ACTIVE", "INACTIVE"]},
+		"count": {"type": "integer", "minimum": 1},
+		"ratio": {"type": "number", "minimum": 0.5},
+		"enabled": {"type": "boolean"},
+		"tags": {"type": "array", "items": {"type": "string", "minLength": 1}},
+		"owner": {
+			"type": "object",
+			"required": ["id"],
+			"properties": {
+				"id": {"type": "string"}
+			}
+		}
+	}
+}`
+
+func TestCompileSchema(t *testing.T) {
+	testCases := []struct {
+		name     string
+		document string
+		wantErr  bool
+	}{
+		{name: "supported keywords", document: testSchema},
+		{name: "empty schema", document: `{}`},
+		{name: "unsupported keyword", document: `{"type": "string", "pattern": "^a"}`, wantErr: true},
+		{name: "unsupported nested keyword", document: `{"type": "object", "properties": {"a": {"maxLength": 3}}}`, wantErr: true},
+		{name: "wrong keyword type", document: `{"minLength": "3"}`, wantErr: true},
+		{name: "not JSON", document: `{"type":`, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := compileSchema(tc.document)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("compileSchema() error = %v, want error %t", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	compiled, err := compileSchema(testSchema)
+	if err != nil {
+		t.Fatalf("could not compile the test schema: %s", err)
+	}
+
+	testCases := []struct {
+		name           string
+		value          string
+		wantViolations []string
+	}{
+		{
+			name:  "valid",
+			value: `{"name": "ca", "status": "ACTIVE", "count": 3, "ratio": 0.75, "enabled": true, "tags": ["a", "b"], "owner": {"id": "1"}}`,
+		},
+		{
+			name:  "minimal",
+			value: `{"name": "ca", "status": "INACTIVE"}`,
+		},
+		{
+			name:           "wrong root type",
+			value:          `["ca"]`,
+			wantViolations: []string{"data: must be of type object, got array"},
+		},
+		{
+			name:           "null root",
+			value:          `null`,
+			wantViolations: []string{"data: must be of type object, got null"},
+		},
+		{
+			name:           "missing required properties",
+			value:          `{}`,
+			wantViolations: []string{"data: name is required", "data: status is required"},
+		},
+		{
+			name:           "additional property",
+			value:          `{"name": "ca", "status": "ACTIVE", "extra": 1}`,
+			wantViolations: []string{"data: extra is not allowed"},
+		},
+		{
+			name:           "wrong property type",
+			value:          `{"name": 1, "status": "ACTIVE"}`,
+			wantViolations: []string{"data.name: must be of type string, got integer"},
+		},
+		{
+			name:           "too short string",
+			value:          `{"name": "c", "status": "ACTIVE"}`,
+			wantViolations: []string{"data.name: must have at least 2 characters"},
+		},
+		{
+			name:  "string length in characters",
+			value: `{"name": "ñ€", "status": "ACTIVE"}`,
+		},
+		{
+			name:           "not in enum",
+			value:          `{"name": "ca", "status": "REVOKED"}`,
+			wantViolations: []string{`data.status: must be one of "ACTIVE", "INACTIVE"`},
+		},
+		{
+			name:           "fractional integer",
+			value:          `{"name": "ca", "status": "ACTIVE", "count": 1.5}`,
+			wantViolations: []string{"data.count: must be of type integer, got number"},
+		},
+		{
+			name:  "integral number",
+			value: `{"name": "ca", "status": "ACTIVE", "ratio": 1}`,
+		},
+		{
+			name:           "below minimum",
+			value:          `{"name": "ca", "status": "ACTIVE", "count": 0, "ratio": 0.25}`,
+			wantViolations: []string{"data.count: must be at least 1", "data.ratio: must be at least 0.5"},
+		},
+		{
+			name:           "wrong boolean",
+			value:          `{"name": "ca", "status": "ACTIVE", "enabled": "true"}`,
+			wantViolations: []string{"data.enabled: must be of type boolean, got string"},
+		},
+		{
+			name:           "invalid array items",
+			value:          `{"name": "ca", "status": "ACTIVE", "tags": ["a", "", 3]}`,
+			wantViolations: []string{"data.tags[1]: must have at least 1 characters", "data.tags[2]: must be of type string, got integer"},
+		},
+		{
+			name:           "invalid nested object",
+			value:          `{"name": "ca", "status": "ACTIVE", "owner": {"id": 1, "name": "x"}}`,
+			wantViolations: []string{"data.owner.id: must be of type string, got integer"},
+		},
+		{
+			name:           "missing nested property",
+			value:          `{"name": "ca", "status": "ACTIVE", "owner": {}}`,
+			wantViolations: []string{"data.owner: id is required"},
+		},
+		{
+			name:  "every violation is reported",
+			value: `{"name": "", "status": "UNKNOWN", "count": -1, "extra": true}`,
+			wantViolations: []string{
+				"data.count: must be at least 1",
+				"data: extra is not allowed",
+				"data.name: must have at least 2 characters",
+				`data.status: must be one of "ACTIVE", "INACTIVE"`,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var value interface{}
+			err := json.Unmarshal([]byte(tc.value), &value)
+			if err != nil {
+				t.Fatalf("invalid test value: %s", err)
+			}
+
+			violations := compiled.validate(value, "data")
+			if len(violations) == 0 && len(tc.wantViolations) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(violations, tc.wantViolations) {
+				t.Errorf("validate() = %q, want %q", violations, tc.wantViolations)
+			}
+		})
+	}
+}
+
+func TestRegisteredSchemasCompile(t *testing.T) {
+	for _, definition := range Definitions() {
+		_, err := compileSchema(string(definition.Schema))
+		if err != nil {
+			t.Errorf("schema of %s v%d: %s", definition.Type, definition.Version, err)
+		}
+	}
+}
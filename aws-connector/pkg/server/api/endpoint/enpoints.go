@@ -14,7 +14,27 @@ type Endpoints struct {
 	cProviderEndpoint.Endpoints
 	HandleUpdateCertificateStatusEndpoint endpoint.Endpoint
 	HandleUpdateCAStatusEndpoint          endpoint.Endpoint
+	HandleUpdateThingShadowEndpoint       endpoint.Endpoint
 	HandleCloudEvents                     endpoint.Endpoint
+	GetDMSAWSSettingsEndpoint             endpoint.Endpoint
+	UpdateDMSAWSSettingsEndpoint          endpoint.Endpoint
+	MigrateDMSShadowsEndpoint             endpoint.Endpoint
+	GetDMSShadowMigrationEndpoint         endpoint.Endpoint
+	GetShadowFanOutReportsEndpoint        endpoint.Endpoint
+	DeleteDMSCABundleEndpoint             endpoint.Endpoint
+	ReconcileEndpoint                     endpoint.Endpoint
+	EnforceRevocationsEndpoint            endpoint.Endpoint
+	MonitorExpiryEndpoint                 endpoint.Endpoint
+	SyncDMSThingGroupsEndpoint            endpoint.Endpoint
+	GetReconciliationReportEndpoint       endpoint.Endpoint
+	GetDriftReportEndpoint                endpoint.Endpoint
+	ImportFleetEndpoint                   endpoint.Endpoint
+	GetFleetImportEndpoint                endpoint.Endpoint
+	GetFleetImportsEndpoint               endpoint.Endpoint
+	GetOutboxEntriesEndpoint              endpoint.Endpoint
+	RetryOutboxEntryEndpoint              endpoint.Endpoint
+	DeleteOutboxEntryEndpoint             endpoint.Endpoint
+	TestEventRoutingEndpoint              endpoint.Endpoint
 }
 
 func MakeServerEndpoints(s service.Service) Endpoints {
@@ -22,7 +42,27 @@ func MakeServerEndpoints(s service.Service) Endpoints {
 
 	updateCAtatus := MakeHandleUpdateCAStatusEndpoint(s)
 	updateCertificateStatus := MakeHandleUpdateCertificateStatusEndpoint(s)
+	updateThingShadow := MakeHandleUpdateThingShadowEndpoint(s)
 	cloudEvents := MakeHandleCloudEvents(s)
+	getDMSAWSSettings := MakeGetDMSAWSSettingsEndpoint(s)
+	updateDMSAWSSettings := MakeUpdateDMSAWSSettingsEndpoint(s)
+	migrateDMSShadows := MakeMigrateDMSShadowsEndpoint(s)
+	getDMSShadowMigration := MakeGetDMSShadowMigrationEndpoint(s)
+	getShadowFanOutReports := MakeGetShadowFanOutReportsEndpoint(s)
+	deleteDMSCABundle := MakeDeleteDMSCABundleEndpoint(s)
+	reconcile := MakeReconcileEndpoint(s)
+	enforceRevocations := MakeEnforceRevocationsEndpoint(s)
+	monitorExpiry := MakeMonitorExpiryEndpoint(s)
+	syncDMSThingGroups := MakeSyncDMSThingGroupsEndpoint(s)
+	getReconciliationReport := MakeGetReconciliationReportEndpoint(s)
+	getDriftReport := MakeGetDriftReportEndpoint(s)
+	importFleet := MakeImportFleetEndpoint(s)
+	getFleetImport := MakeGetFleetImportEndpoint(s)
+	getFleetImports := MakeGetFleetImportsEndpoint(s)
+	getOutboxEntries := MakeGetOutboxEntriesEndpoint(s)
+	retryOutboxEntry := MakeRetryOutboxEntryEndpoint(s)
+	deleteOutboxEntry := MakeDeleteOutboxEntryEndpoint(s)
+	testEventRouting := MakeTestEventRoutingEndpoint(s)
 
 	return Endpoints{
 		Endpoints: cProviderEndpoint.Endpoints{
@@ -36,7 +76,27 @@ func MakeServerEndpoints(s service.Service) Endpoints {
 		},
 		HandleUpdateCertificateStatusEndpoint: updateCertificateStatus,
 		HandleUpdateCAStatusEndpoint:          updateCAtatus,
+		HandleUpdateThingShadowEndpoint:       updateThingShadow,
 		HandleCloudEvents:                     cloudEvents,
+		GetDMSAWSSettingsEndpoint:             getDMSAWSSettings,
+		UpdateDMSAWSSettingsEndpoint:          updateDMSAWSSettings,
+		MigrateDMSShadowsEndpoint:             migrateDMSShadows,
+		GetDMSShadowMigrationEndpoint:         getDMSShadowMigration,
+		GetShadowFanOutReportsEndpoint:        getShadowFanOutReports,
+		DeleteDMSCABundleEndpoint:             deleteDMSCABundle,
+		ReconcileEndpoint:                     reconcile,
+		EnforceRevocationsEndpoint:            enforceRevocations,
+		MonitorExpiryEndpoint:                 monitorExpiry,
+		SyncDMSThingGroupsEndpoint:            syncDMSThingGroups,
+		GetReconciliationReportEndpoint:       getReconciliationReport,
+		GetDriftReportEndpoint:                getDriftReport,
+		ImportFleetEndpoint:                   importFleet,
+		GetFleetImportEndpoint:                getFleetImport,
+		GetFleetImportsEndpoint:               getFleetImports,
+		GetOutboxEntriesEndpoint:              getOutboxEntries,
+		RetryOutboxEntryEndpoint:              retryOutboxEntry,
+		DeleteOutboxEntryEndpoint:             deleteOutboxEntry,
+		TestEventRoutingEndpoint:              testEventRouting,
 	}
 }
 
@@ -48,6 +108,10 @@ func MakeHandleUpdateCAStatusEndpoint(s service.Service) endpoint.Endpoint {
 			CaSerialNumber: req.CaSerialNumber,
 			CaID:           req.CaID,
 			Status:         req.Status,
+			EventID:        req.EventID,
+			EventSource:    req.EventSource,
+			CorrelationID:  req.CorrelationID,
+			Actor:          req.Actor,
 		})
 		return nil, err
 	}
@@ -64,10 +128,220 @@ func MakeHandleUpdateCertificateStatusEndpoint(s service.Service) endpoint.Endpo
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(HandleUpdateCertStatusCodeRequest)
 		err := s.HandleUpdateCertificateStatus(ctx, &api.HandleUpdateCertificateStatusInput{
-			CaName:       req.CaName,
-			SerialNumber: req.SerialNumber,
-			Status:       req.Status,
+			CaName:        req.CaName,
+			SerialNumber:  req.SerialNumber,
+			CertificateID: req.CertificateID,
+			Status:        req.Status,
+			CorrelationID: req.CorrelationID,
+			Actor:         req.Actor,
 		})
 		return nil, err
 	}
 }
+
+func MakeHandleUpdateThingShadowEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(HandleUpdateThingShadowRequest)
+		err := s.HandleUpdateThingShadow(ctx, &api.HandleUpdateThingShadowInput{
+			ThingName:  req.ThingName,
+			ShadowName: req.ShadowName,
+			Document:   req.Document,
+		})
+		return nil, err
+	}
+}
+
+func MakeGetDMSAWSSettingsEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(DMSRequest)
+		output, err := s.GetDMSAWSSettings(ctx, &api.GetDMSAWSSettingsInput{
+			DMSName: req.DMSName,
+		})
+		return output, err
+	}
+}
+
+func MakeUpdateDMSAWSSettingsEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(UpdateDMSAWSSettingsRequest)
+		output, err := s.UpdateDMSAWSSettings(ctx, &api.UpdateDMSAWSSettingsInput{
+			DMSName:         req.DMSName,
+			ShadowName:      req.ShadowName,
+			DeliveryChannel: req.DeliveryChannel,
+			ThingGroup:      req.ThingGroup,
+			CABundleFormat:  req.CABundleFormat,
+			Policies:        req.Policies,
+		})
+		return output, err
+	}
+}
+
+func MakeMigrateDMSShadowsEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(DMSRequest)
+		output, err := s.MigrateDMSShadows(ctx, &api.MigrateDMSShadowsInput{
+			DMSName: req.DMSName,
+		})
+		return output, err
+	}
+}
+
+func MakeGetDMSShadowMigrationEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(DMSRequest)
+		output, err := s.GetDMSShadowMigration(ctx, &api.GetDMSShadowMigrationInput{
+			DMSName: req.DMSName,
+		})
+		return output, err
+	}
+}
+
+func MakeGetShadowFanOutReportsEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(DMSRequest)
+		output, err := s.GetShadowFanOutReports(ctx, &api.GetShadowFanOutReportsInput{
+			DMSName: req.DMSName,
+		})
+		return output, err
+	}
+}
+
+func MakeDeleteDMSCABundleEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(DMSRequest)
+		output, err := s.DeleteDMSCABundle(ctx, &api.DeleteDMSCABundleInput{
+			DMSName: req.DMSName,
+		})
+		return output, err
+	}
+}
+
+func MakeReconcileEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(ReconcileRequest)
+		output, err := s.Reconcile(ctx, &api.ReconcileInput{
+			DryRun: req.DryRun,
+		})
+		return output, err
+	}
+}
+
+func MakeEnforceRevocationsEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(EnforceRevocationsRequest)
+		output, err := s.EnforceRevocations(ctx, &api.EnforceRevocationsInput{
+			DryRun: req.DryRun,
+		})
+		return output, err
+	}
+}
+
+func MakeMonitorExpiryEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(MonitorExpiryRequest)
+		output, err := s.MonitorExpiry(ctx, &api.MonitorExpiryInput{
+			DryRun: req.DryRun,
+		})
+		return output, err
+	}
+}
+
+func MakeSyncDMSThingGroupsEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(SyncDMSThingGroupsRequest)
+		output, err := s.SyncDMSThingGroups(ctx, &api.SyncDMSThingGroupsInput{
+			DryRun: req.DryRun,
+		})
+		return output, err
+	}
+}
+
+func MakeGetReconciliationReportEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		output, err := s.GetReconciliationReport(ctx, &api.GetReconciliationReportInput{})
+		return output, err
+	}
+}
+
+func MakeGetDriftReportEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetDriftReportRequest)
+		output, err := s.GetDriftReport(ctx, &api.GetDriftReportInput{})
+		if err != nil {
+			return output, err
+		}
+		return GetDriftReportResponse{
+			Format: req.Format,
+			Report: output.DriftReport,
+		}, nil
+	}
+}
+
+func MakeImportFleetEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(ImportFleetRequest)
+		output, err := s.ImportFleet(ctx, &api.ImportFleetInput{
+			DMSName: req.DMSName,
+		})
+		return output, err
+	}
+}
+
+func MakeGetFleetImportEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetFleetImportRequest)
+		output, err := s.GetFleetImport(ctx, &api.GetFleetImportInput{
+			ImportID: req.ImportID,
+		})
+		return output, err
+	}
+}
+
+func MakeGetFleetImportsEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		output, err := s.GetFleetImports(ctx, &api.GetFleetImportsInput{})
+		return output, err
+	}
+}
+
+func MakeGetOutboxEntriesEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetOutboxEntriesRequest)
+		output, err := s.GetOutboxEntries(ctx, &api.GetOutboxEntriesInput{
+			Status: req.Status,
+		})
+		return output, err
+	}
+}
+
+func MakeRetryOutboxEntryEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(RetryOutboxEntryRequest)
+		output, err := s.RetryOutboxEntry(ctx, &api.RetryOutboxEntryInput{
+			ID: req.ID,
+		})
+		return output, err
+	}
+}
+
+func MakeDeleteOutboxEntryEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(DeleteOutboxEntryRequest)
+		output, err := s.DeleteOutboxEntry(ctx, &api.DeleteOutboxEntryInput{
+			ID: req.ID,
+		})
+		return output, err
+	}
+}
+
+func MakeTestEventRoutingEndpoint(s service.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		event := request.(cloudevents.Event)
+		output, err := s.TestEventRouting(ctx, &api.TestEventRoutingInput{
+			Type:   event.Type(),
+			Source: event.Source(),
+			Data:   event.Data(),
+		})
+		return output, err
+	}
+}
@@ -1,5 +1,7 @@
 package endpoint
 
+import api "github.com/lamassuiot/aws-connector/pkg/common"
+
 type AttachIoTCorePolicyRequest struct {
 	Policy       string `json:"policy"`
 	CaName       string `json:"ca_name"`
@@ -56,14 +58,92 @@ type UpdateThingConfigurationRequest struct {
 }
 
 type HandleUpdateCertStatusCodeRequest struct {
-	CaName       string `json:"ca_name"`
-	Status       string `json:"status"`
-	SerialNumber string `json:"serial_number"`
+	CaName        string        `json:"ca_name"`
+	Status        string        `json:"status"`
+	SerialNumber  string        `json:"serial_number"`
+	CertificateID string        `json:"certificate_id"`
+	Actor         *api.AWSActor `json:"actor,omitempty"`
+	CorrelationID string        `json:"-"`
 }
 
 type HandleUpdateCAStatusCodeRequest struct {
-	CaID           string `json:"ca_id"`
-	CaName         string `json:"ca_name"`
-	CaSerialNumber string `json:"ca_serial_number"`
-	Status         string `json:"status"`
+	CaID           string        `json:"ca_id"`
+	CaName         string        `json:"ca_name"`
+	CaSerialNumber string        `json:"ca_serial_number"`
+	Status         string        `json:"status"`
+	EventID        string        `json:"-"`
+	Actor          *api.AWSActor `json:"actor,omitempty"`
+	EventSource    string        `json:"-"`
+	CorrelationID  string        `json:"-"`
+}
+
+type HandleUpdateThingShadowRequest struct {
+	ThingName  string
+	ShadowName string
+	Document   api.DeviceShadowDocument
+}
+
+type DMSRequest struct {
+	DMSName string
+}
+
+// UpdateDMSAWSSettingsRequest is a partial update, the settings missing from the body are kept.
+type UpdateDMSAWSSettingsRequest struct {
+	DMSName         string
+	ShadowName      *string              `json:"shadow_name"`
+	DeliveryChannel *api.DeliveryChannel `json:"delivery_channel"`
+	ThingGroup      *string              `json:"thing_group"`
+	CABundleFormat  *api.CABundleFormat  `json:"ca_bundle_format"`
+	Policies        *[]string            `json:"policies"`
+}
+
+type ReconcileRequest struct {
+	DryRun bool
+}
+
+type EnforceRevocationsRequest struct {
+	DryRun bool
+}
+
+type MonitorExpiryRequest struct {
+	DryRun bool
+}
+
+type SyncDMSThingGroupsRequest struct {
+	DryRun bool
+}
+
+const (
+	DriftReportFormatJSON = "json"
+	DriftReportFormatCSV  = "csv"
+)
+
+type GetDriftReportRequest struct {
+	Format string
+}
+
+// GetDriftReportResponse keeps the requested format so the transport can encode the report.
+type GetDriftReportResponse struct {
+	Format string
+	Report api.DriftReport
+}
+
+type ImportFleetRequest struct {
+	DMSName string `json:"dms_name"`
+}
+
+type GetFleetImportRequest struct {
+	ImportID string
+}
+
+type GetOutboxEntriesRequest struct {
+	Status api.OutboxEntryStatus
+}
+
+type RetryOutboxEntryRequest struct {
+	ID uint64
+}
+
+type DeleteOutboxEntryRequest struct {
+	ID uint64
 }
@@ -0,0 +1,180 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awsIotData "github.com/aws/aws-sdk-go/service/iotdataplane"
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	"github.com/lamassuiot/aws-connector/pkg/server/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+func (s *awsService) DeleteDMSCABundle(ctx context.Context, input *api.DeleteDMSCABundleInput) (*api.DeleteDMSCABundleOutput, error) {
+	err := s.clearDMSCABundle(ctx, input.DMSName)
+	if err != nil {
+		return &api.DeleteDMSCABundleOutput{}, err
+	}
+
+	return &api.DeleteDMSCABundleOutput{}, nil
+}
+
+func caBundleTopic(dmsName string) string {
+	return "dt/lms/well-known/" + dmsName + "/cacerts"
+}
+
+// publishDMSCABundle publishes the CA certificates of a DMS as a retained message, unless the
+// same certificates were already published in the same format. It returns the state of the
+// published bundle, nil when it was skipped, and whether the set of certificates changed since
+// the last publication. The state is only stored by recordDMSCABundle, once the devices have
+// been told about a change, so that a failed fan-out is retried by the next update.
+func (s *awsService) publishDMSCABundle(ctx context.Context, dmsName string, format api.CABundleFormat) (*api.CABundleState, bool, error) {
+	cas, err := s.dmsClient.CACerts(ctx, dmsName)
+	if err != nil {
+		return nil, false, err
+	}
+
+	bundle := buildCABundle(dmsName, cas)
+
+	state, err := s.db.GetDMSCABundleState(ctx, dmsName)
+	if err != nil {
+		return nil, false, err
+	}
+
+	changed := state == nil || state.Hash != bundle.Hash
+	if !changed && state.Format == format {
+		log.Info(fmt.Sprintf("CA bundle of DMS %s has not changed (version %d). Skipping publication", dmsName, state.Version))
+		return nil, false, nil
+	}
+
+	bundle.Version = 1
+	if state != nil {
+		bundle.Version = state.Version
+		if changed {
+			bundle.Version++
+		}
+	}
+
+	var payload []byte
+	if format == api.CABundleFormatJSON {
+		payload, err = json.Marshal(bundle)
+		if err != nil {
+			return nil, false, err
+		}
+	} else {
+		for _, ca := range cas {
+			payload = append(payload, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})...)
+		}
+	}
+
+	_, err = s.awsIotData.PublishWithContext(ctx, &awsIotData.PublishInput{
+		Topic:   aws.String(caBundleTopic(dmsName)),
+		Payload: payload,
+		Retain:  aws.Bool(true),
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	log.Info(fmt.Sprintf("published version %d of the CA bundle of DMS %s in %s format", bundle.Version, dmsName, format))
+	return &api.CABundleState{
+		DMSName:     dmsName,
+		Hash:        bundle.Hash,
+		Version:     bundle.Version,
+		Format:      format,
+		PublishedAt: bundle.GeneratedAt,
+	}, changed, nil
+}
+
+// recordDMSCABundle stores the state of a published bundle, so that it is not published again.
+func (s *awsService) recordDMSCABundle(ctx context.Context, state api.CABundleState) error {
+	if s.isDryRun(ctx) {
+		return nil
+	}
+	return s.db.UpdateDMSCABundleState(ctx, state)
+}
+
+// clearDMSCABundle removes the retained CA bundle of a DMS. AWS IoT deletes a retained
+// message when an empty retained message is published on its topic.
+func (s *awsService) clearDMSCABundle(ctx context.Context, dmsName string) error {
+	_, err := s.awsIotData.PublishWithContext(ctx, &awsIotData.PublishInput{
+		Topic:   aws.String(caBundleTopic(dmsName)),
+		Payload: []byte{},
+		Retain:  aws.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	if s.isDryRun(ctx) {
+		return nil
+	}
+
+	log.Info(fmt.Sprintf("cleared the retained CA bundle of DMS %s", dmsName))
+	return s.db.DeleteDMSCABundleState(ctx, dmsName)
+}
+
+// buildCABundle describes the certificates of a DMS. The hash only depends on the set of
+// certificates, not on the order in which Lamassu returns them.
+func buildCABundle(dmsName string, cas []*x509.Certificate) api.CABundle {
+	certificates := []api.CABundleCertificate{}
+	for _, ca := range cas {
+		fingerprint := sha256.Sum256(ca.Raw)
+		certificates = append(certificates, api.CABundleCertificate{
+			Subject:           ca.Subject.String(),
+			SerialNumber:      utils.InsertNth(utils.ToHexInt(ca.SerialNumber), 2),
+			FingerprintSHA256: hex.EncodeToString(fingerprint[:]),
+			NotBefore:         ca.NotBefore,
+			NotAfter:          ca.NotAfter,
+			Certificate:       string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})),
+		})
+	}
+
+	sort.Slice(certificates, func(i, j int) bool {
+		return certificates[i].FingerprintSHA256 < certificates[j].FingerprintSHA256
+	})
+
+	hash := sha256.New()
+	for _, certificate := range certificates {
+		hash.Write([]byte(certificate.FingerprintSHA256))
+	}
+
+	return api.CABundle{
+		SchemaVersion: api.CABundleSchemaVersion,
+		DMSName:       dmsName,
+		Hash:          hex.EncodeToString(hash.Sum(nil)),
+		GeneratedAt:   time.Now(),
+		Certificates:  certificates,
+	}
+}
+
+// parseCABundle returns the hash and the format of a published CA bundle. An empty hash is
+// returned if the payload cannot be parsed.
+func parseCABundle(dmsName string, payload []byte) (string, api.CABundleFormat) {
+	var bundle api.CABundle
+	if json.Unmarshal(payload, &bundle) == nil {
+		return bundle.Hash, api.CABundleFormatJSON
+	}
+
+	cas := []*x509.Certificate{}
+	for block, rest := pem.Decode(payload); block != nil; block, rest = pem.Decode(rest) {
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return "", api.CABundleFormatPEM
+		}
+		cas = append(cas, ca)
+	}
+	if len(cas) == 0 {
+		return "", api.CABundleFormatPEM
+	}
+
+	return buildCABundle(dmsName, cas).Hash, api.CABundleFormatPEM
+}
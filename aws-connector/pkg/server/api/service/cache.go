@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	cProvderApi "github.com/lamassuiot/lamassuiot/pkg/cloud-provider/common/api"
+	log "github.com/sirupsen/logrus"
+)
+
+type cacheRefreshContextKey struct{}
+
+// WithCacheRefresh makes the configuration getters run with the returned context read AWS
+// instead of the cache. The fresh configuration is cached for the next requests.
+func WithCacheRefresh(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cacheRefreshContextKey{}, true)
+}
+
+func isCacheRefresh(ctx context.Context) bool {
+	refresh, _ := ctx.Value(cacheRefreshContextKey{}).(bool)
+	return refresh
+}
+
+func (s *awsService) GetConfiguration(ctx context.Context, input *cProvderApi.GetConfigurationInput) (*cProvderApi.GetConfigurationOutput, error) {
+	if s.configurationCacheTTL > 0 && !isCacheRefresh(ctx) {
+		cached := cProvderApi.GetConfigurationOutput{}
+		found, err := s.db.GetAWSIoTCoreConfig(ctx, &cached)
+		if err != nil {
+			log.Warn("could not read the cached configuration: ", err)
+		} else if found {
+			return &cached, nil
+		}
+	}
+
+	generation, cacheable := s.cacheGeneration(ctx, s.configurationCacheTTL)
+	output, err := s.describeConfiguration(ctx)
+	if err != nil {
+		return output, err
+	}
+
+	if cacheable && s.cacheUnchanged(ctx, generation) {
+		err = s.db.UpdateAWSIoTCoreConfig(ctx, output, s.configurationCacheTTL)
+		if err != nil {
+			log.Warn("could not cache the configuration: ", err)
+		}
+	}
+
+	return output, nil
+}
+
+func (s *awsService) GetDeviceConfiguration(ctx context.Context, input *cProvderApi.GetDeviceConfigurationInput) (*cProvderApi.GetDeviceConfigurationOutput, error) {
+	if s.deviceConfigurationCacheTTL > 0 && !isCacheRefresh(ctx) {
+		cached := cProvderApi.GetDeviceConfigurationOutput{}
+		found, err := s.db.GetAWSIoTCoreThingConfig(ctx, input.DeviceID, &cached.Configuration)
+		if err != nil {
+			log.Warn("could not read the cached device configuration: ", err)
+		} else if found {
+			return &cached, nil
+		}
+	}
+
+	generation, cacheable := s.cacheGeneration(ctx, s.deviceConfigurationCacheTTL)
+	output, err := s.describeDeviceConfiguration(ctx, input)
+	if err != nil {
+		return output, err
+	}
+
+	if cacheable && s.cacheUnchanged(ctx, generation) {
+		err = s.db.UpdateAWSIoTCoreThingConfig(ctx, input.DeviceID, output.Configuration, s.deviceConfigurationCacheTTL)
+		if err != nil {
+			log.Warn("could not cache the device configuration: ", err)
+		}
+	}
+
+	return output, nil
+}
+
+// cacheGeneration returns the generation of the cache before a configuration is read from
+// AWS. The generation is kept in the store, so that the invalidations made by any replica
+// count. It reports false when the configuration must not be cached.
+func (s *awsService) cacheGeneration(ctx context.Context, ttl time.Duration) (uint64, bool) {
+	if ttl <= 0 {
+		return 0, false
+	}
+
+	generation, err := s.db.GetCacheGeneration(ctx)
+	if err != nil {
+		log.Warn("could not read the cache generation: ", err)
+		return 0, false
+	}
+	return generation, true
+}
+
+// cacheUnchanged tells whether the cache was not invalidated since generation was read, so
+// that the configuration read in between can be cached.
+func (s *awsService) cacheUnchanged(ctx context.Context, generation uint64) bool {
+	current, err := s.db.GetCacheGeneration(ctx)
+	if err != nil {
+		log.Warn("could not read the cache generation: ", err)
+		return false
+	}
+	return current == generation
+}
+
+// bumpCacheGeneration keeps the configurations being read from AWS by any replica from being
+// cached after an invalidation.
+func (s *awsService) bumpCacheGeneration(ctx context.Context) error {
+	err := s.db.BumpCacheGeneration(ctx)
+	if err != nil {
+		return fmt.Errorf("could not bump the cache generation: %w", err)
+	}
+	return nil
+}
+
+// invalidateConfigurationCache drops the cached configuration after a CA or DMS change.
+func (s *awsService) invalidateConfigurationCache(ctx context.Context) error {
+	err := s.bumpCacheGeneration(ctx)
+	if err != nil {
+		return err
+	}
+	return s.db.DeleteAWSIoTCoreConfig(ctx)
+}
+
+// invalidateDeviceConfigurationCache drops the cached configuration of a device after a
+// change of its certificates or shadow.
+func (s *awsService) invalidateDeviceConfigurationCache(ctx context.Context, deviceID string) {
+	err := s.bumpCacheGeneration(ctx)
+	if err != nil {
+		log.Warn(err)
+	}
+	err = s.db.DeleteAWSIoTCoreThingConfig(ctx, deviceID)
+	if err != nil {
+		log.Warn("could not invalidate the cached configuration of device "+deviceID+": ", err)
+	}
+}
+
+// invalidateDeviceConfigurationCaches drops the cached configuration of every device, for
+// the changes that cannot be narrowed down to a device.
+func (s *awsService) invalidateDeviceConfigurationCaches(ctx context.Context) {
+	err := s.bumpCacheGeneration(ctx)
+	if err != nil {
+		log.Warn(err)
+	}
+	err = s.db.DeleteAWSIoTCoreThingConfigs(ctx)
+	if err != nil {
+		log.Warn("could not invalidate the cached device configurations: ", err)
+	}
+}
+
+// invalidateCachesForEvent drops the cached configurations a Lamassu event may have made stale.
+func (s *awsService) invalidateCachesForEvent(ctx context.Context, eventType string) {
+	switch {
+	case strings.HasPrefix(eventType, "io.lamassuiot.ca."):
+		err := s.invalidateConfigurationCache(ctx)
+		if err != nil {
+			log.Warn("could not invalidate the cached configuration: ", err)
+		}
+	case strings.HasPrefix(eventType, "io.lamassuiot.certificate."):
+		s.invalidateDeviceConfigurationCaches(ctx)
+	case strings.HasPrefix(eventType, "io.lamassuiot.dms."):
+		err := s.invalidateConfigurationCache(ctx)
+		if err != nil {
+			log.Warn("could not invalidate the cached configuration: ", err)
+		}
+		s.invalidateDeviceConfigurationCaches(ctx)
+	}
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	awsIot "github.com/aws/aws-sdk-go/service/iot"
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	caApi "github.com/lamassuiot/lamassuiot/pkg/ca/common/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// HandleUpdateCAStatus applies the CA status sync action to a CA status changed in AWS. The
+// decision is logged along with the event that reported the change.
+func (s *awsService) HandleUpdateCAStatus(ctx context.Context, input *api.HandleUpdateCAStatusInput) error {
+	s.invalidateConfigurationCache(ctx)
+
+	if s.isStatusChangeEcho(ctx, api.StatusChangeResourceCA, input.CaID, input.Status, input.CorrelationID) {
+		return nil
+	}
+
+	logEntry := log.WithFields(log.Fields{
+		"event_id":     input.EventID,
+		"event_source": input.EventSource,
+		"ca_name":      input.CaName,
+		"aws_ca_id":    input.CaID,
+		"aws_status":   input.Status,
+		"action":       s.caStatusSyncAction,
+	}).WithFields(actorLogFields(input.Actor))
+
+	lamassuCA, err := s.lamassuCAClient.GetCAByName(ctx, &caApi.GetCAByNameInput{
+		CAType: caApi.CATypePKI,
+		CAName: input.CaName,
+	})
+	if err != nil {
+		logEntry.Error("CA status changed in AWS, could not read the Lamassu CA: ", err)
+		return err
+	}
+	logEntry = logEntry.WithField("lamassu_status", lamassuCA.Status)
+
+	lamassuActive := lamassuCA.Status == caApi.StatusActive || lamassuCA.Status == caApi.StatusAboutToExpire
+	awsActive := input.Status == awsIot.CACertificateStatusActive
+	drift := caStatusDrift(input.CaName, lamassuCA.Status, input.Status)
+	if drift == nil {
+		logEntry.Info("CA status changed in AWS, it matches Lamassu")
+		s.clearFlaggedCADrifts(ctx, input.CaName, nil)
+		return nil
+	}
+	logEntry = logEntry.WithField("drift_kind", drift.Kind)
+
+	switch s.caStatusSyncAction {
+	case api.CAStatusSyncActionReport:
+		drift.Action = api.ReconcileActionReport
+		err = s.db.UpdateFlaggedDrift(ctx, api.FlaggedDrift{
+			Drift:       *drift,
+			FlaggedAt:   time.Now(),
+			EventID:     input.EventID,
+			EventSource: input.EventSource,
+			Actor:       input.Actor,
+		})
+		if err != nil {
+			logEntry.Error("CA status changed in AWS, could not flag the drift: ", err)
+			return err
+		}
+		s.clearFlaggedCADrifts(ctx, input.CaName, drift)
+		metrics.IncrCounterWithLabels([]string{"ca_status_sync", "flagged"}, 1, []metrics.Label{{Name: "kind", Value: string(drift.Kind)}})
+		logEntry.Warn("CA status changed in AWS, it no longer matches Lamassu and was flagged")
+
+	case api.CAStatusSyncActionRevoke:
+		if awsActive {
+			// Revoked and expired CAs cannot be activated again in Lamassu.
+			logEntry.Warn(fmt.Sprintf("CA status changed in AWS, the %s Lamassu CA cannot be activated again", lamassuCA.Status))
+			return nil
+		}
+
+		_, err = s.lamassuCAClient.RevokeCA(ctx, &caApi.RevokeCAInput{
+			CAType:           caApi.CATypePKI,
+			CAName:           input.CaName,
+			RevocationReason: s.awsRevocationReason("Deactivated in AWS IoT", input.Actor),
+		})
+		if err != nil {
+			logEntry.Error("CA status changed in AWS, could not revoke the Lamassu CA: ", err)
+			return err
+		}
+		logEntry.Warn("CA status changed in AWS, the Lamassu CA was revoked")
+
+	case api.CAStatusSyncActionRevert:
+		status := awsIot.CACertificateStatusInactive
+		if lamassuActive {
+			status = awsIot.CACertificateStatusActive
+		}
+
+		certificateID := input.CaID
+		if certificateID == "" {
+			awsCA := s.getAWSCAByName(ctx, input.CaName)
+			if awsCA == nil {
+				err = fmt.Errorf("CA %s not found in AWS IoT", input.CaName)
+				logEntry.Error("CA status changed in AWS, could not revert it: ", err)
+				return err
+			}
+			certificateID = *awsCA.CertificateId
+		}
+
+		err = s.setAWSCAStatus(ctx, certificateID, status)
+		if err != nil {
+			logEntry.Error("CA status changed in AWS, could not revert it: ", err)
+			return err
+		}
+		logEntry.Warn(fmt.Sprintf("CA status changed in AWS, it was reverted to %s", status))
+
+	default:
+		logEntry.Warn("CA status changed in AWS, it no longer matches Lamassu and was left as is")
+	}
+
+	return nil
+}
+
+// clearFlaggedCADrifts removes the flagged status drifts of a CA but the one still detected,
+// if any.
+func (s *awsService) clearFlaggedCADrifts(ctx context.Context, caName string, detected *api.Drift) {
+	for _, kind := range []api.DriftKind{api.DriftCAStatus, api.DriftCAInactiveInAWS} {
+		if detected != nil && detected.Kind == kind {
+			continue
+		}
+		err := s.db.DeleteFlaggedDrift(ctx, kind, caName)
+		if err != nil {
+			log.Warn(fmt.Sprintf("could not clear the flagged %s drift of CA %s: ", kind, caName), err)
+		}
+	}
+}
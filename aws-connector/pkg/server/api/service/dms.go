@@ -0,0 +1,616 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsIotData "github.com/aws/aws-sdk-go/service/iotdataplane"
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	"github.com/lamassuiot/aws-connector/pkg/server/api/errors"
+	devApi "github.com/lamassuiot/lamassuiot/pkg/device-manager/common/api"
+	dmsApi "github.com/lamassuiot/lamassuiot/pkg/dms-manager/common/api"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+)
+
+// lamassuShadowKeys are the top level shadow keys owned by Lamassu. Anything else found in
+// a classic shadow belongs to the device and is never copied nor removed.
+var lamassuShadowKeys = []string{"ca_certs", "issuer", "identity_cert", "slots"}
+
+func (s *awsService) GetDMSAWSSettings(ctx context.Context, input *api.GetDMSAWSSettingsInput) (*api.GetDMSAWSSettingsOutput, error) {
+	settings, err := s.getDMSAWSSettings(ctx, input.DMSName)
+	if err != nil {
+		return &api.GetDMSAWSSettingsOutput{}, err
+	}
+
+	return &api.GetDMSAWSSettingsOutput{
+		DMSAWSSettings: settings,
+	}, nil
+}
+
+func (s *awsService) UpdateDMSAWSSettings(ctx context.Context, input *api.UpdateDMSAWSSettingsInput) (*api.UpdateDMSAWSSettingsOutput, error) {
+	dms, err := s.dmsClient.GetDMSByName(ctx, &dmsApi.GetDMSByNameInput{
+		Name: input.DMSName,
+	})
+	if err != nil {
+		return &api.UpdateDMSAWSSettingsOutput{}, &errors.ResourceNotFoundError{
+			ResourceType: "DMS",
+			ResourceId:   input.DMSName,
+		}
+	}
+
+	settings, err := s.getDMSAWSSettings(ctx, input.DMSName)
+	if err != nil {
+		return &api.UpdateDMSAWSSettingsOutput{}, err
+	}
+	// The shadows are migrated from the location in effect before the change, even when the
+	// DMS had none recorded yet.
+	previousLocation := dmsShadowLocation(&dms.DeviceManufacturingService, settings)
+
+	if input.ShadowName != nil {
+		settings.ShadowName = *input.ShadowName
+	}
+	if input.DeliveryChannel != nil {
+		settings.DeliveryChannel = *input.DeliveryChannel
+	}
+	if input.ThingGroup != nil {
+		settings.ThingGroup = *input.ThingGroup
+	}
+	if input.CABundleFormat != nil {
+		settings.CABundleFormat = *input.CABundleFormat
+	}
+	if input.Policies != nil {
+		settings.Policies = *input.Policies
+	}
+
+	if settings.ShadowName == "" {
+		settings.ShadowName = lamassuIdentityShadowName
+	}
+
+	switch settings.CABundleFormat {
+	case "":
+		settings.CABundleFormat = api.CABundleFormatPEM
+	case api.CABundleFormatPEM, api.CABundleFormatJSON:
+	default:
+		return &api.UpdateDMSAWSSettingsOutput{}, &errors.ValidationError{
+			Msg: fmt.Sprintf("ca_bundle_format must be %s or %s", api.CABundleFormatPEM, api.CABundleFormatJSON),
+		}
+	}
+
+	switch settings.DeliveryChannel {
+	case "":
+		settings.DeliveryChannel = api.DeliveryChannelShadow
+	case api.DeliveryChannelShadow, api.DeliveryChannelJobs:
+	default:
+		return &api.UpdateDMSAWSSettingsOutput{}, &errors.ValidationError{
+			Msg: fmt.Sprintf("delivery_channel must be %s or %s", api.DeliveryChannelShadow, api.DeliveryChannelJobs),
+		}
+	}
+
+	if settings.ThingGroup == lamassuThingGroup {
+		return &api.UpdateDMSAWSSettingsOutput{}, &errors.ValidationError{
+			Msg: fmt.Sprintf("thing_group cannot be %s, the group of the devices of every DMS", lamassuThingGroup),
+		}
+	}
+
+	err = s.db.UpdateDMSAWSSettings(ctx, settings)
+	if err != nil {
+		return &api.UpdateDMSAWSSettingsOutput{}, err
+	}
+
+	err = s.updateThingIndexingConfiguration(ctx)
+	if err != nil {
+		log.Warn("Error updating the fleet indexing configuration: ", err)
+	}
+
+	_, err = s.syncDMSShadowLocation(ctx, &dms.DeviceManufacturingService, &previousLocation)
+	if err != nil {
+		return &api.UpdateDMSAWSSettingsOutput{}, err
+	}
+
+	if s.dmsThingGroups {
+		err = s.ensureDMSThingGroup(ctx, settings)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error updating the thing group of DMS %s: ", input.DMSName), err)
+		}
+	}
+
+	// The retained bundle is republished right away so it matches the selected format.
+	bundleState, err := s.db.GetDMSCABundleState(ctx, input.DMSName)
+	if err == nil && bundleState != nil && bundleState.Format != settings.CABundleFormat {
+		var published *api.CABundleState
+		var changed bool
+		published, changed, err = s.publishDMSCABundle(ctx, input.DMSName, settings.CABundleFormat)
+		if err != nil {
+			log.Warn("Error republishing the CA bundle: ", err)
+		} else if published != nil && !changed {
+			// A changed bundle is recorded by the next CA update, once the devices are told.
+			err = s.recordDMSCABundle(ctx, *published)
+			if err != nil {
+				log.Warn("Error storing the CA bundle state: ", err)
+			}
+		}
+	}
+
+	return &api.UpdateDMSAWSSettingsOutput{
+		DMSAWSSettings: settings,
+	}, nil
+}
+
+func (s *awsService) MigrateDMSShadows(ctx context.Context, input *api.MigrateDMSShadowsInput) (*api.MigrateDMSShadowsOutput, error) {
+	dms, err := s.dmsClient.GetDMSByName(ctx, &dmsApi.GetDMSByNameInput{
+		Name: input.DMSName,
+	})
+	if err != nil {
+		return &api.MigrateDMSShadowsOutput{}, &errors.ResourceNotFoundError{
+			ResourceType: "DMS",
+			ResourceId:   input.DMSName,
+		}
+	}
+
+	_, err = s.syncDMSShadowLocation(ctx, &dms.DeviceManufacturingService, nil)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error migrating the shadows of DMS %s: ", input.DMSName), err)
+	}
+
+	migration, err := s.db.GetDMSShadowMigration(ctx, input.DMSName)
+	if err != nil {
+		return &api.MigrateDMSShadowsOutput{}, err
+	}
+	if migration == nil {
+		return &api.MigrateDMSShadowsOutput{}, &errors.ResourceNotFoundError{
+			ResourceType: "ShadowMigration",
+			ResourceId:   input.DMSName,
+		}
+	}
+
+	// A failed migration is retried only for the devices that could not be migrated.
+	if migration.Status != api.ShadowMigrationStatusFailed || len(migration.FailedDevices) == 0 {
+		return &api.MigrateDMSShadowsOutput{
+			ShadowMigration: *migration,
+		}, nil
+	}
+
+	lease, err := s.acquireLease(detachContext(ctx), shadowMigrationLease(input.DMSName))
+	if err != nil {
+		return &api.MigrateDMSShadowsOutput{}, err
+	}
+	if lease == nil {
+		return &api.MigrateDMSShadowsOutput{}, &errors.GenericError{
+			Message:    fmt.Sprintf("a shadow migration of DMS %s is already running", input.DMSName),
+			StatusCode: 409,
+		}
+	}
+
+	// The migration may have been retried since it was read.
+	migration, err = s.db.GetDMSShadowMigration(lease.ctx, input.DMSName)
+	if err != nil || migration.Status != api.ShadowMigrationStatusFailed || len(migration.FailedDevices) == 0 {
+		s.releaseLease(lease)
+		if err != nil {
+			return &api.MigrateDMSShadowsOutput{}, err
+		}
+		return &api.MigrateDMSShadowsOutput{
+			ShadowMigration: *migration,
+		}, nil
+	}
+
+	if s.isDryRun(ctx) {
+		defer s.releaseLease(lease)
+		// Nothing is stored in dry run: the retry is planned right away for every device.
+		for _, deviceID := range migration.FailedDevices {
+			err = s.migrateThingShadow(lease.ctx, deviceID, migration.From, migration.To)
+			if err != nil {
+				log.Warn(fmt.Sprintf("Error planning the shadow migration of thing %s: ", deviceID), err)
+			}
+		}
+		return &api.MigrateDMSShadowsOutput{
+			ShadowMigration: *migration,
+		}, nil
+	}
+
+	deviceIDs := migration.FailedDevices
+	migration.Status = api.ShadowMigrationStatusRunning
+	migration.StartedAt = time.Now()
+	migration.FinishedAt = nil
+	migration.FailedDevices = []string{}
+	migration.Owner = s.instanceID
+
+	err = s.db.UpdateDMSShadowMigration(lease.ctx, *migration)
+	if err != nil {
+		s.releaseLease(lease)
+		return &api.MigrateDMSShadowsOutput{}, err
+	}
+
+	// The retry runs in the background, its progress is available from GetDMSShadowMigration.
+	go func(migration api.ShadowMigration) {
+		defer s.releaseLease(lease)
+		_, err := s.runShadowMigration(lease.ctx, migration, deviceIDs)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error migrating the shadows of DMS %s: ", migration.DMSName), err)
+		}
+	}(*migration)
+
+	return &api.MigrateDMSShadowsOutput{
+		ShadowMigration: *migration,
+	}, nil
+}
+
+func (s *awsService) GetDMSShadowMigration(ctx context.Context, input *api.GetDMSShadowMigrationInput) (*api.GetDMSShadowMigrationOutput, error) {
+	migration, err := s.db.GetDMSShadowMigration(ctx, input.DMSName)
+	if err != nil {
+		return &api.GetDMSShadowMigrationOutput{}, err
+	}
+	if migration == nil {
+		return &api.GetDMSShadowMigrationOutput{}, &errors.ResourceNotFoundError{
+			ResourceType: "ShadowMigration",
+			ResourceId:   input.DMSName,
+		}
+	}
+
+	return &api.GetDMSShadowMigrationOutput{
+		ShadowMigration: *migration,
+	}, nil
+}
+
+func (s *awsService) getDMSAWSSettings(ctx context.Context, dmsName string) (api.DMSAWSSettings, error) {
+	settings, err := s.db.GetDMSAWSSettings(ctx, dmsName)
+	if err != nil {
+		return api.DMSAWSSettings{}, err
+	}
+	if settings == nil {
+		return api.DMSAWSSettings{
+			DMSName:         dmsName,
+			ShadowName:      lamassuIdentityShadowName,
+			DeliveryChannel: api.DeliveryChannelShadow,
+			CABundleFormat:  api.CABundleFormatPEM,
+		}, nil
+	}
+
+	if settings.DeliveryChannel == "" {
+		settings.DeliveryChannel = api.DeliveryChannelShadow
+	}
+	if settings.CABundleFormat == "" {
+		settings.CABundleFormat = api.CABundleFormatPEM
+	}
+	return *settings, nil
+}
+
+// lamassuShadowNames returns every named shadow the connector may write to.
+func (s *awsService) lamassuShadowNames(ctx context.Context) ([]string, error) {
+	names := []string{lamassuIdentityShadowName}
+
+	settingsList, err := s.db.ListDMSAWSSettings(ctx)
+	if err != nil {
+		return names, err
+	}
+
+	for _, settings := range settingsList {
+		if !slices.Contains(names, settings.ShadowName) {
+			names = append(names, settings.ShadowName)
+		}
+	}
+
+	return names, nil
+}
+
+// dmsShadowLocation returns the shadow the Lamassu state of the DMS devices is written to
+// with the given AWS settings.
+func dmsShadowLocation(dms *dmsApi.DeviceManufacturingService, settings api.DMSAWSSettings) api.ShadowLocation {
+	if dms.Aws.ShadowType == dmsApi.ShadowTypeClassic {
+		return api.ShadowLocation{Type: dmsApi.ShadowTypeClassic}
+	}
+
+	location := api.ShadowLocation{
+		Type: dmsApi.ShadowTypeNamed,
+		Name: settings.ShadowName,
+	}
+	if location.Name == "" {
+		location.Name = lamassuIdentityShadowName
+	}
+	return location
+}
+
+// syncDMSShadowLocation returns the shadow the Lamassu state of the DMS devices must be
+// written to. If it differs from the one used so far, the existing state is migrated in the
+// background under the shadow migration lease of the DMS; callers that write to the shadows
+// wait for it with waitDMSShadowLocation. A failed migration is recorded and retried by
+// MigrateDMSShadows. previous is the location in effect before a settings change, used when
+// none has been recorded for the DMS yet.
+func (s *awsService) syncDMSShadowLocation(ctx context.Context, dms *dmsApi.DeviceManufacturingService, previous *api.ShadowLocation) (api.ShadowLocation, error) {
+	settings, err := s.getDMSAWSSettings(ctx, dms.Name)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error obtaining the AWS settings of DMS %s: ", dms.Name), err)
+	}
+	target := dmsShadowLocation(dms, settings)
+
+	for {
+		applied, err := s.db.GetDMSShadowLocation(ctx, dms.Name)
+		if err != nil {
+			return target, err
+		}
+		// Most calls find the location unchanged.
+		if applied != nil && *applied == target {
+			return target, nil
+		}
+
+		// The migrations of a DMS run one at a time, in whichever replica handles the change.
+		lease, err := s.acquireLease(detachContext(ctx), shadowMigrationLease(dms.Name))
+		if err != nil {
+			return target, err
+		}
+		if lease == nil {
+			// Another request or replica is changing the location: look again once it is done.
+			lease, err = s.waitLease(ctx, shadowMigrationLease(dms.Name))
+			if err != nil {
+				return target, err
+			}
+			s.releaseLease(lease)
+			continue
+		}
+
+		err = s.startShadowMigration(lease, dms.Name, previous, target)
+		if err != nil {
+			s.releaseLease(lease)
+		}
+		return target, err
+	}
+}
+
+// startShadowMigration records the new shadow location of the DMS and, if the devices have
+// state in another one, migrates it in the background. The lease is released once done.
+func (s *awsService) startShadowMigration(lease *heldLease, dmsName string, previous *api.ShadowLocation, target api.ShadowLocation) error {
+	ctx := lease.ctx
+
+	applied, err := s.db.GetDMSShadowLocation(ctx, dmsName)
+	if err != nil {
+		return err
+	}
+	if applied == nil {
+		applied = previous
+	}
+
+	if applied != nil && *applied == target {
+		s.releaseLease(lease)
+		return nil
+	}
+
+	if s.isDryRun(ctx) {
+		if applied != nil {
+			log.Info(fmt.Sprintf("dry run: shadows of DMS %s would be migrated from %s to %s", dmsName, shadowLocationString(*applied), shadowLocationString(target)))
+		}
+		s.releaseLease(lease)
+		return nil
+	}
+
+	if applied == nil {
+		err = s.db.UpdateDMSShadowLocation(ctx, dmsName, target)
+		if err != nil {
+			return err
+		}
+		s.releaseLease(lease)
+		return nil
+	}
+
+	// The migration is recorded before the location, so that a write that finds the new
+	// location also finds the migration to wait for.
+	migration := api.ShadowMigration{
+		DMSName:       dmsName,
+		From:          *applied,
+		To:            target,
+		Status:        api.ShadowMigrationStatusRunning,
+		StartedAt:     time.Now(),
+		FailedDevices: []string{},
+		Owner:         s.instanceID,
+	}
+	err = s.db.UpdateDMSShadowMigration(ctx, migration)
+	if err != nil {
+		return err
+	}
+
+	err = s.db.UpdateDMSShadowLocation(ctx, dmsName, target)
+	if err != nil {
+		s.finishShadowMigration(migration, api.ShadowMigrationStatusFailed)
+		return err
+	}
+
+	log.Info(fmt.Sprintf("migrating shadows of DMS %s from %s to %s", dmsName, shadowLocationString(*applied), shadowLocationString(target)))
+	go func() {
+		defer s.releaseLease(lease)
+		_, err := s.runShadowMigration(lease.ctx, migration, nil)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error migrating the shadows of DMS %s: ", dmsName), err)
+		}
+	}()
+	return nil
+}
+
+// waitDMSShadowLocation is syncDMSShadowLocation for the shadow writes, which wait for the
+// running migration of the DMS so that it does not overwrite them.
+func (s *awsService) waitDMSShadowLocation(ctx context.Context, dms *dmsApi.DeviceManufacturingService) (api.ShadowLocation, error) {
+	target, err := s.syncDMSShadowLocation(ctx, dms, nil)
+	if err != nil {
+		return target, err
+	}
+	return target, s.waitShadowMigration(ctx, dms.Name)
+}
+
+// waitShadowMigration waits for the running shadow migration of the DMS, if any.
+func (s *awsService) waitShadowMigration(ctx context.Context, dmsName string) error {
+	migration, err := s.db.GetDMSShadowMigration(ctx, dmsName)
+	if err != nil {
+		return err
+	}
+	if migration == nil || migration.Status != api.ShadowMigrationStatusRunning {
+		return nil
+	}
+
+	lease, err := s.waitLease(ctx, shadowMigrationLease(dmsName))
+	if err != nil {
+		return err
+	}
+	s.releaseLease(lease)
+	return nil
+}
+
+// runShadowMigration migrates the given devices, or every device of the DMS if deviceIDs is nil.
+// The devices left when ctx is done are recorded as failed, to be retried.
+func (s *awsService) runShadowMigration(ctx context.Context, migration api.ShadowMigration, deviceIDs []string) (api.ShadowMigration, error) {
+	if deviceIDs == nil {
+		_, err := s.devManagerClient.IterateDevicesbyDMSWithPredicate(ctx, &devApi.IterateDevicesByDMSWithPredicateInput{
+			DmsName: migration.DMSName,
+			PredicateFunc: func(d *devApi.Device) {
+				deviceIDs = append(deviceIDs, d.ID)
+			},
+		})
+		if err != nil {
+			migration = s.finishShadowMigration(migration, api.ShadowMigrationStatusFailed)
+			return migration, fmt.Errorf("could not list the devices of DMS %s: %w", migration.DMSName, err)
+		}
+	}
+
+	for i, deviceID := range deviceIDs {
+		if ctx.Err() != nil {
+			migration.FailedDevices = append(migration.FailedDevices, deviceIDs[i:]...)
+			break
+		}
+
+		err := s.migrateThingShadow(ctx, deviceID, migration.From, migration.To)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error migrating the shadow of thing %s: ", deviceID), err)
+			migration.FailedDevices = append(migration.FailedDevices, deviceID)
+		} else {
+			migration.MigratedDevices++
+		}
+
+		err = s.db.UpdateDMSShadowMigration(ctx, migration)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error storing the shadow migration of DMS %s: ", migration.DMSName), err)
+		}
+	}
+
+	if len(migration.FailedDevices) > 0 {
+		migration = s.finishShadowMigration(migration, api.ShadowMigrationStatusFailed)
+		return migration, fmt.Errorf("the shadows of %d devices of DMS %s could not be migrated", len(migration.FailedDevices), migration.DMSName)
+	}
+	return s.finishShadowMigration(migration, api.ShadowMigrationStatusCompleted), nil
+}
+
+func (s *awsService) finishShadowMigration(migration api.ShadowMigration, status api.ShadowMigrationStatus) api.ShadowMigration {
+	now := time.Now()
+	migration.Status = status
+	migration.FinishedAt = &now
+
+	log.Info(fmt.Sprintf("shadow migration of DMS %s finished with status %s (%d migrated, %d failed)", migration.DMSName, status, migration.MigratedDevices, len(migration.FailedDevices)))
+	// The outcome is stored even when the migration was cancelled.
+	err := s.db.UpdateDMSShadowMigration(context.Background(), migration)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error storing the shadow migration of DMS %s: ", migration.DMSName), err)
+	}
+	return migration
+}
+
+// migrateThingShadow copies the Lamassu keys of the desired and reported sections from one
+// shadow to the other and then removes them from the old one. Named shadows are owned by
+// Lamassu, so they are deleted altogether.
+func (s *awsService) migrateThingShadow(ctx context.Context, thingName string, from, to api.ShadowLocation) error {
+	output, err := s.awsIotData.GetThingShadowWithContext(ctx, &awsIotData.GetThingShadowInput{
+		ThingName:  aws.String(thingName),
+		ShadowName: shadowLocationName(from),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == awsIotData.ErrCodeResourceNotFoundException {
+			return nil
+		}
+		return err
+	}
+
+	var document struct {
+		State struct {
+			Desired  map[string]json.RawMessage `json:"desired"`
+			Reported map[string]json.RawMessage `json:"reported"`
+		} `json:"state"`
+	}
+	err = json.Unmarshal(output.Payload, &document)
+	if err != nil {
+		return err
+	}
+
+	copiedDesired := map[string]interface{}{}
+	copiedReported := map[string]interface{}{}
+	clearedDesired := map[string]interface{}{}
+	clearedReported := map[string]interface{}{}
+	for _, key := range lamassuShadowKeys {
+		if value, ok := document.State.Desired[key]; ok {
+			copiedDesired[key] = value
+			clearedDesired[key] = nil
+		}
+		if value, ok := document.State.Reported[key]; ok {
+			copiedReported[key] = value
+			clearedReported[key] = nil
+		}
+	}
+
+	if len(copiedDesired) > 0 || len(copiedReported) > 0 {
+		err = s.writeThingShadow(ctx, thingName, shadowLocationName(to), func(version int64) interface{} {
+			return shadowStatePayload(copiedDesired, copiedReported, version)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if from.Type != dmsApi.ShadowTypeClassic {
+		_, err = s.awsIotData.DeleteThingShadowWithContext(ctx, &awsIotData.DeleteThingShadowInput{
+			ThingName:  aws.String(thingName),
+			ShadowName: shadowLocationName(from),
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == awsIotData.ErrCodeResourceNotFoundException {
+			return nil
+		}
+		return err
+	}
+
+	if len(clearedDesired) == 0 && len(clearedReported) == 0 {
+		return nil
+	}
+
+	return s.writeThingShadow(ctx, thingName, nil, func(version int64) interface{} {
+		return shadowStatePayload(clearedDesired, clearedReported, version)
+	})
+}
+
+func shadowStatePayload(desired, reported map[string]interface{}, version int64) map[string]interface{} {
+	state := map[string]interface{}{}
+	if len(desired) > 0 {
+		state["desired"] = desired
+	}
+	if len(reported) > 0 {
+		state["reported"] = reported
+	}
+
+	payload := map[string]interface{}{
+		"state": state,
+	}
+	if version > 0 {
+		payload["version"] = version
+	}
+	return payload
+}
+
+func shadowLocationName(location api.ShadowLocation) *string {
+	if location.Type == dmsApi.ShadowTypeClassic {
+		return nil
+	}
+	return aws.String(location.Name)
+}
+
+func shadowLocationString(location api.ShadowLocation) string {
+	if location.Type == dmsApi.ShadowTypeClassic {
+		return "the classic shadow"
+	}
+	return fmt.Sprintf("named shadow %s", location.Name)
+}
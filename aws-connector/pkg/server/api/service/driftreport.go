@@ -0,0 +1,52 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// GetDriftReport runs the checks of the reconciler without correcting, logging nor counting
+// any drift, so the report never modifies Lamassu nor AWS and lists the same kinds of drift.
+func (s *awsService) GetDriftReport(ctx context.Context, input *api.GetDriftReportInput) (*api.GetDriftReportOutput, error) {
+	r := &reconciliation{
+		dryRun:     true,
+		reportOnly: true,
+		report: api.ReconciliationReport{
+			Drifts: []api.Drift{},
+			Errors: []string{},
+		},
+	}
+	generatedAt := time.Now()
+	s.detectDrifts(ctx, r)
+
+	report := api.DriftReport{
+		GeneratedAt: generatedAt,
+		Entries:     []api.DriftReportEntry{},
+		Errors:      r.report.Errors,
+	}
+	for _, drift := range r.report.Drifts {
+		report.Entries = append(report.Entries, api.DriftReportEntry{
+			Kind:         drift.Kind,
+			Resource:     drift.Resource,
+			LamassuState: drift.LamassuState,
+			AWSState:     drift.AWSState,
+			Detail:       drift.Detail,
+		})
+	}
+
+	flagged, err := s.db.ListFlaggedDrifts(ctx)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("list flagged drifts: %s", err))
+		flagged = []api.FlaggedDrift{}
+	}
+	report.Flagged = flagged
+
+	log.Info(fmt.Sprintf("drift report generated: %d entries, %d flagged, %d checks failed", len(report.Entries), len(report.Flagged), len(report.Errors)))
+	return &api.GetDriftReportOutput{
+		DriftReport: report,
+	}, nil
+}
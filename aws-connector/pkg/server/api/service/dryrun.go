@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	log "github.com/sirupsen/logrus"
+)
+
+type dryRunPlanContextKey struct{}
+
+// dryRunPlan collects the AWS calls skipped while serving a dry run request.
+type dryRunPlan struct {
+	mutex sync.Mutex
+	calls []api.PlannedAWSCall
+}
+
+// WithDryRun marks every operation run with the returned context as a dry run, even if the
+// connector is not in dry run mode.
+func WithDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunPlanContextKey{}, &dryRunPlan{
+		calls: []api.PlannedAWSCall{},
+	})
+}
+
+// DryRunPlannedCalls returns the AWS calls skipped so far by a context created with WithDryRun.
+func DryRunPlannedCalls(ctx context.Context) []api.PlannedAWSCall {
+	plan, ok := ctx.Value(dryRunPlanContextKey{}).(*dryRunPlan)
+	if !ok {
+		return nil
+	}
+
+	plan.mutex.Lock()
+	defer plan.mutex.Unlock()
+	return append([]api.PlannedAWSCall{}, plan.calls...)
+}
+
+func (s *awsService) isDryRun(ctx context.Context) bool {
+	_, ok := ctx.Value(dryRunPlanContextKey{}).(*dryRunPlan)
+	return s.dryRun || ok
+}
+
+// detachContext returns a context for work that outlives the request, keeping its dry run
+// plan if any.
+func detachContext(ctx context.Context) context.Context {
+	if plan, ok := ctx.Value(dryRunPlanContextKey{}).(*dryRunPlan); ok {
+		return context.WithValue(context.Background(), dryRunPlanContextKey{}, plan)
+	}
+	return context.Background()
+}
+
+// recordPlannedCall adds a call skipped in dry run to the plan of the request, if any, and
+// logs it. The Lamassu calls that would issue certificates are recorded along the AWS ones.
+func recordPlannedCall(ctx context.Context, call api.PlannedAWSCall) {
+	if plan, ok := ctx.Value(dryRunPlanContextKey{}).(*dryRunPlan); ok {
+		plan.mutex.Lock()
+		plan.calls = append(plan.calls, call)
+		plan.mutex.Unlock()
+	}
+
+	input, _ := json.Marshal(call.Input)
+	log.WithFields(log.Fields{
+		"service":   call.Service,
+		"operation": call.Operation,
+		"input":     string(input),
+	}).Info("dry run: skipping call")
+}
+
+// isReadOnlyAWSOperation tells the calls that keep going to AWS in dry run mode apart from
+// the ones that would modify the account.
+func isReadOnlyAWSOperation(operation string) bool {
+	for _, prefix := range []string{"Describe", "Get", "List", "Search"} {
+		if strings.HasPrefix(operation, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// dryRunHandler is installed in front of the validation handlers of the AWS clients. Mutating
+// calls made in dry run are recorded and never signed nor sent: their output stays empty.
+func dryRunHandler(dryRun bool) request.NamedHandler {
+	return request.NamedHandler{
+		Name: "lamassu.DryRunHandler",
+		Fn: func(r *request.Request) {
+			if isReadOnlyAWSOperation(r.Operation.Name) {
+				return
+			}
+
+			_, ok := r.Context().Value(dryRunPlanContextKey{}).(*dryRunPlan)
+			if !dryRun && !ok {
+				return
+			}
+
+			recordPlannedCall(r.Context(), api.PlannedAWSCall{
+				Service:   r.ClientInfo.ServiceName,
+				Operation: r.Operation.Name,
+				Input:     r.Params,
+			})
+
+			r.Handlers.Sign.Clear()
+			r.Handlers.Send.Clear()
+			r.Handlers.UnmarshalMeta.Clear()
+			r.Handlers.ValidateResponse.Clear()
+			r.Handlers.Unmarshal.Clear()
+			r.Handlers.Retry.Clear()
+		},
+	}
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awsIot "github.com/aws/aws-sdk-go/service/iot"
+	"github.com/google/uuid"
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// statusChangeHandler is installed on the IoT client to tag the certificate and CA status
+// changes made by the connector. Each change gets a correlation ID, sent in the user agent
+// and recorded as pending once AWS accepts it, so that the status update event it triggers
+// is recognised as an echo when it comes back.
+func (s *awsService) statusChangeHandler() request.NamedHandler {
+	return request.NamedHandler{
+		Name: "lamassu.StatusChangeHandler",
+		Fn: func(r *request.Request) {
+			var change api.PendingStatusChange
+			switch input := r.Params.(type) {
+			case *awsIot.UpdateCertificateInput:
+				change.Resource = api.StatusChangeResourceCertificate
+				change.AWSCertificateID = aws.StringValue(input.CertificateId)
+				change.Status = aws.StringValue(input.NewStatus)
+			case *awsIot.UpdateCACertificateInput:
+				change.Resource = api.StatusChangeResourceCA
+				change.AWSCertificateID = aws.StringValue(input.CertificateId)
+				change.Status = aws.StringValue(input.NewStatus)
+			default:
+				return
+			}
+			// Updates of the auto registration settings alone do not change the status.
+			if change.Status == "" || s.isDryRun(r.Context()) {
+				return
+			}
+
+			change.CorrelationID = uuid.NewString()
+			request.WithAppendUserAgent(api.StatusChangeUserAgentPrefix + change.CorrelationID)(r)
+
+			r.Handlers.Complete.PushBack(func(r *request.Request) {
+				if r.Error != nil || s.statusChangeEchoTTL == 0 {
+					return
+				}
+
+				change.CreatedAt = time.Now()
+				err := s.db.AddPendingStatusChange(r.Context(), change, s.statusChangeEchoTTL)
+				if err != nil {
+					log.Warn(fmt.Sprintf("Error recording the status change %s of %s: ", change.CorrelationID, change.AWSCertificateID), err)
+					return
+				}
+				log.WithFields(log.Fields{
+					"correlation_id":     change.CorrelationID,
+					"resource":           change.Resource,
+					"aws_certificate_id": change.AWSCertificateID,
+					"status":             change.Status,
+				}).Debug("status change recorded")
+			})
+		},
+	}
+}
+
+// isStatusChangeEcho reports whether a status change reported by AWS was made by the
+// connector itself. Events carrying a correlation ID were, otherwise the change is matched
+// against the pending changes of the resource.
+func (s *awsService) isStatusChangeEcho(ctx context.Context, resource api.StatusChangeResource, awsCertificateID string, status string, correlationID string) bool {
+	var change *api.PendingStatusChange
+	if awsCertificateID != "" {
+		var err error
+		change, err = s.db.TakePendingStatusChange(ctx, resource, awsCertificateID, status)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error reading the pending status changes of %s: ", awsCertificateID), err)
+		}
+	}
+
+	if correlationID == "" && change == nil {
+		return false
+	}
+
+	if correlationID == "" {
+		correlationID = change.CorrelationID
+	}
+	log.WithFields(log.Fields{
+		"correlation_id":     correlationID,
+		"resource":           resource,
+		"aws_certificate_id": awsCertificateID,
+		"status":             status,
+	}).Info("Ignoring the status change made by the connector")
+	metrics.IncrCounterWithLabels([]string{"events", "echo_suppressed"}, 1, []metrics.Label{
+		{Name: "resource", Value: string(resource)},
+	})
+	return true
+}
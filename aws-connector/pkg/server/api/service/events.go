@@ -0,0 +1,178 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	awsIot "github.com/aws/aws-sdk-go/service/iot"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	"github.com/lamassuiot/aws-connector/pkg/events"
+	caApi "github.com/lamassuiot/lamassuiot/pkg/ca/common/api"
+	cProvderApi "github.com/lamassuiot/lamassuiot/pkg/cloud-provider/common/api"
+	dmsApi "github.com/lamassuiot/lamassuiot/pkg/dms-manager/common/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// eventDedupKey identifies an event among its redeliveries. The IDs of the Lamassu events are
+// built from the trace and span of the request that caused them, so they are shared by the
+// events of a request and all zeros without tracing: the type, source, time and data of the
+// event are part of the key as well.
+func eventDedupKey(event cloudevents.Event) string {
+	hash := sha256.New()
+	for _, field := range []string{event.ID(), event.Type(), event.Source(), event.Time().UTC().Format(time.RFC3339Nano)} {
+		hash.Write([]byte(field))
+		hash.Write([]byte{0})
+	}
+	hash.Write(event.Data())
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// eventForwardedKey records that the event of a dedup key was enqueued to the outbox, which
+// is kept apart from its handling.
+func eventForwardedKey(dedupKey string) string {
+	return "forwarded/" + dedupKey
+}
+
+// handleLamassuEvent acts on a Lamassu event. Outside of the event driven mode the cloud
+// provider service calls the connector API for most events, so only the DMS status changes
+// are handled.
+func (s *awsService) handleLamassuEvent(ctx context.Context, event cloudevents.Event) error {
+	switch event.Type() {
+	case events.TypeDMSUpdateStatus:
+		var data events.DMSV1
+		err := json.Unmarshal(event.Data(), &data)
+		if err != nil {
+			return err
+		}
+
+		// Revoked and rejected DMSs cannot enroll devices anymore, so their bundle is removed.
+		if data.Status == dmsApi.DMSStatusRevoked || data.Status == dmsApi.DMSStatusRejected {
+			err = s.clearDMSCABundle(ctx, data.Name)
+			if err != nil {
+				return fmt.Errorf("clearing the CA bundle of DMS %s: %w", data.Name, err)
+			}
+		}
+		return nil
+	}
+
+	if s.operatingMode != api.OperatingModeEventDriven {
+		return nil
+	}
+
+	switch event.Type() {
+	case events.TypeCACreate, events.TypeCAImport:
+		var data events.CAV1
+		err := json.Unmarshal(event.Data(), &data)
+		if err != nil {
+			return err
+		}
+
+		// The event may be redelivered, or the CA registered through the API in the meantime.
+		if s.getAWSCAByName(ctx, data.CAName) != nil {
+			log.Debug(fmt.Sprintf("CA %s is already registered in AWS", data.CAName))
+			return nil
+		}
+
+		_, err = s.RegisterCA(ctx, &cProvderApi.RegisterCAInput{
+			CACertificate: data.Deserialize(),
+		})
+		return err
+
+	case events.TypeCAUpdate, events.TypeCARevoke:
+		var data events.CAV1
+		err := json.Unmarshal(event.Data(), &data)
+		if err != nil {
+			return err
+		}
+
+		status, ok := awsCAStatus(data.Status)
+		if !ok {
+			log.Debug(fmt.Sprintf("CA %s has status %s, which has no AWS equivalent", data.CAName, data.Status))
+			return nil
+		}
+		// Only the CAs registered in AWS are kept in sync, the others are registered when created.
+		if s.getAWSCAByName(ctx, data.CAName) == nil {
+			log.Debug(fmt.Sprintf("CA %s is not registered in AWS", data.CAName))
+			return nil
+		}
+
+		_, err = s.UpdateCAStatus(ctx, &cProvderApi.UpdateCAStatusInput{
+			CAName: data.CAName,
+			Status: status,
+		})
+		return err
+
+	case events.TypeCertificateUpdate, events.TypeCertificateRevoke:
+		var data events.CertificateV1
+		err := json.Unmarshal(event.Data(), &data)
+		if err != nil {
+			return err
+		}
+
+		status, ok := awsCertificateStatus(data.Status)
+		if !ok {
+			log.Debug(fmt.Sprintf("Certificate %s/%s has status %s, which has no AWS equivalent", data.CAName, data.SerialNumber, data.Status))
+			return nil
+		}
+		// The certificates of the CAs that are not registered in AWS cannot be used there, and
+		// looking their device up would leave a thing behind.
+		if s.getAWSCAByName(ctx, data.CAName) == nil {
+			log.Debug(fmt.Sprintf("Certificate %s/%s is issued by a CA not registered in AWS", data.CAName, data.SerialNumber))
+			return nil
+		}
+
+		// Device certificates are issued with the device ID as common name.
+		_, err = s.UpdateDeviceCertificateStatus(ctx, &cProvderApi.UpdateDeviceCertificateStatusInput{
+			DeviceID:     data.Subject.CommonName,
+			CAName:       data.CAName,
+			SerialNumber: data.SerialNumber,
+			Status:       status,
+		})
+		return err
+
+	case events.TypeDMSUpdate, events.TypeDMSUpdateAuthorizedCAs:
+		var data events.DMSV1
+		err := json.Unmarshal(event.Data(), &data)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.UpdateDMSCaCerts(ctx, &cProvderApi.UpdateDMSCaCertsInput{
+			DeviceManufacturingService: data.Deserialize(),
+		})
+		return err
+	}
+
+	return nil
+}
+
+// awsCAStatus maps the status of a Lamassu CA to the status of its AWS CA, false when it has
+// no equivalent. AWS CAs are either active or not.
+func awsCAStatus(status string) (string, bool) {
+	switch caApi.CertificateStatus(status) {
+	case caApi.StatusActive, caApi.StatusAboutToExpire:
+		return awsIot.CACertificateStatusActive, true
+	case caApi.StatusRevoked, caApi.StatusExpired:
+		return awsIot.CACertificateStatusInactive, true
+	}
+	return "", false
+}
+
+// awsCertificateStatus maps the status of a Lamassu certificate to the status of its AWS
+// certificate, false when it has no equivalent.
+func awsCertificateStatus(status string) (string, bool) {
+	switch caApi.CertificateStatus(status) {
+	case caApi.StatusActive, caApi.StatusAboutToExpire:
+		return awsIot.CertificateStatusActive, true
+	case caApi.StatusRevoked:
+		return awsIot.CertificateStatusRevoked, true
+	case caApi.StatusExpired:
+		return awsIot.CertificateStatusInactive, true
+	}
+	return "", false
+}
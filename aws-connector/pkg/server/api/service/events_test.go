@@ -0,0 +1,229 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awsIot "github.com/aws/aws-sdk-go/service/iot"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	"github.com/lamassuiot/aws-connector/pkg/events"
+	"github.com/lamassuiot/aws-connector/pkg/server/store/db"
+	caApi "github.com/lamassuiot/lamassuiot/pkg/ca/common/api"
+)
+
+// AWS certificate IDs are SHA-256 fingerprints.
+var (
+	testAWSCAID   = strings.Repeat("a", 64)
+	testAWSCertID = strings.Repeat("c", 64)
+)
+
+// fakeIoTServer answers the AWS IoT calls of the event handling: the only registered CA is
+// testAWSCAID, which is not listed. It records the calls that change AWS.
+type fakeIoTServer struct {
+	mutex sync.Mutex
+	calls []string
+	// failUpdates fails the calls that change AWS.
+	failUpdates bool
+}
+
+func (f *fakeIoTServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/cacertificates":
+		w.Write([]byte(`{"certificates":[]}`))
+	case r.Method == http.MethodGet && r.URL.Path == "/cacertificate/"+testAWSCAID:
+		w.Write([]byte(`{"certificateDescription":{"certificateArn":"arn:aws:iot:eu-west-1:123456789012:cacert/` + testAWSCAID + `","certificateId":"` + testAWSCAID + `","status":"ACTIVE"}}`))
+	case r.Method == http.MethodGet:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message":"not found"}`))
+	case f.failUpdates:
+		// Not retried by the SDK, unlike the throttling and server errors.
+		w.Header().Set("X-Amzn-ErrorType", "InvalidRequestException")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message":"invalid request"}`))
+	default:
+		f.mutex.Lock()
+		f.calls = append(f.calls, r.Method+" "+r.URL.Path+" "+r.URL.Query().Get("newStatus"))
+		f.mutex.Unlock()
+		w.Write([]byte(`{}`))
+	}
+}
+
+func newEventTestService(t *testing.T, iotServer *fakeIoTServer) *awsService {
+	t.Helper()
+
+	server := httptest.NewServer(iotServer)
+	t.Cleanup(server.Close)
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("eu-west-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("key", "secret", ""),
+	}))
+
+	store, err := db.NewInMemoryDB()
+	if err != nil {
+		t.Fatalf("could not open the store: %s", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	ctx := context.Background()
+	err = store.UpdateAWSCAMapping(ctx, api.AWSCAMapping{CAName: "registered", AWSCertificateID: testAWSCAID, AWSCertificateArn: "arn:aws:iot:eu-west-1:123456789012:cacert/" + testAWSCAID})
+	if err != nil {
+		t.Fatalf("could not store the CA mapping: %s", err)
+	}
+	err = store.UpdateCertificateMapping(ctx, api.CertificateMapping{CAName: "registered", SerialNumber: "01", AWSCertificateID: testAWSCertID, AWSCertificateArn: "arn:aws:iot:eu-west-1:123456789012:cert/" + testAWSCertID})
+	if err != nil {
+		t.Fatalf("could not store the certificate mapping: %s", err)
+	}
+
+	return &awsService{
+		db:            store,
+		awsIotSvc:     awsIot.New(sess),
+		operatingMode: api.OperatingModeEventDriven,
+	}
+}
+
+func newCertificateEvent(t *testing.T, eventType string, caName string, status caApi.CertificateStatus) cloudevents.Event {
+	t.Helper()
+
+	event := cloudevents.NewEvent()
+	event.SetID("1")
+	event.SetSource("lamassu")
+	event.SetType(eventType)
+	err := event.SetData(cloudevents.ApplicationJSON, events.CertificateV1{
+		CAName:       caName,
+		SerialNumber: "01",
+		Status:       string(status),
+		Subject:      caApi.SubjectSerialized{CommonName: "device"},
+	})
+	if err != nil {
+		t.Fatalf("could not build the event: %s", err)
+	}
+	return event
+}
+
+func TestHandleLamassuEventStatuses(t *testing.T) {
+	testCases := []struct {
+		name      string
+		eventType string
+		caName    string
+		status    caApi.CertificateStatus
+		wantCalls []string
+	}{
+		{
+			name:      "active certificate",
+			eventType: events.TypeCertificateUpdate,
+			caName:    "registered",
+			status:    caApi.StatusActive,
+			wantCalls: []string{"PUT /certificates/" + testAWSCertID + " ACTIVE"},
+		},
+		{
+			name:      "certificate about to expire stays active",
+			eventType: events.TypeCertificateUpdate,
+			caName:    "registered",
+			status:    caApi.StatusAboutToExpire,
+			wantCalls: []string{"PUT /certificates/" + testAWSCertID + " ACTIVE"},
+		},
+		{
+			name:      "revoked certificate",
+			eventType: events.TypeCertificateRevoke,
+			caName:    "registered",
+			status:    caApi.StatusRevoked,
+			wantCalls: []string{"PUT /certificates/" + testAWSCertID + " REVOKED"},
+		},
+		{
+			name:      "expired certificate becomes inactive",
+			eventType: events.TypeCertificateUpdate,
+			caName:    "registered",
+			status:    caApi.StatusExpired,
+			wantCalls: []string{"PUT /certificates/" + testAWSCertID + " INACTIVE"},
+		},
+		{
+			name:      "certificate status without AWS equivalent",
+			eventType: events.TypeCertificateUpdate,
+			caName:    "registered",
+			status:    "PENDING",
+		},
+		{
+			name:      "certificate of a CA not registered in AWS",
+			eventType: events.TypeCertificateUpdate,
+			caName:    "unregistered",
+			status:    caApi.StatusExpired,
+		},
+		{
+			name:      "CA about to expire stays active",
+			eventType: events.TypeCAUpdate,
+			caName:    "registered",
+			status:    caApi.StatusAboutToExpire,
+			wantCalls: []string{"PUT /cacertificate/" + testAWSCAID + " ACTIVE"},
+		},
+		{
+			name:      "expired CA becomes inactive",
+			eventType: events.TypeCAUpdate,
+			caName:    "registered",
+			status:    caApi.StatusExpired,
+			wantCalls: []string{"PUT /cacertificate/" + testAWSCAID + " INACTIVE"},
+		},
+		{
+			name:      "revoked CA becomes inactive",
+			eventType: events.TypeCARevoke,
+			caName:    "registered",
+			status:    caApi.StatusRevoked,
+			wantCalls: []string{"PUT /cacertificate/" + testAWSCAID + " INACTIVE"},
+		},
+		{
+			name:      "CA not registered in AWS",
+			eventType: events.TypeCAUpdate,
+			caName:    "unregistered",
+			status:    caApi.StatusExpired,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			iotServer := &fakeIoTServer{}
+			s := newEventTestService(t, iotServer)
+
+			event := newCertificateEvent(t, tc.eventType, tc.caName, tc.status)
+			err := s.handleLamassuEvent(context.Background(), event)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if strings.Join(iotServer.calls, "\n") != strings.Join(tc.wantCalls, "\n") {
+				t.Fatalf("expected the AWS calls %q, got %q", tc.wantCalls, iotServer.calls)
+			}
+		})
+	}
+}
+
+func TestRedeliveredEventIsForwardedOnce(t *testing.T) {
+	ctx := context.Background()
+	s := newEventTestService(t, &fakeIoTServer{failUpdates: true})
+	event := newCertificateEvent(t, events.TypeCertificateRevoke, "registered", caApi.StatusRevoked)
+
+	// The handling keeps failing, so every redelivery handles the event again.
+	for i := 0; i < 2; i++ {
+		err := s.HandleCloudEvents(ctx, event)
+		if err == nil {
+			t.Fatalf("delivery %d: expected the handling error", i)
+		}
+	}
+
+	entries, err := s.db.ListOutboxEntries(ctx)
+	if err != nil {
+		t.Fatalf("could not list the outbox: %s", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected the event to be enqueued once, got %d entries", len(entries))
+	}
+}
@@ -0,0 +1,336 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/aws/aws-sdk-go/aws"
+	awsIot "github.com/aws/aws-sdk-go/service/iot"
+	"github.com/google/uuid"
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	"github.com/lamassuiot/aws-connector/pkg/server/api/errors"
+	caApi "github.com/lamassuiot/lamassuiot/pkg/ca/common/api"
+	devApi "github.com/lamassuiot/lamassuiot/pkg/device-manager/common/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// expiryNoticeGracePeriod keeps the re-enrollment notice of a certificate past its expiry,
+// until the certificate is deactivated.
+const expiryNoticeGracePeriod = 24 * time.Hour
+
+// MonitorExpiry acts on the device certificates active in AWS that are about to expire,
+// asking their devices to re-enroll, or that have expired, deactivating them. AWS does not
+// reject expired certificates on its own. The CAs about to expire are warned about. Only the
+// CAs registered by the connector are checked.
+func (s *awsService) MonitorExpiry(ctx context.Context, input *api.MonitorExpiryInput) (*api.MonitorExpiryOutput, error) {
+	lease, err := s.acquireLease(ctx, expiryMonitorLease)
+	if err != nil {
+		return &api.MonitorExpiryOutput{}, err
+	}
+	if lease == nil {
+		return &api.MonitorExpiryOutput{}, &errors.GenericError{
+			Message:    "an expiry check is already running",
+			StatusCode: 409,
+		}
+	}
+	defer s.releaseLease(lease)
+	ctx = lease.ctx
+
+	dryRun := input.DryRun || s.isDryRun(ctx)
+	report := &api.ExpiryReport{
+		ID:          uuid.NewString(),
+		DryRun:      dryRun,
+		StartedAt:   time.Now(),
+		ExpiringCAs: []api.ExpiringCA{},
+		Expiring:    []api.ExpiringCertificate{},
+		Errors:      []string{},
+	}
+
+	awsCAs, err := s.listAWSLamassuCAs(ctx)
+	if err != nil {
+		return &api.MonitorExpiryOutput{}, err
+	}
+
+	for _, awsCA := range awsCAs {
+		err = s.checkCAExpiry(ctx, report, awsCA)
+		if err != nil {
+			log.Warn(fmt.Sprintf("expiry monitor could not check the validity of CA %s: ", awsCA.lamassuCAName), err)
+			report.Errors = append(report.Errors, fmt.Sprintf("could not check the validity of CA %s: %s", awsCA.lamassuCAName, err))
+		}
+
+		err = s.monitorCACertificates(ctx, report, awsCA)
+		if err != nil {
+			log.Warn(fmt.Sprintf("expiry monitor could not check the certificates of CA %s: ", awsCA.lamassuCAName), err)
+			report.Errors = append(report.Errors, fmt.Sprintf("could not check the certificates of CA %s: %s", awsCA.lamassuCAName, err))
+		}
+		report.CAs++
+	}
+
+	now := time.Now()
+	report.FinishedAt = &now
+	log.Info(fmt.Sprintf("expiry check %s finished: %d certificates checked, %d expiring, %d CAs expiring", report.ID, report.Certificates, len(report.Expiring), len(report.ExpiringCAs)))
+
+	return &api.MonitorExpiryOutput{
+		ExpiryReport: *report,
+	}, nil
+}
+
+func (s *awsService) checkCAExpiry(ctx context.Context, report *api.ExpiryReport, awsCA awsLamassuCA) error {
+	description, err := s.awsIotSvc.DescribeCACertificateWithContext(ctx, &awsIot.DescribeCACertificateInput{
+		CertificateId: aws.String(awsCA.certificateID),
+	})
+	if err != nil {
+		return err
+	}
+	if description.CertificateDescription == nil || description.CertificateDescription.Validity == nil {
+		return nil
+	}
+
+	notAfter := aws.TimeValue(description.CertificateDescription.Validity.NotAfter)
+	left := time.Until(notAfter)
+	metrics.SetGaugeWithLabels([]string{"expiry", "ca_days_left"}, float32(left.Hours()/24), []metrics.Label{{Name: "ca_name", Value: awsCA.lamassuCAName}})
+	if left > s.caExpiryWarningWindow {
+		return nil
+	}
+
+	expiring := api.ExpiringCA{
+		CAName:           awsCA.lamassuCAName,
+		AWSCertificateID: awsCA.certificateID,
+		NotAfter:         notAfter,
+		Expired:          left <= 0,
+	}
+	logEntry := log.WithFields(log.Fields{
+		"ca_name":            expiring.CAName,
+		"aws_certificate_id": expiring.AWSCertificateID,
+		"not_after":          expiring.NotAfter,
+	})
+	if expiring.Expired {
+		logEntry.Error("CA registered in AWS has expired")
+	} else {
+		logEntry.Warn(fmt.Sprintf("CA registered in AWS expires in %s", left.Round(time.Hour)))
+	}
+
+	report.ExpiringCAs = append(report.ExpiringCAs, expiring)
+	return nil
+}
+
+// monitorCACertificates checks the certificates of a CA active in AWS. Their validity is
+// taken from the certificates issued by the Lamassu CA, matched by fingerprint, which is the
+// AWS certificate ID, and read from AWS for the certificates unknown to Lamassu.
+func (s *awsService) monitorCACertificates(ctx context.Context, report *api.ExpiryReport, awsCA awsLamassuCA) error {
+	lamassuCertificates := map[string]caApi.Certificate{}
+	_, err := s.lamassuCAClient.IterateCertificatesWithPredicate(ctx, &caApi.IterateCertificatesWithPredicateInput{
+		CAType: caApi.CATypePKI,
+		CAName: awsCA.lamassuCAName,
+		PredicateFunc: func(c *caApi.Certificate) {
+			if c.Certificate != nil {
+				fingerprint := sha256.Sum256(c.Certificate.Raw)
+				lamassuCertificates[hex.EncodeToString(fingerprint[:])] = *c
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	awsCertificates := []*awsIot.Certificate{}
+	err = s.awsIotSvc.ListCertificatesByCAPagesWithContext(ctx, &awsIot.ListCertificatesByCAInput{
+		CaCertificateId: aws.String(awsCA.certificateID),
+	}, func(page *awsIot.ListCertificatesByCAOutput, lastPage bool) bool {
+		for _, certificate := range page.Certificates {
+			if aws.StringValue(certificate.Status) == awsIot.CertificateStatusActive {
+				awsCertificates = append(awsCertificates, certificate)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, awsCertificate := range awsCertificates {
+		report.Certificates++
+		expiring := api.ExpiringCertificate{
+			CAName:           awsCA.lamassuCAName,
+			AWSCertificateID: aws.StringValue(awsCertificate.CertificateId),
+		}
+
+		if certificate, ok := lamassuCertificates[expiring.AWSCertificateID]; ok {
+			expiring.SerialNumber = certificate.SerialNumber
+			expiring.NotAfter = certificate.Certificate.NotAfter
+		} else {
+			description, err := s.awsIotSvc.DescribeCertificateWithContext(ctx, &awsIot.DescribeCertificateInput{
+				CertificateId: awsCertificate.CertificateId,
+			})
+			if err != nil {
+				log.Warn(fmt.Sprintf("Error reading the validity of certificate %s: ", expiring.AWSCertificateID), err)
+				report.Errors = append(report.Errors, fmt.Sprintf("could not check certificate %s: %s", expiring.AWSCertificateID, err))
+				continue
+			}
+			if description.CertificateDescription == nil || description.CertificateDescription.Validity == nil {
+				continue
+			}
+			expiring.NotAfter = aws.TimeValue(description.CertificateDescription.Validity.NotAfter)
+		}
+
+		left := time.Until(expiring.NotAfter)
+		switch {
+		case left <= 0:
+			expiring.Action = api.ExpiryActionDeactivate
+			if !report.DryRun {
+				err = s.setAWSCertificateStatus(ctx, expiring.AWSCertificateID, awsIot.CertificateStatusInactive)
+				if err != nil {
+					expiring.Error = err.Error()
+				} else {
+					expiring.Done = true
+				}
+			}
+		case left <= s.certificateRenewalWindow:
+			expiring.Action = api.ExpiryActionReenroll
+			notice, err := s.db.GetCertificateExpiryNotice(ctx, expiring.AWSCertificateID)
+			if err != nil {
+				log.Warn(fmt.Sprintf("Error reading the expiry notice of certificate %s: ", expiring.AWSCertificateID), err)
+			}
+			if notice != nil {
+				// The devices were already asked to re-enroll.
+				expiring.DeviceIDs = notice.DeviceIDs
+				expiring.Done = true
+				report.Expiring = append(report.Expiring, expiring)
+				continue
+			}
+			s.requestReenrollment(ctx, &expiring, aws.StringValue(awsCertificate.CertificateArn), report.DryRun)
+		default:
+			continue
+		}
+
+		s.recordExpiringCertificate(&expiring, report.DryRun)
+		report.Expiring = append(report.Expiring, expiring)
+	}
+
+	return nil
+}
+
+// requestReenrollment sets the re-enrollment flag of the slot holding a certificate on the
+// things using it, through the same path as the re-enrollment requests of Lamassu. The request
+// is only recorded once every device has been asked, so that the devices are not asked again
+// on every check while the failed ones are retried.
+func (s *awsService) requestReenrollment(ctx context.Context, expiring *api.ExpiringCertificate, certificateArn string, dryRun bool) {
+	err := s.awsIotSvc.ListPrincipalThingsPagesWithContext(ctx, &awsIot.ListPrincipalThingsInput{
+		Principal: aws.String(certificateArn),
+	}, func(page *awsIot.ListPrincipalThingsOutput, lastPage bool) bool {
+		expiring.DeviceIDs = append(expiring.DeviceIDs, aws.StringValueSlice(page.Things)...)
+		return true
+	})
+	if err != nil {
+		expiring.Error = err.Error()
+		return
+	}
+	if len(expiring.DeviceIDs) == 0 {
+		expiring.Error = "the certificate is not attached to any thing"
+		return
+	}
+
+	failures := []string{}
+	for _, deviceID := range expiring.DeviceIDs {
+		device, err := s.devManagerClient.GetDeviceById(ctx, deviceID)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", deviceID, err))
+			continue
+		}
+
+		slotID := certificateSlot(&device.Device, expiring)
+		if slotID == "" {
+			// The slot already holds another certificate, the device has re-enrolled.
+			log.Info(fmt.Sprintf("certificate %s is no longer active in a slot of device %s, it is not asked to re-enroll", expiring.AWSCertificateID, deviceID))
+			continue
+		}
+		if dryRun {
+			continue
+		}
+
+		err = s.setReenrollmentFlag(ctx, &device.Device, slotID, true)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", deviceID, err))
+		}
+	}
+	if len(failures) > 0 {
+		expiring.Error = strings.Join(failures, "; ")
+		return
+	}
+	if dryRun {
+		return
+	}
+	expiring.Done = true
+
+	err = s.db.UpdateCertificateExpiryNotice(ctx, api.CertificateExpiryNotice{
+		AWSCertificateID: expiring.AWSCertificateID,
+		DeviceIDs:        expiring.DeviceIDs,
+		NotAfter:         expiring.NotAfter,
+		NotifiedAt:       time.Now(),
+	}, time.Until(expiring.NotAfter)+expiryNoticeGracePeriod)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error recording the expiry notice of certificate %s: ", expiring.AWSCertificateID), err)
+	}
+}
+
+// certificateSlot returns the slot of a device whose active certificate is the expiring one,
+// matched by fingerprint, or by serial number when the certificate is not included. It
+// returns an empty string when no slot holds the certificate anymore.
+func certificateSlot(device *devApi.Device, expiring *api.ExpiringCertificate) string {
+	for _, slot := range device.Slots {
+		if slot == nil || slot.ActiveCertificate == nil {
+			continue
+		}
+
+		active := slot.ActiveCertificate
+		if active.Certificate != nil {
+			fingerprint := sha256.Sum256(active.Certificate.Raw)
+			if hex.EncodeToString(fingerprint[:]) == expiring.AWSCertificateID {
+				return slot.ID
+			}
+		} else if expiring.SerialNumber != "" && active.CAName == expiring.CAName && active.SerialNumber == expiring.SerialNumber {
+			return slot.ID
+		}
+	}
+	return ""
+}
+
+func (s *awsService) recordExpiringCertificate(expiring *api.ExpiringCertificate, dryRun bool) {
+	result := "reported"
+	switch {
+	case expiring.Error != "":
+		result = "failed"
+	case expiring.Done:
+		result = "done"
+	}
+
+	logEntry := log.WithFields(log.Fields{
+		"ca_name":            expiring.CAName,
+		"serial_number":      expiring.SerialNumber,
+		"aws_certificate_id": expiring.AWSCertificateID,
+		"not_after":          expiring.NotAfter,
+		"device_ids":         expiring.DeviceIDs,
+		"action":             expiring.Action,
+		"result":             result,
+		"dry_run":            dryRun,
+	})
+	switch {
+	case expiring.Error != "":
+		logEntry.Error("could not act on an expiring certificate: ", expiring.Error)
+	case expiring.Action == api.ExpiryActionDeactivate:
+		logEntry.Warn("certificate expired but still active in AWS")
+	default:
+		logEntry.Info("certificate about to expire, asking its devices to re-enroll")
+	}
+
+	metrics.IncrCounterWithLabels([]string{"expiry", "certificates"}, 1, []metrics.Label{
+		{Name: "ca_name", Value: expiring.CAName},
+		{Name: "action", Value: string(expiring.Action)},
+		{Name: "result", Value: result},
+	})
+}
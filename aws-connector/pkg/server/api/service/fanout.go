@@ -0,0 +1,182 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	devApi "github.com/lamassuiot/lamassuiot/pkg/device-manager/common/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// fanOutReportInterval is the number of processed devices after which the report of a
+// running fan-out is persisted, so its progress can be followed.
+const fanOutReportInterval = 500
+
+func (s *awsService) GetShadowFanOutReports(ctx context.Context, input *api.GetShadowFanOutReportsInput) (*api.GetShadowFanOutReportsOutput, error) {
+	reports, err := s.db.GetShadowFanOutReports(ctx, input.DMSName)
+	if err != nil {
+		return &api.GetShadowFanOutReportsOutput{}, err
+	}
+
+	return &api.GetShadowFanOutReportsOutput{
+		Reports: reports,
+	}, nil
+}
+
+// newShadowFanOutReport returns the report of a new fan-out of an action to the devices of a DMS.
+func newShadowFanOutReport(dmsName string, action api.ShadowAction) api.ShadowFanOutReport {
+	return api.ShadowFanOutReport{
+		ID:        uuid.NewString(),
+		DMSName:   dmsName,
+		Action:    action,
+		Status:    api.ShadowFanOutStatusRunning,
+		StartedAt: time.Now(),
+		Failed:    []api.ShadowFanOutFailure{},
+	}
+}
+
+// fanOutAction delivers the action of the report to every device of its DMS using a bounded
+// pool of workers. The pace of the deliveries is set by the rate limiters shared by the whole
+// service, so concurrent runs never exceed the AWS quotas.
+func (s *awsService) fanOutAction(ctx context.Context, report api.ShadowFanOutReport, deliver func(ctx context.Context, deviceID string) error) api.ShadowFanOutReport {
+	dmsName := report.DMSName
+	action := report.Action
+	s.saveShadowFanOutReport(ctx, report)
+
+	var reportMutex sync.Mutex
+	processed := 0
+	record := func(update func()) {
+		reportMutex.Lock()
+		defer reportMutex.Unlock()
+
+		update()
+		processed++
+		if processed%fanOutReportInterval == 0 {
+			s.saveShadowFanOutReport(ctx, report)
+		}
+	}
+
+	deviceIDs := make(chan string, s.shadowUpdateWorkers)
+	var wg sync.WaitGroup
+	for i := 0; i < s.shadowUpdateWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for deviceID := range deviceIDs {
+				err := deliver(ctx, deviceID)
+				if err != nil {
+					log.Warn(fmt.Sprintf("Error delivering %s to thing %s: ", action, deviceID), err)
+					record(func() {
+						report.Failed = append(report.Failed, api.ShadowFanOutFailure{DeviceID: deviceID, Error: err.Error()})
+					})
+				} else {
+					record(func() {
+						report.Succeeded++
+					})
+				}
+			}
+		}()
+	}
+
+	_, err := s.devManagerClient.IterateDevicesbyDMSWithPredicate(ctx, &devApi.IterateDevicesByDMSWithPredicateInput{
+		DmsName: dmsName,
+		PredicateFunc: func(d *devApi.Device) {
+			if !fanOutReaches(d) {
+				record(func() {
+					report.Skipped++
+				})
+				return
+			}
+			deviceIDs <- d.ID
+		},
+	})
+	close(deviceIDs)
+	wg.Wait()
+
+	return s.finishShadowFanOut(ctx, report, err)
+}
+
+// fanOutIdentityJobs delivers the action of the report to every device of its DMS through IoT
+// Jobs. The things are targeted by as few jobs as the target limit of a job allows, so that
+// the CreateJob quota is not spent one device at a time.
+func (s *awsService) fanOutIdentityJobs(ctx context.Context, report api.ShadowFanOutReport, desired api.Desired) api.ShadowFanOutReport {
+	s.saveShadowFanOutReport(ctx, report)
+
+	batch := []string{}
+	createJob := func() {
+		targetArns := make([]string, len(batch))
+		for i, deviceID := range batch {
+			targetArns[i] = s.thingArn(deviceID)
+		}
+
+		_, err := s.createIdentityJob(ctx, report.Action, targetArns, desired)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error delivering %s to %d things of DMS %s: ", report.Action, len(batch), report.DMSName), err)
+			for _, deviceID := range batch {
+				report.Failed = append(report.Failed, api.ShadowFanOutFailure{DeviceID: deviceID, Error: err.Error()})
+			}
+		} else {
+			report.Succeeded += len(batch)
+		}
+		s.saveShadowFanOutReport(ctx, report)
+		batch = []string{}
+	}
+
+	_, err := s.devManagerClient.IterateDevicesbyDMSWithPredicate(ctx, &devApi.IterateDevicesByDMSWithPredicateInput{
+		DmsName: report.DMSName,
+		PredicateFunc: func(d *devApi.Device) {
+			if !fanOutReaches(d) {
+				report.Skipped++
+				return
+			}
+			batch = append(batch, d.ID)
+			if len(batch) == jobTargetsLimit {
+				createJob()
+			}
+		},
+	})
+	if len(batch) > 0 {
+		createJob()
+	}
+
+	return s.finishShadowFanOut(ctx, report, err)
+}
+
+// fanOutReaches tells whether a fan-out delivers to the device. Devices that are not
+// provisioned have no thing in AWS yet and decommissioned ones will never read their shadow
+// or jobs again.
+func fanOutReaches(d *devApi.Device) bool {
+	return d.Status != devApi.DeviceStatusPendingProvisioning && d.Status != devApi.DeviceStatusDecommissioned
+}
+
+// finishShadowFanOut records the outcome of a fan-out, which failed altogether if err is not nil.
+func (s *awsService) finishShadowFanOut(ctx context.Context, report api.ShadowFanOutReport, err error) api.ShadowFanOutReport {
+	now := time.Now()
+	report.FinishedAt = &now
+	report.Status = api.ShadowFanOutStatusCompleted
+	if err != nil {
+		report.Status = api.ShadowFanOutStatusFailed
+		report.Error = err.Error()
+	}
+
+	log.Info(fmt.Sprintf("fan-out %s of DMS %s finished with status %s: %d succeeded, %d failed, %d skipped", report.ID, report.DMSName, report.Status, report.Succeeded, len(report.Failed), report.Skipped))
+	s.saveShadowFanOutReport(ctx, report)
+
+	return report
+}
+
+func (s *awsService) saveShadowFanOutReport(ctx context.Context, report api.ShadowFanOutReport) {
+	// Reports describe deliveries that happened, a dry run has none.
+	if s.isDryRun(ctx) {
+		return
+	}
+
+	err := s.db.UpdateShadowFanOutReport(ctx, report)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error storing the shadow fan-out report %s: ", report.ID), err)
+	}
+}
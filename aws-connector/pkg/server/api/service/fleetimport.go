@@ -0,0 +1,491 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsIot "github.com/aws/aws-sdk-go/service/iot"
+	"github.com/google/uuid"
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	"github.com/lamassuiot/aws-connector/pkg/server/api/errors"
+	"github.com/lamassuiot/aws-connector/pkg/server/utils"
+	caApi "github.com/lamassuiot/lamassuiot/pkg/ca/common/api"
+	devApi "github.com/lamassuiot/lamassuiot/pkg/device-manager/common/api"
+	dmsApi "github.com/lamassuiot/lamassuiot/pkg/dms-manager/common/api"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// fleetImportReportInterval is the number of processed things after which the report of a
+	// running import is persisted.
+	fleetImportReportInterval = 100
+
+	thingAttributeDeviceID = "lamassuDeviceID"
+	thingAttributeDMSName  = "lamassuDMSName"
+	importedDeviceTag      = "aws-import"
+)
+
+// fleetImport holds the state of a running import.
+type fleetImport struct {
+	report api.FleetImport
+	// devices maps the ID of every Lamassu device to its DMS.
+	devices   map[string]string
+	processed int
+}
+
+func (f *fleetImport) issue(resourceType string, resource string, status api.FleetImportIssueStatus, detail string) {
+	log.Warn(fmt.Sprintf("fleet import %s: %s %s %s: %s", f.report.ID, resourceType, resource, status, detail))
+	f.report.Issues = append(f.report.Issues, api.FleetImportIssue{
+		ResourceType: resourceType,
+		Resource:     resource,
+		Status:       status,
+		Detail:       detail,
+	})
+}
+
+func (s *awsService) ImportFleet(ctx context.Context, input *api.ImportFleetInput) (*api.ImportFleetOutput, error) {
+	if input.DMSName == "" {
+		return &api.ImportFleetOutput{}, &errors.ValidationError{
+			Msg: "dms_name is required",
+		}
+	}
+
+	_, err := s.dmsClient.GetDMSByName(ctx, &dmsApi.GetDMSByNameInput{
+		Name: input.DMSName,
+	})
+	if err != nil {
+		return &api.ImportFleetOutput{}, &errors.ResourceNotFoundError{
+			ResourceType: "DMS",
+			ResourceId:   input.DMSName,
+		}
+	}
+
+	// The import outlives the request, and so does its lease.
+	lease, err := s.acquireLease(detachContext(ctx), fleetImportLease)
+	if err != nil {
+		return &api.ImportFleetOutput{}, err
+	}
+	if lease == nil {
+		return &api.ImportFleetOutput{}, &errors.GenericError{
+			Message:    "a fleet import is already running",
+			StatusCode: 409,
+		}
+	}
+
+	report := api.FleetImport{
+		ID:        uuid.NewString(),
+		DMSName:   input.DMSName,
+		Status:    api.FleetImportStatusRunning,
+		StartedAt: time.Now(),
+		Owner:     s.instanceID,
+		Issues:    []api.FleetImportIssue{},
+	}
+	s.saveFleetImport(ctx, report)
+
+	// Large fleets take long to import, the progress is available in the import report.
+	go func() {
+		defer s.releaseLease(lease)
+		s.runFleetImport(lease.ctx, report)
+	}()
+
+	return &api.ImportFleetOutput{
+		FleetImport: report,
+	}, nil
+}
+
+func (s *awsService) GetFleetImport(ctx context.Context, input *api.GetFleetImportInput) (*api.GetFleetImportOutput, error) {
+	report, err := s.db.GetFleetImport(ctx, input.ImportID)
+	if err != nil {
+		return &api.GetFleetImportOutput{}, err
+	}
+	if report == nil {
+		return &api.GetFleetImportOutput{}, &errors.ResourceNotFoundError{
+			ResourceType: "FleetImport",
+			ResourceId:   input.ImportID,
+		}
+	}
+
+	return &api.GetFleetImportOutput{
+		FleetImport: *report,
+	}, nil
+}
+
+func (s *awsService) GetFleetImports(ctx context.Context, input *api.GetFleetImportsInput) (*api.GetFleetImportsOutput, error) {
+	reports, err := s.db.GetFleetImports(ctx)
+	if err != nil {
+		return &api.GetFleetImportsOutput{}, err
+	}
+
+	return &api.GetFleetImportsOutput{
+		Imports: reports,
+	}, nil
+}
+
+// runFleetImport imports the things provisioned under every AWS CA known to Lamassu. Each
+// step checks what a previous run already did, so an import can be run again after a failure.
+// Neither CAs nor certificates are created in Lamassu, whose CA client offers no import.
+func (s *awsService) runFleetImport(ctx context.Context, report api.FleetImport) {
+	f := &fleetImport{
+		report:  report,
+		devices: map[string]string{},
+	}
+
+	err := s.prepareFleetImport(ctx, f)
+	if err != nil {
+		s.finishFleetImport(ctx, f, err)
+		return
+	}
+
+	awsCAs := []*awsIot.CACertificate{}
+	err = s.awsIotSvc.ListCACertificatesPagesWithContext(ctx, &awsIot.ListCACertificatesInput{}, func(page *awsIot.ListCACertificatesOutput, lastPage bool) bool {
+		awsCAs = append(awsCAs, page.Certificates...)
+		return true
+	})
+	if err != nil {
+		s.finishFleetImport(ctx, f, fmt.Errorf("could not list AWS CA certificates: %w", err))
+		return
+	}
+	f.report.TotalCAs = len(awsCAs)
+	s.saveFleetImport(ctx, f.report)
+
+	lamassuCAs := map[string]caApi.CACertificate{}
+	_, err = s.lamassuCAClient.IterateCAsWithPredicate(ctx, &caApi.IterateCAsWithPredicateInput{
+		CAType: caApi.CATypePKI,
+		PredicateFunc: func(c *caApi.CACertificate) {
+			if c.Certificate.Certificate == nil {
+				return
+			}
+			lamassuCAs[certificateFingerprint(c.Certificate.Certificate)] = *c
+		},
+	})
+	if err != nil {
+		s.finishFleetImport(ctx, f, fmt.Errorf("could not list Lamassu CAs: %w", err))
+		return
+	}
+
+	for _, awsCA := range awsCAs {
+		caName, ok := s.importAWSCA(ctx, f, awsCA, lamassuCAs)
+		if !ok {
+			continue
+		}
+
+		things, err := s.listCAThings(ctx, aws.StringValue(awsCA.CertificateId))
+		if err != nil {
+			f.report.CAs.Failed++
+			f.issue("CA", caName, api.FleetImportIssueFailed, fmt.Sprintf("could not list the things of the CA: %s", err))
+			continue
+		}
+
+		for thingName, serialNumbers := range things {
+			s.importThing(ctx, f, thingName, serialNumbers)
+
+			f.processed++
+			if f.processed%fleetImportReportInterval == 0 {
+				s.saveFleetImport(ctx, f.report)
+			}
+		}
+	}
+
+	// The configuration lists the CAs by their tags.
+	if f.report.CAs.Imported > 0 {
+		err = s.invalidateConfigurationCache(ctx)
+		if err != nil {
+			s.finishFleetImport(ctx, f, fmt.Errorf("could not invalidate the configuration cache: %w", err))
+			return
+		}
+	}
+
+	s.finishFleetImport(ctx, f, nil)
+}
+
+// prepareFleetImport loads the existing Lamassu devices and makes sure the thing group of the
+// provisioned things exists.
+func (s *awsService) prepareFleetImport(ctx context.Context, f *fleetImport) error {
+	dmsNames := []string{}
+	_, err := s.dmsClient.IterateDMSsWithPredicate(ctx, &dmsApi.IterateDMSsWithPredicateInput{
+		PredicateFunc: func(dms *dmsApi.DeviceManufacturingService) {
+			dmsNames = append(dmsNames, dms.Name)
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("could not list Lamassu DMSs: %w", err)
+	}
+
+	for _, dmsName := range dmsNames {
+		_, err = s.devManagerClient.IterateDevicesbyDMSWithPredicate(ctx, &devApi.IterateDevicesByDMSWithPredicateInput{
+			DmsName: dmsName,
+			PredicateFunc: func(device *devApi.Device) {
+				f.devices[device.ID] = device.DmsName
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("could not list the devices of DMS %s: %w", dmsName, err)
+		}
+	}
+
+	_, err = s.ensureThingGroup(ctx, lamassuThingGroup, "")
+	return err
+}
+
+func (s *awsService) finishFleetImport(ctx context.Context, f *fleetImport, err error) {
+	now := time.Now()
+	f.report.FinishedAt = &now
+	f.report.Status = api.FleetImportStatusCompleted
+	if err != nil {
+		f.report.Status = api.FleetImportStatusFailed
+		f.report.Error = err.Error()
+	}
+
+	log.Info(fmt.Sprintf("fleet import %s finished with status %s: CAs %+v, things %+v", f.report.ID, f.report.Status, f.report.CAs, f.report.Things))
+	s.saveFleetImport(ctx, f.report)
+}
+
+func (s *awsService) saveFleetImport(ctx context.Context, report api.FleetImport) {
+	err := s.db.UpdateFleetImport(ctx, report)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error storing the fleet import report %s: ", report.ID), err)
+	}
+}
+
+// importAWSCA links an AWS CA with the Lamassu CA holding the same certificate by tagging it.
+// AWS does not keep the private key of its CAs, so CAs unknown to Lamassu have to be imported
+// into Lamassu beforehand and are skipped.
+func (s *awsService) importAWSCA(ctx context.Context, f *fleetImport, awsCA *awsIot.CACertificate, lamassuCAs map[string]caApi.CACertificate) (string, bool) {
+	certificateID := aws.StringValue(awsCA.CertificateId)
+
+	description, err := s.awsIotSvc.DescribeCACertificateWithContext(ctx, &awsIot.DescribeCACertificateInput{
+		CertificateId: awsCA.CertificateId,
+	})
+	if err != nil {
+		f.report.CAs.Failed++
+		f.issue("CA", certificateID, api.FleetImportIssueFailed, fmt.Sprintf("could not describe the CA: %s", err))
+		return "", false
+	}
+
+	certificate, err := parseCertificatePEM(aws.StringValue(description.CertificateDescription.CertificatePem))
+	if err != nil {
+		f.report.CAs.Failed++
+		f.issue("CA", certificateID, api.FleetImportIssueFailed, fmt.Sprintf("could not parse the CA certificate: %s", err))
+		return "", false
+	}
+
+	lamassuCA, ok := lamassuCAs[certificateFingerprint(certificate)]
+	if !ok {
+		f.report.CAs.Skipped++
+		f.issue("CA", certificateID, api.FleetImportIssueSkipped, fmt.Sprintf("CA %s is not in Lamassu, import it with its private key and run the import again", certificate.Subject.CommonName))
+		return "", false
+	}
+
+	tagsResponse, err := s.awsIotSvc.ListTagsForResourceWithContext(ctx, &awsIot.ListTagsForResourceInput{
+		ResourceArn: awsCA.CertificateArn,
+	})
+	if err != nil {
+		f.report.CAs.Failed++
+		f.issue("CA", lamassuCA.CAName, api.FleetImportIssueFailed, fmt.Sprintf("could not list the tags of the CA: %s", err))
+		return "", false
+	}
+
+	tagged := slices.IndexFunc(tagsResponse.Tags, func(tag *awsIot.Tag) bool {
+		return aws.StringValue(tag.Key) == "lamassuCAName" && aws.StringValue(tag.Value) == lamassuCA.CAName
+	}) != -1
+	if tagged {
+		f.report.CAs.AlreadyImported++
+		return lamassuCA.CAName, true
+	}
+
+	_, err = s.awsIotSvc.TagResourceWithContext(ctx, &awsIot.TagResourceInput{
+		ResourceArn: awsCA.CertificateArn,
+		Tags: []*awsIot.Tag{
+			{
+				Key:   aws.String("lamassuCAName"),
+				Value: aws.String(lamassuCA.CAName),
+			},
+			{
+				Key:   aws.String("serialNumber"),
+				Value: aws.String(lamassuCA.SerialNumber),
+			},
+		},
+	})
+	if err != nil {
+		f.report.CAs.Failed++
+		f.issue("CA", lamassuCA.CAName, api.FleetImportIssueFailed, fmt.Sprintf("could not tag the CA: %s", err))
+		return "", false
+	}
+
+	f.report.CAs.Imported++
+	return lamassuCA.CAName, true
+}
+
+// listCAThings returns the things with an active certificate issued by an AWS CA, along with
+// the serial numbers of their certificates.
+func (s *awsService) listCAThings(ctx context.Context, caCertificateID string) (map[string][]string, error) {
+	certificates := []*awsIot.Certificate{}
+	err := s.awsIotSvc.ListCertificatesByCAPagesWithContext(ctx, &awsIot.ListCertificatesByCAInput{
+		CaCertificateId: aws.String(caCertificateID),
+	}, func(page *awsIot.ListCertificatesByCAOutput, lastPage bool) bool {
+		certificates = append(certificates, page.Certificates...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	things := map[string][]string{}
+	for _, certificate := range certificates {
+		if aws.StringValue(certificate.Status) != awsIot.CertificateStatusActive {
+			continue
+		}
+
+		principalThings, err := s.awsIotSvc.ListPrincipalThingsWithContext(ctx, &awsIot.ListPrincipalThingsInput{
+			Principal: certificate.CertificateArn,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(principalThings.Things) == 0 {
+			continue
+		}
+
+		description, err := s.awsIotSvc.DescribeCertificateWithContext(ctx, &awsIot.DescribeCertificateInput{
+			CertificateId: certificate.CertificateId,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		crt, err := parseCertificatePEM(aws.StringValue(description.CertificateDescription.CertificatePem))
+		if err != nil {
+			return nil, err
+		}
+
+		serialNumber := utils.InsertNth(utils.ToHexInt(crt.SerialNumber), 2)
+		for _, thingName := range principalThings.Things {
+			things[aws.StringValue(thingName)] = append(things[aws.StringValue(thingName)], serialNumber)
+		}
+	}
+
+	return things, nil
+}
+
+// importThing creates the Lamassu device of a thing and records its identifiers in the thing
+// attributes, things cannot be tagged. Things are named after the ID of their device. The
+// device manager client can only create devices, so the serial numbers of the certificates of
+// the thing are kept in the device tags.
+func (s *awsService) importThing(ctx context.Context, f *fleetImport, thingName string, serialNumbers []string) {
+	imported := false
+
+	dmsName, exists := f.devices[thingName]
+	if !exists {
+		dmsName = f.report.DMSName
+		tags := []string{importedDeviceTag}
+		for _, serialNumber := range serialNumbers {
+			tags = append(tags, "serial-number:"+serialNumber)
+		}
+
+		if s.isDryRun(ctx) {
+			log.Info(fmt.Sprintf("dry run: device %s would be created in DMS %s", thingName, dmsName))
+		} else {
+			_, err := s.devManagerClient.CreateDevice(ctx, thingName, thingName, dmsName, fmt.Sprintf("Imported from AWS IoT thing %s", thingName), tags, "", "")
+			if err != nil {
+				f.report.Things.Failed++
+				f.issue("THING", thingName, api.FleetImportIssueFailed, fmt.Sprintf("could not create the device: %s", err))
+				return
+			}
+		}
+		f.devices[thingName] = dmsName
+		imported = true
+	}
+
+	thing, err := s.awsIotSvc.DescribeThingWithContext(ctx, &awsIot.DescribeThingInput{
+		ThingName: aws.String(thingName),
+	})
+	if err != nil {
+		f.report.Things.Failed++
+		f.issue("THING", thingName, api.FleetImportIssueFailed, fmt.Sprintf("could not describe the thing: %s", err))
+		return
+	}
+
+	if aws.StringValue(thing.Attributes[thingAttributeDeviceID]) != thingName || aws.StringValue(thing.Attributes[thingAttributeDMSName]) != dmsName {
+		_, err = s.awsIotSvc.UpdateThingWithContext(ctx, &awsIot.UpdateThingInput{
+			ThingName: aws.String(thingName),
+			AttributePayload: &awsIot.AttributePayload{
+				Attributes: map[string]*string{
+					thingAttributeDeviceID: aws.String(thingName),
+					thingAttributeDMSName:  aws.String(dmsName),
+				},
+				Merge: aws.Bool(true),
+			},
+		})
+		if err != nil {
+			f.report.Things.Failed++
+			f.issue("THING", thingName, api.FleetImportIssueFailed, fmt.Sprintf("could not tag the thing: %s", err))
+			return
+		}
+
+		// Provisioned things belong to the Lamassu group, which the connector relies on to
+		// find them.
+		_, err = s.awsIotSvc.AddThingToThingGroupWithContext(ctx, &awsIot.AddThingToThingGroupInput{
+			ThingName:      aws.String(thingName),
+			ThingGroupName: aws.String(lamassuThingGroup),
+		})
+		if err != nil {
+			f.report.Things.Failed++
+			f.issue("THING", thingName, api.FleetImportIssueFailed, fmt.Sprintf("could not add the thing to group %s: %s", lamassuThingGroup, err))
+			return
+		}
+		imported = true
+	}
+
+	if imported {
+		f.report.Things.Imported++
+	} else {
+		f.report.Things.AlreadyImported++
+	}
+}
+
+// ensureThingGroup creates a thing group, as a child of parentGroupName when not empty, and
+// reports whether it was created. The parent of an existing group is left as it is.
+func (s *awsService) ensureThingGroup(ctx context.Context, thingGroupName string, parentGroupName string) (bool, error) {
+	_, err := s.awsIotSvc.DescribeThingGroupWithContext(ctx, &awsIot.DescribeThingGroupInput{
+		ThingGroupName: aws.String(thingGroupName),
+	})
+	if err == nil {
+		return false, nil
+	}
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != awsIot.ErrCodeResourceNotFoundException {
+		return false, err
+	}
+
+	input := &awsIot.CreateThingGroupInput{
+		ThingGroupName: aws.String(thingGroupName),
+	}
+	if parentGroupName != "" {
+		input.ParentGroupName = aws.String(parentGroupName)
+	}
+	_, err = s.awsIotSvc.CreateThingGroupWithContext(ctx, input)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func parseCertificatePEM(certificatePEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certificatePEM))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func certificateFingerprint(certificate *x509.Certificate) string {
+	fingerprint := sha256.Sum256(certificate.Raw)
+	return hex.EncodeToString(fingerprint[:])
+}
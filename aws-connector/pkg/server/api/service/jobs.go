@@ -0,0 +1,121 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awsIot "github.com/aws/aws-sdk-go/service/iot"
+	"github.com/google/uuid"
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	identityJobOperation = "lamassu-identity"
+	identityJobIDPrefix  = "lamassu-"
+	// createJobRate is the default AWS quota of CreateJob calls per second.
+	createJobRate = 10
+	// jobTargetsLimit is the largest number of targets AWS accepts in a single job.
+	jobTargetsLimit = 100
+)
+
+// createIdentityJob requests an identity action through IoT Jobs, targeting at most
+// jobTargetsLimit things or groups. The job document carries the same desired state that
+// would be written into the shadow.
+func (s *awsService) createIdentityJob(ctx context.Context, action api.ShadowAction, targetArns []string, desired api.Desired) (string, error) {
+	document, err := json.Marshal(api.IdentityJobDocument{
+		Operation: identityJobOperation,
+		Action:    action,
+		State: api.StatePayload{
+			Desired: desired,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = s.jobsLimiter.Wait(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	jobID := identityJobID(action)
+	_, err = s.awsIotSvc.CreateJobWithContext(ctx, &awsIot.CreateJobInput{
+		JobId:           aws.String(jobID),
+		Targets:         aws.StringSlice(targetArns),
+		Document:        aws.String(string(document)),
+		Description:     aws.String(fmt.Sprintf("Lamassu %s", action)),
+		TargetSelection: aws.String(awsIot.TargetSelectionSnapshot),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	log.Info(fmt.Sprintf("created job %s targeting %s", jobID, strings.Join(targetArns, ", ")))
+	return jobID, nil
+}
+
+// getThingIdentityJobs returns the executions of the identity jobs created for a thing,
+// either directly or through one of its groups.
+func (s *awsService) getThingIdentityJobs(ctx context.Context, thingName string) ([]AWSThingJobExecution, error) {
+	executions := []AWSThingJobExecution{}
+
+	err := s.awsIotSvc.ListJobExecutionsForThingPagesWithContext(ctx, &awsIot.ListJobExecutionsForThingInput{
+		ThingName: aws.String(thingName),
+	}, func(page *awsIot.ListJobExecutionsForThingOutput, lastPage bool) bool {
+		for _, summary := range page.ExecutionSummaries {
+			action, ok := identityJobAction(aws.StringValue(summary.JobId))
+			if !ok || summary.JobExecutionSummary == nil {
+				continue
+			}
+
+			executions = append(executions, AWSThingJobExecution{
+				JobID:         aws.StringValue(summary.JobId),
+				Action:        action,
+				Status:        aws.StringValue(summary.JobExecutionSummary.Status),
+				QueuedAt:      summary.JobExecutionSummary.QueuedAt,
+				StartedAt:     summary.JobExecutionSummary.StartedAt,
+				LastUpdatedAt: summary.JobExecutionSummary.LastUpdatedAt,
+			})
+		}
+		return true
+	})
+
+	return executions, err
+}
+
+func (s *awsService) thingArn(thingName string) string {
+	return fmt.Sprintf("arn:aws:iot:%s:%s:thing/%s", s.accountDefaultRegion, s.accountID, thingName)
+}
+
+// certificateArn is the ARN of an AWS certificate, whose ID is the SHA-256 fingerprint of
+// the certificate.
+func (s *awsService) certificateArn(certificateID string) string {
+	return fmt.Sprintf("arn:aws:iot:%s:%s:cert/%s", s.accountDefaultRegion, s.accountID, certificateID)
+}
+
+func (s *awsService) thingGroupArn(thingGroupName string) string {
+	return fmt.Sprintf("arn:aws:iot:%s:%s:thinggroup/%s", s.accountDefaultRegion, s.accountID, thingGroupName)
+}
+
+// identityJobID builds a unique job ID that keeps the requested action recoverable. Job IDs
+// are limited to 64 characters: the longest action leaves room for a dashless UUID.
+func identityJobID(action api.ShadowAction) string {
+	return identityJobIDPrefix + identityJobActionSlug(action) + "-" + strings.ReplaceAll(uuid.NewString(), "-", "")
+}
+
+func identityJobAction(jobID string) (api.ShadowAction, bool) {
+	for _, action := range []api.ShadowAction{api.ShadowActionUpdateCACerts, api.ShadowActionRotateIdentityCert, api.ShadowActionUpdateDevoSlot} {
+		if strings.HasPrefix(jobID, identityJobIDPrefix+identityJobActionSlug(action)+"-") {
+			return action, true
+		}
+	}
+	return "", false
+}
+
+func identityJobActionSlug(action api.ShadowAction) string {
+	return strings.ToLower(strings.ReplaceAll(string(action), "_", "-"))
+}
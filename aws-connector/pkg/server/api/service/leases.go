@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// leaseTTL bounds how long the lease of a replica that stopped keeps its job from running
+// elsewhere. The leases of the running jobs are renewed every leaseTTL/3.
+const leaseTTL = time.Minute
+
+// leaseWaitInterval is how often a lease held by another run is tried again while waiting for it.
+const leaseWaitInterval = time.Second
+
+// workflowResumeInterval is how often the replicas look for the workflows left behind by a
+// replica that stopped, whose leases expire after leaseTTL.
+const workflowResumeInterval = leaseTTL
+
+const (
+	reconcilerLease            = "reconciler"
+	revocationEnforcementLease = "revocation-enforcement"
+	expiryMonitorLease         = "expiry-monitor"
+	thingGroupSyncLease        = "thing-group-sync"
+	fleetImportLease           = "fleet-import"
+)
+
+func shadowMigrationLease(dmsName string) string {
+	return "shadow-migration/" + dmsName
+}
+
+// caCertsFanOutLease is the lease of the CA certificate updates of a DMS, delivered one at a time.
+func caCertsFanOutLease(dmsName string) string {
+	return "ca-certs-fan-out/" + dmsName
+}
+
+// outboxLease is the lease of the deliveries to a destination, which also tells apart the
+// destinations whose entries are delivered in order.
+func outboxLease(destination api.EventDestination) string {
+	destinationType := destination.Type
+	// Entries stored before destinations were introduced have none.
+	if destinationType == "" {
+		destinationType = api.EventDestinationSQS
+	}
+	return "outbox/" + string(destinationType) + "/" + destination.Target
+}
+
+// heldLease is a lease held for a run of a job. Its context is cancelled when the lease is
+// lost, so that the job stops before another replica picks it up.
+type heldLease struct {
+	name   string
+	owner  string
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// acquireLease acquires the lease of name for a new run of a job, and keeps renewing it until
+// it is released. It returns nil when the job is already running, in this replica or in
+// another one sharing the store.
+func (s *awsService) acquireLease(ctx context.Context, name string) (*heldLease, error) {
+	// Each run owns its lease, so that two runs of the same replica exclude each other too.
+	owner := s.instanceID + "/" + uuid.NewString()
+	acquired, err := s.db.AcquireLease(ctx, name, owner, leaseTTL)
+	if err != nil || !acquired {
+		return nil, err
+	}
+
+	leaseCtx, cancel := context.WithCancel(ctx)
+	lease := &heldLease{
+		name:   name,
+		owner:  owner,
+		ctx:    leaseCtx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go s.renewLease(lease)
+
+	return lease, nil
+}
+
+// waitLease is acquireLease for the jobs that must wait for the running one to finish instead
+// of being skipped.
+func (s *awsService) waitLease(ctx context.Context, name string) (*heldLease, error) {
+	for {
+		lease, err := s.acquireLease(ctx, name)
+		if err != nil || lease != nil {
+			return lease, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(leaseWaitInterval):
+		}
+	}
+}
+
+func (s *awsService) renewLease(lease *heldLease) {
+	defer close(lease.done)
+
+	ticker := time.NewTicker(leaseTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lease.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		acquired, err := s.db.AcquireLease(lease.ctx, lease.name, lease.owner, leaseTTL)
+		if err != nil {
+			// The lease is still held until it expires, the renewal is tried again.
+			log.Warn("could not renew the lease of "+lease.name+": ", err)
+			continue
+		}
+		if !acquired {
+			log.Error("the lease of " + lease.name + " was lost, the job is stopped")
+			lease.cancel()
+			return
+		}
+	}
+}
+
+// releaseLease stops renewing the lease and releases it, so that the job can run again.
+func (s *awsService) releaseLease(lease *heldLease) {
+	lease.cancel()
+	<-lease.done
+
+	err := s.db.ReleaseLease(context.Background(), lease.name, lease.owner)
+	if err != nil {
+		log.Warn("could not release the lease of "+lease.name+": ", err)
+	}
+}
+
+// instanceID names this replica after its host, to tell in the workflow reports which replica
+// runs them. The random suffix tells the runs of a replica apart after a restart.
+func instanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return uuid.NewString()
+	}
+	return hostname + "-" + uuid.NewString()[:8]
+}
@@ -195,6 +195,22 @@ func (mw loggingMiddleware) HandleUpdateCAStatus(ctx context.Context, input *api
 	return mw.next.HandleUpdateCAStatus(ctx, input)
 }
 
+func (mw loggingMiddleware) HandleUpdateThingShadow(ctx context.Context, input *api.HandleUpdateThingShadowInput) (err error) {
+	defer func(begin time.Time) {
+		var logMsg = map[string]interface{}{}
+		logMsg["method"] = "HandleUpdateThingShadow"
+		logMsg["took"] = time.Since(begin)
+		logMsg["input"] = input
+
+		if err == nil {
+			log.WithFields(logMsg).Trace()
+		} else {
+			log.WithFields(logMsg).Error(err)
+		}
+	}(time.Now())
+	return mw.next.HandleUpdateThingShadow(ctx, input)
+}
+
 func (mw loggingMiddleware) HandleCloudEvents(ctx context.Context, event cloudevents.Event) (err error) {
 	defer func(begin time.Time) {
 		msg, _ := json.Marshal(event)
@@ -229,3 +245,307 @@ func (mw loggingMiddleware) GetDefaultRegion() (output string) {
 	}(time.Now())
 	return mw.next.GetDefaultRegion()
 }
+
+func (mw loggingMiddleware) GetDMSAWSSettings(ctx context.Context, input *api.GetDMSAWSSettingsInput) (output *api.GetDMSAWSSettingsOutput, err error) {
+	defer func(begin time.Time) {
+		var logMsg = map[string]interface{}{}
+		logMsg["method"] = "GetDMSAWSSettings"
+		logMsg["took"] = time.Since(begin)
+		logMsg["input"] = input
+
+		if err == nil {
+			log.WithFields(logMsg).Trace(fmt.Sprintf("output: %v", output))
+		} else {
+			log.WithFields(logMsg).Error(err)
+		}
+	}(time.Now())
+	return mw.next.GetDMSAWSSettings(ctx, input)
+}
+
+func (mw loggingMiddleware) UpdateDMSAWSSettings(ctx context.Context, input *api.UpdateDMSAWSSettingsInput) (output *api.UpdateDMSAWSSettingsOutput, err error) {
+	defer func(begin time.Time) {
+		var logMsg = map[string]interface{}{}
+		logMsg["method"] = "UpdateDMSAWSSettings"
+		logMsg["took"] = time.Since(begin)
+		logMsg["input"] = input
+
+		if err == nil {
+			log.WithFields(logMsg).Trace(fmt.Sprintf("output: %v", output))
+		} else {
+			log.WithFields(logMsg).Error(err)
+		}
+	}(time.Now())
+	return mw.next.UpdateDMSAWSSettings(ctx, input)
+}
+
+func (mw loggingMiddleware) MigrateDMSShadows(ctx context.Context, input *api.MigrateDMSShadowsInput) (output *api.MigrateDMSShadowsOutput, err error) {
+	defer func(begin time.Time) {
+		var logMsg = map[string]interface{}{}
+		logMsg["method"] = "MigrateDMSShadows"
+		logMsg["took"] = time.Since(begin)
+		logMsg["input"] = input
+
+		if err == nil {
+			log.WithFields(logMsg).Trace(fmt.Sprintf("output: %v", output))
+		} else {
+			log.WithFields(logMsg).Error(err)
+		}
+	}(time.Now())
+	return mw.next.MigrateDMSShadows(ctx, input)
+}
+
+func (mw loggingMiddleware) GetDMSShadowMigration(ctx context.Context, input *api.GetDMSShadowMigrationInput) (output *api.GetDMSShadowMigrationOutput, err error) {
+	defer func(begin time.Time) {
+		var logMsg = map[string]interface{}{}
+		logMsg["method"] = "GetDMSShadowMigration"
+		logMsg["took"] = time.Since(begin)
+		logMsg["input"] = input
+
+		if err == nil {
+			log.WithFields(logMsg).Trace(fmt.Sprintf("output: %v", output))
+		} else {
+			log.WithFields(logMsg).Error(err)
+		}
+	}(time.Now())
+	return mw.next.GetDMSShadowMigration(ctx, input)
+}
+
+func (mw loggingMiddleware) GetShadowFanOutReports(ctx context.Context, input *api.GetShadowFanOutReportsInput) (output *api.GetShadowFanOutReportsOutput, err error) {
+	defer func(begin time.Time) {
+		var logMsg = map[string]interface{}{}
+		logMsg["method"] = "GetShadowFanOutReports"
+		logMsg["took"] = time.Since(begin)
+		logMsg["input"] = input
+
+		if err == nil {
+			log.WithFields(logMsg).Trace(fmt.Sprintf("output: %v", output))
+		} else {
+			log.WithFields(logMsg).Error(err)
+		}
+	}(time.Now())
+	return mw.next.GetShadowFanOutReports(ctx, input)
+}
+
+func (mw loggingMiddleware) DeleteDMSCABundle(ctx context.Context, input *api.DeleteDMSCABundleInput) (output *api.DeleteDMSCABundleOutput, err error) {
+	defer func(begin time.Time) {
+		var logMsg = map[string]interface{}{}
+		logMsg["method"] = "DeleteDMSCABundle"
+		logMsg["took"] = time.Since(begin)
+		logMsg["input"] = input
+
+		if err == nil {
+			log.WithFields(logMsg).Trace(fmt.Sprintf("output: %v", output))
+		} else {
+			log.WithFields(logMsg).Error(err)
+		}
+	}(time.Now())
+	return mw.next.DeleteDMSCABundle(ctx, input)
+}
+
+func (mw loggingMiddleware) Reconcile(ctx context.Context, input *api.ReconcileInput) (output *api.ReconcileOutput, err error) {
+	defer func(begin time.Time) {
+		var logMsg = map[string]interface{}{}
+		logMsg["method"] = "Reconcile"
+		logMsg["took"] = time.Since(begin)
+		logMsg["input"] = input
+
+		if err == nil {
+			log.WithFields(logMsg).Trace(fmt.Sprintf("output: %v", output))
+		} else {
+			log.WithFields(logMsg).Error(err)
+		}
+	}(time.Now())
+	return mw.next.Reconcile(ctx, input)
+}
+
+func (mw loggingMiddleware) EnforceRevocations(ctx context.Context, input *api.EnforceRevocationsInput) (output *api.EnforceRevocationsOutput, err error) {
+	defer func(begin time.Time) {
+		var logMsg = map[string]interface{}{}
+		logMsg["method"] = "EnforceRevocations"
+		logMsg["took"] = time.Since(begin)
+		logMsg["input"] = input
+
+		if err == nil {
+			log.WithFields(logMsg).Trace(fmt.Sprintf("output: %v", output))
+		} else {
+			log.WithFields(logMsg).Error(err)
+		}
+	}(time.Now())
+	return mw.next.EnforceRevocations(ctx, input)
+}
+
+func (mw loggingMiddleware) MonitorExpiry(ctx context.Context, input *api.MonitorExpiryInput) (output *api.MonitorExpiryOutput, err error) {
+	defer func(begin time.Time) {
+		var logMsg = map[string]interface{}{}
+		logMsg["method"] = "MonitorExpiry"
+		logMsg["took"] = time.Since(begin)
+		logMsg["input"] = input
+
+		if err == nil {
+			log.WithFields(logMsg).Trace(fmt.Sprintf("output: %v", output))
+		} else {
+			log.WithFields(logMsg).Error(err)
+		}
+	}(time.Now())
+	return mw.next.MonitorExpiry(ctx, input)
+}
+
+func (mw loggingMiddleware) SyncDMSThingGroups(ctx context.Context, input *api.SyncDMSThingGroupsInput) (output *api.SyncDMSThingGroupsOutput, err error) {
+	defer func(begin time.Time) {
+		var logMsg = map[string]interface{}{}
+		logMsg["method"] = "SyncDMSThingGroups"
+		logMsg["took"] = time.Since(begin)
+		logMsg["input"] = input
+
+		if err == nil {
+			log.WithFields(logMsg).Trace(fmt.Sprintf("output: %v", output))
+		} else {
+			log.WithFields(logMsg).Error(err)
+		}
+	}(time.Now())
+	return mw.next.SyncDMSThingGroups(ctx, input)
+}
+
+func (mw loggingMiddleware) GetReconciliationReport(ctx context.Context, input *api.GetReconciliationReportInput) (output *api.GetReconciliationReportOutput, err error) {
+	defer func(begin time.Time) {
+		var logMsg = map[string]interface{}{}
+		logMsg["method"] = "GetReconciliationReport"
+		logMsg["took"] = time.Since(begin)
+		logMsg["input"] = input
+
+		if err == nil {
+			log.WithFields(logMsg).Trace(fmt.Sprintf("output: %v", output))
+		} else {
+			log.WithFields(logMsg).Error(err)
+		}
+	}(time.Now())
+	return mw.next.GetReconciliationReport(ctx, input)
+}
+
+func (mw loggingMiddleware) GetDriftReport(ctx context.Context, input *api.GetDriftReportInput) (output *api.GetDriftReportOutput, err error) {
+	defer func(begin time.Time) {
+		var logMsg = map[string]interface{}{}
+		logMsg["method"] = "GetDriftReport"
+		logMsg["took"] = time.Since(begin)
+		logMsg["input"] = input
+
+		if err == nil {
+			log.WithFields(logMsg).Trace(fmt.Sprintf("output: %v", output))
+		} else {
+			log.WithFields(logMsg).Error(err)
+		}
+	}(time.Now())
+	return mw.next.GetDriftReport(ctx, input)
+}
+
+func (mw loggingMiddleware) ImportFleet(ctx context.Context, input *api.ImportFleetInput) (output *api.ImportFleetOutput, err error) {
+	defer func(begin time.Time) {
+		var logMsg = map[string]interface{}{}
+		logMsg["method"] = "ImportFleet"
+		logMsg["took"] = time.Since(begin)
+		logMsg["input"] = input
+
+		if err == nil {
+			log.WithFields(logMsg).Trace(fmt.Sprintf("output: %v", output))
+		} else {
+			log.WithFields(logMsg).Error(err)
+		}
+	}(time.Now())
+	return mw.next.ImportFleet(ctx, input)
+}
+
+func (mw loggingMiddleware) GetFleetImport(ctx context.Context, input *api.GetFleetImportInput) (output *api.GetFleetImportOutput, err error) {
+	defer func(begin time.Time) {
+		var logMsg = map[string]interface{}{}
+		logMsg["method"] = "GetFleetImport"
+		logMsg["took"] = time.Since(begin)
+		logMsg["input"] = input
+
+		if err == nil {
+			log.WithFields(logMsg).Trace(fmt.Sprintf("output: %v", output))
+		} else {
+			log.WithFields(logMsg).Error(err)
+		}
+	}(time.Now())
+	return mw.next.GetFleetImport(ctx, input)
+}
+
+func (mw loggingMiddleware) GetFleetImports(ctx context.Context, input *api.GetFleetImportsInput) (output *api.GetFleetImportsOutput, err error) {
+	defer func(begin time.Time) {
+		var logMsg = map[string]interface{}{}
+		logMsg["method"] = "GetFleetImports"
+		logMsg["took"] = time.Since(begin)
+		logMsg["input"] = input
+
+		if err == nil {
+			log.WithFields(logMsg).Trace(fmt.Sprintf("output: %v", output))
+		} else {
+			log.WithFields(logMsg).Error(err)
+		}
+	}(time.Now())
+	return mw.next.GetFleetImports(ctx, input)
+}
+
+func (mw loggingMiddleware) GetOutboxEntries(ctx context.Context, input *api.GetOutboxEntriesInput) (output *api.GetOutboxEntriesOutput, err error) {
+	defer func(begin time.Time) {
+		var logMsg = map[string]interface{}{}
+		logMsg["method"] = "GetOutboxEntries"
+		logMsg["took"] = time.Since(begin)
+		logMsg["input"] = input
+
+		if err == nil {
+			log.WithFields(logMsg).Trace(fmt.Sprintf("output: %v", output))
+		} else {
+			log.WithFields(logMsg).Error(err)
+		}
+	}(time.Now())
+	return mw.next.GetOutboxEntries(ctx, input)
+}
+
+func (mw loggingMiddleware) RetryOutboxEntry(ctx context.Context, input *api.RetryOutboxEntryInput) (output *api.RetryOutboxEntryOutput, err error) {
+	defer func(begin time.Time) {
+		var logMsg = map[string]interface{}{}
+		logMsg["method"] = "RetryOutboxEntry"
+		logMsg["took"] = time.Since(begin)
+		logMsg["input"] = input
+
+		if err == nil {
+			log.WithFields(logMsg).Trace(fmt.Sprintf("output: %v", output))
+		} else {
+			log.WithFields(logMsg).Error(err)
+		}
+	}(time.Now())
+	return mw.next.RetryOutboxEntry(ctx, input)
+}
+
+func (mw loggingMiddleware) DeleteOutboxEntry(ctx context.Context, input *api.DeleteOutboxEntryInput) (output *api.DeleteOutboxEntryOutput, err error) {
+	defer func(begin time.Time) {
+		var logMsg = map[string]interface{}{}
+		logMsg["method"] = "DeleteOutboxEntry"
+		logMsg["took"] = time.Since(begin)
+		logMsg["input"] = input
+
+		if err == nil {
+			log.WithFields(logMsg).Trace(fmt.Sprintf("output: %v", output))
+		} else {
+			log.WithFields(logMsg).Error(err)
+		}
+	}(time.Now())
+	return mw.next.DeleteOutboxEntry(ctx, input)
+}
+
+func (mw loggingMiddleware) TestEventRouting(ctx context.Context, input *api.TestEventRoutingInput) (output *api.TestEventRoutingOutput, err error) {
+	defer func(begin time.Time) {
+		var logMsg = map[string]interface{}{}
+		logMsg["method"] = "TestEventRouting"
+		logMsg["took"] = time.Since(begin)
+		logMsg["input"] = input
+
+		if err == nil {
+			log.WithFields(logMsg).Trace(fmt.Sprintf("output: %v", output))
+		} else {
+			log.WithFields(logMsg).Error(err)
+		}
+	}(time.Now())
+	return mw.next.TestEventRouting(ctx, input)
+}
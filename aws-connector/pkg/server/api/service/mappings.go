@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsIot "github.com/aws/aws-sdk-go/service/iot"
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// updateMappedCertificateStatus updates the status of a certificate whose AWS certificate is
+// known. It reports false when the certificate has to be looked up in AWS instead.
+func (s *awsService) updateMappedCertificateStatus(ctx context.Context, caName string, serialNumber string, status string) (bool, error) {
+	mapping, err := s.db.GetCertificateMapping(ctx, caName, serialNumber)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error reading the AWS certificate of %s/%s: ", caName, serialNumber), err)
+		return false, nil
+	}
+	if mapping == nil {
+		return false, nil
+	}
+
+	_, err = s.awsIotSvc.UpdateCertificateWithContext(ctx, &awsIot.UpdateCertificateInput{
+		CertificateId: aws.String(mapping.AWSCertificateID),
+		NewStatus:     aws.String(status),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == awsIot.ErrCodeResourceNotFoundException {
+			// The certificate was deleted from AWS, forget it and look it up again.
+			err = s.db.DeleteCertificateMapping(ctx, caName, serialNumber)
+			if err != nil {
+				log.Warn(fmt.Sprintf("Error deleting the AWS certificate of %s/%s: ", caName, serialNumber), err)
+			}
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *awsService) storeCertificateMapping(ctx context.Context, mapping api.CertificateMapping) {
+	err := s.db.UpdateCertificateMapping(ctx, mapping)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error storing the AWS certificate of %s/%s: ", mapping.CAName, mapping.SerialNumber), err)
+	}
+}
+
+// resumeWorkflows keeps picking up the workflows left behind by a replica that stopped, which
+// are the running workflows whose lease is free. Shadow migrations are resumed, they can
+// safely migrate a device twice. Fleet imports are marked as failed and can be run again.
+func (s *awsService) resumeWorkflows(ctx context.Context) {
+	ticker := time.NewTicker(workflowResumeInterval)
+	defer ticker.Stop()
+
+	for {
+		s.resumeShadowMigrations(ctx)
+		s.failInterruptedFleetImports(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *awsService) resumeShadowMigrations(ctx context.Context) {
+	migrations, err := s.db.ListDMSShadowMigrations(ctx)
+	if err != nil {
+		log.Warn("Error listing the shadow migrations: ", err)
+	}
+	for _, migration := range migrations {
+		if migration.Status != api.ShadowMigrationStatusRunning {
+			continue
+		}
+
+		lease, err := s.acquireLease(ctx, shadowMigrationLease(migration.DMSName))
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error acquiring the shadow migration of DMS %s: ", migration.DMSName), err)
+			continue
+		}
+		if lease == nil {
+			continue
+		}
+
+		// The migration may have finished before the lease was acquired.
+		current, err := s.db.GetDMSShadowMigration(ctx, migration.DMSName)
+		if err != nil || current == nil || current.Status != api.ShadowMigrationStatusRunning {
+			s.releaseLease(lease)
+			continue
+		}
+
+		log.Info(fmt.Sprintf("resuming the interrupted shadow migration of DMS %s", current.DMSName))
+		current.FailedDevices = []string{}
+		current.MigratedDevices = 0
+		current.Owner = s.instanceID
+		go func(migration api.ShadowMigration) {
+			defer s.releaseLease(lease)
+			_, err := s.runShadowMigration(lease.ctx, migration, nil)
+			if err != nil {
+				log.Error("Error resuming the shadow migration: ", err)
+			}
+		}(*current)
+	}
+}
+
+func (s *awsService) failInterruptedFleetImports(ctx context.Context) {
+	// The running imports are interrupted when no replica holds the import lease.
+	lease, err := s.acquireLease(ctx, fleetImportLease)
+	if err != nil {
+		log.Warn("Error acquiring the fleet import lease: ", err)
+		return
+	}
+	if lease == nil {
+		return
+	}
+	defer s.releaseLease(lease)
+
+	imports, err := s.db.GetFleetImports(ctx)
+	if err != nil {
+		log.Warn("Error listing the fleet imports: ", err)
+	}
+	for _, report := range imports {
+		if report.Status != api.FleetImportStatusRunning {
+			continue
+		}
+
+		now := time.Now()
+		report.Status = api.FleetImportStatusFailed
+		report.Error = "interrupted by a stop of the connector"
+		report.FinishedAt = &now
+		s.saveFleetImport(ctx, report)
+	}
+}
@@ -2,6 +2,8 @@ package service
 
 import (
 	"time"
+
+	api "github.com/lamassuiot/aws-connector/pkg/common"
 )
 
 //-------------
@@ -32,8 +34,19 @@ type AWSCAConfiguration struct {
 //-------------
 
 type AWSThingConfig struct {
-	Certificates   []AWSThingCertificate `json:"certificates"`
-	LastConnection int                   `json:"last_connection"`
+	Certificates     []AWSThingCertificate        `json:"certificates"`
+	LastConnection   int                          `json:"last_connection"`
+	CompletedActions []api.ShadowActionCompletion `json:"completed_actions"`
+	Jobs             []AWSThingJobExecution       `json:"jobs"`
+}
+
+type AWSThingJobExecution struct {
+	JobID         string           `json:"job_id"`
+	Action        api.ShadowAction `json:"action"`
+	Status        string           `json:"status"`
+	QueuedAt      *time.Time       `json:"queued_at,omitempty"`
+	StartedAt     *time.Time       `json:"started_at,omitempty"`
+	LastUpdatedAt *time.Time       `json:"last_updated_at,omitempty"`
 }
 
 type AWSThingCertificate struct {
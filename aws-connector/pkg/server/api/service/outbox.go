@@ -0,0 +1,342 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awsIotData "github.com/aws/aws-sdk-go/service/iotdataplane"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	"github.com/lamassuiot/aws-connector/pkg/server/api/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// outboxPollInterval is how often the dispatcher looks for entries to retry, or added by
+// other replicas sharing the store.
+const outboxPollInterval = 5 * time.Second
+
+// The delay between the attempts to deliver an entry doubles up to outboxMaxBackoff.
+const (
+	outboxMinBackoff = time.Second
+	outboxMaxBackoff = 5 * time.Minute
+)
+
+// outboxMessageGroupID is the message group of the events sent to a FIFO queue. A single
+// group keeps every event in order.
+const outboxMessageGroupID = "lamassu-events"
+
+func (s *awsService) GetOutboxEntries(ctx context.Context, input *api.GetOutboxEntriesInput) (*api.GetOutboxEntriesOutput, error) {
+	if input.Status != "" && input.Status != api.OutboxEntryStatusPending && input.Status != api.OutboxEntryStatusFailed {
+		return &api.GetOutboxEntriesOutput{}, &errors.ValidationError{
+			Msg: fmt.Sprintf("status must be %s or %s", api.OutboxEntryStatusPending, api.OutboxEntryStatusFailed),
+		}
+	}
+
+	entries, err := s.db.ListOutboxEntries(ctx)
+	if err != nil {
+		return &api.GetOutboxEntriesOutput{}, err
+	}
+
+	filtered := []api.OutboxEntry{}
+	for _, entry := range entries {
+		if input.Status == "" || entry.Status == input.Status {
+			filtered = append(filtered, entry)
+		}
+	}
+
+	return &api.GetOutboxEntriesOutput{
+		Entries: filtered,
+	}, nil
+}
+
+func (s *awsService) RetryOutboxEntry(ctx context.Context, input *api.RetryOutboxEntryInput) (*api.RetryOutboxEntryOutput, error) {
+	entry, lease, err := s.lockOutboxEntry(ctx, input.ID)
+	if err != nil {
+		return &api.RetryOutboxEntryOutput{}, err
+	}
+	defer s.releaseLease(lease)
+
+	entry.Status = api.OutboxEntryStatusPending
+	entry.Attempts = 0
+	entry.NextAttemptAt = time.Now()
+	err = s.db.UpdateOutboxEntry(ctx, *entry)
+	if err != nil {
+		return &api.RetryOutboxEntryOutput{}, err
+	}
+
+	s.wakeOutboxDispatcher()
+
+	return &api.RetryOutboxEntryOutput{
+		OutboxEntry: *entry,
+	}, nil
+}
+
+func (s *awsService) DeleteOutboxEntry(ctx context.Context, input *api.DeleteOutboxEntryInput) (*api.DeleteOutboxEntryOutput, error) {
+	entry, lease, err := s.lockOutboxEntry(ctx, input.ID)
+	if err != nil {
+		return &api.DeleteOutboxEntryOutput{}, err
+	}
+	defer s.releaseLease(lease)
+
+	err = s.db.DeleteOutboxEntry(ctx, entry.ID)
+	if err != nil {
+		return &api.DeleteOutboxEntryOutput{}, err
+	}
+	log.Warn(fmt.Sprintf("outbox entry %d of event %s was deleted without being delivered", entry.ID, entry.EventID))
+
+	// The entries held back by the deleted one can be delivered.
+	s.wakeOutboxDispatcher()
+
+	return &api.DeleteOutboxEntryOutput{
+		OutboxEntry: *entry,
+	}, nil
+}
+
+// lockOutboxEntry returns an outbox entry holding the lease of its destination, so that the
+// entry is not changed while a dispatcher may be delivering it. The lease must be released.
+func (s *awsService) lockOutboxEntry(ctx context.Context, id uint64) (*api.OutboxEntry, *heldLease, error) {
+	entry, err := s.db.GetOutboxEntry(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if entry == nil {
+		return nil, nil, &errors.ResourceNotFoundError{
+			ResourceType: "OutboxEntry",
+			ResourceId:   strconv.FormatUint(id, 10),
+		}
+	}
+
+	lease, err := s.waitLease(ctx, outboxLease(entry.Destination))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The entry may have been delivered while waiting.
+	entry, err = s.db.GetOutboxEntry(ctx, id)
+	if err == nil && entry == nil {
+		err = &errors.ResourceNotFoundError{
+			ResourceType: "OutboxEntry",
+			ResourceId:   strconv.FormatUint(id, 10),
+		}
+	}
+	if err != nil {
+		s.releaseLease(lease)
+		return nil, nil, err
+	}
+
+	return entry, lease, nil
+}
+
+func (s *awsService) TestEventRouting(ctx context.Context, input *api.TestEventRoutingInput) (*api.TestEventRoutingOutput, error) {
+	return &api.TestEventRoutingOutput{
+		EventRoute: api.RouteEvent(s.eventRoutingRules, input.Type, input.Source, input.Data),
+	}, nil
+}
+
+// enqueueOutboundEvent stores an event in the outbox, from which the dispatcher delivers it
+// to destination.
+func (s *awsService) enqueueOutboundEvent(ctx context.Context, event cloudevents.Event, destination api.EventDestination) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if s.isDryRun(ctx) {
+		// Nothing is stored in dry run: the delivery is planned right away.
+		return s.deliverOutboundEvent(ctx, destination, payload)
+	}
+
+	now := time.Now()
+	_, err = s.db.AddOutboxEntry(ctx, api.OutboxEntry{
+		EventID:       event.ID(),
+		EventType:     event.Type(),
+		Destination:   destination,
+		Payload:       payload,
+		Status:        api.OutboxEntryStatusPending,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.wakeOutboxDispatcher()
+	return nil
+}
+
+func (s *awsService) wakeOutboxDispatcher() {
+	select {
+	case s.outboxWakeUp <- struct{}{}:
+	default:
+	}
+}
+
+func (s *awsService) deliverOutboundEvent(ctx context.Context, destination api.EventDestination, payload []byte) error {
+	switch destination.Type {
+	// Entries stored before destinations were introduced have none.
+	case api.EventDestinationSQS, "":
+		queueURL := s.sqsQueueURL(destination.Target)
+		input := &sqs.SendMessageInput{
+			MessageBody: aws.String(string(payload)),
+			QueueUrl:    aws.String(queueURL),
+		}
+
+		// FIFO queues keep the events in order and drop the redelivered ones. The Lamassu event
+		// IDs are not unique, so the deduplication ID is a hash of the whole event, which the
+		// attempts to deliver an entry share.
+		if strings.HasSuffix(queueURL, ".fifo") {
+			hash := sha256.Sum256(payload)
+			input.MessageGroupId = aws.String(outboxMessageGroupID)
+			input.MessageDeduplicationId = aws.String(hex.EncodeToString(hash[:]))
+		}
+
+		_, err := s.sqsSvc.SendMessageWithContext(ctx, input)
+		return err
+	case api.EventDestinationIoTTopic:
+		_, err := s.awsIotData.PublishWithContext(ctx, &awsIotData.PublishInput{
+			Topic:   aws.String(destination.Target),
+			Qos:     aws.Int64(1),
+			Payload: payload,
+		})
+		return err
+	default:
+		return fmt.Errorf("unknown destination type %s", destination.Type)
+	}
+}
+
+// sqsQueueURL returns the URL of a queue of the account given its name or URL, or the URL of
+// the outbound queue.
+func (s *awsService) sqsQueueURL(queue string) string {
+	if queue == "" {
+		return s.sqsOutboundURL
+	}
+	if strings.HasPrefix(queue, "https://") {
+		return queue
+	}
+	return "https://sqs." + s.accountDefaultRegion + ".amazonaws.com/" + s.accountID + "/" + queue
+}
+
+// dispatchOutbox delivers the outbox entries until ctx is done. It is woken up when an entry
+// is added or retried, and polls the outbox for the entries due for a new attempt.
+func (s *awsService) dispatchOutbox(ctx context.Context) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		s.dispatchOutboxEntries(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.outboxWakeUp:
+		}
+	}
+}
+
+// dispatchOutboxEntries delivers the pending entries of every destination. The destinations
+// are delivered concurrently, so that one that fails does not hold the others back.
+func (s *awsService) dispatchOutboxEntries(ctx context.Context) {
+	entries, err := s.db.ListOutboxEntries(ctx)
+	if err != nil {
+		log.Warn("Error listing the outbox entries: ", err)
+		return
+	}
+
+	destinations := map[string]api.EventDestination{}
+	for _, entry := range entries {
+		destinations[outboxLease(entry.Destination)] = entry.Destination
+	}
+
+	var wg sync.WaitGroup
+	for _, destination := range destinations {
+		wg.Add(1)
+		go func(destination api.EventDestination) {
+			defer wg.Done()
+			s.dispatchDestinationEntries(ctx, destination)
+		}(destination)
+	}
+	wg.Wait()
+}
+
+// dispatchDestinationEntries delivers the pending entries of a destination in order. It stops
+// at the first entry that cannot be delivered, so that no event overtakes it. Entries that run
+// out of attempts are marked as failed and keep holding the others back until they are retried
+// or deleted.
+func (s *awsService) dispatchDestinationEntries(ctx context.Context, destination api.EventDestination) {
+	// The replicas sharing the outbox take turns to deliver a destination, so that each entry
+	// is delivered by one of them and in order.
+	lease, err := s.acquireLease(ctx, outboxLease(destination))
+	if err != nil {
+		log.Warn("Error acquiring the outbox lease: ", err)
+		return
+	}
+	if lease == nil {
+		return
+	}
+	defer s.releaseLease(lease)
+	ctx = lease.ctx
+
+	// The entries are listed again under the lease, another replica may have delivered some.
+	entries, err := s.db.ListOutboxEntries(ctx)
+	if err != nil {
+		log.Warn("Error listing the outbox entries: ", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if outboxLease(entry.Destination) != lease.name {
+			continue
+		}
+		if entry.Status != api.OutboxEntryStatusPending || time.Now().Before(entry.NextAttemptAt) {
+			return
+		}
+
+		err = s.deliverOutboundEvent(ctx, entry.Destination, entry.Payload)
+		if err == nil {
+			err = s.db.DeleteOutboxEntry(ctx, entry.ID)
+			if err != nil {
+				// The entry will be delivered again, which at-least-once consumers tolerate.
+				log.Warn(fmt.Sprintf("Error removing the delivered outbox entry %d: ", entry.ID), err)
+				return
+			}
+			continue
+		}
+
+		entry.Attempts++
+		entry.LastError = err.Error()
+		if entry.Attempts >= s.outboxMaxAttempts {
+			entry.Status = api.OutboxEntryStatusFailed
+			log.Error(fmt.Sprintf("Giving up delivering event %s after %d attempts, the following events of its destination wait until it is retried or deleted: ", entry.EventID, entry.Attempts), err)
+		} else {
+			entry.NextAttemptAt = time.Now().Add(outboxBackoff(entry.Attempts))
+			log.Warn(fmt.Sprintf("Error delivering event %s, retrying at %s: ", entry.EventID, entry.NextAttemptAt.Format(time.RFC3339)), err)
+		}
+
+		err = s.db.UpdateOutboxEntry(ctx, entry)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error updating the outbox entry %d: ", entry.ID), err)
+		}
+		return
+	}
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxMinBackoff
+	for i := 1; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > outboxMaxBackoff {
+		return outboxMaxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,797 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsIot "github.com/aws/aws-sdk-go/service/iot"
+	awsIotData "github.com/aws/aws-sdk-go/service/iotdataplane"
+	"github.com/google/uuid"
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	"github.com/lamassuiot/aws-connector/pkg/server/api/errors"
+	caApi "github.com/lamassuiot/lamassuiot/pkg/ca/common/api"
+	cProvderApi "github.com/lamassuiot/lamassuiot/pkg/cloud-provider/common/api"
+	devApi "github.com/lamassuiot/lamassuiot/pkg/device-manager/common/api"
+	dmsApi "github.com/lamassuiot/lamassuiot/pkg/dms-manager/common/api"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+)
+
+// reconciliation holds the state of a single reconciler run.
+type reconciliation struct {
+	dryRun bool
+	// reportOnly only collects the drifts, for the drift report: they are neither
+	// corrected, logged nor counted.
+	reportOnly bool
+	report     api.ReconciliationReport
+}
+
+// awsLamassuCA is an AWS CA certificate registered by the connector for a Lamassu CA.
+type awsLamassuCA struct {
+	lamassuCAName string
+	certificateID string
+	status        string
+}
+
+func (s *awsService) Reconcile(ctx context.Context, input *api.ReconcileInput) (*api.ReconcileOutput, error) {
+	lease, err := s.acquireLease(ctx, reconcilerLease)
+	if err != nil {
+		return &api.ReconcileOutput{}, err
+	}
+	if lease == nil {
+		return &api.ReconcileOutput{}, &errors.GenericError{
+			Message:    "a reconciliation is already running",
+			StatusCode: 409,
+		}
+	}
+	defer s.releaseLease(lease)
+	ctx = lease.ctx
+
+	dryRun := input.DryRun || s.isDryRun(ctx)
+	r := &reconciliation{
+		dryRun: dryRun,
+		report: api.ReconciliationReport{
+			ID:        uuid.NewString(),
+			DryRun:    dryRun,
+			StartedAt: time.Now(),
+			Drifts:    []api.Drift{},
+			Errors:    []string{},
+		},
+	}
+
+	s.detectDrifts(ctx, r)
+
+	now := time.Now()
+	r.report.FinishedAt = &now
+	log.Info(fmt.Sprintf("reconciliation %s finished: %d drifts found, %d checks failed", r.report.ID, len(r.report.Drifts), len(r.report.Errors)))
+	metrics.SetGaugeWithLabels([]string{"reconciler", "drifts"}, float32(len(r.report.Drifts)), []metrics.Label{{Name: "dry_run", Value: fmt.Sprint(r.dryRun)}})
+
+	if !r.dryRun {
+		err := s.db.UpdateReconciliationReport(ctx, r.report)
+		if err != nil {
+			log.Warn("could not store the reconciliation report: ", err)
+		}
+	}
+
+	return &api.ReconcileOutput{
+		ReconciliationReport: r.report,
+	}, nil
+}
+
+func (s *awsService) GetReconciliationReport(ctx context.Context, input *api.GetReconciliationReportInput) (*api.GetReconciliationReportOutput, error) {
+	report, err := s.db.GetReconciliationReport(ctx)
+	if err != nil {
+		return &api.GetReconciliationReportOutput{}, err
+	}
+	if report == nil {
+		return &api.GetReconciliationReportOutput{}, &errors.ResourceNotFoundError{
+			ResourceType: "ReconciliationReport",
+			ResourceId:   "latest",
+		}
+	}
+
+	return &api.GetReconciliationReportOutput{
+		ReconciliationReport: *report,
+	}, nil
+}
+
+// detectDrifts runs every check of the reconciler, handling the drifts as they are found.
+func (s *awsService) detectDrifts(ctx context.Context, r *reconciliation) {
+	awsCAs, err := s.listAWSLamassuCAs(ctx)
+	if err != nil {
+		r.fail("list AWS CA certificates", err)
+	} else {
+		s.reconcileCAs(ctx, r, awsCAs)
+		for _, awsCA := range awsCAs {
+			s.reconcileProvisioning(ctx, r, awsCA)
+		}
+	}
+
+	s.reconcileCABundles(ctx, r)
+	s.reconcileThings(ctx, r)
+}
+
+func (r *reconciliation) fail(check string, err error) {
+	if r.reportOnly {
+		log.Warn(fmt.Sprintf("drift report could not %s: ", check), err)
+	} else {
+		log.Warn(fmt.Sprintf("reconciler could not %s: ", check), err)
+	}
+	r.report.Errors = append(r.report.Errors, fmt.Sprintf("could not %s: %s", check, err))
+}
+
+// handleDrift applies the configured rule to a drift. Every drift is logged and counted,
+// whether it is corrected or only reported. converge is nil for the kinds that can only be
+// reported.
+func (s *awsService) handleDrift(ctx context.Context, r *reconciliation, drift api.Drift, converge func(ctx context.Context) error) {
+	if r.reportOnly {
+		r.report.Drifts = append(r.report.Drifts, drift)
+		return
+	}
+
+	drift.Action = s.reconcileRules[drift.Kind]
+	if drift.Action == "" {
+		drift.Action = api.ReconcileActionReport
+	}
+
+	result := "reported"
+	if drift.Action == api.ReconcileActionConverge && converge != nil && !r.dryRun {
+		err := converge(ctx)
+		if err != nil {
+			drift.Error = err.Error()
+			result = "failed"
+		} else {
+			drift.Corrected = true
+			result = "corrected"
+		}
+	}
+
+	logEntry := log.WithFields(log.Fields{
+		"kind":     drift.Kind,
+		"resource": drift.Resource,
+		"action":   drift.Action,
+		"result":   result,
+		"dry_run":  r.dryRun,
+	})
+	if drift.Error != "" {
+		logEntry.Error(drift.Detail, ": ", drift.Error)
+	} else {
+		logEntry.Warn(drift.Detail)
+	}
+
+	metrics.IncrCounterWithLabels([]string{"reconciler", "drift"}, 1, []metrics.Label{
+		{Name: "kind", Value: string(drift.Kind)},
+		{Name: "result", Value: result},
+	})
+
+	r.report.Drifts = append(r.report.Drifts, drift)
+}
+
+func (s *awsService) listAWSLamassuCAs(ctx context.Context) ([]awsLamassuCA, error) {
+	cas := []awsLamassuCA{}
+	var tagErr error
+
+	err := s.awsIotSvc.ListCACertificatesPagesWithContext(ctx, &awsIot.ListCACertificatesInput{}, func(page *awsIot.ListCACertificatesOutput, lastPage bool) bool {
+		for _, ca := range page.Certificates {
+			tagsResponse, err := s.awsIotSvc.ListTagsForResourceWithContext(ctx, &awsIot.ListTagsForResourceInput{
+				ResourceArn: ca.CertificateArn,
+			})
+			if err != nil {
+				tagErr = err
+				return false
+			}
+
+			nameTagIdx := slices.IndexFunc(tagsResponse.Tags, func(tag *awsIot.Tag) bool {
+				return aws.StringValue(tag.Key) == "lamassuCAName"
+			})
+			if nameTagIdx == -1 {
+				continue
+			}
+
+			cas = append(cas, awsLamassuCA{
+				lamassuCAName: aws.StringValue(tagsResponse.Tags[nameTagIdx].Value),
+				certificateID: aws.StringValue(ca.CertificateId),
+				status:        aws.StringValue(ca.Status),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return cas, err
+	}
+
+	return cas, tagErr
+}
+
+func (s *awsService) reconcileCAs(ctx context.Context, r *reconciliation, awsCAs []awsLamassuCA) {
+	lamassuCAs := map[string]caApi.CACertificate{}
+	_, err := s.lamassuCAClient.IterateCAsWithPredicate(ctx, &caApi.IterateCAsWithPredicateInput{
+		CAType: caApi.CATypePKI,
+		PredicateFunc: func(c *caApi.CACertificate) {
+			lamassuCAs[c.CAName] = *c
+		},
+	})
+	if err != nil {
+		r.fail("list Lamassu CAs", err)
+		return
+	}
+
+	registered := map[string]bool{}
+	for _, awsCA := range awsCAs {
+		registered[awsCA.lamassuCAName] = true
+
+		lamassuCA, ok := lamassuCAs[awsCA.lamassuCAName]
+		if !ok {
+			if awsCA.status == awsIot.CACertificateStatusActive {
+				s.handleDrift(ctx, r, api.Drift{
+					Kind:     api.DriftCAMissingInLamassu,
+					Resource: awsCA.certificateID,
+					AWSState: awsCA.status,
+					Detail:   fmt.Sprintf("AWS CA %s is registered for Lamassu CA %s, which does not exist", awsCA.certificateID, awsCA.lamassuCAName),
+				}, func(ctx context.Context) error {
+					return s.setAWSCAStatus(ctx, awsCA.certificateID, awsIot.CACertificateStatusInactive)
+				})
+			}
+			if !r.reportOnly && !r.dryRun {
+				s.clearFlaggedCADrifts(ctx, awsCA.lamassuCAName, nil)
+			}
+			continue
+		}
+
+		drift := caStatusDrift(awsCA.lamassuCAName, lamassuCA.Status, awsCA.status)
+		if drift != nil {
+			status := awsIot.CACertificateStatusActive
+			if drift.Kind == api.DriftCAStatus {
+				status = awsIot.CACertificateStatusInactive
+			}
+			s.handleDrift(ctx, r, *drift, func(ctx context.Context) error {
+				return s.setAWSCAStatus(ctx, awsCA.certificateID, status)
+			})
+		}
+		if !r.reportOnly && !r.dryRun {
+			s.clearFlaggedCADrifts(ctx, awsCA.lamassuCAName, drift)
+		}
+
+		s.reconcileCertificates(ctx, r, awsCA)
+	}
+
+	for name, lamassuCA := range lamassuCAs {
+		if registered[name] || (lamassuCA.Status != caApi.StatusActive && lamassuCA.Status != caApi.StatusAboutToExpire) {
+			continue
+		}
+		s.handleDrift(ctx, r, api.Drift{
+			Kind:         api.DriftCAMissingInAWS,
+			Resource:     name,
+			LamassuState: string(lamassuCA.Status),
+			Detail:       fmt.Sprintf("Lamassu CA %s is not registered in AWS", name),
+		}, nil)
+	}
+}
+
+// caStatusDrift returns the drift between the status of a Lamassu CA and the status of its
+// AWS CA, or nil when they match.
+func caStatusDrift(caName string, lamassuStatus caApi.CertificateStatus, awsStatus string) *api.Drift {
+	lamassuActive := lamassuStatus == caApi.StatusActive || lamassuStatus == caApi.StatusAboutToExpire
+	switch {
+	case !lamassuActive && awsStatus == awsIot.CACertificateStatusActive:
+		return &api.Drift{
+			Kind:         api.DriftCAStatus,
+			Resource:     caName,
+			LamassuState: string(lamassuStatus),
+			AWSState:     awsStatus,
+			Detail:       fmt.Sprintf("Lamassu CA %s is %s but active in AWS", caName, lamassuStatus),
+		}
+	case lamassuActive && awsStatus == awsIot.CACertificateStatusInactive:
+		return &api.Drift{
+			Kind:         api.DriftCAInactiveInAWS,
+			Resource:     caName,
+			LamassuState: string(lamassuStatus),
+			AWSState:     awsStatus,
+			Detail:       fmt.Sprintf("Lamassu CA %s is %s but inactive in AWS", caName, lamassuStatus),
+		}
+	default:
+		return nil
+	}
+}
+
+func (s *awsService) setAWSCAStatus(ctx context.Context, certificateID string, status string) error {
+	_, err := s.awsIotSvc.UpdateCACertificateWithContext(ctx, &awsIot.UpdateCACertificateInput{
+		CertificateId: aws.String(certificateID),
+		NewStatus:     aws.String(status),
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.invalidateConfigurationCache(ctx)
+}
+
+// reconcileCertificates compares the certificates issued by a Lamassu CA with the ones
+// registered in AWS under its CA. AWS certificate IDs are the SHA-256 fingerprint of the
+// certificate, which is used to match both sides.
+func (s *awsService) reconcileCertificates(ctx context.Context, r *reconciliation, awsCA awsLamassuCA) {
+	lamassuCertificates := map[string]caApi.Certificate{}
+	_, err := s.lamassuCAClient.IterateCertificatesWithPredicate(ctx, &caApi.IterateCertificatesWithPredicateInput{
+		CAType: caApi.CATypePKI,
+		CAName: awsCA.lamassuCAName,
+		PredicateFunc: func(c *caApi.Certificate) {
+			if c.Certificate == nil {
+				return
+			}
+			fingerprint := sha256.Sum256(c.Certificate.Raw)
+			lamassuCertificates[hex.EncodeToString(fingerprint[:])] = *c
+		},
+	})
+	if err != nil {
+		r.fail(fmt.Sprintf("list the certificates of Lamassu CA %s", awsCA.lamassuCAName), err)
+		return
+	}
+
+	awsCertificates := []*awsIot.Certificate{}
+	err = s.awsIotSvc.ListCertificatesByCAPagesWithContext(ctx, &awsIot.ListCertificatesByCAInput{
+		CaCertificateId: aws.String(awsCA.certificateID),
+	}, func(page *awsIot.ListCertificatesByCAOutput, lastPage bool) bool {
+		awsCertificates = append(awsCertificates, page.Certificates...)
+		return true
+	})
+	if err != nil {
+		r.fail(fmt.Sprintf("list the AWS certificates of CA %s", awsCA.certificateID), err)
+		return
+	}
+
+	for _, awsCertificate := range awsCertificates {
+		certificateID := aws.StringValue(awsCertificate.CertificateId)
+		certificateArn := aws.StringValue(awsCertificate.CertificateArn)
+		status := aws.StringValue(awsCertificate.Status)
+
+		lamassuCertificate, ok := lamassuCertificates[certificateID]
+		var statusDrift *api.Drift
+		if ok {
+			statusDrift = certificateStatusDrift(awsCA.lamassuCAName, lamassuCertificate, status)
+		}
+		switch {
+		case !ok:
+			if status == awsIot.CertificateStatusActive {
+				s.handleDrift(ctx, r, api.Drift{
+					Kind:     api.DriftCertificateMissingInLamassu,
+					Resource: certificateID,
+					AWSState: status,
+					Detail:   fmt.Sprintf("AWS certificate %s was issued by Lamassu CA %s, which does not know it", certificateID, awsCA.lamassuCAName),
+				}, func(ctx context.Context) error {
+					return s.setAWSCertificateStatus(ctx, certificateID, awsIot.CertificateStatusInactive)
+				})
+			}
+
+		case statusDrift != nil:
+			s.handleDrift(ctx, r, *statusDrift, func(ctx context.Context) error {
+				err := s.revokeAWSCertificate(ctx, awsCA.lamassuCAName, lamassuCertificate.SerialNumber, awsCertificate)
+				if err == nil {
+					status = awsIot.CertificateStatusRevoked
+				}
+				return err
+			})
+
+		case lamassuCertificate.Status != caApi.StatusRevoked && status == awsIot.CertificateStatusRevoked:
+			s.handleDrift(ctx, r, api.Drift{
+				Kind:         api.DriftCertificateRevokedInAWS,
+				Resource:     lamassuCertificate.SerialNumber,
+				LamassuState: string(lamassuCertificate.Status),
+				AWSState:     status,
+				Detail:       fmt.Sprintf("certificate %s of CA %s was revoked in AWS but is %s in Lamassu", lamassuCertificate.SerialNumber, awsCA.lamassuCAName, lamassuCertificate.Status),
+			}, func(ctx context.Context) error {
+				return s.HandleUpdateCertificateStatus(ctx, &api.HandleUpdateCertificateStatusInput{
+					CaName:       awsCA.lamassuCAName,
+					SerialNumber: lamassuCertificate.SerialNumber,
+					Status:       "REVOKED",
+				})
+			})
+
+		// Lamassu may not have marked an expired certificate yet, which the expiry monitor
+		// deactivates in AWS: it is not reactivated.
+		case (lamassuCertificate.Status == caApi.StatusActive || lamassuCertificate.Status == caApi.StatusAboutToExpire) && status == awsIot.CertificateStatusInactive && time.Now().Before(lamassuCertificate.Certificate.NotAfter):
+			s.handleDrift(ctx, r, api.Drift{
+				Kind:         api.DriftCertificateInactiveInAWS,
+				Resource:     lamassuCertificate.SerialNumber,
+				LamassuState: string(lamassuCertificate.Status),
+				AWSState:     status,
+				Detail:       fmt.Sprintf("certificate %s of CA %s is %s in Lamassu but inactive in AWS", lamassuCertificate.SerialNumber, awsCA.lamassuCAName, lamassuCertificate.Status),
+			}, func(ctx context.Context) error {
+				return s.setAWSCertificateStatus(ctx, certificateID, awsIot.CertificateStatusActive)
+			})
+		}
+
+		if status == awsIot.CertificateStatusRevoked {
+			s.reconcileRevokedCertificateThings(ctx, r, certificateID, certificateArn)
+		}
+	}
+}
+
+// certificateStatusDrift returns the drift of a certificate revoked in Lamassu but not in
+// AWS, or nil. The revocation enforcement looks for the same drift more often.
+func certificateStatusDrift(caName string, certificate caApi.Certificate, awsStatus string) *api.Drift {
+	if certificate.Status != caApi.StatusRevoked || awsStatus == awsIot.CertificateStatusRevoked {
+		return nil
+	}
+	return &api.Drift{
+		Kind:         api.DriftCertificateStatus,
+		Resource:     certificate.SerialNumber,
+		LamassuState: string(certificate.Status),
+		AWSState:     awsStatus,
+		Detail:       fmt.Sprintf("certificate %s of CA %s is revoked in Lamassu but %s in AWS", certificate.SerialNumber, caName, awsStatus),
+	}
+}
+
+// revokeAWSCertificate corrects a certificate status drift, and maps the AWS certificate to
+// the Lamassu one for the next runs.
+func (s *awsService) revokeAWSCertificate(ctx context.Context, caName string, serialNumber string, awsCertificate *awsIot.Certificate) error {
+	err := s.setAWSCertificateStatus(ctx, aws.StringValue(awsCertificate.CertificateId), awsIot.CertificateStatusRevoked)
+	if err != nil {
+		return err
+	}
+
+	s.storeCertificateMapping(ctx, api.CertificateMapping{
+		CAName:            caName,
+		SerialNumber:      serialNumber,
+		AWSCertificateID:  aws.StringValue(awsCertificate.CertificateId),
+		AWSCertificateArn: aws.StringValue(awsCertificate.CertificateArn),
+	})
+	return nil
+}
+
+func (s *awsService) setAWSCertificateStatus(ctx context.Context, certificateID string, status string) error {
+	_, err := s.awsIotSvc.UpdateCertificateWithContext(ctx, &awsIot.UpdateCertificateInput{
+		CertificateId: aws.String(certificateID),
+		NewStatus:     aws.String(status),
+	})
+	return err
+}
+
+func (s *awsService) reconcileRevokedCertificateThings(ctx context.Context, r *reconciliation, certificateID string, certificateArn string) {
+	principalThings, err := s.awsIotSvc.ListPrincipalThingsWithContext(ctx, &awsIot.ListPrincipalThingsInput{
+		Principal: aws.String(certificateArn),
+	})
+	if err != nil {
+		r.fail(fmt.Sprintf("list the things of certificate %s", certificateID), err)
+		return
+	}
+
+	for _, thingName := range principalThings.Things {
+		thingName := aws.StringValue(thingName)
+		s.handleDrift(ctx, r, api.Drift{
+			Kind:     api.DriftRevokedCertificateAttached,
+			Resource: thingName,
+			AWSState: awsIot.CertificateStatusRevoked,
+			Detail:   fmt.Sprintf("revoked certificate %s is still attached to thing %s", certificateID, thingName),
+		}, func(ctx context.Context) error {
+			_, err := s.awsIotSvc.DetachThingPrincipalWithContext(ctx, &awsIot.DetachThingPrincipalInput{
+				ThingName: aws.String(thingName),
+				Principal: aws.String(certificateArn),
+			})
+			return err
+		})
+	}
+}
+
+// reconcileCABundles compares the retained CA bundle of every DMS with its current CA
+// certificates.
+func (s *awsService) reconcileCABundles(ctx context.Context, r *reconciliation) {
+	dmss := []dmsApi.DeviceManufacturingService{}
+	_, err := s.dmsClient.IterateDMSsWithPredicate(ctx, &dmsApi.IterateDMSsWithPredicateInput{
+		PredicateFunc: func(d *dmsApi.DeviceManufacturingService) {
+			dmss = append(dmss, *d)
+		},
+	})
+	if err != nil {
+		r.fail("list Lamassu DMSs", err)
+		return
+	}
+
+	for _, dms := range dmss {
+		dmsName := dms.Name
+		retained, err := s.getRetainedCABundle(ctx, dmsName)
+		if err != nil {
+			r.fail(fmt.Sprintf("read the retained CA bundle of DMS %s", dmsName), err)
+			continue
+		}
+
+		if dms.Status == dmsApi.DMSStatusRevoked || dms.Status == dmsApi.DMSStatusRejected {
+			if len(retained) > 0 {
+				s.handleDrift(ctx, r, api.Drift{
+					Kind:         api.DriftCABundleStale,
+					Resource:     dmsName,
+					LamassuState: string(dms.Status),
+					Detail:       fmt.Sprintf("DMS %s is %s but its CA bundle is still retained", dmsName, dms.Status),
+				}, func(ctx context.Context) error {
+					return s.clearDMSCABundle(ctx, dmsName)
+				})
+			}
+			continue
+		}
+
+		if dms.Status != dmsApi.DMSStatusApproved {
+			continue
+		}
+
+		cas, err := s.dmsClient.CACerts(ctx, dmsName)
+		if err != nil {
+			r.fail(fmt.Sprintf("get the CA certificates of DMS %s", dmsName), err)
+			continue
+		}
+
+		settings, err := s.getDMSAWSSettings(ctx, dmsName)
+		if err != nil {
+			r.fail(fmt.Sprintf("get the AWS settings of DMS %s", dmsName), err)
+			continue
+		}
+
+		retainedHash, retainedFormat := parseCABundle(dmsName, retained)
+		if retainedHash != buildCABundle(dmsName, cas).Hash || retainedFormat != settings.CABundleFormat {
+			s.handleDrift(ctx, r, api.Drift{
+				Kind:         api.DriftCABundleOutdated,
+				Resource:     dmsName,
+				LamassuState: string(dms.Status),
+				Detail:       fmt.Sprintf("the retained CA bundle of DMS %s does not match its CA certificates", dmsName),
+			}, func(ctx context.Context) error {
+				// Forgetting the last publication makes the bundle be published again and
+				// the devices be asked to update their CA certificates.
+				err := s.db.DeleteDMSCABundleState(ctx, dmsName)
+				if err != nil {
+					return err
+				}
+				_, err = s.UpdateDMSCaCerts(ctx, &cProvderApi.UpdateDMSCaCertsInput{
+					DeviceManufacturingService: dms,
+				})
+				return err
+			})
+		}
+	}
+}
+
+func (s *awsService) getRetainedCABundle(ctx context.Context, dmsName string) ([]byte, error) {
+	output, err := s.awsIotData.GetRetainedMessageWithContext(ctx, &awsIotData.GetRetainedMessageInput{
+		Topic: aws.String(caBundleTopic(dmsName)),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == awsIotData.ErrCodeResourceNotFoundException {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return output.Payload, nil
+}
+
+// listManagedThings lists the things managed by the connector: the things of the Lamassu
+// group, where the provisioning templates put them, and the things tagged with the ID of
+// their device. The names of every other thing are returned too, a device may be backed
+// by a thing the connector created without tagging it.
+func (s *awsService) listManagedThings(ctx context.Context) (managed map[string]bool, all map[string]bool, err error) {
+	managed = map[string]bool{}
+	all = map[string]bool{}
+
+	err = s.awsIotSvc.ListThingsPagesWithContext(ctx, &awsIot.ListThingsInput{}, func(page *awsIot.ListThingsOutput, lastPage bool) bool {
+		for _, thing := range page.Things {
+			thingName := aws.StringValue(thing.ThingName)
+			all[thingName] = true
+			if _, ok := thing.Attributes[thingAttributeDeviceID]; ok {
+				managed[thingName] = true
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = s.awsIotSvc.ListThingsInThingGroupPagesWithContext(ctx, &awsIot.ListThingsInThingGroupInput{
+		ThingGroupName: aws.String(lamassuThingGroup),
+		Recursive:      aws.Bool(true),
+	}, func(page *awsIot.ListThingsInThingGroupOutput, lastPage bool) bool {
+		for _, thing := range page.Things {
+			managed[aws.StringValue(thing)] = true
+		}
+		return true
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != awsIot.ErrCodeResourceNotFoundException {
+			return nil, nil, err
+		}
+	}
+
+	return managed, all, nil
+}
+
+// reconcileThings compares the devices of every DMS with the things in AWS. Things are
+// named after the ID of their device.
+func (s *awsService) reconcileThings(ctx context.Context, r *reconciliation) {
+	managed, things, err := s.listManagedThings(ctx)
+	if err != nil {
+		r.fail("list AWS things", err)
+		return
+	}
+
+	dmsNames := []string{}
+	_, err = s.dmsClient.IterateDMSsWithPredicate(ctx, &dmsApi.IterateDMSsWithPredicateInput{
+		PredicateFunc: func(dms *dmsApi.DeviceManufacturingService) {
+			dmsNames = append(dmsNames, dms.Name)
+		},
+	})
+	if err != nil {
+		r.fail("list Lamassu DMSs", err)
+		return
+	}
+
+	devices := map[string]bool{}
+	missing := []api.Drift{}
+	for _, dmsName := range dmsNames {
+		dmsName := dmsName
+		_, err = s.devManagerClient.IterateDevicesbyDMSWithPredicate(ctx, &devApi.IterateDevicesByDMSWithPredicateInput{
+			DmsName: dmsName,
+			PredicateFunc: func(device *devApi.Device) {
+				devices[device.ID] = true
+				// Devices pending provisioning have no thing yet and the thing of a
+				// decommissioned device may already be gone.
+				if things[device.ID] || device.Status == devApi.DeviceStatusPendingProvisioning || device.Status == devApi.DeviceStatusDecommissioned {
+					return
+				}
+				missing = append(missing, api.Drift{
+					Kind:         api.DriftDeviceWithoutThing,
+					Resource:     device.ID,
+					LamassuState: string(device.Status),
+					Detail:       fmt.Sprintf("device %s of DMS %s is %s but has no thing in AWS", device.ID, dmsName, device.Status),
+				})
+			},
+		})
+		if err != nil {
+			// Without every device, things cannot be told apart from orphaned ones.
+			r.fail(fmt.Sprintf("list the devices of DMS %s", dmsName), err)
+			return
+		}
+	}
+
+	for _, drift := range missing {
+		s.handleDrift(ctx, r, drift, nil)
+	}
+
+	for thingName := range managed {
+		if devices[thingName] {
+			continue
+		}
+		s.handleDrift(ctx, r, api.Drift{
+			Kind:     api.DriftThingWithoutDevice,
+			Resource: thingName,
+			AWSState: "PROVISIONED",
+			Detail:   fmt.Sprintf("thing %s has no device in Lamassu", thingName),
+		}, nil)
+	}
+}
+
+// reconcileProvisioning checks that the provisioning template of a CA is the one the
+// connector would create today and that it references the latest policy of the CA. CAs
+// that were never configured have no template and are not reported.
+func (s *awsService) reconcileProvisioning(ctx context.Context, r *reconciliation, awsCA awsLamassuCA) {
+	caDescription, err := s.awsIotSvc.DescribeCACertificateWithContext(ctx, &awsIot.DescribeCACertificateInput{
+		CertificateId: aws.String(awsCA.certificateID),
+	})
+	if err != nil {
+		r.fail(fmt.Sprintf("describe AWS CA %s", awsCA.certificateID), err)
+		return
+	}
+	if caDescription.RegistrationConfig == nil || aws.StringValue(caDescription.RegistrationConfig.TemplateName) == "" {
+		return
+	}
+
+	templateName := aws.StringValue(caDescription.RegistrationConfig.TemplateName)
+	template, err := s.awsIotSvc.DescribeProvisioningTemplateWithContext(ctx, &awsIot.DescribeProvisioningTemplateInput{
+		TemplateName: aws.String(templateName),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == awsIot.ErrCodeResourceNotFoundException {
+			s.handleDrift(ctx, r, api.Drift{
+				Kind:         api.DriftTemplateOutdated,
+				Resource:     templateName,
+				LamassuState: awsCA.lamassuCAName,
+				Detail:       fmt.Sprintf("provisioning template %s of CA %s does not exist", templateName, awsCA.lamassuCAName),
+			}, nil)
+			return
+		}
+		r.fail(fmt.Sprintf("describe provisioning template %s", templateName), err)
+		return
+	}
+
+	var parsedTemplate struct {
+		Resources struct {
+			Policy struct {
+				Properties struct {
+					PolicyName string `json:"PolicyName"`
+				} `json:"Properties"`
+			} `json:"policy"`
+		} `json:"Resources"`
+	}
+	json.Unmarshal([]byte(aws.StringValue(template.TemplateBody)), &parsedTemplate)
+	policyName := parsedTemplate.Resources.Policy.Properties.PolicyName
+
+	switch {
+	case !aws.BoolValue(template.Enabled):
+		s.handleDrift(ctx, r, api.Drift{
+			Kind:         api.DriftTemplateOutdated,
+			Resource:     templateName,
+			LamassuState: awsCA.lamassuCAName,
+			AWSState:     "DISABLED",
+			Detail:       fmt.Sprintf("provisioning template %s of CA %s is disabled", templateName, awsCA.lamassuCAName),
+		}, nil)
+	case !sameJSON(aws.StringValue(template.TemplateBody), jitpTemplateBody(policyName)):
+		s.handleDrift(ctx, r, api.Drift{
+			Kind:         api.DriftTemplateOutdated,
+			Resource:     templateName,
+			LamassuState: awsCA.lamassuCAName,
+			AWSState:     aws.StringValue(template.TemplateBody),
+			Detail:       fmt.Sprintf("provisioning template %s of CA %s differs from the template created by the connector", templateName, awsCA.lamassuCAName),
+		}, nil)
+	}
+
+	if policyName == "" {
+		return
+	}
+
+	_, err = s.awsIotSvc.GetPolicyWithContext(ctx, &awsIot.GetPolicyInput{
+		PolicyName: aws.String(policyName),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == awsIot.ErrCodeResourceNotFoundException {
+			s.handleDrift(ctx, r, api.Drift{
+				Kind:         api.DriftPolicyOutdated,
+				Resource:     policyName,
+				LamassuState: awsCA.lamassuCAName,
+				Detail:       fmt.Sprintf("policy %s referenced by the template of CA %s does not exist", policyName, awsCA.lamassuCAName),
+			}, nil)
+			return
+		}
+		r.fail(fmt.Sprintf("get policy %s", policyName), err)
+		return
+	}
+
+	latestPolicy := ""
+	prefix := caPolicyNamePrefix(awsCA.lamassuCAName)
+	err = s.awsIotSvc.ListPoliciesPagesWithContext(ctx, &awsIot.ListPoliciesInput{}, func(page *awsIot.ListPoliciesOutput, lastPage bool) bool {
+		for _, policy := range page.Policies {
+			name := aws.StringValue(policy.PolicyName)
+			if strings.HasPrefix(name, prefix) && name > latestPolicy {
+				latestPolicy = name
+			}
+		}
+		return true
+	})
+	if err != nil {
+		r.fail("list AWS policies", err)
+		return
+	}
+
+	if latestPolicy > policyName {
+		s.handleDrift(ctx, r, api.Drift{
+			Kind:         api.DriftPolicyOutdated,
+			Resource:     policyName,
+			LamassuState: awsCA.lamassuCAName,
+			AWSState:     latestPolicy,
+			Detail:       fmt.Sprintf("the template of CA %s references policy %s instead of the latest policy %s", awsCA.lamassuCAName, policyName, latestPolicy),
+		}, nil)
+	}
+}
+
+// sameJSON compares two JSON documents regardless of their formatting and key order.
+func sameJSON(a string, b string) bool {
+	var parsedA, parsedB interface{}
+	if json.Unmarshal([]byte(a), &parsedA) != nil || json.Unmarshal([]byte(b), &parsedB) != nil {
+		return false
+	}
+	return reflect.DeepEqual(parsedA, parsedB)
+}
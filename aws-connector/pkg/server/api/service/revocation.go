@@ -0,0 +1,53 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// awsRevocationReason describes a revocation mirroring a change made in AWS. Lamassu only
+// keeps a free text reason, so the RFC 5280 reason selected for the actor comes first,
+// followed by who made the change, from where and when. Lamassu does not parse it: the RFC
+// 5280 reason is not set as the reason code of the revocation, and the actor cannot be
+// queried in Lamassu. The actor fields are only structured in the connector logs.
+func (s *awsService) awsRevocationReason(change string, actor *api.AWSActor) string {
+	if actor == nil {
+		return fmt.Sprintf("%s (%d): %s", api.RevocationReasonUnspecified, api.RevocationReasonUnspecified, change)
+	}
+
+	reason := api.RevocationReasonFor(s.revocationReasonRules, *actor)
+	details := []string{fmt.Sprintf("%s (%d): %s", reason, reason, change)}
+	if name := actor.Name(); name != "" {
+		details = append(details, "by "+name)
+	}
+	if actor.SourceIP != "" {
+		details = append(details, "from "+actor.SourceIP)
+	}
+	if !actor.EventTime.IsZero() {
+		details = append(details, "at "+actor.EventTime.UTC().Format(time.RFC3339))
+	}
+	description := strings.Join(details, " ")
+	if actor.EventID != "" {
+		description += fmt.Sprintf(", CloudTrail event %s", actor.EventID)
+	}
+	return description
+}
+
+// actorLogFields are the log fields identifying the AWS actor of a change.
+func actorLogFields(actor *api.AWSActor) log.Fields {
+	if actor == nil {
+		return log.Fields{}
+	}
+	return log.Fields{
+		"actor_type":       actor.Type,
+		"actor_arn":        actor.ARN,
+		"actor_invoked_by": actor.InvokedBy,
+		"actor_source_ip":  actor.SourceIP,
+		"cloudtrail_event": actor.EventID,
+		"cloudtrail_time":  actor.EventTime,
+	}
+}
@@ -0,0 +1,240 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/aws/aws-sdk-go/aws"
+	awsIot "github.com/aws/aws-sdk-go/service/iot"
+	"github.com/google/uuid"
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	"github.com/lamassuiot/aws-connector/pkg/server/api/errors"
+	caApi "github.com/lamassuiot/lamassuiot/pkg/ca/common/api"
+	"github.com/lamassuiot/lamassuiot/pkg/utils/common"
+	"github.com/lamassuiot/lamassuiot/pkg/utils/common/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// EnforceRevocations makes sure that the certificates revoked in Lamassu are revoked in AWS,
+// which does not check CRLs. Only the CAs registered by the connector are checked.
+func (s *awsService) EnforceRevocations(ctx context.Context, input *api.EnforceRevocationsInput) (*api.EnforceRevocationsOutput, error) {
+	lease, err := s.acquireLease(ctx, revocationEnforcementLease)
+	if err != nil {
+		return &api.EnforceRevocationsOutput{}, err
+	}
+	if lease == nil {
+		return &api.EnforceRevocationsOutput{}, &errors.GenericError{
+			Message:    "a revocation enforcement is already running",
+			StatusCode: 409,
+		}
+	}
+	defer s.releaseLease(lease)
+	ctx = lease.ctx
+
+	dryRun := input.DryRun || s.isDryRun(ctx)
+	report := &api.RevocationEnforcementReport{
+		ID:        uuid.NewString(),
+		DryRun:    dryRun,
+		StartedAt: time.Now(),
+		Enforced:  []api.EnforcedRevocation{},
+		Errors:    []string{},
+	}
+
+	awsCAs, err := s.listAWSLamassuCAs(ctx)
+	if err != nil {
+		return &api.EnforceRevocationsOutput{}, err
+	}
+
+	for _, awsCA := range awsCAs {
+		err = s.enforceCARevocations(ctx, report, awsCA)
+		if err != nil {
+			log.Warn(fmt.Sprintf("revocation enforcement could not check CA %s: ", awsCA.lamassuCAName), err)
+			report.Errors = append(report.Errors, fmt.Sprintf("could not check CA %s: %s", awsCA.lamassuCAName, err))
+		}
+		report.CAs++
+	}
+
+	now := time.Now()
+	report.FinishedAt = &now
+	log.Info(fmt.Sprintf("revocation enforcement %s finished: %d revoked certificates checked, %d still usable in AWS", report.ID, report.RevokedCertificates, len(report.Enforced)))
+	metrics.SetGaugeWithLabels([]string{"revocation_enforcement", "pending"}, float32(len(report.Enforced)), []metrics.Label{{Name: "dry_run", Value: fmt.Sprint(dryRun)}})
+
+	return &api.EnforceRevocationsOutput{
+		RevocationEnforcementReport: *report,
+	}, nil
+}
+
+// revokedCertificatesPageSize is how many revoked certificates are read from Lamassu at once.
+const revokedCertificatesPageSize = 100
+
+// enforceCARevocations corrects the certificate status drifts of a Lamassu CA, looking only at
+// its revoked certificates. AWS certificates are matched by serial number through the stored
+// mappings, or by their ID, the SHA-256 fingerprint of the certificate.
+func (s *awsService) enforceCARevocations(ctx context.Context, report *api.RevocationEnforcementReport, awsCA awsLamassuCA) error {
+	revoked, err := s.listRevokedCertificates(ctx, awsCA.lamassuCAName)
+	if err != nil {
+		return err
+	}
+	if len(revoked) == 0 {
+		return nil
+	}
+	report.RevokedCertificates += len(revoked)
+
+	awsCertificates := map[string]*awsIot.Certificate{}
+	err = s.awsIotSvc.ListCertificatesByCAPagesWithContext(ctx, &awsIot.ListCertificatesByCAInput{
+		CaCertificateId: aws.String(awsCA.certificateID),
+	}, func(page *awsIot.ListCertificatesByCAOutput, lastPage bool) bool {
+		for _, certificate := range page.Certificates {
+			awsCertificates[aws.StringValue(certificate.CertificateId)] = certificate
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, certificate := range revoked {
+		certificateID := ""
+		mapping, err := s.db.GetCertificateMapping(ctx, awsCA.lamassuCAName, certificate.SerialNumber)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error reading the AWS certificate of %s/%s: ", awsCA.lamassuCAName, certificate.SerialNumber), err)
+		}
+		if mapping != nil {
+			certificateID = mapping.AWSCertificateID
+		} else if certificate.Certificate != nil {
+			fingerprint := sha256.Sum256(certificate.Certificate.Raw)
+			certificateID = hex.EncodeToString(fingerprint[:])
+		}
+
+		awsCertificate, ok := awsCertificates[certificateID]
+		if !ok || certificateStatusDrift(awsCA.lamassuCAName, certificate, aws.StringValue(awsCertificate.Status)) == nil {
+			continue
+		}
+
+		enforced := api.EnforcedRevocation{
+			CAName:           awsCA.lamassuCAName,
+			SerialNumber:     certificate.SerialNumber,
+			AWSCertificateID: certificateID,
+			AWSStatus:        aws.StringValue(awsCertificate.Status),
+		}
+		if certificate.RevocationTimestamp.Valid {
+			revokedAt := certificate.RevocationTimestamp.Time
+			enforced.RevokedAt = &revokedAt
+		}
+
+		if !report.DryRun {
+			err = s.revokeAWSCertificate(ctx, awsCA.lamassuCAName, certificate.SerialNumber, awsCertificate)
+			if err != nil {
+				enforced.Error = err.Error()
+			} else {
+				enforced.Revoked = true
+			}
+		}
+
+		s.recordEnforcedRevocation(&enforced, report.DryRun)
+		report.Enforced = append(report.Enforced, enforced)
+	}
+
+	return nil
+}
+
+// listRevokedCertificates reads the certificates revoked by a Lamassu CA, page by page. The
+// Lamassu CA client offers no CRL, so they are selected with a status filter.
+func (s *awsService) listRevokedCertificates(ctx context.Context, caName string) ([]caApi.Certificate, error) {
+	filters := []types.Filter{
+		&types.EnumFilterField{
+			BaseFilter: types.BaseFilter{FieldName: "status"},
+			Operator:   types.In,
+			Collection: []string{string(caApi.StatusRevoked)},
+		},
+		// The client only sends the filters when there are more than two of them, so the
+		// revocation time, which every revoked certificate has, is bounded on both sides.
+		&types.DatesFilterField{
+			BaseFilter:  types.BaseFilter{FieldName: "revocation_timestamp"},
+			Operator:    types.After,
+			CompareWith: time.Unix(0, 0),
+		},
+		&types.DatesFilterField{
+			BaseFilter:  types.BaseFilter{FieldName: "revocation_timestamp"},
+			Operator:    types.Before,
+			CompareWith: time.Now().Add(time.Hour),
+		},
+	}
+
+	revoked := []caApi.Certificate{}
+	for offset := 0; ; offset += revokedCertificatesPageSize {
+		page, err := s.lamassuCAClient.GetCertificates(ctx, &caApi.GetCertificatesInput{
+			CAType: caApi.CATypePKI,
+			CAName: caName,
+			QueryParameters: common.QueryParameters{
+				Filters: filters,
+				Pagination: common.PaginationOptions{
+					Limit:  revokedCertificatesPageSize,
+					Offset: offset,
+				},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, certificate := range page.Certificates {
+			// Lamassu versions ignoring the filter return every certificate.
+			if certificate.Status == caApi.StatusRevoked {
+				revoked = append(revoked, certificate)
+			}
+		}
+
+		// A page larger than requested holds every certificate, pagination is not supported.
+		lastPage := len(page.Certificates) != revokedCertificatesPageSize
+		if page.TotalCertificates > 0 && offset+len(page.Certificates) >= page.TotalCertificates {
+			lastPage = true
+		}
+		if lastPage {
+			return revoked, nil
+		}
+	}
+}
+
+// recordEnforcedRevocation logs a revocation found missing in AWS, and measures how long the
+// certificate remained usable in AWS after being revoked in Lamassu.
+func (s *awsService) recordEnforcedRevocation(enforced *api.EnforcedRevocation, dryRun bool) {
+	result := "reported"
+	switch {
+	case enforced.Error != "":
+		result = "failed"
+	case enforced.Revoked:
+		result = "revoked"
+	}
+
+	var latency time.Duration
+	if enforced.RevokedAt != nil {
+		latency = time.Since(*enforced.RevokedAt)
+		enforced.Latency = latency.Round(time.Second).String()
+	}
+
+	logEntry := log.WithFields(log.Fields{
+		"ca_name":            enforced.CAName,
+		"serial_number":      enforced.SerialNumber,
+		"aws_certificate_id": enforced.AWSCertificateID,
+		"aws_status":         enforced.AWSStatus,
+		"latency":            enforced.Latency,
+		"result":             result,
+		"dry_run":            dryRun,
+	})
+	if enforced.Error != "" {
+		logEntry.Error("certificate revoked in Lamassu could not be revoked in AWS: ", enforced.Error)
+	} else {
+		logEntry.Warn("certificate revoked in Lamassu is still usable in AWS")
+	}
+
+	labels := []metrics.Label{{Name: "ca_name", Value: enforced.CAName}}
+	metrics.IncrCounterWithLabels([]string{"revocation_enforcement", "enforced"}, 1, append(labels, metrics.Label{Name: "result", Value: result}))
+	if enforced.Revoked && enforced.RevokedAt != nil {
+		metrics.AddSampleWithLabels([]string{"revocation_enforcement", "latency_seconds"}, float32(latency.Seconds()), labels)
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
@@ -35,6 +37,7 @@ import (
 	dmsApi "github.com/lamassuiot/lamassuiot/pkg/dms-manager/common/api"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/exp/slices"
+	"golang.org/x/time/rate"
 )
 
 type Service interface {
@@ -42,26 +45,97 @@ type Service interface {
 	//Responses received from AWS via SQS
 	HandleUpdateCertificateStatus(ctx context.Context, input *api.HandleUpdateCertificateStatusInput) error
 	HandleUpdateCAStatus(ctx context.Context, input *api.HandleUpdateCAStatusInput) error
+	HandleUpdateThingShadow(ctx context.Context, input *api.HandleUpdateThingShadowInput) error
 	HandleCloudEvents(ctx context.Context, event cloudevents.Event) error
+	GetDMSAWSSettings(ctx context.Context, input *api.GetDMSAWSSettingsInput) (*api.GetDMSAWSSettingsOutput, error)
+	UpdateDMSAWSSettings(ctx context.Context, input *api.UpdateDMSAWSSettingsInput) (*api.UpdateDMSAWSSettingsOutput, error)
+	MigrateDMSShadows(ctx context.Context, input *api.MigrateDMSShadowsInput) (*api.MigrateDMSShadowsOutput, error)
+	GetDMSShadowMigration(ctx context.Context, input *api.GetDMSShadowMigrationInput) (*api.GetDMSShadowMigrationOutput, error)
+	GetShadowFanOutReports(ctx context.Context, input *api.GetShadowFanOutReportsInput) (*api.GetShadowFanOutReportsOutput, error)
+	DeleteDMSCABundle(ctx context.Context, input *api.DeleteDMSCABundleInput) (*api.DeleteDMSCABundleOutput, error)
+	Reconcile(ctx context.Context, input *api.ReconcileInput) (*api.ReconcileOutput, error)
+	EnforceRevocations(ctx context.Context, input *api.EnforceRevocationsInput) (*api.EnforceRevocationsOutput, error)
+	MonitorExpiry(ctx context.Context, input *api.MonitorExpiryInput) (*api.MonitorExpiryOutput, error)
+	SyncDMSThingGroups(ctx context.Context, input *api.SyncDMSThingGroupsInput) (*api.SyncDMSThingGroupsOutput, error)
+	GetReconciliationReport(ctx context.Context, input *api.GetReconciliationReportInput) (*api.GetReconciliationReportOutput, error)
+	GetDriftReport(ctx context.Context, input *api.GetDriftReportInput) (*api.GetDriftReportOutput, error)
+	ImportFleet(ctx context.Context, input *api.ImportFleetInput) (*api.ImportFleetOutput, error)
+	GetFleetImport(ctx context.Context, input *api.GetFleetImportInput) (*api.GetFleetImportOutput, error)
+	GetFleetImports(ctx context.Context, input *api.GetFleetImportsInput) (*api.GetFleetImportsOutput, error)
+	GetOutboxEntries(ctx context.Context, input *api.GetOutboxEntriesInput) (*api.GetOutboxEntriesOutput, error)
+	RetryOutboxEntry(ctx context.Context, input *api.RetryOutboxEntryInput) (*api.RetryOutboxEntryOutput, error)
+	DeleteOutboxEntry(ctx context.Context, input *api.DeleteOutboxEntryInput) (*api.DeleteOutboxEntryOutput, error)
+	TestEventRouting(ctx context.Context, input *api.TestEventRoutingInput) (*api.TestEventRoutingOutput, error)
 	GetAccountID() string
 	GetDefaultRegion() string
 }
 
 type awsService struct {
-	ID                   string
-	lamassuCAClient      lamassuCAClient.LamassuCAClient
-	dmsClient            lamassudmsclient.LamassuDMSManagerClient
-	devManagerClient     lamassuDevManagerClient.LamassuDeviceManagerClient
-	db                   store.DB
-	awsIotSvc            *awsIot.IoT
-	awsIotData           *awsIotData.IoTDataPlane
-	accountID            string
-	accountDefaultRegion string
-	sqsOutboundURL       string
-	sqsSvc               *sqs.SQS
+	ID                          string
+	lamassuCAClient             lamassuCAClient.LamassuCAClient
+	dmsClient                   lamassudmsclient.LamassuDMSManagerClient
+	devManagerClient            lamassuDevManagerClient.LamassuDeviceManagerClient
+	db                          store.DB
+	awsIotSvc                   *awsIot.IoT
+	awsIotData                  *awsIotData.IoTDataPlane
+	accountID                   string
+	accountDefaultRegion        string
+	sqsOutboundURL              string
+	sqsSvc                      *sqs.SQS
+	shadowUpdateWorkers         int
+	shadowLimiter               *rate.Limiter
+	jobsLimiter                 *rate.Limiter
+	reconcileRules              map[api.DriftKind]api.ReconcileAction
+	dryRun                      bool
+	configurationCacheTTL       time.Duration
+	deviceConfigurationCacheTTL time.Duration
+	// instanceID tells the replicas sharing the store apart.
+	instanceID         string
+	outboxMaxAttempts  int
+	outboxWakeUp       chan struct{}
+	eventRoutingRules  []api.EventRoutingRule
+	operatingMode      api.OperatingMode
+	caStatusSyncAction api.CAStatusSyncAction
+	// statusChangeEchoTTL bounds how long the status changes made by the connector are
+	// remembered, waiting for their events to come back.
+	statusChangeEchoTTL time.Duration
+	// revocationReasonRules select the RFC 5280 reason of the revocations made in AWS.
+	revocationReasonRules []api.RevocationReasonRule
+	// Device certificates expiring within certificateRenewalWindow are re-enrolled, and the CAs
+	// expiring within caExpiryWarningWindow are warned about.
+	certificateRenewalWindow time.Duration
+	caExpiryWarningWindow    time.Duration
+	// dmsThingGroups keeps the things in the thing group of their DMS, created under
+	// dmsThingGroupRoot when it is set.
+	dmsThingGroups    bool
+	dmsThingGroupRoot string
 }
 
-func NewAwsConnectorService(connectorId string, lamassuCAClient lamassuCAClient.LamassuCAClient, dmsClient lamassudmsclient.LamassuDMSManagerClient, devManagerClient lamassuDevManagerClient.LamassuDeviceManagerClient, db store.DB, awsDefaultRegion string, awsKeyID string, awsKeySecret string, awsSQSOutboundQueueName string) (Service, error) {
+// Options are the settings of the connector service beyond the Lamassu clients, the store and
+// the AWS account.
+type Options struct {
+	// Shadow updates fanned out to the devices of a DMS are made by ShadowUpdateWorkers
+	// workers, at most ShadowUpdateRate per second.
+	ShadowUpdateWorkers int
+	ShadowUpdateRate    float64
+	ReconcileRules      map[api.DriftKind]api.ReconcileAction
+	// DryRun records the mutating AWS calls instead of making them.
+	DryRun                      bool
+	ConfigurationCacheTTL       time.Duration
+	DeviceConfigurationCacheTTL time.Duration
+	OutboxMaxAttempts           int
+	EventRoutingRules           []api.EventRoutingRule
+	OperatingMode               api.OperatingMode
+	CAStatusSyncAction          api.CAStatusSyncAction
+	StatusChangeEchoTTL         time.Duration
+	RevocationReasonRules       []api.RevocationReasonRule
+	CertificateRenewalWindow    time.Duration
+	CAExpiryWarningWindow       time.Duration
+	DMSThingGroups              bool
+	DMSThingGroupRoot           string
+}
+
+func NewAwsConnectorService(connectorId string, lamassuCAClient lamassuCAClient.LamassuCAClient, dmsClient lamassudmsclient.LamassuDMSManagerClient, devManagerClient lamassuDevManagerClient.LamassuDeviceManagerClient, db store.DB, awsDefaultRegion string, awsKeyID string, awsKeySecret string, awsSQSOutboundQueueName string, options Options) (Service, error) {
 	sess := session.Must(session.NewSession(&aws.Config{
 		Region:      aws.String(awsDefaultRegion),
 		Credentials: credentials.NewStaticCredentials(awsKeyID, awsKeySecret, ""),
@@ -71,24 +145,56 @@ func NewAwsConnectorService(connectorId string, lamassuCAClient lamassuCAClient.
 	awsSvc := awsIot.New(sess, aws.NewConfig())
 	awsIotDataPlane := awsIotData.New(sess, aws.NewConfig())
 	awsIotDataPlane.Endpoint = "https://a3penyvxwz0v8m-ats.iot.eu-west-1.amazonaws.com"
+	awsSvc.Handlers.Validate.PushFrontNamed(dryRunHandler(options.DryRun))
+	awsIotDataPlane.Handlers.Validate.PushFrontNamed(dryRunHandler(options.DryRun))
+	sqsSvc.Handlers.Validate.PushFrontNamed(dryRunHandler(options.DryRun))
 	awsIdentity, err := awsSts.GetCallerIdentity(nil)
 	if err != nil {
 		log.Fatal("Could not get AWS Identity: ", err)
 	}
 	sqsOutboundURL := "https://sqs." + awsDefaultRegion + ".amazonaws.com/" + *awsIdentity.Account + "/" + awsSQSOutboundQueueName
-	return &awsService{
-		lamassuCAClient:      lamassuCAClient,
-		dmsClient:            dmsClient,
-		devManagerClient:     devManagerClient,
-		ID:                   connectorId,
-		db:                   db,
-		awsIotSvc:            awsSvc,
-		awsIotData:           awsIotDataPlane,
-		accountID:            *awsIdentity.Account,
-		accountDefaultRegion: awsDefaultRegion,
-		sqsOutboundURL:       sqsOutboundURL,
-		sqsSvc:               sqsSvc,
-	}, nil
+	if options.ShadowUpdateWorkers < 1 {
+		return nil, fmt.Errorf("at least one shadow update worker is needed, got %d", options.ShadowUpdateWorkers)
+	}
+
+	svc := &awsService{
+		lamassuCAClient:             lamassuCAClient,
+		dmsClient:                   dmsClient,
+		devManagerClient:            devManagerClient,
+		ID:                          connectorId,
+		db:                          db,
+		awsIotSvc:                   awsSvc,
+		awsIotData:                  awsIotDataPlane,
+		accountID:                   *awsIdentity.Account,
+		accountDefaultRegion:        awsDefaultRegion,
+		sqsOutboundURL:              sqsOutboundURL,
+		sqsSvc:                      sqsSvc,
+		shadowUpdateWorkers:         options.ShadowUpdateWorkers,
+		shadowLimiter:               rate.NewLimiter(rate.Limit(options.ShadowUpdateRate), options.ShadowUpdateWorkers),
+		jobsLimiter:                 rate.NewLimiter(rate.Limit(createJobRate), 1),
+		reconcileRules:              options.ReconcileRules,
+		dryRun:                      options.DryRun,
+		configurationCacheTTL:       options.ConfigurationCacheTTL,
+		deviceConfigurationCacheTTL: options.DeviceConfigurationCacheTTL,
+		instanceID:                  instanceID(),
+		outboxMaxAttempts:           options.OutboxMaxAttempts,
+		outboxWakeUp:                make(chan struct{}, 1),
+		eventRoutingRules:           options.EventRoutingRules,
+		operatingMode:               options.OperatingMode,
+		caStatusSyncAction:          options.CAStatusSyncAction,
+		statusChangeEchoTTL:         options.StatusChangeEchoTTL,
+		revocationReasonRules:       options.RevocationReasonRules,
+		certificateRenewalWindow:    options.CertificateRenewalWindow,
+		caExpiryWarningWindow:       options.CAExpiryWarningWindow,
+		dmsThingGroups:              options.DMSThingGroups,
+		dmsThingGroupRoot:           options.DMSThingGroupRoot,
+	}
+	awsSvc.Handlers.Validate.PushBackNamed(svc.statusChangeHandler())
+
+	go svc.resumeWorkflows(context.Background())
+	go svc.dispatchOutbox(context.Background())
+
+	return svc, nil
 }
 
 func (s *awsService) Health() bool {
@@ -103,74 +209,84 @@ func (s *awsService) GetDefaultRegion() string {
 	return s.accountDefaultRegion
 }
 
+// defaultSlotID is the slot of the identity certificate of the devices.
+const defaultSlotID = "default"
+
 func (s *awsService) UpdateDeviceDigitalTwinReenrollmentStatus(ctx context.Context, input *cProvderApi.UpdateDeviceDigitalTwinReenrollmentStatusInput) (*cProvderApi.UpdateDeviceDigitalTwinReenrollmentStatusOutput, error) {
-	var shadowPayload api.DeviceShadowPayload
-	if input.SlotID == "default" {
-		shadowPayload = api.DeviceShadowPayload{
-			State: api.StatePayload{
-				Desired: api.Desired{
-					Issuer: api.ShadowIssuer{},
-					IdentityCert: api.ShadowIdentityCert{
-						Rotate: input.ForceReenroll,
-					},
-					Slots: api.ShadowSlots{
-						Devo: api.ShadowDevo{},
-					},
-				},
+	device, err := s.devManagerClient.GetDeviceById(ctx, input.DeviceID)
+	if err != nil {
+		log.Warn("Error obtaining the device ", err)
+		return &cProvderApi.UpdateDeviceDigitalTwinReenrollmentStatusOutput{}, err
+	}
+
+	err = s.setReenrollmentFlag(ctx, &device.Device, input.SlotID, input.ForceReenroll)
+	if err != nil {
+		return &cProvderApi.UpdateDeviceDigitalTwinReenrollmentStatusOutput{}, err
+	}
+	return &cProvderApi.UpdateDeviceDigitalTwinReenrollmentStatusOutput{}, nil
+}
+
+// setReenrollmentFlag asks a device to re-enroll a slot, or withdraws the request, through
+// the delivery channel of its DMS: the identity certificate for the default slot, the devo
+// slot otherwise.
+func (s *awsService) setReenrollmentFlag(ctx context.Context, device *devApi.Device, slotID string, forceReenroll bool) error {
+	var desired api.Desired
+	var action api.ShadowAction
+	if slotID == defaultSlotID {
+		action = api.ShadowActionRotateIdentityCert
+		desired = api.Desired{
+			IdentityCert: &api.ShadowIdentityCert{
+				Rotate: forceReenroll,
 			},
 		}
 	} else {
-		shadowPayload = api.DeviceShadowPayload{
-			State: api.StatePayload{
-				Desired: api.Desired{
-					Issuer:       api.ShadowIssuer{},
-					IdentityCert: api.ShadowIdentityCert{},
-					Slots: api.ShadowSlots{
-						Devo: api.ShadowDevo{
-							Update: input.ForceReenroll,
-						},
-					},
+		action = api.ShadowActionUpdateDevoSlot
+		desired = api.Desired{
+			Slots: &api.ShadowSlots{
+				Devo: &api.ShadowDevo{
+					Update: forceReenroll,
 				},
 			},
 		}
 	}
 
-	payloadBytes, err := json.Marshal(shadowPayload)
-	if err != nil {
-		log.Warn("Error Marshalling shadow payload: ", err)
-	}
-
-	device, err := s.devManagerClient.GetDeviceById(ctx, input.DeviceID)
-	if err != nil {
-		log.Warn("Error obtaining the device ", err)
-	}
 	dms, err := s.dmsClient.GetDMSByName(ctx, &dmsApi.GetDMSByNameInput{
 		Name: device.DmsName,
 	})
 	if err != nil {
 		log.Warn("Error obtaining the dms ", err)
+		return err
 	}
-	if dms.Aws.ShadowType == dmsApi.ShadowTypeClassic {
-		_, err = s.awsIotData.UpdateThingShadow(&awsIotData.UpdateThingShadowInput{
-			ThingName: &input.DeviceID,
-			Payload:   payloadBytes,
-		})
-		if err != nil {
-			log.Warn("Error updating thing shadow: ", err)
+
+	settings, err := s.getDMSAWSSettings(ctx, dms.Name)
+	if err != nil {
+		log.Warn("Error obtaining the AWS settings of the dms ", err)
+		return err
+	}
+
+	if settings.DeliveryChannel == api.DeliveryChannelJobs {
+		// A job cannot be withdrawn the way a shadow flag is cleared, so only requests are sent.
+		if forceReenroll {
+			_, err = s.createIdentityJob(ctx, action, []string{s.thingArn(device.ID)}, desired)
+			if err != nil {
+				log.Warn("Error creating the identity job: ", err)
+				return err
+			}
 		}
 	} else {
-		_, err = s.awsIotData.UpdateThingShadow(&awsIotData.UpdateThingShadowInput{
-			ThingName:  &input.DeviceID,
-			ShadowName: aws.String("lamassu-identity"),
-			Payload:    payloadBytes,
-		})
+		var shadowLocation api.ShadowLocation
+		shadowLocation, err = s.waitDMSShadowLocation(ctx, &dms.DeviceManufacturingService)
+		if err == nil {
+			err = s.updateThingShadow(ctx, device.ID, shadowLocation, desired)
+		}
 		if err != nil {
 			log.Warn("Error updating thing shadow: ", err)
-
+			return err
 		}
 	}
 
-	return &cProvderApi.UpdateDeviceDigitalTwinReenrollmentStatusOutput{}, nil
+	s.invalidateDeviceConfigurationCache(ctx, device.ID)
+	return nil
 }
 
 func (s *awsService) UpdateConfiguration(ctx context.Context, input *cProvderApi.UpdateConfigurationInput) (*cProvderApi.UpdateConfigurationOutput, error) {
@@ -214,13 +330,11 @@ func (s *awsService) UpdateConfiguration(ctx context.Context, input *cProvderApi
 		nameTag := tagsResponse.Tags[nameTagIdx]
 		if *nameTag.Value == awsConfig.CAName {
 			now := time.Now()
-			policyName := "lms" + strings.ReplaceAll(awsConfig.CAName, " ", "-") + "_" + now.Format("2006-01-02_15-04-05")
-			templateName := "lms_" + now.Format("2006-01-02_15-04-05")
-			templateBody := fmt.Sprintf(
-				`{"Parameters":{"AWS::IoT::Certificate::CommonName":{"Type":"String"},"AWS::IoT::Certificate::Country":{"Type":"String"},"AWS::IoT::Certificate::Id":{"Type":"String"},"AWS::IoT::Certificate::SerialNumber":{"Type":"String"}},"Resources":{"thing":{"Type":"AWS::IoT::Thing","Properties":{"ThingName":{"Ref":"AWS::IoT::Certificate::CommonName"},"ThingGroups":["LAMASSU"],"AttributePayload":{}}},"certificate":{"Type":"AWS::IoT::Certificate","Properties":{"CertificateId":{"Ref":"AWS::IoT::Certificate::Id"},"Status":"ACTIVE"}},"policy":{"Type":"AWS::IoT::Policy","Properties":{"PolicyName":"%s"}}}}`,
-				policyName)
+			policyName := caPolicyNamePrefix(awsConfig.CAName) + now.Format(awsResourceTimeFormat)
+			templateName := "lms_" + now.Format(awsResourceTimeFormat)
+			templateBody := jitpTemplateBody(policyName)
 
-			_, err = s.awsIotSvc.CreatePolicy(&awsIot.CreatePolicyInput{
+			_, err = s.awsIotSvc.CreatePolicyWithContext(ctx, &awsIot.CreatePolicyInput{
 				PolicyDocument: aws.String(awsConfig.Policy),
 				PolicyName:     aws.String(policyName),
 				Tags: []*awsIot.Tag{
@@ -236,7 +350,7 @@ func (s *awsService) UpdateConfiguration(ctx context.Context, input *cProvderApi
 				return &cProvderApi.UpdateConfigurationOutput{}, err
 			}
 
-			_, err = s.awsIotSvc.CreateProvisioningTemplate(&awsIot.CreateProvisioningTemplateInput{
+			_, err = s.awsIotSvc.CreateProvisioningTemplateWithContext(ctx, &awsIot.CreateProvisioningTemplateInput{
 				TemplateName:        aws.String(templateName),
 				Enabled:             aws.Bool(true),
 				Description:         aws.String("Created by AWS connector"),
@@ -250,7 +364,7 @@ func (s *awsService) UpdateConfiguration(ctx context.Context, input *cProvderApi
 				return &cProvderApi.UpdateConfigurationOutput{}, err
 			}
 
-			_, err = s.awsIotSvc.UpdateCACertificate(&awsIot.UpdateCACertificateInput{
+			_, err = s.awsIotSvc.UpdateCACertificateWithContext(ctx, &awsIot.UpdateCACertificateInput{
 				CertificateId:             ca.CertificateId,
 				NewAutoRegistrationStatus: aws.String("ENABLE"),
 				NewStatus:                 aws.String("ACTIVE"),
@@ -267,19 +381,109 @@ func (s *awsService) UpdateConfiguration(ctx context.Context, input *cProvderApi
 		}
 	}
 
-	s.db.DeleteAWSIoTCoreConfig(ctx)
+	s.invalidateConfigurationCache(ctx)
 
 	return &cProvderApi.UpdateConfigurationOutput{}, nil
 }
 
+const (
+	awsResourceTimeFormat = "2006-01-02_15-04-05"
+	lamassuThingGroup     = "LAMASSU"
+)
+
+// caPolicyNamePrefix is shared by every policy created for a CA. The creation time that
+// follows it sorts lexicographically, so the most recent policy has the greatest name.
+func caPolicyNamePrefix(caName string) string {
+	return "lms" + strings.ReplaceAll(caName, " ", "-") + "_"
+}
+
+// jitpTemplateBody is the provisioning template registered along a CA: it creates the thing
+// named after the certificate common name and attaches the CA policy to its certificate.
+func jitpTemplateBody(policyName string) string {
+	return fmt.Sprintf(
+		`{"Parameters":{"AWS::IoT::Certificate::CommonName":{"Type":"String"},"AWS::IoT::Certificate::Country":{"Type":"String"},"AWS::IoT::Certificate::Id":{"Type":"String"},"AWS::IoT::Certificate::SerialNumber":{"Type":"String"}},"Resources":{"thing":{"Type":"AWS::IoT::Thing","Properties":{"ThingName":{"Ref":"AWS::IoT::Certificate::CommonName"},"ThingGroups":["%s"],"AttributePayload":{}}},"certificate":{"Type":"AWS::IoT::Certificate","Properties":{"CertificateId":{"Ref":"AWS::IoT::Certificate::Id"},"Status":"ACTIVE"}},"policy":{"Type":"AWS::IoT::Policy","Properties":{"PolicyName":"%s"}}}}`,
+		lamassuThingGroup, policyName)
+}
+
 func (s *awsService) RegisterCA(ctx context.Context, input *cProvderApi.RegisterCAInput) (*cProvderApi.RegisterCAOutput, error) {
 	registrationCode, err := s.awsIotSvc.GetRegistrationCode(&awsIot.GetRegistrationCodeInput{})
 	if err != nil {
 		return &cProvderApi.RegisterCAOutput{}, err
 	}
 
+	var verificationCertPEM, caPEM []byte
+	if s.isDryRun(ctx) {
+		// Signing the verification certificate would issue a real certificate in Lamassu,
+		// the CA is registered without it in the plan.
+		recordPlannedCall(ctx, api.PlannedAWSCall{
+			Service:   "lamassu-ca",
+			Operation: "SignCertificateRequest",
+			Input: map[string]string{
+				"ca_name":     input.CAName,
+				"common_name": aws.StringValue(registrationCode.RegistrationCode),
+			},
+		})
+
+		caOutput, err := s.lamassuCAClient.GetCAByName(ctx, &caApi.GetCAByNameInput{
+			CAType: caApi.CATypePKI,
+			CAName: input.CAName,
+		})
+		if err != nil {
+			return &cProvderApi.RegisterCAOutput{}, err
+		}
+		caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caOutput.Certificate.Certificate.Raw})
+	} else {
+		verificationCertPEM, caPEM, err = s.signVerificationCertificate(ctx, input.CAName, aws.StringValue(registrationCode.RegistrationCode))
+		if err != nil {
+			return &cProvderApi.RegisterCAOutput{}, err
+		}
+	}
+
+	serialN := &awsIot.Tag{
+		Key:   aws.String("serialNumber"),
+		Value: aws.String(input.SerialNumber),
+	}
+	caname := &awsIot.Tag{
+		Key:   aws.String("lamassuCAName"),
+		Value: aws.String(input.CAName),
+	}
+	tags := []*awsIot.Tag{serialN, caname}
+	registerCAInput := &awsIot.RegisterCACertificateInput{
+		CaCertificate: aws.String(string(caPEM)),
+		Tags:          tags,
+	}
+	if verificationCertPEM != nil {
+		registerCAInput.VerificationCertificate = aws.String(string(verificationCertPEM))
+	}
+	registerCAResponse, err := s.awsIotSvc.RegisterCACertificateWithContext(ctx, registerCAInput)
+
+	if err != nil {
+		log.Error("Could not register CA Certificate in AWS")
+		return &cProvderApi.RegisterCAOutput{}, err
+	}
+
+	// The output is empty in dry run.
+	if registerCAResponse.CertificateId != nil {
+		err = s.db.UpdateAWSCAMapping(ctx, api.AWSCAMapping{
+			CAName:            input.CAName,
+			AWSCertificateID:  aws.StringValue(registerCAResponse.CertificateId),
+			AWSCertificateArn: aws.StringValue(registerCAResponse.CertificateArn),
+		})
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error storing the AWS CA of CA %s: ", input.CAName), err)
+		}
+	}
+
+	s.invalidateConfigurationCache(ctx)
+
+	return &cProvderApi.RegisterCAOutput{}, nil
+}
+
+// signVerificationCertificate has the Lamassu CA sign the verification certificate proving
+// the possession of the CA to AWS, whose common name is the registration code.
+func (s *awsService) signVerificationCertificate(ctx context.Context, caName string, registrationCode string) ([]byte, []byte, error) {
 	subj := pkix.Name{
-		CommonName: *registrationCode.RegistrationCode,
+		CommonName: registrationCode,
 	}
 	rawSubj := subj.ToRDNSequence()
 	asn1Subj, _ := asn1.Marshal(rawSubj)
@@ -292,53 +496,31 @@ func (s *awsService) RegisterCA(ctx context.Context, input *cProvderApi.Register
 	privKey, _ := rsa.GenerateKey(rand.Reader, 4096)
 	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &template, privKey)
 	if err != nil {
-		return &cProvderApi.RegisterCAOutput{}, err
+		return nil, nil, err
 	}
 
 	// Generate CSR for verification certificate
 	csr, err := x509.ParseCertificateRequest(csrBytes)
 	if err != nil {
-		return &cProvderApi.RegisterCAOutput{}, err
+		return nil, nil, err
 	}
 
 	// Sign verification certificate CSR
 	singOutput, err := s.lamassuCAClient.SignCertificateRequest(ctx, &caApi.SignCertificateRequestInput{
 		CAType:                    caApi.CATypePKI,
-		CAName:                    input.CAName,
+		CAName:                    caName,
 		CertificateSigningRequest: csr,
 		SignVerbatim:              false,
 		CommonName:                csr.Subject.CommonName,
 	})
 	if err != nil {
-		return &cProvderApi.RegisterCAOutput{}, err
+		return nil, nil, err
 	}
 
 	verificationCertPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: singOutput.Certificate.Raw})
 	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: singOutput.CACertificate.Raw})
 
-	serialN := &awsIot.Tag{
-		Key:   aws.String("serialNumber"),
-		Value: aws.String(input.SerialNumber),
-	}
-	caname := &awsIot.Tag{
-		Key:   aws.String("lamassuCAName"),
-		Value: aws.String(input.CAName),
-	}
-	tags := []*awsIot.Tag{serialN, caname}
-	_, err = s.awsIotSvc.RegisterCACertificate(&awsIot.RegisterCACertificateInput{
-		CaCertificate:           aws.String(string(caPEM)),
-		VerificationCertificate: aws.String(string(verificationCertPEM)),
-		Tags:                    tags,
-	})
-
-	if err != nil {
-		log.Error("Could not register CA Certificate in AWS")
-		return &cProvderApi.RegisterCAOutput{}, err
-	}
-
-	s.db.DeleteAWSIoTCoreConfig(ctx)
-
-	return &cProvderApi.RegisterCAOutput{}, nil
+	return verificationCertPEM, caPEM, nil
 }
 
 func (s *awsService) UpdateCAStatus(ctx context.Context, input *cProvderApi.UpdateCAStatusInput) (*cProvderApi.UpdateCAStatusOutput, error) {
@@ -347,12 +529,12 @@ func (s *awsService) UpdateCAStatus(ctx context.Context, input *cProvderApi.Upda
 		newStatus = "INACTIVE"
 	}
 
-	awsCA := s.getAWSCAByName(input.CAName)
+	awsCA := s.getAWSCAByName(ctx, input.CAName)
 	if awsCA == nil {
 		return &cProvderApi.UpdateCAStatusOutput{}, errors.New("CA not found in AWS IoT")
 	}
 
-	_, err := s.awsIotSvc.UpdateCACertificate(&awsIot.UpdateCACertificateInput{
+	_, err := s.awsIotSvc.UpdateCACertificateWithContext(ctx, &awsIot.UpdateCACertificateInput{
 		CertificateId: aws.String(*awsCA.CertificateId),
 		NewStatus:     aws.String(newStatus),
 	})
@@ -360,7 +542,7 @@ func (s *awsService) UpdateCAStatus(ctx context.Context, input *cProvderApi.Upda
 		return &cProvderApi.UpdateCAStatusOutput{}, err
 	}
 
-	err = s.db.DeleteAWSIoTCoreConfig(ctx)
+	err = s.invalidateConfigurationCache(ctx)
 	if err != nil {
 		return &cProvderApi.UpdateCAStatusOutput{}, err
 	}
@@ -369,83 +551,126 @@ func (s *awsService) UpdateCAStatus(ctx context.Context, input *cProvderApi.Upda
 }
 
 func (s *awsService) UpdateDMSCaCerts(ctx context.Context, input *cProvderApi.UpdateDMSCaCertsInput) (*cProvderApi.UpdateDMSCaCertsOutput, error) {
-	cas, err := s.dmsClient.CACerts(ctx, input.Name)
-	if err != nil {
-		return &cProvderApi.UpdateDMSCaCertsOutput{}, err
-	}
-	var caCerts []byte
-	for _, ca := range cas {
-		cacert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
-		caCerts = append(caCerts, cacert...)
-	}
-	topic := "dt/lms/well-known/" + input.Name + "/cacerts"
-	retained := true
-	_, err = s.awsIotData.Publish(&awsIotData.PublishInput{
-		Topic:   &topic,
-		Payload: caCerts,
-		Retain:  &retained,
-	})
-
 	dms, err := s.dmsClient.GetDMSByName(ctx, &dmsApi.GetDMSByNameInput{
 		Name: input.Name,
 	})
 	if err != nil {
 		log.Warn("Error obtaining the dms ", err)
+		return &cProvderApi.UpdateDMSCaCertsOutput{}, err
 	}
 
-	_, err = s.devManagerClient.IterateDevicesbyDMSWithPredicate(ctx, &devApi.IterateDevicesByDMSWithPredicateInput{
-		DmsName: input.Name,
-		PredicateFunc: func(d *devApi.Device) {
-			shadowPayload := api.DeviceShadowPayload{
-				State: api.StatePayload{
-					Desired: api.Desired{
-						CaCerts: api.ShadowCaCerts{
-							UpdateCaCerts: true,
-						},
-						Issuer:       api.ShadowIssuer{},
-						IdentityCert: api.ShadowIdentityCert{},
-						Slots:        api.ShadowSlots{},
-					},
-				},
-			}
-			payloadBytes, err := json.Marshal(shadowPayload)
-			if err != nil {
-				log.Warn("Error Marshalling shadow payload: ", err)
-			}
-			if dms.Aws.ShadowType == dmsApi.ShadowTypeClassic {
-				_, err = s.awsIotData.UpdateThingShadow(&awsIotData.UpdateThingShadowInput{
-					ThingName: &d.ID,
-					Payload:   payloadBytes,
-				})
-				if err != nil {
-					log.Warn("Error updating thing shadow: ", err)
-				}
-			} else {
-				_, err = s.awsIotData.UpdateThingShadow(&awsIotData.UpdateThingShadowInput{
-					ThingName:  &d.ID,
-					ShadowName: aws.String("lamassu-identity"),
-					Payload:    payloadBytes,
-				})
-				if err != nil {
-					log.Warn("Error updating thing shadow: ", err)
-
-				}
-			}
+	settings, err := s.getDMSAWSSettings(ctx, input.Name)
+	if err != nil {
+		log.Warn("Error obtaining the AWS settings of the dms ", err)
+	}
 
-		},
-	})
+	published, changed, err := s.publishDMSCABundle(ctx, input.Name, settings.CABundleFormat)
 	if err != nil {
+		log.Error("Error publishing the CA bundle: ", err)
 		return &cProvderApi.UpdateDMSCaCertsOutput{}, err
 	}
+	if published == nil {
+		return &cProvderApi.UpdateDMSCaCertsOutput{}, nil
+	}
+	if !changed {
+		return &cProvderApi.UpdateDMSCaCertsOutput{}, s.recordDMSCABundle(ctx, *published)
+	}
+
+	desired := api.Desired{
+		CaCerts: &api.ShadowCaCerts{
+			UpdateCaCerts: true,
+		},
+	}
+
+	if settings.DeliveryChannel == api.DeliveryChannelJobs && settings.ThingGroup != "" {
+		_, err = s.createIdentityJob(ctx, api.ShadowActionUpdateCACerts, []string{s.thingGroupArn(settings.ThingGroup)}, desired)
+		if err != nil {
+			return &cProvderApi.UpdateDMSCaCertsOutput{}, err
+		}
+		return &cProvderApi.UpdateDMSCaCertsOutput{}, s.recordDMSCABundle(ctx, *published)
+	}
+
+	reportID := s.startCACertsFanOut(ctx, &dms.DeviceManufacturingService, settings, *published, desired)
+	log.Info(fmt.Sprintf("updating the CA certificates of the devices of DMS %s, fan-out %s", input.Name, reportID))
+
 	return &cProvderApi.UpdateDMSCaCertsOutput{}, nil
 }
 
+// startCACertsFanOut asks every device of the DMS to update its CA certificates in the
+// background and returns the ID of the fan-out report, where the progress is recorded. The
+// updates of a DMS run one at a time under its lease; the bundle is recorded once every
+// device was told, otherwise the next update retries the fan-out.
+func (s *awsService) startCACertsFanOut(ctx context.Context, dms *dmsApi.DeviceManufacturingService, settings api.DMSAWSSettings, published api.CABundleState, desired api.Desired) string {
+	report := newShadowFanOutReport(dms.Name, api.ShadowActionUpdateCACerts)
+	s.saveShadowFanOutReport(ctx, report)
+
+	run := func() {
+		lease, err := s.waitLease(ctx, caCertsFanOutLease(dms.Name))
+		if err != nil {
+			s.finishShadowFanOut(ctx, report, err)
+			return
+		}
+		defer s.releaseLease(lease)
+		ctx := lease.ctx
+
+		// The outcome of every device is available in the fan-out reports of the DMS.
+		if settings.DeliveryChannel == api.DeliveryChannelJobs {
+			report = s.fanOutIdentityJobs(ctx, report, desired)
+		} else {
+			shadowLocation, err := s.waitDMSShadowLocation(ctx, dms)
+			if err != nil {
+				s.finishShadowFanOut(ctx, report, err)
+				return
+			}
+			report = s.fanOutAction(ctx, report, func(ctx context.Context, deviceID string) error {
+				return s.updateThingShadow(ctx, deviceID, shadowLocation, desired)
+			})
+		}
+		err = report.Err()
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error updating the CA certificates of the devices of DMS %s: ", dms.Name), err)
+			return
+		}
+
+		err = s.recordDMSCABundle(ctx, published)
+		if err != nil {
+			log.Warn("Error storing the CA bundle state: ", err)
+		}
+	}
+
+	// A dry run is planned within the request, so that the plan lists every call.
+	if s.isDryRun(ctx) {
+		run()
+		return report.ID
+	}
+
+	// The fan-out outlives the request, and so does its lease.
+	ctx = detachContext(ctx)
+	go run()
+
+	return report.ID
+}
+
 func (s *awsService) UpdateDeviceCertificateStatus(ctx context.Context, input *cProvderApi.UpdateDeviceCertificateStatusInput) (*cProvderApi.UpdateDeviceCertificateStatusOutput, error) {
 	deviceID := input.DeviceID
 	splitedDeviceID := strings.Split(deviceID, ":")
 	if len(splitedDeviceID) == 2 { // device is using SLOT ID
 		deviceID = splitedDeviceID[1]
 	}
+	defer s.invalidateDeviceConfigurationCache(ctx, deviceID)
+
+	updated, err := s.updateMappedCertificateStatus(ctx, input.CAName, input.SerialNumber, string(input.Status))
+	if err != nil {
+		log.Error("could not update iot certificate: ", err)
+		return &cProvderApi.UpdateDeviceCertificateStatusOutput{}, err
+	}
+	if updated {
+		if input.Status == awsIot.CertificateStatusActive {
+			// The device may have enrolled again through another DMS.
+			s.assignDeviceThingGroup(ctx, deviceID)
+		}
+		return &cProvderApi.UpdateDeviceCertificateStatusOutput{}, nil
+	}
 
 	searchResult, err := s.awsIotSvc.SearchIndex(&awsIot.SearchIndexInput{QueryString: aws.String("thingName:" + deviceID)})
 	if err != nil {
@@ -481,7 +706,7 @@ func (s *awsService) UpdateDeviceCertificateStatus(ctx context.Context, input *c
 			}
 
 			if utils.InsertNth(utils.ToHexInt(crt.SerialNumber), 2) == input.SerialNumber {
-				_, err = s.awsIotSvc.UpdateCertificate(&awsIot.UpdateCertificateInput{
+				_, err = s.awsIotSvc.UpdateCertificateWithContext(ctx, &awsIot.UpdateCertificateInput{
 					CertificateId: aws.String(certificateID),
 					NewStatus:     aws.String(string(input.Status)),
 				})
@@ -490,18 +715,27 @@ func (s *awsService) UpdateDeviceCertificateStatus(ctx context.Context, input *c
 					return &cProvderApi.UpdateDeviceCertificateStatusOutput{}, err
 				}
 
+				s.storeCertificateMapping(ctx, api.CertificateMapping{
+					CAName:            input.CAName,
+					SerialNumber:      input.SerialNumber,
+					AWSCertificateID:  certificateID,
+					AWSCertificateArn: *principal,
+				})
 				updatedThingCertifcate = true
 			}
 		}
 		if !updatedThingCertifcate {
 			log.Info("The device does not have the certificate yet. Registering manually")
+		} else if input.Status == awsIot.CertificateStatusActive {
+			// The device may have enrolled again through another DMS.
+			s.assignDeviceThingGroup(ctx, deviceID)
 		}
 	} else if len(searchResult.Things) > 1 {
 		log.Warn(fmt.Sprintf("Inconsistent thing repo: More than one result for [DeviceID]= %s", deviceID))
 	} else {
 		log.Info("No results with device ID")
 
-		_, err = s.awsIotSvc.CreateThing(&awsIot.CreateThingInput{
+		_, err = s.awsIotSvc.CreateThingWithContext(ctx, &awsIot.CreateThingInput{
 			ThingName: aws.String(deviceID),
 		})
 		if err != nil {
@@ -529,7 +763,7 @@ func (s *awsService) UpdateDeviceCertificateStatus(ctx context.Context, input *c
 		certificatePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateOutput.Certificate.Certificate.Raw})
 		caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caOutput.Certificate.Certificate.Raw})
 
-		registerCertificateResponse, err := s.awsIotSvc.RegisterCertificate(&awsIot.RegisterCertificateInput{
+		registerCertificateResponse, err := s.awsIotSvc.RegisterCertificateWithContext(ctx, &awsIot.RegisterCertificateInput{
 			CaCertificatePem: aws.String(string(caPEM)),
 			CertificatePem:   aws.String(string(certificatePEM)),
 			Status:           &input.Status,
@@ -540,21 +774,38 @@ func (s *awsService) UpdateDeviceCertificateStatus(ctx context.Context, input *c
 			return &cProvderApi.UpdateDeviceCertificateStatusOutput{}, err
 		}
 
-		_, err = s.awsIotSvc.AttachThingPrincipal(&awsIot.AttachThingPrincipalInput{
-			Principal: registerCertificateResponse.CertificateArn,
+		if registerCertificateResponse.CertificateId != nil {
+			s.storeCertificateMapping(ctx, api.CertificateMapping{
+				CAName:            input.CAName,
+				SerialNumber:      input.SerialNumber,
+				AWSCertificateID:  aws.StringValue(registerCertificateResponse.CertificateId),
+				AWSCertificateArn: aws.StringValue(registerCertificateResponse.CertificateArn),
+			})
+		}
+
+		certificateArn := registerCertificateResponse.CertificateArn
+		if certificateArn == nil {
+			// The output is empty in dry run, the certificate ID is its SHA-256 fingerprint.
+			fingerprint := sha256.Sum256(certificateOutput.Certificate.Certificate.Raw)
+			certificateArn = aws.String(s.certificateArn(hex.EncodeToString(fingerprint[:])))
+		}
+
+		_, err = s.awsIotSvc.AttachThingPrincipalWithContext(ctx, &awsIot.AttachThingPrincipalInput{
+			Principal: certificateArn,
 			ThingName: aws.String(deviceID),
 		})
 
 		if err != nil {
 			log.Error("could not attach iot thing principal: ", err)
 		}
+
+		s.assignDeviceThingGroup(ctx, deviceID)
 	}
 
-	// s.db.DeleteAWSIoTCoreThingConfig(ctx, input.DeviceID)
 	return &cProvderApi.UpdateDeviceCertificateStatusOutput{}, nil
 }
 
-func (s *awsService) GetConfiguration(ctx context.Context, input *cProvderApi.GetConfigurationInput) (*cProvderApi.GetConfigurationOutput, error) {
+func (s *awsService) describeConfiguration(ctx context.Context) (*cProvderApi.GetConfigurationOutput, error) {
 	endpointAddress := ""
 	endpointInfo, err := s.awsIotSvc.DescribeEndpoint(&awsIot.DescribeEndpointInput{EndpointType: aws.String("iot:Data")})
 	if err != nil {
@@ -684,51 +935,11 @@ func (s *awsService) GetConfiguration(ctx context.Context, input *cProvderApi.Ge
 
 }
 
-func (s *awsService) GetDeviceConfiguration(ctx context.Context, input *cProvderApi.GetDeviceConfigurationInput) (*cProvderApi.GetDeviceConfigurationOutput, error) {
+func (s *awsService) describeDeviceConfiguration(ctx context.Context, input *cProvderApi.GetDeviceConfigurationInput) (*cProvderApi.GetDeviceConfigurationOutput, error) {
 	searchResult, err := s.awsIotSvc.SearchIndex(&awsIot.SearchIndexInput{QueryString: aws.String("thingName:" + input.DeviceID)})
 
 	if err != nil && strings.Contains(err.Error(), "Index AWS_Things does not exist") {
-		_, err = s.awsIotSvc.UpdateIndexingConfiguration(&awsIot.UpdateIndexingConfigurationInput{
-			ThingIndexingConfiguration: &awsIot.ThingIndexingConfiguration{
-				ThingIndexingMode:             aws.String("REGISTRY_AND_SHADOW"),
-				ThingConnectivityIndexingMode: aws.String("STATUS"),
-				DeviceDefenderIndexingMode:    aws.String("OFF"),
-				NamedShadowIndexingMode:       aws.String("ON"),
-				Filter: &awsIot.IndexingFilter{
-					NamedShadowNames: aws.StringSlice([]string{"lamassu-identity"}),
-				},
-				ManagedFields: []*awsIot.Field{
-					{
-						Name: aws.String("connectivity.version"),
-						Type: aws.String("Number"),
-					},
-					{
-						Name: aws.String("connectivity.timestamp"),
-						Type: aws.String("Number"),
-					},
-					{
-						Name: aws.String("connectivity.connected"),
-						Type: aws.String("Boolean"),
-					},
-					{
-						Name: aws.String("thingId"),
-						Type: aws.String("String"),
-					},
-					{
-						Name: aws.String("thingName"),
-						Type: aws.String("String"),
-					},
-					{
-						Name: aws.String("registry.thingTypeName"),
-						Type: aws.String("String"),
-					},
-					{
-						Name: aws.String("registry.thingGroupNames"),
-						Type: aws.String("String"),
-					},
-				},
-			},
-		})
+		err = s.updateThingIndexingConfiguration(ctx)
 		if err != nil {
 			log.Error("could not update aws index configuration: ", err)
 		}
@@ -785,61 +996,107 @@ func (s *awsService) GetDeviceConfiguration(ctx context.Context, input *cProvder
 			thing.Certificates = append(thing.Certificates, thingCrt)
 		}
 
+		thing.CompletedActions, err = s.db.GetDeviceShadowActionCompletions(ctx, *thingResult.ThingName)
+		if err != nil {
+			log.Warn("could not read completed shadow actions: ", err)
+		}
+
+		thing.Jobs, err = s.getThingIdentityJobs(ctx, *thingResult.ThingName)
+		if err != nil {
+			log.Warn("could not list the identity jobs of the thing: ", err)
+		}
+
 		return &cProvderApi.GetDeviceConfigurationOutput{
 			Configuration: thing,
-		}, err
+		}, nil
 	}
 	return &cProvderApi.GetDeviceConfigurationOutput{}, errors.New("Device not found")
 }
 
-func (s *awsService) HandleUpdateCAStatus(ctx context.Context, input *api.HandleUpdateCAStatusInput) error {
-	log.Info(fmt.Sprintf("invalidating config cache due to CA update. caName:%s caSerialNumber:%s caID:%s status:%s", input.CaName, input.CaSerialNumber, input.CaID, input.Status))
-	s.db.DeleteAWSIoTCoreConfig(ctx)
-	return nil
-}
+func (s *awsService) HandleCloudEvents(ctx context.Context, event cloudevents.Event) error {
+	// Events are delivered at least once, the redeliveries of a handled event are ignored.
+	dedupKey := eventDedupKey(event)
+	processed, err := s.db.IsEventProcessed(ctx, dedupKey)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error checking whether event %s was processed: ", event.ID()), err)
+	}
+	if processed {
+		log.Debug(fmt.Sprintf("Skipping event %s, it was already processed", event.ID()))
+		return nil
+	}
 
-func (s *awsService) HandleUpdateConfiguration(ctx context.Context, config interface{}) error {
-	s.db.UpdateAWSIoTCoreConfig(ctx, config)
-	return nil
-}
+	// Every event is handled whatever its route, which only decides whether it is forwarded:
+	// the connector keeps AWS in sync with Lamassu even for the events nobody else needs.
+	s.invalidateCachesForEvent(ctx, event.Type())
 
-func (s *awsService) HandleUpdateThingConfiguration(ctx context.Context, deviceID string, config interface{}) error {
-	s.db.UpdateAWSIoTCoreThingConfig(ctx, deviceID, config)
-	return nil
-}
-func (s *awsService) HandleCloudEvents(ctx context.Context, event cloudevents.Event) error {
-	body, _ := json.Marshal(event)
-	msgBody := string(body)
-	// switch event.Type() {
-	// case "io.lamassuiot.dms.update":
-	// 	var data dmsApi.DeviceManufacturingServiceSerialized
-	// 	err := json.Unmarshal(event.Data(), &data)
-	// 	_, err = s.UpdateDMSCaCerts(ctx, &cProvderApi.UpdateDMSCaCertsInput{
-	// 		DeviceManufacturingService: data.Deserialize(),
-	// 	})
-	// 	return err
-	// case "io.lamassuiot.dms.update-authorizedcas":
-	// 	var data dmsApi.DeviceManufacturingServiceSerialized
-	// 	err := json.Unmarshal(event.Data(), &data)
-	// 	_, err = s.UpdateDMSCaCerts(ctx, &cProvderApi.UpdateDMSCaCertsInput{
-	// 		DeviceManufacturingService: data.Deserialize(),
-	// 	})
-	// 	return err
-	// }
-	s.sqsSvc.SendMessage(&sqs.SendMessageInput{
-		MessageBody: &msgBody,
-		QueueUrl:    &s.sqsOutboundURL,
-	})
+	handlingErr := s.handleLamassuEvent(ctx, event)
+	if handlingErr != nil {
+		// The event is not marked as processed, so that a redelivery handles it again. The
+		// reconciler repairs the status and CA bundle drifts it leaves otherwise.
+		log.Error(fmt.Sprintf("Error handling event %s of type %s: ", event.ID(), event.Type()), handlingErr)
+	}
+
+	route := api.RouteEvent(s.eventRoutingRules, event.Type(), event.Source(), event.Data())
+	if route.Action == api.EventRoutingActionForward {
+		// The forwarding is recorded apart from the handling: the redeliveries of an event
+		// whose handling failed are handled again, but not enqueued again.
+		forwardedKey := eventForwardedKey(dedupKey)
+		forwarded, err := s.db.IsEventProcessed(ctx, forwardedKey)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error checking whether event %s was forwarded: ", event.ID()), err)
+		}
+		if forwarded {
+			log.Debug(fmt.Sprintf("Not forwarding event %s again, it is already in the outbox", event.ID()))
+		} else {
+			// A failed delivery is retried from the outbox. RabbitMQ messages are acknowledged
+			// on receipt: returning an error does not requeue the event, it is not forwarded
+			// when it cannot be stored.
+			err = s.enqueueOutboundEvent(ctx, event, *route.Destination)
+			if err != nil {
+				log.Error(fmt.Sprintf("Error storing event %s in the outbox: ", event.ID()), err)
+				return err
+			}
+			if !s.isDryRun(ctx) {
+				err = s.db.MarkEventProcessed(ctx, forwardedKey)
+				if err != nil {
+					log.Warn(fmt.Sprintf("Error marking event %s as forwarded: ", event.ID()), err)
+				}
+			}
+		}
+	} else {
+		log.Debug(fmt.Sprintf("Not forwarding event %s of type %s, its route is %s", event.ID(), event.Type(), route.Action))
+	}
+
+	if handlingErr != nil {
+		return handlingErr
+	}
+	if s.isDryRun(ctx) {
+		return nil
+	}
+
+	err = s.db.MarkEventProcessed(ctx, dedupKey)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error marking event %s as processed: ", event.ID()), err)
+	}
 	return nil
 }
 
 func (s *awsService) HandleUpdateCertificateStatus(ctx context.Context, input *api.HandleUpdateCertificateStatusInput) error {
+	// The certificate status changed in AWS. The certificate is not mapped to its device, so
+	// every cached device configuration is dropped.
+	s.invalidateDeviceConfigurationCaches(ctx)
+
+	if s.isStatusChangeEcho(ctx, api.StatusChangeResourceCertificate, input.CertificateID, input.Status, input.CorrelationID) {
+		return nil
+	}
+
 	if input.Status == "REVOKED" {
+		reason := s.awsRevocationReason("Revoked in AWS IoT", input.Actor)
 		_, err := s.lamassuCAClient.RevokeCertificate(ctx, &caApi.RevokeCertificateInput{
 			CAType:                  caApi.CATypePKI,
 			CAName:                  input.CaName,
 			CertificateSerialNumber: input.SerialNumber,
-			RevocationReason:        "Revoked thorugh AWS",
+			RevocationReason:        reason,
 		})
 		if err != nil {
 			switch err.(type) {
@@ -850,6 +1107,7 @@ func (s *awsService) HandleUpdateCertificateStatus(ctx context.Context, input *a
 			}
 
 		}
+		log.WithFields(actorLogFields(input.Actor)).Info(fmt.Sprintf("Certificate %s/%s revoked in AWS, revoked in Lamassu: %s", input.CaName, input.SerialNumber, reason))
 	}
 	return nil
 }
@@ -858,7 +1116,43 @@ func (s *awsService) HandleUpdateCertificateStatus(ctx context.Context, input *a
 // ------------------------------------------------- Utils Functions -------------------------------------------------
 // ---------------------------------------------------------------------------------------------------------------------
 
-func (s *awsService) getAWSCAByName(caName string) *awsIot.CACertificate {
+// getAWSCAByName looks the AWS CA up through the stored mapping, falling back to matching
+// the common name of the registered CAs when the mapping is missing or stale.
+func (s *awsService) getAWSCAByName(ctx context.Context, caName string) *awsIot.CACertificate {
+	mapping, err := s.db.GetAWSCAMapping(ctx, caName)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error reading the AWS CA of CA %s: ", caName), err)
+	}
+	if mapping != nil {
+		describeOut, err := s.awsIotSvc.DescribeCACertificateWithContext(ctx, &awsIot.DescribeCACertificateInput{
+			CertificateId: aws.String(mapping.AWSCertificateID),
+		})
+		if err == nil {
+			return &awsIot.CACertificate{
+				CertificateArn: describeOut.CertificateDescription.CertificateArn,
+				CertificateId:  describeOut.CertificateDescription.CertificateId,
+				CreationDate:   describeOut.CertificateDescription.CreationDate,
+				Status:         describeOut.CertificateDescription.Status,
+			}
+		}
+		log.Warn(fmt.Sprintf("Error describing the mapped AWS CA %s of CA %s: ", mapping.AWSCertificateID, caName), err)
+	}
+
+	awsCA := s.findAWSCAByName(caName)
+	if awsCA != nil {
+		err = s.db.UpdateAWSCAMapping(ctx, api.AWSCAMapping{
+			CAName:            caName,
+			AWSCertificateID:  aws.StringValue(awsCA.CertificateId),
+			AWSCertificateArn: aws.StringValue(awsCA.CertificateArn),
+		})
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error storing the AWS CA of CA %s: ", caName), err)
+		}
+	}
+	return awsCA
+}
+
+func (s *awsService) findAWSCAByName(caName string) *awsIot.CACertificate {
 	listCAsResponse, err := s.awsIotSvc.ListCACertificates(&awsIot.ListCACertificatesInput{
 		AscendingOrder: aws.Bool(true),
 		PageSize:       aws.Int64(int64(50)),
@@ -890,3 +1184,55 @@ func (s *awsService) getAWSCAByName(caName string) *awsIot.CACertificate {
 
 	return listCAsResponse.Certificates[nameTagIdx]
 }
+
+// updateThingIndexingConfiguration enables the fleet index, restricting the indexed named
+// shadows to the ones Lamassu writes to.
+func (s *awsService) updateThingIndexingConfiguration(ctx context.Context) error {
+	shadowNames, err := s.lamassuShadowNames(ctx)
+	if err != nil {
+		log.Warn("Error listing the configured shadow names: ", err)
+	}
+
+	_, err = s.awsIotSvc.UpdateIndexingConfigurationWithContext(ctx, &awsIot.UpdateIndexingConfigurationInput{
+		ThingIndexingConfiguration: &awsIot.ThingIndexingConfiguration{
+			ThingIndexingMode:             aws.String("REGISTRY_AND_SHADOW"),
+			ThingConnectivityIndexingMode: aws.String("STATUS"),
+			DeviceDefenderIndexingMode:    aws.String("OFF"),
+			NamedShadowIndexingMode:       aws.String("ON"),
+			Filter: &awsIot.IndexingFilter{
+				NamedShadowNames: aws.StringSlice(shadowNames),
+			},
+			ManagedFields: []*awsIot.Field{
+				{
+					Name: aws.String("connectivity.version"),
+					Type: aws.String("Number"),
+				},
+				{
+					Name: aws.String("connectivity.timestamp"),
+					Type: aws.String("Number"),
+				},
+				{
+					Name: aws.String("connectivity.connected"),
+					Type: aws.String("Boolean"),
+				},
+				{
+					Name: aws.String("thingId"),
+					Type: aws.String("String"),
+				},
+				{
+					Name: aws.String("thingName"),
+					Type: aws.String("String"),
+				},
+				{
+					Name: aws.String("registry.thingTypeName"),
+					Type: aws.String("String"),
+				},
+				{
+					Name: aws.String("registry.thingGroupNames"),
+					Type: aws.String("String"),
+				},
+			},
+		},
+	})
+	return err
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsIotData "github.com/aws/aws-sdk-go/service/iotdataplane"
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	lamassuIdentityShadowName = "lamassu-identity"
+	maxShadowUpdateAttempts   = 5
+	shadowThrottlingBackoff   = 500 * time.Millisecond
+)
+
+func (s *awsService) HandleUpdateThingShadow(ctx context.Context, input *api.HandleUpdateThingShadowInput) error {
+	if input.ShadowName != "" {
+		shadowNames, err := s.lamassuShadowNames(ctx)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(shadowNames, input.ShadowName) {
+			return nil
+		}
+	}
+
+	desired := input.Document.State.Desired
+	reported := input.Document.State.Reported
+
+	clearedDesired := map[string]interface{}{}
+	clearedReported := map[string]interface{}{}
+	completed := []api.ShadowAction{}
+
+	if desired.CaCerts != nil && desired.CaCerts.UpdateCaCerts && reported.CaCerts != nil && reported.CaCerts.UpdateCaCerts {
+		clearedDesired["ca_certs"] = map[string]interface{}{"update_cacerts": nil}
+		clearedReported["ca_certs"] = map[string]interface{}{"update_cacerts": nil}
+		completed = append(completed, api.ShadowActionUpdateCACerts)
+	}
+
+	if desired.IdentityCert != nil && desired.IdentityCert.Rotate && reported.IdentityCert != nil && reported.IdentityCert.Rotate {
+		clearedDesired["identity_cert"] = map[string]interface{}{"rotate": nil}
+		clearedReported["identity_cert"] = map[string]interface{}{"rotate": nil}
+		completed = append(completed, api.ShadowActionRotateIdentityCert)
+	}
+
+	if desired.Slots != nil && desired.Slots.Devo != nil && desired.Slots.Devo.Update && reported.Slots != nil && reported.Slots.Devo != nil && reported.Slots.Devo.Update {
+		clearedDesired["slots"] = map[string]interface{}{"devo": map[string]interface{}{"update": nil}}
+		clearedReported["slots"] = map[string]interface{}{"devo": map[string]interface{}{"update": nil}}
+		completed = append(completed, api.ShadowActionUpdateDevoSlot)
+	}
+
+	if len(completed) == 0 {
+		return nil
+	}
+
+	var shadowName *string
+	if input.ShadowName != "" {
+		shadowName = aws.String(input.ShadowName)
+	}
+
+	// Setting a key to null removes it from the shadow, so the device stops receiving the
+	// delta and the next request for the same action starts from a clean state.
+	err := s.writeThingShadow(ctx, input.ThingName, shadowName, func(version int64) interface{} {
+		payload := map[string]interface{}{
+			"state": map[string]interface{}{
+				"desired":  clearedDesired,
+				"reported": clearedReported,
+			},
+		}
+		if version > 0 {
+			payload["version"] = version
+		}
+		return payload
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, action := range completed {
+		log.Info(fmt.Sprintf("thing %s completed shadow action %s (shadow version %d)", input.ThingName, action, input.Document.Version))
+		err = s.db.AddDeviceShadowActionCompletion(ctx, input.ThingName, api.ShadowActionCompletion{
+			Action:        action,
+			ShadowVersion: input.Document.Version,
+			CompletedAt:   time.Now(),
+		})
+		if err != nil {
+			log.Warn(fmt.Sprintf("could not record completion of %s for thing %s: ", action, input.ThingName), err)
+		}
+	}
+	s.invalidateDeviceConfigurationCache(ctx, input.ThingName)
+
+	return nil
+}
+
+// updateThingShadow writes a partial desired state into the Lamassu shadow of a thing.
+func (s *awsService) updateThingShadow(ctx context.Context, thingName string, location api.ShadowLocation, desired api.Desired) error {
+	return s.writeThingShadow(ctx, thingName, shadowLocationName(location), func(version int64) interface{} {
+		return api.DeviceShadowPayload{
+			State: api.StatePayload{
+				Desired: desired,
+			},
+			Version: version,
+		}
+	})
+}
+
+// writeThingShadow conditions every write on the shadow version read just before it, and
+// retries with a fresh version whenever AWS reports that someone else updated the shadow first.
+// Throttled calls are retried with an exponential backoff.
+func (s *awsService) writeThingShadow(ctx context.Context, thingName string, shadowName *string, payload func(version int64) interface{}) error {
+	for attempt := 1; ; attempt++ {
+		version, err := s.getThingShadowVersion(ctx, thingName, shadowName)
+		if err != nil {
+			if isThrottlingError(err) && attempt < maxShadowUpdateAttempts {
+				s.backOffThrottledShadowCall(ctx, thingName, attempt)
+				continue
+			}
+			return err
+		}
+
+		payloadBytes, err := json.Marshal(payload(version))
+		if err != nil {
+			return err
+		}
+
+		err = s.shadowLimiter.Wait(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.awsIotData.UpdateThingShadowWithContext(ctx, &awsIotData.UpdateThingShadowInput{
+			ThingName:  aws.String(thingName),
+			ShadowName: shadowName,
+			Payload:    payloadBytes,
+		})
+		if err == nil {
+			return nil
+		}
+
+		if attempt < maxShadowUpdateAttempts {
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == awsIotData.ErrCodeConflictException {
+				log.Debug(fmt.Sprintf("shadow version conflict for thing %s (version %d, attempt %d). Retrying", thingName, version, attempt))
+				continue
+			}
+			if isThrottlingError(err) {
+				s.backOffThrottledShadowCall(ctx, thingName, attempt)
+				continue
+			}
+		}
+
+		return err
+	}
+}
+
+func (s *awsService) backOffThrottledShadowCall(ctx context.Context, thingName string, attempt int) {
+	backoff := shadowThrottlingBackoff * time.Duration(1<<(attempt-1))
+	log.Debug(fmt.Sprintf("shadow call for thing %s throttled (attempt %d). Retrying in %s", thingName, attempt, backoff))
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(backoff):
+	}
+}
+
+func isThrottlingError(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == awsIotData.ErrCodeThrottlingException
+}
+
+// getThingShadowVersion returns the current version of the shadow, or 0 if the shadow has
+// not been created yet.
+func (s *awsService) getThingShadowVersion(ctx context.Context, thingName string, shadowName *string) (int64, error) {
+	err := s.shadowLimiter.Wait(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	output, err := s.awsIotData.GetThingShadowWithContext(ctx, &awsIotData.GetThingShadowInput{
+		ThingName:  aws.String(thingName),
+		ShadowName: shadowName,
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == awsIotData.ErrCodeResourceNotFoundException {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	var document api.DeviceShadowDocument
+	err = json.Unmarshal(output.Payload, &document)
+	if err != nil {
+		return 0, err
+	}
+
+	return document.Version, nil
+}
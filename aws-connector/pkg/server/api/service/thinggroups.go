@@ -0,0 +1,479 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsIot "github.com/aws/aws-sdk-go/service/iot"
+	"github.com/google/uuid"
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	"github.com/lamassuiot/aws-connector/pkg/server/api/errors"
+	devApi "github.com/lamassuiot/lamassuiot/pkg/device-manager/common/api"
+	dmsApi "github.com/lamassuiot/lamassuiot/pkg/dms-manager/common/api"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+)
+
+// dmsThingGroupPrefix names the thing groups created for the DMSs without a thing group in
+// their AWS settings.
+const dmsThingGroupPrefix = "lms-dms-"
+
+var invalidThingGroupCharacters = regexp.MustCompile(`[^a-zA-Z0-9:_-]`)
+
+// dmsThingGroup is the thing group the devices of a DMS are kept in. The DMS names that are
+// not valid group names as they are get a hash of the name appended once fixed, so that two
+// DMSs never share a group, e.g. a.b and a-b.
+func dmsThingGroup(settings api.DMSAWSSettings) string {
+	if settings.ThingGroup != "" {
+		return settings.ThingGroup
+	}
+
+	name := dmsThingGroupPrefix + invalidThingGroupCharacters.ReplaceAllString(settings.DMSName, "-")
+	if name == dmsThingGroupPrefix+settings.DMSName && len(name) <= 128 {
+		return name
+	}
+
+	hash := sha256.Sum256([]byte(settings.DMSName))
+	suffix := "-" + hex.EncodeToString(hash[:])[:8]
+	if len(name) > 128-len(suffix) {
+		name = name[:128-len(suffix)]
+	}
+	return name + suffix
+}
+
+// SyncDMSThingGroups makes sure that the things of the Lamassu devices are in the thing group
+// of their DMS, and not in the groups the connector created for the other DMSs, and that the
+// DMS policies are attached to the groups. Things provisioned by JITP join their DMS group
+// this way, as AWS does not know their DMS.
+func (s *awsService) SyncDMSThingGroups(ctx context.Context, input *api.SyncDMSThingGroupsInput) (*api.SyncDMSThingGroupsOutput, error) {
+	if !s.dmsThingGroups {
+		return &api.SyncDMSThingGroupsOutput{}, &errors.GenericError{
+			Message:    "the DMS thing groups are disabled",
+			StatusCode: 409,
+		}
+	}
+	lease, err := s.acquireLease(ctx, thingGroupSyncLease)
+	if err != nil {
+		return &api.SyncDMSThingGroupsOutput{}, err
+	}
+	if lease == nil {
+		return &api.SyncDMSThingGroupsOutput{}, &errors.GenericError{
+			Message:    "a thing group sync is already running",
+			StatusCode: 409,
+		}
+	}
+	defer s.releaseLease(lease)
+	ctx = lease.ctx
+
+	dryRun := input.DryRun || s.isDryRun(ctx)
+	report := &api.DMSThingGroupSyncReport{
+		ID:        uuid.NewString(),
+		DryRun:    dryRun,
+		StartedAt: time.Now(),
+		Moves:     []api.ThingGroupMove{},
+		Errors:    []string{},
+	}
+
+	dmsNames := []string{}
+	_, err = s.dmsClient.IterateDMSsWithPredicate(ctx, &dmsApi.IterateDMSsWithPredicateInput{
+		PredicateFunc: func(dms *dmsApi.DeviceManufacturingService) {
+			dmsNames = append(dmsNames, dms.Name)
+		},
+	})
+	if err != nil {
+		return &api.SyncDMSThingGroupsOutput{}, err
+	}
+
+	ownedGroups, err := s.ownedThingGroupNames(ctx)
+	if err != nil {
+		return &api.SyncDMSThingGroupsOutput{}, err
+	}
+
+	for _, dmsName := range dmsNames {
+		err = s.syncDMSThingGroup(ctx, report, dmsName, ownedGroups)
+		if err != nil {
+			log.Warn(fmt.Sprintf("thing group sync could not check DMS %s: ", dmsName), err)
+			report.Errors = append(report.Errors, fmt.Sprintf("could not check DMS %s: %s", dmsName, err))
+		}
+		report.DMSs++
+	}
+
+	now := time.Now()
+	report.FinishedAt = &now
+	log.Info(fmt.Sprintf("thing group sync %s finished: %d devices checked, %d things out of their DMS group", report.ID, report.Devices, len(report.Moves)))
+
+	return &api.SyncDMSThingGroupsOutput{
+		DMSThingGroupSyncReport: *report,
+	}, nil
+}
+
+func (s *awsService) syncDMSThingGroup(ctx context.Context, report *api.DMSThingGroupSyncReport, dmsName string, ownedGroups []string) error {
+	settings, err := s.getDMSAWSSettings(ctx, dmsName)
+	if err != nil {
+		return err
+	}
+	group := dmsThingGroup(settings)
+
+	if !report.DryRun {
+		err = s.ensureDMSThingGroup(ctx, settings)
+		if err != nil {
+			return err
+		}
+	}
+
+	members := map[string]bool{}
+	err = s.awsIotSvc.ListThingsInThingGroupPagesWithContext(ctx, &awsIot.ListThingsInThingGroupInput{
+		ThingGroupName: aws.String(group),
+	}, func(page *awsIot.ListThingsInThingGroupOutput, lastPage bool) bool {
+		for _, thingName := range page.Things {
+			members[aws.StringValue(thingName)] = true
+		}
+		return true
+	})
+	// The group does not exist yet in dry run.
+	if aerr, ok := err.(awserr.Error); err != nil && (!ok || aerr.Code() != awsIot.ErrCodeResourceNotFoundException) {
+		return err
+	}
+
+	deviceIDs := []string{}
+	_, err = s.devManagerClient.IterateDevicesbyDMSWithPredicate(ctx, &devApi.IterateDevicesByDMSWithPredicateInput{
+		DmsName: dmsName,
+		PredicateFunc: func(device *devApi.Device) {
+			// Devices pending provisioning have no thing yet and the thing of a
+			// decommissioned device may already be gone.
+			if device.Status == devApi.DeviceStatusPendingProvisioning || device.Status == devApi.DeviceStatusDecommissioned {
+				return
+			}
+			deviceIDs = append(deviceIDs, device.ID)
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, deviceID := range deviceIDs {
+		report.Devices++
+		if members[deviceID] {
+			// Things leaving another DMS group are found when the DMS they joined is checked.
+			continue
+		}
+
+		move, err := s.moveThingToDMSGroup(ctx, deviceID, dmsName, group, ownedGroups, report.DryRun)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error reading the thing groups of %s: ", deviceID), err)
+			report.Errors = append(report.Errors, fmt.Sprintf("could not check thing %s: %s", deviceID, err))
+			continue
+		}
+		if move != nil {
+			report.Moves = append(report.Moves, *move)
+		}
+	}
+
+	return nil
+}
+
+// assignDeviceThingGroup puts the thing of a device in the thing group of its DMS, as soon as
+// the connector registers its certificate, without waiting for the next sync.
+func (s *awsService) assignDeviceThingGroup(ctx context.Context, deviceID string) {
+	if !s.dmsThingGroups {
+		return
+	}
+
+	device, err := s.devManagerClient.GetDeviceById(ctx, deviceID)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error obtaining the DMS of device %s: ", deviceID), err)
+		return
+	}
+	settings, err := s.getDMSAWSSettings(ctx, device.DmsName)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error obtaining the AWS settings of DMS %s: ", device.DmsName), err)
+		return
+	}
+
+	group := dmsThingGroup(settings)
+	err = s.createDMSThingGroup(ctx, group)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error creating the thing group of DMS %s: ", device.DmsName), err)
+		return
+	}
+
+	ownedGroups, err := s.ownedThingGroupNames(ctx)
+	if err != nil {
+		log.Warn("Error listing the DMS thing groups: ", err)
+		return
+	}
+	_, err = s.moveThingToDMSGroup(ctx, deviceID, device.DmsName, group, ownedGroups, false)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error reading the thing groups of %s: ", deviceID), err)
+	}
+}
+
+// moveThingToDMSGroup adds a thing to the group of its DMS, removing it from the groups the
+// connector created for the other DMSs. It returns nil when the thing does not exist or is
+// already where it belongs. Errors moving the thing are reported in the move.
+func (s *awsService) moveThingToDMSGroup(ctx context.Context, thingName string, dmsName string, group string, ownedGroups []string, dryRun bool) (*api.ThingGroupMove, error) {
+	inGroup := false
+	removeFrom := []string{}
+	err := s.awsIotSvc.ListThingGroupsForThingPagesWithContext(ctx, &awsIot.ListThingGroupsForThingInput{
+		ThingName: aws.String(thingName),
+	}, func(page *awsIot.ListThingGroupsForThingOutput, lastPage bool) bool {
+		for _, thingGroup := range page.ThingGroups {
+			name := aws.StringValue(thingGroup.GroupName)
+			if name == group {
+				inGroup = true
+			} else if isOwnedThingGroup(name, ownedGroups) {
+				removeFrom = append(removeFrom, name)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == awsIot.ErrCodeResourceNotFoundException {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if inGroup && len(removeFrom) == 0 {
+		return nil, nil
+	}
+
+	move := &api.ThingGroupMove{
+		ThingName:   thingName,
+		DMSName:     dmsName,
+		ThingGroup:  group,
+		RemovedFrom: removeFrom,
+	}
+	if !dryRun {
+		input := &awsIot.UpdateThingGroupsForThingInput{
+			ThingName:           aws.String(thingName),
+			ThingGroupsToRemove: aws.StringSlice(removeFrom),
+		}
+		if !inGroup {
+			input.ThingGroupsToAdd = aws.StringSlice([]string{group})
+		}
+		_, err = s.awsIotSvc.UpdateThingGroupsForThingWithContext(ctx, input)
+		if err == nil {
+			_, err = s.awsIotSvc.UpdateThingWithContext(ctx, &awsIot.UpdateThingInput{
+				ThingName: aws.String(thingName),
+				AttributePayload: &awsIot.AttributePayload{
+					Attributes: map[string]*string{
+						thingAttributeDeviceID: aws.String(thingName),
+						thingAttributeDMSName:  aws.String(dmsName),
+					},
+					Merge: aws.Bool(true),
+				},
+			})
+		}
+		if err != nil {
+			move.Error = err.Error()
+		} else {
+			move.Moved = true
+		}
+	}
+
+	s.recordThingGroupMove(move, dryRun)
+	return move, nil
+}
+
+func (s *awsService) recordThingGroupMove(move *api.ThingGroupMove, dryRun bool) {
+	result := "reported"
+	switch {
+	case move.Error != "":
+		result = "failed"
+	case move.Moved:
+		result = "moved"
+	}
+
+	logEntry := log.WithFields(log.Fields{
+		"thing_name":   move.ThingName,
+		"dms_name":     move.DMSName,
+		"thing_group":  move.ThingGroup,
+		"removed_from": move.RemovedFrom,
+		"result":       result,
+		"dry_run":      dryRun,
+	})
+	if move.Error != "" {
+		logEntry.Error("could not move the thing to the group of its DMS: ", move.Error)
+	} else {
+		logEntry.Info("thing moved to the group of its DMS")
+	}
+
+	metrics.IncrCounterWithLabels([]string{"thing_groups", "moved"}, 1, []metrics.Label{
+		{Name: "dms_name", Value: move.DMSName},
+		{Name: "result", Value: result},
+	})
+}
+
+// ensureDMSThingGroup creates the thing group of a DMS, under the root group when one is
+// configured, and attaches the DMS policies to it.
+func (s *awsService) ensureDMSThingGroup(ctx context.Context, settings api.DMSAWSSettings) error {
+	if s.dmsThingGroupRoot != "" {
+		_, err := s.ensureThingGroup(ctx, s.dmsThingGroupRoot, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	group := dmsThingGroup(settings)
+	err := s.createDMSThingGroup(ctx, group)
+	if err != nil {
+		return err
+	}
+
+	return s.syncThingGroupPolicies(ctx, group, settings.Policies)
+}
+
+// createDMSThingGroup creates the thing group of a DMS under the root group, recording that
+// the connector owns it when it did not exist.
+func (s *awsService) createDMSThingGroup(ctx context.Context, group string) error {
+	created, err := s.ensureThingGroup(ctx, group, s.dmsThingGroupRoot)
+	if err != nil || !created || s.isDryRun(ctx) {
+		return err
+	}
+
+	ownership, err := s.getThingGroupOwnership(ctx, group)
+	if err != nil {
+		return err
+	}
+	ownership.Created = true
+	return s.db.UpdateThingGroupOwnership(ctx, ownership)
+}
+
+// syncThingGroupPolicies attaches the policies to a thing group, and detaches the policies the
+// connector attached that are no longer listed. The policies attached by others are left, even
+// when they are listed, so that removing them from the DMS settings does not detach them.
+func (s *awsService) syncThingGroupPolicies(ctx context.Context, group string, policies []string) error {
+	target := aws.String(s.thingGroupArn(group))
+
+	ownership, err := s.getThingGroupOwnership(ctx, group)
+	if err != nil {
+		return err
+	}
+
+	attached := []string{}
+	err = s.awsIotSvc.ListAttachedPoliciesPagesWithContext(ctx, &awsIot.ListAttachedPoliciesInput{
+		Target: target,
+	}, func(page *awsIot.ListAttachedPoliciesOutput, lastPage bool) bool {
+		for _, policy := range page.Policies {
+			attached = append(attached, aws.StringValue(policy.PolicyName))
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	// The policies detached by others since are no longer the connector's.
+	owned := []string{}
+	for _, policy := range ownership.AttachedPolicies {
+		if slices.Contains(attached, policy) {
+			owned = append(owned, policy)
+		}
+	}
+
+	err = s.attachThingGroupPolicies(ctx, group, policies, attached, &owned)
+	if err == nil {
+		err = s.detachThingGroupPolicies(ctx, group, policies, &owned)
+	}
+
+	// What was done before an error is recorded as well.
+	if s.isDryRun(ctx) {
+		return err
+	}
+	ownership.AttachedPolicies = owned
+	updateErr := s.db.UpdateThingGroupOwnership(ctx, ownership)
+	if err != nil {
+		return err
+	}
+	return updateErr
+}
+
+func (s *awsService) attachThingGroupPolicies(ctx context.Context, group string, policies []string, attached []string, owned *[]string) error {
+	for _, policy := range policies {
+		if slices.Contains(attached, policy) {
+			continue
+		}
+		_, err := s.awsIotSvc.AttachPolicyWithContext(ctx, &awsIot.AttachPolicyInput{
+			PolicyName: aws.String(policy),
+			Target:     aws.String(s.thingGroupArn(group)),
+		})
+		if err != nil {
+			return fmt.Errorf("attaching policy %s to thing group %s: %w", policy, group, err)
+		}
+		*owned = append(*owned, policy)
+		log.Info(fmt.Sprintf("policy %s attached to thing group %s", policy, group))
+	}
+	return nil
+}
+
+func (s *awsService) detachThingGroupPolicies(ctx context.Context, group string, policies []string, owned *[]string) error {
+	kept := []string{}
+	for i, policy := range *owned {
+		if slices.Contains(policies, policy) {
+			kept = append(kept, policy)
+			continue
+		}
+		_, err := s.awsIotSvc.DetachPolicyWithContext(ctx, &awsIot.DetachPolicyInput{
+			PolicyName: aws.String(policy),
+			Target:     aws.String(s.thingGroupArn(group)),
+		})
+		if err != nil {
+			*owned = append(kept, (*owned)[i:]...)
+			return fmt.Errorf("detaching policy %s from thing group %s: %w", policy, group, err)
+		}
+		log.Info(fmt.Sprintf("policy %s detached from thing group %s", policy, group))
+	}
+	*owned = kept
+	return nil
+}
+
+// getThingGroupOwnership returns what the connector did to a thing group, nothing for the
+// groups it never changed.
+func (s *awsService) getThingGroupOwnership(ctx context.Context, group string) (api.ThingGroupOwnership, error) {
+	ownership, err := s.db.GetThingGroupOwnership(ctx, group)
+	if err != nil {
+		return api.ThingGroupOwnership{}, err
+	}
+	if ownership == nil {
+		return api.ThingGroupOwnership{
+			ThingGroup:       group,
+			AttachedPolicies: []string{},
+		}, nil
+	}
+	return *ownership, nil
+}
+
+// ownedThingGroupNames returns the thing groups the connector created for the DMSs.
+func (s *awsService) ownedThingGroupNames(ctx context.Context) ([]string, error) {
+	groups := []string{}
+	ownerships, err := s.db.ListThingGroupOwnerships(ctx)
+	if err != nil {
+		return groups, err
+	}
+
+	for _, ownership := range ownerships {
+		if ownership.Created {
+			groups = append(groups, ownership.ThingGroup)
+		}
+	}
+	return groups, nil
+}
+
+// isOwnedThingGroup reports whether the connector manages the members of a thing group. The
+// groups named after a DMS are recognised by their prefix, as they may have been created before
+// the connector recorded the groups it creates. The groups supplied by the operator, such as
+// the LAMASSU group JITP puts every thing in, are never managed.
+func isOwnedThingGroup(group string, ownedGroups []string) bool {
+	if group == lamassuThingGroup {
+		return false
+	}
+	return strings.HasPrefix(group, dmsThingGroupPrefix) || slices.Contains(ownedGroups, group)
+}
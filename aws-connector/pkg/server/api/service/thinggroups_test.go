@@ -0,0 +1,63 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+)
+
+func TestDMSThingGroup(t *testing.T) {
+	long := strings.Repeat("d", 130)
+
+	testCases := []struct {
+		name     string
+		settings api.DMSAWSSettings
+		want     string
+	}{
+		{
+			name:     "valid name",
+			settings: api.DMSAWSSettings{DMSName: "a-b"},
+			want:     "lms-dms-a-b",
+		},
+		{
+			name:     "thing group of the settings",
+			settings: api.DMSAWSSettings{DMSName: "a.b", ThingGroup: "my-group"},
+			want:     "my-group",
+		},
+		{
+			name:     "fixed name",
+			settings: api.DMSAWSSettings{DMSName: "a.b"},
+			want:     "lms-dms-a-b-2e7336dc",
+		},
+		{
+			name:     "truncated name",
+			settings: api.DMSAWSSettings{DMSName: long},
+			want:     "lms-dms-" + long[:111] + "-1b8d6559",
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			got := dmsThingGroup(tc.settings)
+			if got != tc.want {
+				t.Errorf("dmsThingGroup() = %s, want %s", got, tc.want)
+			}
+			if len(got) > 128 {
+				t.Errorf("dmsThingGroup() is %d characters long", len(got))
+			}
+		})
+	}
+}
+
+func TestDMSThingGroupsDoNotCollide(t *testing.T) {
+	groups := map[string]string{}
+	for _, dmsName := range []string{"a-b", "a.b", "a b", "a/b", strings.Repeat("d", 130), strings.Repeat("d", 131)} {
+		group := dmsThingGroup(api.DMSAWSSettings{DMSName: dmsName})
+		if other, ok := groups[group]; ok {
+			t.Fatalf("DMSs %q and %q share the thing group %s", other, dmsName, group)
+		}
+		groups[group] = dmsName
+	}
+}
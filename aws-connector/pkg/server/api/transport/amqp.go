@@ -4,26 +4,32 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 
+	metrics "github.com/armon/go-metrics"
 	cloudevents "github.com/cloudevents/sdk-go/v2"
 	amqptransport "github.com/go-kit/kit/transport/amqp"
+	"github.com/lamassuiot/aws-connector/pkg/events"
 	"github.com/lamassuiot/aws-connector/pkg/server/api/endpoint"
 	"github.com/lamassuiot/aws-connector/pkg/server/api/service"
+	log "github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
 )
 
-func MakeAmqpHandler(s service.Service) *amqptransport.Subscriber {
+// MakeAmqpHandler subscribes the connector to the Lamassu events. The events of a registered
+// type are validated, and rejected when invalid. The events of an unregistered type are
+// handled and routed without validation when forwardUnknownEvents is set, and rejected
+// otherwise.
+func MakeAmqpHandler(s service.Service, forwardUnknownEvents bool) *amqptransport.Subscriber {
 	endpoints := endpoint.MakeServerEndpoints(s)
 	options := []amqptransport.SubscriberOption{}
 
 	// AMQP Subscribers
 	lamassuEventsSubscriber := amqptransport.NewSubscriber(
 		endpoints.HandleCloudEvents,
-		decodeCloudEventAMQPRequest,
+		makeCloudEventAMQPDecoder(forwardUnknownEvents),
 		amqptransport.EncodeJSONResponse,
-		append(
-			options,
-		)...,
+		options...,
 	)
 
 	return lamassuEventsSubscriber
@@ -35,16 +41,32 @@ func DecodeB64(message string) (string, error) {
 	return string(base64Text), err
 }
 
-func decodeCloudEventAMQPRequest(ctx context.Context, delivery *amqp.Delivery) (interface{}, error) {
-	var event cloudevents.Event
-	err := json.Unmarshal(delivery.Body, &event)
-	if err != nil {
-		return nil, err
-	}
+func makeCloudEventAMQPDecoder(forwardUnknownEvents bool) amqptransport.DecodeRequestFunc {
+	return func(ctx context.Context, delivery *amqp.Delivery) (interface{}, error) {
+		var event cloudevents.Event
+		err := json.Unmarshal(delivery.Body, &event)
+		if err != nil {
+			log.Warn("Rejecting AMQP message, it is not a CloudEvent: ", err)
+			return nil, err
+		}
 
-	if err != nil {
-		return nil, err
-	}
+		if forwardUnknownEvents && !events.Registered(event.Type()) {
+			err = event.Validate()
+			if err != nil {
+				log.Warn(fmt.Sprintf("Rejecting event %s, it is not a valid CloudEvent: ", event.ID()), err)
+				return nil, err
+			}
+			metrics.IncrCounterWithLabels([]string{"events", "unvalidated"}, 1, []metrics.Label{{Name: "type", Value: event.Type()}, {Name: "direction", Value: string(events.DirectionLamassuToAWS)}})
+			log.Debug(fmt.Sprintf("Event %s is of the unregistered type %s, it is forwarded without validation", event.ID(), event.Type()))
+			return event, nil
+		}
 
-	return event, nil
+		err = events.Validate(event, events.DirectionLamassuToAWS)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Rejecting event %s: ", event.ID()), err)
+			return nil, err
+		}
+
+		return event, nil
+	}
 }
@@ -0,0 +1,34 @@
+package transport
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/lamassuiot/aws-connector/pkg/server/api/service"
+)
+
+// RefreshQueryParam requests the configuration to be read from AWS instead of the cache.
+const RefreshQueryParam = "refresh"
+
+// MakeCacheRefreshHandler bypasses the configuration cache for the requests sent with
+// Cache-Control: no-cache or ?refresh=true.
+func MakeCacheRefreshHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		refresh, err := parseBoolQueryParam(r, RefreshQueryParam)
+		if err != nil {
+			encodeError(r.Context(), err, w)
+			return
+		}
+
+		for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+				refresh = true
+			}
+		}
+
+		if refresh {
+			r = r.WithContext(service.WithCacheRefresh(r.Context()))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
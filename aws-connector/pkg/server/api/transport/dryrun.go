@@ -0,0 +1,94 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	"github.com/lamassuiot/aws-connector/pkg/server/api/errors"
+	"github.com/lamassuiot/aws-connector/pkg/server/api/service"
+)
+
+// DryRunHeader requests a dry run of a single request.
+const DryRunHeader = "X-Dry-Run"
+
+type dryRunResponse struct {
+	DryRun       bool                 `json:"dry_run"`
+	PlannedCalls []api.PlannedAWSCall `json:"planned_calls"`
+	// StatusCode and Response are the ones the request got without the AWS calls.
+	StatusCode int             `json:"status_code"`
+	Response   json.RawMessage `json:"response,omitempty"`
+}
+
+// bufferedResponseWriter holds a response until the planned AWS calls are known.
+type bufferedResponseWriter struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *bufferedResponseWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+}
+
+// MakeDryRunHandler answers the requests run in dry run with the AWS calls they would have
+// made. In dry run mode, requests that would not have modified AWS get their usual response.
+func MakeDryRunHandler(next http.Handler, dryRun bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested := false
+		if value := r.Header.Get(DryRunHeader); value != "" {
+			var err error
+			requested, err = strconv.ParseBool(value)
+			if err != nil {
+				encodeError(r.Context(), &errors.ValidationError{Msg: DryRunHeader + " must be a boolean"}, w)
+				return
+			}
+		}
+
+		if !requested && !dryRun {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := service.WithDryRun(r.Context())
+		buffered := &bufferedResponseWriter{
+			header:     http.Header{},
+			statusCode: http.StatusOK,
+		}
+		next.ServeHTTP(buffered, r.WithContext(ctx))
+
+		plannedCalls := service.DryRunPlannedCalls(ctx)
+		if !requested && len(plannedCalls) == 0 {
+			for key, values := range buffered.header {
+				w.Header()[key] = values
+			}
+			w.WriteHeader(buffered.statusCode)
+			w.Write(buffered.body.Bytes())
+			return
+		}
+
+		response := buffered.body.Bytes()
+		if !json.Valid(response) {
+			response, _ = json.Marshal(buffered.body.String())
+		}
+
+		w.Header().Set(DryRunHeader, "true")
+		encodeJSONResponse(context.Background(), w, dryRunResponse{
+			DryRun:       true,
+			PlannedCalls: plannedCalls,
+			StatusCode:   buffered.statusCode,
+			Response:     response,
+		})
+	})
+}
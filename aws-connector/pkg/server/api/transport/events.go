@@ -0,0 +1,161 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"github.com/lamassuiot/aws-connector/pkg/server/api/endpoint"
+	"github.com/lamassuiot/aws-connector/pkg/server/api/errors"
+	"github.com/lamassuiot/aws-connector/pkg/server/api/service"
+	log "github.com/sirupsen/logrus"
+)
+
+// Headers authenticating the events posted to the ingestion endpoint. The signature is the
+// hex encoded HMAC-SHA256 of "<timestamp>.<body>", prefixed by "sha256=".
+const (
+	APIKeyHeader             = "X-Api-Key"
+	SignatureHeader          = "X-Lamassu-Signature"
+	SignatureTimestampHeader = "X-Lamassu-Timestamp"
+)
+
+// Signed requests older or newer than signatureTolerance are rejected, so that they cannot be
+// replayed later.
+const signatureTolerance = 5 * time.Minute
+
+// maxEventSize is the size limit of the EventBridge events.
+const maxEventSize = 256 * 1024
+
+// EventIngestionAuth holds the credentials accepted by the ingestion endpoint. A request is
+// authenticated by either of them.
+type EventIngestionAuth struct {
+	APIKey     string
+	HMACSecret string
+}
+
+func (a EventIngestionAuth) Enabled() bool {
+	return a.APIKey != "" || a.HMACSecret != ""
+}
+
+// MakeCloudEventsHandler accepts the AWS events posted as CloudEvents, in structured or binary
+// content mode, and hands them to the same endpoints as the SQS consumer.
+func MakeCloudEventsHandler(s service.Service, auth EventIngestionAuth) http.Handler {
+	e := endpoint.MakeServerEndpoints(s)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			encodeError(ctx, &errors.GenericError{Message: "method not allowed", StatusCode: http.StatusMethodNotAllowed}, w)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxEventSize))
+		if err != nil {
+			encodeError(ctx, &errors.GenericError{Message: fmt.Sprintf("events are limited to %d bytes", maxEventSize), StatusCode: http.StatusRequestEntityTooLarge}, w)
+			return
+		}
+
+		err = auth.authenticate(r.Header, body, time.Now())
+		if err != nil {
+			log.Warn("Rejecting unauthenticated event: ", err)
+			encodeError(ctx, err, w)
+			return
+		}
+
+		event, err := decodeHTTPCloudEvent(r, body)
+		if err != nil {
+			encodeError(ctx, &errors.ValidationError{Msg: err.Error()}, w)
+			return
+		}
+
+		err = handleInboundEvent(ctx, *event, e)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Error handling event %s posted through HTTP: ", event.ID()), err)
+			encodeError(ctx, err, w)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// decodeHTTPCloudEvent reads the event in binary or structured content mode. EventBridge API
+// destinations post JSON documents as application/json, which are read as structured events.
+func decodeHTTPCloudEvent(r *http.Request, body []byte) (*cloudevents.Event, error) {
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	message := cehttp.NewMessageFromHttpRequest(r)
+	if message.ReadEncoding() != binding.EncodingUnknown {
+		event, err := binding.ToEvent(r.Context(), message)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CloudEvent: %w", err)
+		}
+		return event, nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return nil, fmt.Errorf("the request is not a CloudEvent in binary or structured content mode")
+	}
+
+	event := cloudevents.NewEvent()
+	err := json.Unmarshal(body, &event)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CloudEvent: %w", err)
+	}
+	return &event, nil
+}
+
+func (a EventIngestionAuth) authenticate(header http.Header, body []byte, now time.Time) error {
+	if apiKey := header.Get(APIKeyHeader); apiKey != "" && a.APIKey != "" {
+		if subtle.ConstantTimeCompare([]byte(apiKey), []byte(a.APIKey)) == 1 {
+			return nil
+		}
+		return unauthorized("invalid API key")
+	}
+
+	if signature := header.Get(SignatureHeader); signature != "" && a.HMACSecret != "" {
+		timestamp, err := strconv.ParseInt(header.Get(SignatureTimestampHeader), 10, 64)
+		if err != nil {
+			return unauthorized(SignatureTimestampHeader + " must be a unix timestamp")
+		}
+		signedAt := time.Unix(timestamp, 0)
+		if signedAt.Before(now.Add(-signatureTolerance)) || signedAt.After(now.Add(signatureTolerance)) {
+			return unauthorized("the signature timestamp is too far from the current time")
+		}
+
+		if !strings.HasPrefix(signature, "sha256=") {
+			return unauthorized("the signature must be prefixed by sha256=")
+		}
+		received, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+		if err != nil {
+			return unauthorized("invalid signature")
+		}
+		mac := hmac.New(sha256.New, []byte(a.HMACSecret))
+		mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+		mac.Write(body)
+		if !hmac.Equal(received, mac.Sum(nil)) {
+			return unauthorized("invalid signature")
+		}
+		return nil
+	}
+
+	return unauthorized("an API key or a signature is required")
+}
+
+func unauthorized(msg string) error {
+	return &errors.GenericError{Message: msg, StatusCode: http.StatusUnauthorized}
+}
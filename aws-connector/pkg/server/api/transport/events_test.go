@@ -0,0 +1,258 @@
+package transport
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lamassuiot/aws-connector/pkg/server/api/errors"
+)
+
+func sign(secret string, timestamp int64, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "." + body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestEventIngestionAuthenticate(t *testing.T) {
+	const (
+		apiKey = "api-key"
+		secret = "hmac-secret"
+		body   = `{"specversion":"1.0","id":"1","source":"aws","type":"io.lamassu.iotcore.cert.status.update"}`
+	)
+	now := time.Unix(1700000000, 0)
+	signedAt := now.Unix()
+
+	testCases := []struct {
+		name    string
+		auth    EventIngestionAuth
+		header  map[string]string
+		body    string
+		wantErr bool
+	}{
+		{
+			name:   "valid API key",
+			auth:   EventIngestionAuth{APIKey: apiKey},
+			header: map[string]string{APIKeyHeader: apiKey},
+		},
+		{
+			name:    "wrong API key",
+			auth:    EventIngestionAuth{APIKey: apiKey},
+			header:  map[string]string{APIKeyHeader: "other"},
+			wantErr: true,
+		},
+		{
+			name:    "API key not configured",
+			auth:    EventIngestionAuth{HMACSecret: secret},
+			header:  map[string]string{APIKeyHeader: apiKey},
+			wantErr: true,
+		},
+		{
+			name:   "valid signature",
+			auth:   EventIngestionAuth{HMACSecret: secret},
+			header: map[string]string{SignatureHeader: sign(secret, signedAt, body), SignatureTimestampHeader: strconv.FormatInt(signedAt, 10)},
+		},
+		{
+			name:   "valid signature within the tolerance",
+			auth:   EventIngestionAuth{HMACSecret: secret},
+			header: map[string]string{SignatureHeader: sign(secret, signedAt-299, body), SignatureTimestampHeader: strconv.FormatInt(signedAt-299, 10)},
+		},
+		{
+			name:   "signature checked when the API key is not configured",
+			auth:   EventIngestionAuth{HMACSecret: secret},
+			header: map[string]string{APIKeyHeader: apiKey, SignatureHeader: sign(secret, signedAt, body), SignatureTimestampHeader: strconv.FormatInt(signedAt, 10)},
+		},
+		{
+			name:    "signature of another body",
+			auth:    EventIngestionAuth{HMACSecret: secret},
+			header:  map[string]string{SignatureHeader: sign(secret, signedAt, body+" "), SignatureTimestampHeader: strconv.FormatInt(signedAt, 10)},
+			wantErr: true,
+		},
+		{
+			name:    "signature with another secret",
+			auth:    EventIngestionAuth{HMACSecret: secret},
+			header:  map[string]string{SignatureHeader: sign("other", signedAt, body), SignatureTimestampHeader: strconv.FormatInt(signedAt, 10)},
+			wantErr: true,
+		},
+		{
+			name:    "signature of another timestamp",
+			auth:    EventIngestionAuth{HMACSecret: secret},
+			header:  map[string]string{SignatureHeader: sign(secret, signedAt, body), SignatureTimestampHeader: strconv.FormatInt(signedAt+1, 10)},
+			wantErr: true,
+		},
+		{
+			name:    "expired signature",
+			auth:    EventIngestionAuth{HMACSecret: secret},
+			header:  map[string]string{SignatureHeader: sign(secret, signedAt-301, body), SignatureTimestampHeader: strconv.FormatInt(signedAt-301, 10)},
+			wantErr: true,
+		},
+		{
+			name:    "signature from the future",
+			auth:    EventIngestionAuth{HMACSecret: secret},
+			header:  map[string]string{SignatureHeader: sign(secret, signedAt+301, body), SignatureTimestampHeader: strconv.FormatInt(signedAt+301, 10)},
+			wantErr: true,
+		},
+		{
+			name:    "missing timestamp",
+			auth:    EventIngestionAuth{HMACSecret: secret},
+			header:  map[string]string{SignatureHeader: sign(secret, signedAt, body)},
+			wantErr: true,
+		},
+		{
+			name:    "signature without prefix",
+			auth:    EventIngestionAuth{HMACSecret: secret},
+			header:  map[string]string{SignatureHeader: strings.TrimPrefix(sign(secret, signedAt, body), "sha256="), SignatureTimestampHeader: strconv.FormatInt(signedAt, 10)},
+			wantErr: true,
+		},
+		{
+			name:    "signature not hex encoded",
+			auth:    EventIngestionAuth{HMACSecret: secret},
+			header:  map[string]string{SignatureHeader: "sha256=zz", SignatureTimestampHeader: strconv.FormatInt(signedAt, 10)},
+			wantErr: true,
+		},
+		{
+			name:    "signature not configured",
+			auth:    EventIngestionAuth{APIKey: apiKey},
+			header:  map[string]string{SignatureHeader: sign(secret, signedAt, body), SignatureTimestampHeader: strconv.FormatInt(signedAt, 10)},
+			wantErr: true,
+		},
+		{
+			name:    "no credentials",
+			auth:    EventIngestionAuth{APIKey: apiKey, HMACSecret: secret},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			header := http.Header{}
+			for name, value := range tc.header {
+				header.Set(name, value)
+			}
+
+			err := tc.auth.authenticate(header, []byte(body), now)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("authenticate() error = %v, want error %t", err, tc.wantErr)
+			}
+			if err == nil {
+				return
+			}
+			genericErr, ok := err.(*errors.GenericError)
+			if !ok || genericErr.StatusCode != http.StatusUnauthorized {
+				t.Errorf("authenticate() error = %#v, want a 401 error", err)
+			}
+		})
+	}
+}
+
+func TestDecodeHTTPCloudEvent(t *testing.T) {
+	const structured = `{"specversion":"1.0","id":"1","source":"aws","type":"io.lamassu.iotcore.cert.status.update","datacontenttype":"application/json","data":{"ca_name":"ca"}}`
+
+	testCases := []struct {
+		name        string
+		contentType string
+		header      map[string]string
+		body        string
+		wantErr     bool
+	}{
+		{
+			name:        "structured content mode",
+			contentType: "application/cloudevents+json",
+			body:        structured,
+		},
+		{
+			name:        "JSON posted by an API destination",
+			contentType: "application/json; charset=utf-8",
+			body:        structured,
+		},
+		{
+			name:        "binary content mode",
+			contentType: "application/json",
+			header: map[string]string{
+				"ce-specversion": "1.0",
+				"ce-id":          "1",
+				"ce-source":      "aws",
+				"ce-type":        "io.lamassu.iotcore.cert.status.update",
+			},
+			body: `{"ca_name":"ca"}`,
+		},
+		{
+			name:        "not JSON",
+			contentType: "text/plain",
+			body:        structured,
+			wantErr:     true,
+		},
+		{
+			name:        "invalid JSON",
+			contentType: "application/json",
+			body:        `{"specversion":`,
+			wantErr:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v1/events", strings.NewReader(tc.body))
+			r.Header.Set("Content-Type", tc.contentType)
+			for name, value := range tc.header {
+				r.Header.Set(name, value)
+			}
+
+			event, err := decodeHTTPCloudEvent(r, []byte(tc.body))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("decodeHTTPCloudEvent() error = %v, want error %t", err, tc.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if event.ID() != "1" || event.Type() != "io.lamassu.iotcore.cert.status.update" {
+				t.Errorf("decodeHTTPCloudEvent() = %s", event)
+			}
+			if string(event.Data()) != `{"ca_name":"ca"}` {
+				t.Errorf("decodeHTTPCloudEvent() data = %s", event.Data())
+			}
+		})
+	}
+}
+
+func TestCloudEventsHandlerRejectsUnauthenticatedRequests(t *testing.T) {
+	handler := MakeCloudEventsHandler(nil, EventIngestionAuth{APIKey: "api-key"})
+
+	testCases := []struct {
+		name       string
+		method     string
+		header     map[string]string
+		body       string
+		wantStatus int
+	}{
+		{name: "wrong method", method: http.MethodGet, wantStatus: http.StatusMethodNotAllowed},
+		{name: "too large", method: http.MethodPost, header: map[string]string{APIKeyHeader: "api-key"}, body: strings.Repeat("a", maxEventSize+1), wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "no credentials", method: http.MethodPost, body: "{}", wantStatus: http.StatusUnauthorized},
+		{name: "wrong API key", method: http.MethodPost, header: map[string]string{APIKeyHeader: "other"}, body: "{}", wantStatus: http.StatusUnauthorized},
+		{name: "not a CloudEvent", method: http.MethodPost, header: map[string]string{APIKeyHeader: "api-key", "Content-Type": "text/plain"}, body: "{}", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, "/v1/events", strings.NewReader(tc.body))
+			for name, value := range tc.header {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, r)
+			if w.Code != tc.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tc.wantStatus)
+			}
+		})
+	}
+}
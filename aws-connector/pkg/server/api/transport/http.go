@@ -0,0 +1,449 @@
+package transport
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	"github.com/lamassuiot/aws-connector/pkg/events"
+	"github.com/lamassuiot/aws-connector/pkg/server/api/endpoint"
+	"github.com/lamassuiot/aws-connector/pkg/server/api/errors"
+	"github.com/lamassuiot/aws-connector/pkg/server/api/service"
+	cloudprovidertransport "github.com/lamassuiot/lamassuiot/pkg/cloud-provider/server/api/transport"
+)
+
+func InvalidJsonFormat() error {
+	return &errors.GenericError{
+		Message:    "Invalid JSON format",
+		StatusCode: 400,
+	}
+}
+
+// MakeHTTPHandler serves the AWS connector specific routes and hands every other request
+// to the cloud provider handler shared by all Lamassu connectors.
+func MakeHTTPHandler(s service.Service) http.Handler {
+	r := mux.NewRouter()
+	e := endpoint.MakeServerEndpoints(s)
+
+	options := []httptransport.ServerOption{
+		httptransport.ServerErrorEncoder(encodeError),
+	}
+
+	r.Methods("GET").Path("/dms/{dmsName}/aws-settings").Handler(
+		httptransport.NewServer(
+			e.GetDMSAWSSettingsEndpoint,
+			decodeDMSRequest,
+			encodeJSONResponse,
+			options...,
+		),
+	)
+
+	r.Methods("PATCH").Path("/dms/{dmsName}/aws-settings").Handler(
+		httptransport.NewServer(
+			e.UpdateDMSAWSSettingsEndpoint,
+			decodeUpdateDMSAWSSettingsRequest,
+			encodeJSONResponse,
+			options...,
+		),
+	)
+
+	r.Methods("POST").Path("/dms/{dmsName}/shadow-migration").Handler(
+		httptransport.NewServer(
+			e.MigrateDMSShadowsEndpoint,
+			decodeDMSRequest,
+			encodeJSONResponse,
+			options...,
+		),
+	)
+
+	r.Methods("GET").Path("/dms/{dmsName}/shadow-migration").Handler(
+		httptransport.NewServer(
+			e.GetDMSShadowMigrationEndpoint,
+			decodeDMSRequest,
+			encodeJSONResponse,
+			options...,
+		),
+	)
+
+	r.Methods("GET").Path("/dms/{dmsName}/shadow-fanout-reports").Handler(
+		httptransport.NewServer(
+			e.GetShadowFanOutReportsEndpoint,
+			decodeDMSRequest,
+			encodeJSONResponse,
+			options...,
+		),
+	)
+
+	r.Methods("DELETE").Path("/dms/{dmsName}/cacerts").Handler(
+		httptransport.NewServer(
+			e.DeleteDMSCABundleEndpoint,
+			decodeDMSRequest,
+			encodeJSONResponse,
+			options...,
+		),
+	)
+
+	r.Methods("POST").Path("/reconciliation").Handler(
+		httptransport.NewServer(
+			e.ReconcileEndpoint,
+			decodeReconcileRequest,
+			encodeJSONResponse,
+			options...,
+		),
+	)
+
+	r.Methods("GET").Path("/reconciliation").Handler(
+		httptransport.NewServer(
+			e.GetReconciliationReportEndpoint,
+			decodeEmptyRequest,
+			encodeJSONResponse,
+			options...,
+		),
+	)
+
+	r.Methods("POST").Path("/revocation-enforcement").Handler(
+		httptransport.NewServer(
+			e.EnforceRevocationsEndpoint,
+			decodeEnforceRevocationsRequest,
+			encodeJSONResponse,
+			options...,
+		),
+	)
+
+	r.Methods("POST").Path("/expiry-monitor").Handler(
+		httptransport.NewServer(
+			e.MonitorExpiryEndpoint,
+			decodeMonitorExpiryRequest,
+			encodeJSONResponse,
+			options...,
+		),
+	)
+
+	r.Methods("POST").Path("/dms-thing-groups/sync").Handler(
+		httptransport.NewServer(
+			e.SyncDMSThingGroupsEndpoint,
+			decodeSyncDMSThingGroupsRequest,
+			encodeJSONResponse,
+			options...,
+		),
+	)
+
+	r.Methods("GET").Path("/drift-report").Handler(
+		httptransport.NewServer(
+			e.GetDriftReportEndpoint,
+			decodeGetDriftReportRequest,
+			encodeGetDriftReportResponse,
+			options...,
+		),
+	)
+
+	r.Methods("POST").Path("/fleet-imports").Handler(
+		httptransport.NewServer(
+			e.ImportFleetEndpoint,
+			decodeImportFleetRequest,
+			encodeJSONResponse,
+			options...,
+		),
+	)
+
+	r.Methods("GET").Path("/fleet-imports").Handler(
+		httptransport.NewServer(
+			e.GetFleetImportsEndpoint,
+			decodeEmptyRequest,
+			encodeJSONResponse,
+			options...,
+		),
+	)
+
+	r.Methods("GET").Path("/fleet-imports/{importID}").Handler(
+		httptransport.NewServer(
+			e.GetFleetImportEndpoint,
+			decodeGetFleetImportRequest,
+			encodeJSONResponse,
+			options...,
+		),
+	)
+
+	r.Methods("GET").Path("/outbox").Handler(
+		httptransport.NewServer(
+			e.GetOutboxEntriesEndpoint,
+			decodeGetOutboxEntriesRequest,
+			encodeJSONResponse,
+			options...,
+		),
+	)
+
+	r.Methods("POST").Path("/outbox/{entryID}/retry").Handler(
+		httptransport.NewServer(
+			e.RetryOutboxEntryEndpoint,
+			decodeRetryOutboxEntryRequest,
+			encodeJSONResponse,
+			options...,
+		),
+	)
+
+	r.Methods("DELETE").Path("/outbox/{entryID}").Handler(
+		httptransport.NewServer(
+			e.DeleteOutboxEntryEndpoint,
+			decodeDeleteOutboxEntryRequest,
+			encodeJSONResponse,
+			options...,
+		),
+	)
+
+	r.Methods("POST").Path("/event-routing/test").Handler(
+		httptransport.NewServer(
+			e.TestEventRoutingEndpoint,
+			decodeTestEventRoutingRequest,
+			encodeJSONResponse,
+			options...,
+		),
+	)
+
+	r.NotFoundHandler = cloudprovidertransport.MakeHTTPHandler(s)
+
+	return r
+}
+
+func decodeDMSRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	vars := mux.Vars(r)
+
+	return endpoint.DMSRequest{
+		DMSName: vars["dmsName"],
+	}, nil
+}
+
+func decodeUpdateDMSAWSSettingsRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	var body endpoint.UpdateDMSAWSSettingsRequest
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		return nil, InvalidJsonFormat()
+	}
+
+	body.DMSName = mux.Vars(r)["dmsName"]
+	return body, nil
+}
+
+func decodeImportFleetRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	var body endpoint.ImportFleetRequest
+	err = json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		return nil, InvalidJsonFormat()
+	}
+
+	return body, nil
+}
+
+func decodeGetFleetImportRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	return endpoint.GetFleetImportRequest{
+		ImportID: mux.Vars(r)["importID"],
+	}, nil
+}
+
+func decodeGetOutboxEntriesRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	return endpoint.GetOutboxEntriesRequest{
+		Status: api.OutboxEntryStatus(strings.ToUpper(r.URL.Query().Get("status"))),
+	}, nil
+}
+
+func decodeRetryOutboxEntryRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	id, err := strconv.ParseUint(mux.Vars(r)["entryID"], 10, 64)
+	if err != nil {
+		return nil, &errors.ValidationError{
+			Msg: "entryID must be a positive integer",
+		}
+	}
+
+	return endpoint.RetryOutboxEntryRequest{
+		ID: id,
+	}, nil
+}
+
+func decodeDeleteOutboxEntryRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	id, err := strconv.ParseUint(mux.Vars(r)["entryID"], 10, 64)
+	if err != nil {
+		return nil, &errors.ValidationError{
+			Msg: "entryID must be a positive integer",
+		}
+	}
+
+	return endpoint.DeleteOutboxEntryRequest{
+		ID: id,
+	}, nil
+}
+
+// decodeTestEventRoutingRequest takes a sample CloudEvent in JSON format.
+func decodeTestEventRoutingRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	var event cloudevents.Event
+	err = json.NewDecoder(r.Body).Decode(&event)
+	if err != nil {
+		return nil, &errors.ValidationError{
+			Msg: fmt.Sprintf("invalid CloudEvent: %s", err),
+		}
+	}
+
+	return event, nil
+}
+
+func decodeReconcileRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	dryRun, err := parseBoolQueryParam(r, "dry_run")
+	if err != nil {
+		return nil, err
+	}
+
+	return endpoint.ReconcileRequest{
+		DryRun: dryRun,
+	}, nil
+}
+
+func decodeEnforceRevocationsRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	dryRun, err := parseBoolQueryParam(r, "dry_run")
+	if err != nil {
+		return nil, err
+	}
+
+	return endpoint.EnforceRevocationsRequest{
+		DryRun: dryRun,
+	}, nil
+}
+
+func decodeMonitorExpiryRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	dryRun, err := parseBoolQueryParam(r, "dry_run")
+	if err != nil {
+		return nil, err
+	}
+
+	return endpoint.MonitorExpiryRequest{
+		DryRun: dryRun,
+	}, nil
+}
+
+func decodeSyncDMSThingGroupsRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	dryRun, err := parseBoolQueryParam(r, "dry_run")
+	if err != nil {
+		return nil, err
+	}
+
+	return endpoint.SyncDMSThingGroupsRequest{
+		DryRun: dryRun,
+	}, nil
+}
+
+// decodeGetDriftReportRequest takes the format from the format query parameter, falling
+// back to the Accept header.
+func decodeGetDriftReportRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = endpoint.DriftReportFormatJSON
+		if strings.Contains(r.Header.Get("Accept"), "text/csv") {
+			format = endpoint.DriftReportFormatCSV
+		}
+	}
+
+	if format != endpoint.DriftReportFormatJSON && format != endpoint.DriftReportFormatCSV {
+		return nil, &errors.ValidationError{
+			Msg: "format must be json or csv",
+		}
+	}
+
+	return endpoint.GetDriftReportRequest{
+		Format: format,
+	}, nil
+}
+
+func encodeGetDriftReportResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	resp := response.(endpoint.GetDriftReportResponse)
+	if resp.Format != endpoint.DriftReportFormatCSV {
+		return encodeJSONResponse(ctx, w, resp.Report)
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"drift-report-%s.csv\"", resp.Report.GeneratedAt.UTC().Format("20060102T150405Z")))
+
+	records := [][]string{{"kind", "resource", "lamassu_state", "aws_state", "detail"}}
+	for _, entry := range resp.Report.Entries {
+		records = append(records, []string{string(entry.Kind), entry.Resource, entry.LamassuState, entry.AWSState, entry.Detail})
+	}
+	// Flagged drifts are told apart from the detected ones, which they usually duplicate.
+	for _, flagged := range resp.Report.Flagged {
+		records = append(records, []string{"FLAGGED", flagged.Resource, flagged.LamassuState, flagged.AWSState, fmt.Sprintf("%s: %s (event %s at %s)", flagged.Kind, flagged.Detail, flagged.EventID, flagged.FlaggedAt.UTC().Format(time.RFC3339))})
+	}
+	// Failed checks are kept in the export, otherwise a partial report would look complete.
+	for _, checkErr := range resp.Report.Errors {
+		records = append(records, []string{"ERROR", "", "", "", checkErr})
+	}
+
+	writer := csv.NewWriter(w)
+	for _, record := range records {
+		err := writer.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func decodeEmptyRequest(ctx context.Context, r *http.Request) (request interface{}, err error) {
+	return nil, nil
+}
+
+func parseBoolQueryParam(r *http.Request, name string) (bool, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return false, nil
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, &errors.ValidationError{
+			Msg: fmt.Sprintf("%s must be a boolean", name),
+		}
+	}
+	return parsed, nil
+}
+
+func encodeJSONResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return json.NewEncoder(w).Encode(response)
+}
+
+func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
+	if err == nil {
+		panic("encodeError with nil error")
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(codeFrom(err))
+
+	json.NewEncoder(w).Encode(errorWrapper{Error: err.Error()})
+}
+
+type errorWrapper struct {
+	Error string `json:"error"`
+}
+
+func codeFrom(err error) int {
+	switch e := err.(type) {
+	case *errors.ValidationError:
+		return http.StatusBadRequest
+	case *errors.DuplicateResourceError:
+		return http.StatusConflict
+	case *errors.ResourceNotFoundError:
+		return http.StatusNotFound
+	case *errors.GenericError:
+		return e.StatusCode
+	case *events.UnknownEventTypeError, *events.InvalidEventError:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/types"
+	"github.com/lamassuiot/aws-connector/pkg/events"
 	"github.com/lamassuiot/aws-connector/pkg/server/api/endpoint"
 	"github.com/lamassuiot/aws-connector/pkg/server/api/service"
 	log "github.com/sirupsen/logrus"
@@ -31,6 +33,7 @@ func pollMessages(chn chan<- *sqs.Message, sqsURL string) {
 
 		if err != nil {
 			log.Warn("Error polling messages from SQS: ", err)
+			continue
 		}
 
 		for _, message := range output.Messages {
@@ -40,31 +43,89 @@ func pollMessages(chn chan<- *sqs.Message, sqsURL string) {
 
 }
 
-func handleMessage(msg *sqs.Message, e endpoint.Endpoints) error {
+// handleMessage handles a message of the inbound queue and tells whether it can be deleted:
+// it was handled, or it was rejected and would be rejected again on every redelivery. The
+// messages whose handling failed are kept in the queue and handled again once their
+// visibility timeout expires.
+func handleMessage(msg *sqs.Message, e endpoint.Endpoints) bool {
 	var event cloudevents.Event
-	json.Unmarshal([]byte(*msg.Body), &event)
+	err := json.Unmarshal([]byte(*msg.Body), &event)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Rejecting SQS message %s, it is not a CloudEvent: ", *msg.MessageId), err)
+		return true
+	}
 
 	jsonM, _ := event.MarshalJSON()
 	log.Debug(fmt.Sprintf("Incoming SQS message. SQS Message ID %s. Event type %s. Event JSON: %s", *msg.MessageId, event.Type(), string(jsonM)))
 
-	switch event.Type() {
-	case "io.lamassu.iotcore.cert.status.update":
-		var eventData endpoint.HandleUpdateCertStatusCodeRequest
-		json.Unmarshal(event.Data(), &eventData)
-		log.Info(eventData)
-		_, err := e.HandleUpdateCertificateStatusEndpoint(context.Background(), eventData)
+	err = handleInboundEvent(context.Background(), event, e)
+	if isRejectedEvent(err) {
+		log.Warn(fmt.Sprintf("Rejecting SQS message %s: ", *msg.MessageId), err)
+		return true
+	}
+	if err != nil {
+		log.Warn(fmt.Sprintf("Error handling SQS message %s, it will be retried: ", *msg.MessageId), err)
+		return false
+	}
+	return true
+}
+
+// isRejectedEvent tells whether an event was rejected by its validation, which fails the
+// same way however many times the event is delivered.
+func isRejectedEvent(err error) bool {
+	var unknownType *events.UnknownEventTypeError
+	var invalid *events.InvalidEventError
+	return errors.As(err, &unknownType) || errors.As(err, &invalid)
+}
+
+// handleInboundEvent validates an event sent by AWS and hands it to its endpoint. It serves the
+// SQS consumer and the HTTP ingestion endpoint.
+func handleInboundEvent(ctx context.Context, event cloudevents.Event, e endpoint.Endpoints) error {
+	data, err := events.Decode(event, events.DirectionAWSToLamassu)
+	if err != nil {
 		return err
+	}
 
-	case "io.lamassu.iotcore.ca.status.update":
-		var eventData endpoint.HandleUpdateCAStatusCodeRequest
-		json.Unmarshal(event.Data(), &eventData)
-		_, err := e.HandleUpdateCAStatusEndpoint(context.Background(), eventData)
-		log.Info(eventData)
+	// Status update events caused by the connector carry the correlation ID of the change.
+	correlationID, _ := types.ToString(event.Extensions()[events.ExtensionCorrelationID])
+
+	switch eventData := data.(type) {
+	case *events.CertificateStatusUpdateV1:
+		_, err := e.HandleUpdateCertificateStatusEndpoint(ctx, endpoint.HandleUpdateCertStatusCodeRequest{
+			CaName:        eventData.CAName,
+			Status:        eventData.Status,
+			SerialNumber:  eventData.SerialNumber,
+			CertificateID: eventData.CertificateID,
+			Actor:         eventData.Actor,
+			CorrelationID: correlationID,
+		})
+		return err
+
+	case *events.CAStatusUpdateV1:
+		_, err := e.HandleUpdateCAStatusEndpoint(ctx, endpoint.HandleUpdateCAStatusCodeRequest{
+			CaID:           eventData.CAID,
+			CaName:         eventData.CAName,
+			CaSerialNumber: eventData.CASerialNumber,
+			Status:         eventData.Status,
+			Actor:          eventData.Actor,
+			EventID:        event.ID(),
+			EventSource:    event.Source(),
+			CorrelationID:  correlationID,
+		})
+		return err
+
+	case *events.ThingShadowUpdateV1:
+		thingName, _ := types.ToString(event.Extensions()[events.ExtensionThingName])
+		shadowName, _ := types.ToString(event.Extensions()[events.ExtensionShadowName])
+		_, err := e.HandleUpdateThingShadowEndpoint(ctx, endpoint.HandleUpdateThingShadowRequest{
+			ThingName:  thingName,
+			ShadowName: shadowName,
+			Document:   *eventData,
+		})
 		return err
 
 	default:
-		log.Warn(fmt.Sprintf("no matching evene type for incoming SQS message with type:%s ", event.Type()))
-		return errors.New("unhandeled message")
+		return &events.UnknownEventTypeError{Type: event.Type()}
 	}
 }
 
@@ -91,8 +152,7 @@ func MakeSQSHandler(s service.Service, awsSQSInboundQueueName string) {
 		go pollMessages(chnMessages, sqsURL)
 
 		for message := range chnMessages {
-			err := handleMessage(message, e)
-			if err == nil {
+			if handleMessage(message, e) {
 				deleteMessage(message, sqsURL)
 			}
 		}
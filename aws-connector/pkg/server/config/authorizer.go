@@ -0,0 +1,27 @@
+package config
+
+import "time"
+
+// AuthorizerConfig configures the custom authorizer Lambda. The AWS credentials and region
+// are those of the Lambda function.
+type AuthorizerConfig struct {
+	// CertFile and KeyFile authenticate the authorizer to the Lamassu services over https.
+	CertFile string `split_words:"true"`
+	KeyFile  string `split_words:"true"`
+
+	// AuthorizerAudience is required in the aud claim of the tokens when not empty.
+	AuthorizerAudience         string        `split_words:"true"`
+	AuthorizerMaxTokenLifetime time.Duration `split_words:"true" default:"24h"`
+	// AuthorizerRefreshAfter is how often AWS IoT authorizes again the open connections.
+	AuthorizerRefreshAfter time.Duration `split_words:"true" default:"5m"`
+	// AuthorizerCACacheTTL is how long the CAs registered in AWS and their policies are
+	// cached.
+	AuthorizerCACacheTTL time.Duration `split_words:"true" default:"5m"`
+
+	LamassuCAAddress                       string `required:"true" split_words:"true"`
+	LamassuCACertFile                      string `split_words:"true"`
+	LamassuCAInsecureSkipVerify            bool   `split_words:"true"`
+	LamassuDeviceManagerAddress            string `required:"true" split_words:"true"`
+	LamassuDeviceManagerCertFile           string `split_words:"true"`
+	LamassuDeviceManagerInsecureSkipVerify bool   `split_words:"true"`
+}
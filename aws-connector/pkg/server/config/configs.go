@@ -1,6 +1,10 @@
 package config
 
-import "github.com/lamassuiot/lamassuiot/pkg/utils/server"
+import (
+	"time"
+
+	"github.com/lamassuiot/lamassuiot/pkg/utils/server"
+)
 
 type AWSConnectorConfig struct {
 	server.BaseConfiguration
@@ -9,6 +13,14 @@ type AWSConnectorConfig struct {
 	ConnectorName           string `required:"true" split_words:"true"`
 	ConnectorPersistenceDir string `required:"true" split_words:"true"`
 
+	// StoreBackend selects where the connector state is kept: "badger" in
+	// ConnectorPersistenceDir, "sqlite" in StoreSQLitePath for local and development setups,
+	// or "postgres" to share it between replicas.
+	StoreBackend     string `split_words:"true" default:"badger"`
+	StorePostgresDSN string `split_words:"true"`
+	// StoreSQLitePath defaults to connector.db in ConnectorPersistenceDir.
+	StoreSQLitePath string `split_words:"true"`
+
 	Exchange string
 	Queue    string
 
@@ -21,8 +33,77 @@ type AWSConnectorConfig struct {
 	AWSAccessKeyID          string `required:"true" split_words:"true"`
 	AWSSecretAccessKey      string `required:"true" split_words:"true"`
 	AWSDefaultRegion        string `required:"true" split_words:"true"`
-	AWSSqsInboundQueueName  string `required:"true" split_words:"true"`
 	AWSSqsOutboundQueueName string `split_words:"true"`
+	// The inbound queue is only polled when AWSSqsInboundEnabled is set, AWS events are
+	// otherwise posted to /v1/events.
+	AWSSqsInboundEnabled   bool   `split_words:"true" default:"false"`
+	AWSSqsInboundQueueName string `split_words:"true"`
+
+	// The AWS events posted to /v1/events are authenticated by an API key or an HMAC
+	// signature. The endpoint is disabled when both are empty.
+	HTTPEventsAPIKey     string `split_words:"true"`
+	HTTPEventsHMACSecret string `split_words:"true"`
+
+	// ForwardUnknownLamassuEvents lets the Lamassu events of a type the connector has no
+	// schema for through without validation. They are rejected when unset.
+	ForwardUnknownLamassuEvents bool `split_words:"true" default:"true"`
+
+	AWSShadowUpdateWorkers int     `split_words:"true" default:"10"`
+	AWSShadowUpdateRate    float64 `split_words:"true" default:"20"`
+
+	// OperatingMode is "orchestrated" when the Lamassu cloud provider service calls the
+	// connector API, or "event-driven" when the connector acts on the Lamassu events.
+	OperatingMode string `split_words:"true" default:"orchestrated"`
+
+	// CAStatusSyncAction is applied to the CA status changes made in AWS: IGNORE, REPORT the
+	// drift, REVOKE the Lamassu CA, or REVERT the AWS status.
+	CAStatusSyncAction string `split_words:"true" default:"REPORT"`
+
+	// StatusChangeEchoTTL bounds how long the status changes made by the connector are
+	// matched against the status update events coming from AWS. 0 only relies on the
+	// correlation ID carried by the events.
+	StatusChangeEchoTTL time.Duration `split_words:"true" default:"15m"`
+
+	// AWSRevocationReasonRules map the actors revoking certificates and CAs in AWS to RFC 5280
+	// reasons, as a comma separated list of MATCH=REASON pairs.
+	AWSRevocationReasonRules string `split_words:"true"`
+
+	// EventRoutingRulesFile is a JSON file with the rules routing the Lamassu events. Every
+	// event is forwarded to the outbound queue when empty.
+	EventRoutingRulesFile string `split_words:"true"`
+
+	// OutboxMaxAttempts bounds the attempts to deliver an event to the outbound queue.
+	OutboxMaxAttempts int `split_words:"true" default:"20"`
+
+	// ReconcilerSchedule is a cron spec, the reconciler is disabled when empty.
+	ReconcilerSchedule string `split_words:"true"`
+	ReconcilerRules    string `split_words:"true"`
+
+	// RevocationEnforcementSchedule is a cron spec, the certificates revoked in Lamassu are
+	// not checked in AWS when empty.
+	RevocationEnforcementSchedule string `split_words:"true" default:"@every 15m"`
+
+	// ExpiryMonitorSchedule is a cron spec, the expiry of the certificates registered in AWS
+	// is not checked when empty. Devices are asked to re-enroll CertificateRenewalWindow
+	// before their certificate expires.
+	ExpiryMonitorSchedule    string        `split_words:"true" default:"@every 6h"`
+	CertificateRenewalWindow time.Duration `split_words:"true" default:"720h"`
+	CAExpiryWarningWindow    time.Duration `split_words:"true" default:"2160h"`
+
+	// DMSThingGroups keeps the things in a thing group per DMS, nested under
+	// DMSThingGroupRoot when it is set. DMSThingGroupSchedule is a cron spec, the things
+	// provisioned by JITP or moved to another DMS are only put in their group by the
+	// certificate updates when it is empty.
+	DMSThingGroups        bool   `split_words:"true" default:"false"`
+	DMSThingGroupRoot     string `split_words:"true"`
+	DMSThingGroupSchedule string `split_words:"true" default:"@every 1h"`
+
+	// DryRun records the mutating AWS calls instead of making them.
+	DryRun bool `split_words:"true" default:"false"`
+
+	// The configuration cache is disabled for a TTL of 0.
+	ConfigurationCacheTTL       time.Duration `split_words:"true" default:"1h"`
+	DeviceConfigurationCacheTTL time.Duration `split_words:"true" default:"1m"`
 
 	LamassuCAAddress                       string `required:"true" split_words:"true"`
 	LamassuCACertFile                      string `split_words:"true"`
@@ -3,25 +3,143 @@ package db
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"os"
+	"sort"
 	"time"
 
 	badger "github.com/dgraph-io/badger/v3"
+	api "github.com/lamassuiot/aws-connector/pkg/common"
 	"github.com/lamassuiot/aws-connector/pkg/server/store"
+	log "github.com/sirupsen/logrus"
 )
 
 type BadgerDB struct {
-	db *badger.DB
+	db             *badger.DB
+	outboxSequence *badger.Sequence
 }
 
 const (
-	AWSConfig = "CONFIG"
+	AWSConfig            = "CONFIG"
+	ReconciliationReport = "RECONCILIATION_REPORT"
 )
 
+const awsThingConfigPrefix = "THINGS_CONFIG_"
+
 func AWSThingConfig(deviceID string) string {
-	return "THINGS_CONFIG_" + deviceID
+	return awsThingConfigPrefix + deviceID
+}
+
+func DeviceShadowActions(deviceID string) string {
+	return "THINGS_SHADOW_ACTIONS_" + deviceID
+}
+
+const dmsAWSSettingsPrefix = "DMS_AWS_SETTINGS_"
+
+func DMSAWSSettings(dmsName string) string {
+	return dmsAWSSettingsPrefix + dmsName
+}
+
+func DMSShadowLocation(dmsName string) string {
+	return "DMS_SHADOW_LOCATION_" + dmsName
+}
+
+func DMSShadowMigration(dmsName string) string {
+	return dmsShadowMigrationPrefix + dmsName
+}
+
+func DMSCABundleState(dmsName string) string {
+	return "DMS_CA_BUNDLE_" + dmsName
+}
+
+const thingGroupOwnershipPrefix = "THING_GROUP_OWNERSHIP_"
+
+func ThingGroupOwnership(thingGroup string) string {
+	return thingGroupOwnershipPrefix + thingGroup
+}
+
+const flaggedDriftPrefix = "FLAGGED_DRIFT_"
+
+func FlaggedDrift(kind api.DriftKind, resource string) string {
+	return flaggedDriftPrefix + string(kind) + "/" + resource
+}
+
+const shadowFanOutReportAllPrefix = "SHADOW_FANOUT_REPORT_"
+
+func shadowFanOutReportPrefix(dmsName string) string {
+	return shadowFanOutReportAllPrefix + dmsName + "/"
+}
+
+func ShadowFanOutReport(dmsName string, reportID string) string {
+	return shadowFanOutReportPrefix(dmsName) + reportID
+}
+
+const dmsShadowMigrationPrefix = "DMS_SHADOW_MIGRATION_"
+
+func AWSCAMappingByName(caName string) string {
+	return "CA_MAPPING_NAME_" + caName
+}
+
+func AWSCAMappingByAWSID(awsCertificateID string) string {
+	return "CA_MAPPING_AWS_" + awsCertificateID
+}
+
+func CertificateMappingBySerialNumber(caName string, serialNumber string) string {
+	return "CERTIFICATE_MAPPING_SERIAL_" + caName + "/" + serialNumber
+}
+
+func CertificateMappingByAWSID(awsCertificateID string) string {
+	return "CERTIFICATE_MAPPING_AWS_" + awsCertificateID
+}
+
+func ProcessedEvent(eventID string) string {
+	return "PROCESSED_EVENT_" + eventID
+}
+
+func PendingStatusChange(resource api.StatusChangeResource, awsCertificateID string, status string) string {
+	return "PENDING_STATUS_CHANGE_" + string(resource) + "_" + awsCertificateID + "/" + status
+}
+
+func CertificateExpiryNotice(awsCertificateID string) string {
+	return "CERTIFICATE_EXPIRY_NOTICE_" + awsCertificateID
+}
+
+// processedEventTTL bounds how long a processed event is remembered. Redeliveries happen
+// within minutes, so a day is plenty.
+const processedEventTTL = 24 * time.Hour
+
+const (
+	outboxPrefix   = "OUTBOX_"
+	OutboxSequence = "SEQUENCE_OUTBOX"
+)
+
+// OutboxEntry pads the ID of the entry, so that the keys sort in delivery order.
+func OutboxEntry(id uint64) string {
+	return fmt.Sprintf("%s%020d", outboxPrefix, id)
+}
+
+// outboxSequenceBandwidth is how many outbox IDs are leased at once. The unused IDs of a
+// lease are skipped after a restart.
+const outboxSequenceBandwidth = 100
+
+func Lease(name string) string {
+	return "LEASE_" + name
 }
 
+const CacheGeneration = "CACHE_GENERATION"
+
+const fleetImportPrefix = "FLEET_IMPORT_"
+
+func FleetImport(importID string) string {
+	return fleetImportPrefix + importID
+}
+
+// shadowFanOutReportTTL bounds how long the report of a shadow fan-out run is kept.
+const shadowFanOutReportTTL = 7 * 24 * time.Hour
+
+// maxDeviceShadowActionCompletions bounds the completion history kept for each device.
+const maxDeviceShadowActionCompletions = 50
+
 func NewInMemoryDB() (store.DB, error) {
 	err := os.RemoveAll("/tmp/badger")
 	if err != nil {
@@ -33,114 +151,721 @@ func NewInMemoryDB() (store.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	return newBadgerDB(db)
+}
+
+func newBadgerDB(db *badger.DB) (store.DB, error) {
+	outboxSequence, err := db.GetSequence([]byte(OutboxSequence), outboxSequenceBandwidth)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	return &BadgerDB{
-		db: db,
+		db:             db,
+		outboxSequence: outboxSequence,
 	}, nil
 }
 
-func (b *BadgerDB) UpdateAWSIoTCoreConfig(ctx context.Context, newConfig interface{}) error {
-	err := b.db.Update(func(txn *badger.Txn) error {
-		bytes, err := json.Marshal(newConfig)
-		if err != nil {
-			return err
-		}
+func (b *BadgerDB) UpdateAWSIoTCoreConfig(ctx context.Context, newConfig interface{}, ttl time.Duration) error {
+	return b.setCacheValue(AWSConfig, newConfig, ttl)
+}
 
-		e := badger.NewEntry([]byte(AWSConfig), []byte(bytes)).WithTTL(time.Hour)
-		err = txn.SetEntry(e)
+func (b *BadgerDB) GetAWSIoTCoreConfig(ctx context.Context, config interface{}) (bool, error) {
+	return b.getCacheValue(AWSConfig, config)
+}
 
-		return nil
+func (b *BadgerDB) DeleteAWSIoTCoreConfig(ctx context.Context) error {
+	err := b.db.Update(func(txn *badger.Txn) error {
+		err := txn.Delete([]byte(AWSConfig))
+		return err
 	})
 
 	return err
 }
 
-func (b *BadgerDB) GetAWSIoTCoreConfig(ctx context.Context) (map[string]interface{}, error) {
-	var valCopy []byte
+func (b *BadgerDB) GetAWSIoTCoreThingConfig(ctx context.Context, deviceID string, config interface{}) (bool, error) {
+	return b.getCacheValue(AWSThingConfig(deviceID), config)
+}
 
+func (b *BadgerDB) UpdateAWSIoTCoreThingConfig(ctx context.Context, deviceID string, newConfig interface{}, ttl time.Duration) error {
+	return b.setCacheValue(AWSThingConfig(deviceID), newConfig, ttl)
+}
+
+func (b *BadgerDB) DeleteAWSIoTCoreThingConfig(ctx context.Context, deviceID string) error {
+	err := b.db.Update(func(txn *badger.Txn) error {
+		err := txn.Delete([]byte(AWSThingConfig(deviceID)))
+		return err
+	})
+
+	return err
+}
+
+func (b *BadgerDB) DeleteAWSIoTCoreThingConfigs(ctx context.Context) error {
+	keys := [][]byte{}
 	err := b.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(AWSConfig))
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := []byte(awsThingConfigPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// A write batch splits the deletes over several transactions, as a large fleet would
+	// not fit in a single one.
+	batch := b.db.NewWriteBatch()
+	defer batch.Cancel()
+	for _, key := range keys {
+		err = batch.Delete(key)
 		if err != nil {
 			return err
 		}
+	}
+	return batch.Flush()
+}
+
+func (b *BadgerDB) GetDeviceShadowActionCompletions(ctx context.Context, deviceID string) ([]api.ShadowActionCompletion, error) {
+	completions := []api.ShadowActionCompletion{}
 
-		err = item.Value(func(val []byte) error {
-			valCopy = append([]byte{}, val...)
+	err := b.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(DeviceShadowActions(deviceID)))
+		if err == badger.ErrKeyNotFound {
 			return nil
+		} else if err != nil {
+			return err
+		}
+
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &completions)
 		})
+	})
+
+	return completions, err
+}
+
+func (b *BadgerDB) AddDeviceShadowActionCompletion(ctx context.Context, deviceID string, completion api.ShadowActionCompletion) error {
+	err := b.db.Update(func(txn *badger.Txn) error {
+		completions := []api.ShadowActionCompletion{}
+
+		item, err := txn.Get([]byte(DeviceShadowActions(deviceID)))
+		if err == nil {
+			err = item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &completions)
+			})
+			if err != nil {
+				return err
+			}
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		completions = append(completions, completion)
+		if len(completions) > maxDeviceShadowActionCompletions {
+			completions = completions[len(completions)-maxDeviceShadowActionCompletions:]
+		}
+
+		bytes, err := json.Marshal(completions)
+		if err != nil {
+			return err
+		}
+
+		return txn.Set([]byte(DeviceShadowActions(deviceID)), bytes)
+	})
+
+	return err
+}
+
+func (b *BadgerDB) GetDMSAWSSettings(ctx context.Context, dmsName string) (*api.DMSAWSSettings, error) {
+	var settings *api.DMSAWSSettings
+	err := b.getValue(DMSAWSSettings(dmsName), &settings)
+	return settings, err
+}
+
+func (b *BadgerDB) ListDMSAWSSettings(ctx context.Context) ([]api.DMSAWSSettings, error) {
+	settingsList := []api.DMSAWSSettings{}
+
+	err := b.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(dmsAWSSettingsPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var settings api.DMSAWSSettings
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &settings)
+			})
+			if err != nil {
+				return err
+			}
+			settingsList = append(settingsList, settings)
+		}
+
+		return nil
+	})
+
+	return settingsList, err
+}
+
+func (b *BadgerDB) UpdateDMSAWSSettings(ctx context.Context, settings api.DMSAWSSettings) error {
+	return b.setValue(DMSAWSSettings(settings.DMSName), settings)
+}
+
+func (b *BadgerDB) GetDMSShadowLocation(ctx context.Context, dmsName string) (*api.ShadowLocation, error) {
+	var location *api.ShadowLocation
+	err := b.getValue(DMSShadowLocation(dmsName), &location)
+	return location, err
+}
+
+func (b *BadgerDB) UpdateDMSShadowLocation(ctx context.Context, dmsName string, location api.ShadowLocation) error {
+	return b.setValue(DMSShadowLocation(dmsName), location)
+}
+
+func (b *BadgerDB) GetDMSShadowMigration(ctx context.Context, dmsName string) (*api.ShadowMigration, error) {
+	var migration *api.ShadowMigration
+	err := b.getValue(DMSShadowMigration(dmsName), &migration)
+	return migration, err
+}
+
+func (b *BadgerDB) UpdateDMSShadowMigration(ctx context.Context, migration api.ShadowMigration) error {
+	return b.setValue(DMSShadowMigration(migration.DMSName), migration)
+}
+
+func (b *BadgerDB) GetDMSCABundleState(ctx context.Context, dmsName string) (*api.CABundleState, error) {
+	var state *api.CABundleState
+	err := b.getValue(DMSCABundleState(dmsName), &state)
+	return state, err
+}
+
+func (b *BadgerDB) UpdateDMSCABundleState(ctx context.Context, state api.CABundleState) error {
+	return b.setValue(DMSCABundleState(state.DMSName), state)
+}
+
+func (b *BadgerDB) DeleteDMSCABundleState(ctx context.Context, dmsName string) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(DMSCABundleState(dmsName)))
+	})
+}
+
+func (b *BadgerDB) GetReconciliationReport(ctx context.Context) (*api.ReconciliationReport, error) {
+	var report *api.ReconciliationReport
+	err := b.getValue(ReconciliationReport, &report)
+	return report, err
+}
+
+func (b *BadgerDB) UpdateReconciliationReport(ctx context.Context, report api.ReconciliationReport) error {
+	return b.setValue(ReconciliationReport, report)
+}
+
+func (b *BadgerDB) GetThingGroupOwnership(ctx context.Context, thingGroup string) (*api.ThingGroupOwnership, error) {
+	var ownership *api.ThingGroupOwnership
+	err := b.getValue(ThingGroupOwnership(thingGroup), &ownership)
+	return ownership, err
+}
+
+func (b *BadgerDB) ListThingGroupOwnerships(ctx context.Context) ([]api.ThingGroupOwnership, error) {
+	ownerships := []api.ThingGroupOwnership{}
+
+	err := b.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(thingGroupOwnershipPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var ownership api.ThingGroupOwnership
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &ownership)
+			})
+			if err != nil {
+				return err
+			}
+			ownerships = append(ownerships, ownership)
+		}
 
 		return nil
 	})
 
+	return ownerships, err
+}
+
+func (b *BadgerDB) UpdateThingGroupOwnership(ctx context.Context, ownership api.ThingGroupOwnership) error {
+	return b.setValue(ThingGroupOwnership(ownership.ThingGroup), ownership)
+}
+
+func (b *BadgerDB) ListFlaggedDrifts(ctx context.Context) ([]api.FlaggedDrift, error) {
+	drifts := []api.FlaggedDrift{}
+
+	err := b.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(flaggedDriftPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var drift api.FlaggedDrift
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &drift)
+			})
+			if err != nil {
+				return err
+			}
+			drifts = append(drifts, drift)
+		}
+
+		return nil
+	})
+
+	return drifts, err
+}
+
+func (b *BadgerDB) UpdateFlaggedDrift(ctx context.Context, drift api.FlaggedDrift) error {
+	return b.setValue(FlaggedDrift(drift.Kind, drift.Resource), drift)
+}
+
+func (b *BadgerDB) DeleteFlaggedDrift(ctx context.Context, kind api.DriftKind, resource string) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(FlaggedDrift(kind, resource)))
+	})
+}
+
+func (b *BadgerDB) GetShadowFanOutReports(ctx context.Context, dmsName string) ([]api.ShadowFanOutReport, error) {
+	reports := []api.ShadowFanOutReport{}
+
+	err := b.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(shadowFanOutReportPrefix(dmsName))
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var report api.ShadowFanOutReport
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &report)
+			})
+			if err != nil {
+				return err
+			}
+			reports = append(reports, report)
+		}
+
+		return nil
+	})
 	if err != nil {
-		return make(map[string]interface{}), err
+		return reports, err
 	}
 
-	valMap := map[string]interface{}{}
-	if err := json.Unmarshal([]byte(string(valCopy)), &valMap); err != nil {
-		return make(map[string]interface{}), err
-	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].StartedAt.After(reports[j].StartedAt)
+	})
 
-	return valMap, nil
+	return reports, nil
 }
 
-func (b *BadgerDB) DeleteAWSIoTCoreConfig(ctx context.Context) error {
-	err := b.db.Update(func(txn *badger.Txn) error {
-		err := txn.Delete([]byte(AWSConfig))
-		return err
+func (b *BadgerDB) UpdateShadowFanOutReport(ctx context.Context, report api.ShadowFanOutReport) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		bytes, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+
+		e := badger.NewEntry([]byte(ShadowFanOutReport(report.DMSName, report.ID)), bytes).WithTTL(shadowFanOutReportTTL)
+		return txn.SetEntry(e)
 	})
+}
 
-	return err
+func (b *BadgerDB) GetFleetImport(ctx context.Context, importID string) (*api.FleetImport, error) {
+	var fleetImport *api.FleetImport
+	err := b.getValue(FleetImport(importID), &fleetImport)
+	return fleetImport, err
 }
-func (b *BadgerDB) GetAWSIoTCoreThingConfig(ctx context.Context, deviceID string) (interface{}, error) {
-	var valCopy []byte
+
+func (b *BadgerDB) GetFleetImports(ctx context.Context) ([]api.FleetImport, error) {
+	imports := []api.FleetImport{}
 
 	err := b.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(AWSThingConfig(deviceID)))
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(fleetImportPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var fleetImport api.FleetImport
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &fleetImport)
+			})
+			if err != nil {
+				return err
+			}
+			imports = append(imports, fleetImport)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return imports, err
+	}
+
+	sort.Slice(imports, func(i, j int) bool {
+		return imports[i].StartedAt.After(imports[j].StartedAt)
+	})
+
+	return imports, nil
+}
+
+func (b *BadgerDB) UpdateFleetImport(ctx context.Context, fleetImport api.FleetImport) error {
+	return b.setValue(FleetImport(fleetImport.ID), fleetImport)
+}
+
+func (b *BadgerDB) ListDMSShadowMigrations(ctx context.Context) ([]api.ShadowMigration, error) {
+	migrations := []api.ShadowMigration{}
+
+	err := b.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(dmsShadowMigrationPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var migration api.ShadowMigration
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &migration)
+			})
+			if err != nil {
+				return err
+			}
+			migrations = append(migrations, migration)
+		}
+
+		return nil
+	})
+
+	return migrations, err
+}
+
+func (b *BadgerDB) GetAWSCAMapping(ctx context.Context, caName string) (*api.AWSCAMapping, error) {
+	var mapping *api.AWSCAMapping
+	err := b.getValue(AWSCAMappingByName(caName), &mapping)
+	return mapping, err
+}
+
+func (b *BadgerDB) GetAWSCAMappingByAWSID(ctx context.Context, awsCertificateID string) (*api.AWSCAMapping, error) {
+	var mapping *api.AWSCAMapping
+	err := b.getValue(AWSCAMappingByAWSID(awsCertificateID), &mapping)
+	return mapping, err
+}
+
+func (b *BadgerDB) UpdateAWSCAMapping(ctx context.Context, mapping api.AWSCAMapping) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		bytes, err := json.Marshal(mapping)
 		if err != nil {
 			return err
 		}
 
-		err = item.Value(func(val []byte) error {
-			valCopy = append([]byte{}, val...)
-			return nil
-		})
+		err = txn.Set([]byte(AWSCAMappingByName(mapping.CAName)), bytes)
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte(AWSCAMappingByAWSID(mapping.AWSCertificateID)), bytes)
+	})
+}
 
-		return nil
+func (b *BadgerDB) DeleteAWSCAMapping(ctx context.Context, caName string) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		var mapping api.AWSCAMapping
+		found, err := getTxnValue(txn, AWSCAMappingByName(caName), &mapping)
+		if err != nil || !found {
+			return err
+		}
+
+		err = txn.Delete([]byte(AWSCAMappingByName(caName)))
+		if err != nil {
+			return err
+		}
+		return txn.Delete([]byte(AWSCAMappingByAWSID(mapping.AWSCertificateID)))
 	})
+}
+
+func (b *BadgerDB) GetCertificateMapping(ctx context.Context, caName string, serialNumber string) (*api.CertificateMapping, error) {
+	var mapping *api.CertificateMapping
+	err := b.getValue(CertificateMappingBySerialNumber(caName, serialNumber), &mapping)
+	return mapping, err
+}
+
+func (b *BadgerDB) GetCertificateMappingByAWSID(ctx context.Context, awsCertificateID string) (*api.CertificateMapping, error) {
+	var mapping *api.CertificateMapping
+	err := b.getValue(CertificateMappingByAWSID(awsCertificateID), &mapping)
+	return mapping, err
+}
+
+func (b *BadgerDB) UpdateCertificateMapping(ctx context.Context, mapping api.CertificateMapping) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		bytes, err := json.Marshal(mapping)
+		if err != nil {
+			return err
+		}
+
+		err = txn.Set([]byte(CertificateMappingBySerialNumber(mapping.CAName, mapping.SerialNumber)), bytes)
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte(CertificateMappingByAWSID(mapping.AWSCertificateID)), bytes)
+	})
+}
+
+func (b *BadgerDB) DeleteCertificateMapping(ctx context.Context, caName string, serialNumber string) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		var mapping api.CertificateMapping
+		found, err := getTxnValue(txn, CertificateMappingBySerialNumber(caName, serialNumber), &mapping)
+		if err != nil || !found {
+			return err
+		}
+
+		err = txn.Delete([]byte(CertificateMappingBySerialNumber(caName, serialNumber)))
+		if err != nil {
+			return err
+		}
+		return txn.Delete([]byte(CertificateMappingByAWSID(mapping.AWSCertificateID)))
+	})
+}
+
+func (b *BadgerDB) IsEventProcessed(ctx context.Context, eventID string) (bool, error) {
+	var processed bool
+	err := b.getValue(ProcessedEvent(eventID), &processed)
+	return processed, err
+}
+
+func (b *BadgerDB) MarkEventProcessed(ctx context.Context, eventID string) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		e := badger.NewEntry([]byte(ProcessedEvent(eventID)), []byte("true")).WithTTL(processedEventTTL)
+		return txn.SetEntry(e)
+	})
+}
 
+func (b *BadgerDB) AddPendingStatusChange(ctx context.Context, change api.PendingStatusChange, ttl time.Duration) error {
+	return b.setCacheValue(PendingStatusChange(change.Resource, change.AWSCertificateID, change.Status), change, ttl)
+}
+
+func (b *BadgerDB) TakePendingStatusChange(ctx context.Context, resource api.StatusChangeResource, awsCertificateID string, status string) (*api.PendingStatusChange, error) {
+	var change *api.PendingStatusChange
+	err := b.db.Update(func(txn *badger.Txn) error {
+		key := PendingStatusChange(resource, awsCertificateID, status)
+		found, err := getTxnValue(txn, key, &change)
+		if err != nil || !found {
+			return err
+		}
+		return txn.Delete([]byte(key))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+func (b *BadgerDB) GetCertificateExpiryNotice(ctx context.Context, awsCertificateID string) (*api.CertificateExpiryNotice, error) {
+	var notice *api.CertificateExpiryNotice
+	_, err := b.getCacheValue(CertificateExpiryNotice(awsCertificateID), &notice)
+	return notice, err
+}
+
+func (b *BadgerDB) UpdateCertificateExpiryNotice(ctx context.Context, notice api.CertificateExpiryNotice, ttl time.Duration) error {
+	return b.setCacheValue(CertificateExpiryNotice(notice.AWSCertificateID), notice, ttl)
+}
+
+func (b *BadgerDB) AddOutboxEntry(ctx context.Context, entry api.OutboxEntry) (*api.OutboxEntry, error) {
+	id, err := b.outboxSequence.Next()
 	if err != nil {
 		return nil, err
 	}
 
-	var valMap interface{}
-	if err := json.Unmarshal([]byte(string(valCopy)), &valMap); err != nil {
-		return valMap, err
+	// IDs start at 1, so that a zero ID is never a valid entry.
+	entry.ID = id + 1
+	err = b.setValue(OutboxEntry(entry.ID), entry)
+	if err != nil {
+		return nil, err
 	}
+	return &entry, nil
+}
 
-	return valMap, nil
+func (b *BadgerDB) GetOutboxEntry(ctx context.Context, id uint64) (*api.OutboxEntry, error) {
+	var entry *api.OutboxEntry
+	err := b.getValue(OutboxEntry(id), &entry)
+	return entry, err
 }
 
-func (b *BadgerDB) UpdateAWSIoTCoreThingConfig(ctx context.Context, deviceID string, newConfig interface{}) error {
+func (b *BadgerDB) ListOutboxEntries(ctx context.Context) ([]api.OutboxEntry, error) {
+	entries := []api.OutboxEntry{}
+
+	err := b.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(outboxPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var entry api.OutboxEntry
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &entry)
+			})
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+
+		return nil
+	})
+
+	return entries, err
+}
+
+func (b *BadgerDB) UpdateOutboxEntry(ctx context.Context, entry api.OutboxEntry) error {
+	return b.setValue(OutboxEntry(entry.ID), entry)
+}
+
+func (b *BadgerDB) DeleteOutboxEntry(ctx context.Context, id uint64) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(OutboxEntry(id)))
+	})
+}
+
+// lease is the value stored under the key of a lease. Badger expires keys with a granularity
+// of seconds, so the expiration is kept in the value as well.
+type lease struct {
+	Owner     string    `json:"owner"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (b *BadgerDB) AcquireLease(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error) {
+	acquired := false
 	err := b.db.Update(func(txn *badger.Txn) error {
-		bytes, err := json.Marshal(newConfig)
+		var held lease
+		found, err := getTxnValue(txn, Lease(name), &held)
 		if err != nil {
 			return err
 		}
+		if found && held.Owner != owner && time.Now().Before(held.ExpiresAt) {
+			return nil
+		}
 
-		e := badger.NewEntry([]byte(AWSThingConfig(deviceID)), []byte(bytes)).WithTTL(5 * time.Second)
-		err = txn.SetEntry(e)
+		bytes, err := json.Marshal(lease{Owner: owner, ExpiresAt: time.Now().Add(ttl)})
+		if err != nil {
+			return err
+		}
 
-		return nil
+		acquired = true
+		return txn.SetEntry(badger.NewEntry([]byte(Lease(name)), bytes).WithTTL(ttl + time.Second))
 	})
+	if err == badger.ErrConflict {
+		// Another owner acquired the lease concurrently.
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return acquired, nil
+}
 
-	return err
+func (b *BadgerDB) ReleaseLease(ctx context.Context, name string, owner string) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		var held lease
+		found, err := getTxnValue(txn, Lease(name), &held)
+		if err != nil || !found || held.Owner != owner {
+			return err
+		}
+		return txn.Delete([]byte(Lease(name)))
+	})
 }
 
-func (b *BadgerDB) DeleteAWSIoTCoreThingConfig(ctx context.Context, deviceID string) error {
-	err := b.db.Update(func(txn *badger.Txn) error {
-		err := txn.Delete([]byte(AWSThingConfig(deviceID)))
+func (b *BadgerDB) GetCacheGeneration(ctx context.Context) (uint64, error) {
+	var generation uint64
+	err := b.getValue(CacheGeneration, &generation)
+	return generation, err
+}
+
+func (b *BadgerDB) BumpCacheGeneration(ctx context.Context) error {
+	for {
+		err := b.db.Update(func(txn *badger.Txn) error {
+			var generation uint64
+			_, err := getTxnValue(txn, CacheGeneration, &generation)
+			if err != nil {
+				return err
+			}
+
+			bytes, err := json.Marshal(generation + 1)
+			if err != nil {
+				return err
+			}
+			return txn.Set([]byte(CacheGeneration), bytes)
+		})
+		if err != badger.ErrConflict {
+			return err
+		}
+	}
+}
+
+func (b *BadgerDB) Close() error {
+	err := b.outboxSequence.Release()
+	if err != nil {
+		log.Warn("could not release the outbox sequence: ", err)
+	}
+	return b.db.Close()
+}
+
+// getValue decodes the JSON stored under key into value, leaving it untouched if the key
+// does not exist.
+func (b *BadgerDB) getValue(key string, value interface{}) error {
+	return b.db.View(func(txn *badger.Txn) error {
+		_, err := getTxnValue(txn, key, value)
 		return err
 	})
+}
 
-	return err
+// getTxnValue is getValue within a transaction, it reports whether the key exists.
+func getTxnValue(txn *badger.Txn, key string, value interface{}) (bool, error) {
+	item, err := txn.Get([]byte(key))
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, item.Value(func(val []byte) error {
+		return json.Unmarshal(val, value)
+	})
+}
+
+// getCacheValue is getValue for cached entries: it reports whether an unexpired entry was
+// found, so that a miss can be told apart from an empty value.
+func (b *BadgerDB) getCacheValue(key string, value interface{}) (bool, error) {
+	found := false
+	err := b.db.View(func(txn *badger.Txn) error {
+		var err error
+		found, err = getTxnValue(txn, key, value)
+		return err
+	})
+	return found, err
+}
+
+// setCacheValue stores value under key until ttl elapses.
+func (b *BadgerDB) setCacheValue(key string, value interface{}, ttl time.Duration) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		bytes, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+
+		return txn.SetEntry(badger.NewEntry([]byte(key), bytes).WithTTL(ttl))
+	})
+}
+
+func (b *BadgerDB) setValue(key string, value interface{}) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		bytes, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+
+		return txn.Set([]byte(key), bytes)
+	})
 }
@@ -0,0 +1,153 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/lamassuiot/aws-connector/pkg/server/store"
+	log "github.com/sirupsen/logrus"
+)
+
+const SchemaVersion = "SCHEMA_VERSION"
+
+// migration upgrades the key layout of the store to version. It runs in a single
+// transaction along the version update, so a failed migration leaves the store untouched.
+type migration struct {
+	version     int
+	description string
+	migrate     func(txn *badger.Txn) error
+}
+
+// migrations are applied in order to bring a store to the current key layout. Released
+// migrations must never change: a new layout is introduced by appending a migration.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "initial key layout",
+	},
+	{
+		version:     2,
+		description: "fan-out reports count the succeeded and skipped devices",
+		migrate: func(txn *badger.Txn) error {
+			it := txn.NewIterator(badger.DefaultIteratorOptions)
+			defer it.Close()
+
+			prefix := []byte(shadowFanOutReportAllPrefix)
+			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+				item := it.Item()
+				value, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				value, changed, err := countFanOutReportDevices(value)
+				if err != nil {
+					return err
+				}
+				if !changed {
+					continue
+				}
+
+				e := badger.NewEntry(item.KeyCopy(nil), value)
+				if item.ExpiresAt() > 0 {
+					e = e.WithTTL(time.Until(time.Unix(int64(item.ExpiresAt()), 0)))
+				}
+				err = txn.SetEntry(e)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// countFanOutReportDevices replaces the lists of succeeded and skipped devices of a fan-out
+// report written by an older connector with their length.
+func countFanOutReportDevices(value []byte) ([]byte, bool, error) {
+	var report map[string]json.RawMessage
+	err := json.Unmarshal(value, &report)
+	if err != nil {
+		return nil, false, err
+	}
+
+	changed := false
+	for _, field := range []string{"succeeded", "skipped"} {
+		var devices []string
+		if json.Unmarshal(report[field], &devices) != nil || devices == nil {
+			continue
+		}
+		report[field] = json.RawMessage(strconv.Itoa(len(devices)))
+		changed = true
+	}
+	if !changed {
+		return value, false, nil
+	}
+
+	value, err = json.Marshal(report)
+	return value, true, err
+}
+
+// NewPersistentDB opens the store kept in the badger directory of dir, upgrading its key
+// layout if it was written by an older connector.
+func NewPersistentDB(dir string) (store.DB, error) {
+	db, err := badger.Open(badger.DefaultOptions(filepath.Join(dir, "badger")))
+	if err != nil {
+		return nil, err
+	}
+
+	err = migrate(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return newBadgerDB(db)
+}
+
+func migrate(db *badger.DB) error {
+	current := 0
+	err := db.View(func(txn *badger.Txn) error {
+		_, err := getTxnValue(txn, SchemaVersion, &current)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		return fmt.Errorf("store schema version %d is newer than the supported version %d", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		err = db.Update(func(txn *badger.Txn) error {
+			if m.migrate != nil {
+				err := m.migrate(txn)
+				if err != nil {
+					return err
+				}
+			}
+
+			version, err := json.Marshal(m.version)
+			if err != nil {
+				return err
+			}
+			return txn.Set([]byte(SchemaVersion), version)
+		})
+		if err != nil {
+			return fmt.Errorf("could not migrate the store to schema version %d (%s): %w", m.version, m.description, err)
+		}
+
+		log.Info(fmt.Sprintf("store migrated to schema version %d: %s", m.version, m.description))
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lamassuiot/aws-connector/pkg/server/store"
+	_ "github.com/lib/pq"
+)
+
+// postgresMigrationsLock identifies the advisory lock held while the schema is migrated, so
+// that replicas started together do not migrate it twice.
+const postgresMigrationsLock = 7213004154627368081
+
+// postgresMigrations are applied in order to bring a database to the current schema. Released
+// migrations must never change: a new schema is introduced by appending a migration.
+var postgresMigrations = []sqlMigration{
+	{
+		version:     1,
+		description: "initial schema",
+		statements: []string{
+			`CREATE TABLE connector_state (
+				key        TEXT PRIMARY KEY,
+				value      TEXT NOT NULL,
+				expires_at TIMESTAMPTZ
+			)`,
+			`CREATE TABLE aws_ca_mappings (
+				ca_name             TEXT PRIMARY KEY,
+				aws_certificate_id  TEXT NOT NULL,
+				aws_certificate_arn TEXT NOT NULL
+			)`,
+			`CREATE INDEX aws_ca_mappings_aws_certificate_id ON aws_ca_mappings (aws_certificate_id)`,
+			`CREATE TABLE certificate_mappings (
+				ca_name             TEXT NOT NULL,
+				serial_number       TEXT NOT NULL,
+				aws_certificate_id  TEXT NOT NULL,
+				aws_certificate_arn TEXT NOT NULL,
+				PRIMARY KEY (ca_name, serial_number)
+			)`,
+			`CREATE INDEX certificate_mappings_aws_certificate_id ON certificate_mappings (aws_certificate_id)`,
+			`CREATE TABLE processed_events (
+				event_id   TEXT PRIMARY KEY,
+				expires_at TIMESTAMPTZ NOT NULL
+			)`,
+			`CREATE TABLE device_shadow_action_completions (
+				id             BIGSERIAL PRIMARY KEY,
+				device_id      TEXT NOT NULL,
+				action         TEXT NOT NULL,
+				shadow_version BIGINT NOT NULL,
+				completed_at   TIMESTAMPTZ NOT NULL
+			)`,
+			`CREATE INDEX device_shadow_action_completions_device_id ON device_shadow_action_completions (device_id, id)`,
+			`CREATE TABLE leases (
+				name       TEXT PRIMARY KEY,
+				owner      TEXT NOT NULL,
+				expires_at TIMESTAMPTZ NOT NULL
+			)`,
+		},
+	},
+	{
+		version:     2,
+		description: "outbox",
+		statements: []string{
+			`CREATE TABLE outbox_entries (
+				id              BIGSERIAL PRIMARY KEY,
+				event_id        TEXT NOT NULL,
+				event_type      TEXT NOT NULL,
+				payload         TEXT NOT NULL,
+				status          TEXT NOT NULL,
+				attempts        INTEGER NOT NULL,
+				last_error      TEXT NOT NULL,
+				created_at      TIMESTAMPTZ NOT NULL,
+				next_attempt_at TIMESTAMPTZ NOT NULL
+			)`,
+		},
+	},
+	{
+		version:     3,
+		description: "outbox destinations",
+		statements: []string{
+			`ALTER TABLE outbox_entries
+				ADD COLUMN destination_type   TEXT NOT NULL DEFAULT 'SQS',
+				ADD COLUMN destination_target TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version:     4,
+		description: "fan-out reports count the succeeded and skipped devices",
+		statements: []string{
+			`UPDATE connector_state SET value = (value::jsonb
+				|| jsonb_build_object('succeeded', jsonb_array_length(value::jsonb->'succeeded'))
+				|| jsonb_build_object('skipped', jsonb_array_length(value::jsonb->'skipped')))::text
+			WHERE key LIKE 'SHADOW\_FANOUT\_REPORT\_%'
+				AND jsonb_typeof(value::jsonb->'succeeded') = 'array'
+				AND jsonb_typeof(value::jsonb->'skipped') = 'array'`,
+		},
+	},
+}
+
+// NewPostgresDB connects to the PostgreSQL database of dsn, creating or upgrading its schema
+// if needed.
+func NewPostgresDB(dsn string) (store.DB, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	err = migrateSQL(context.Background(), db, postgresMigrations, `SELECT pg_advisory_xact_lock($1)`, int64(postgresMigrationsLock))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return newSQLDB(db), nil
+}
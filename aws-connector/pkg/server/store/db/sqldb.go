@@ -0,0 +1,655 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// SQLDB keeps the connector state in a SQL database, PostgreSQL when several replicas of the
+// connector share it or SQLite for local and development setups. The documents Badger keeps by
+// key are kept under the same key in the connector_state table, while the mappings, the
+// processed events and the shadow action completions have tables of their own.
+type SQLDB struct {
+	db   *sql.DB
+	stop chan struct{}
+}
+
+// expiredPurgeInterval is how often the expired cache entries, reports and processed events
+// are removed. They are ignored by the reads as soon as they expire.
+const expiredPurgeInterval = time.Hour
+
+type sqlMigration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+func newSQLDB(db *sql.DB) *SQLDB {
+	s := &SQLDB{
+		db:   db,
+		stop: make(chan struct{}),
+	}
+	go s.purgeExpired()
+
+	return s
+}
+
+// migrateSQL applies the migrations newer than the schema version of the database. When lock
+// is not empty, it is executed first to keep other replicas from migrating at the same time.
+func migrateSQL(ctx context.Context, db *sql.DB, migrations []sqlMigration, lock string, lockArgs ...interface{}) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if lock != "" {
+		_, err = tx.ExecContext(ctx, lock, lockArgs...)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`)
+	if err != nil {
+		return err
+	}
+
+	current := 0
+	err = tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than the supported version %d", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		for _, statement := range m.statements {
+			_, err = tx.ExecContext(ctx, statement)
+			if err != nil {
+				return fmt.Errorf("could not migrate the database to schema version %d (%s): %w", m.version, m.description, err)
+			}
+		}
+		log.Info(fmt.Sprintf("database migrated to schema version %d: %s", m.version, m.description))
+	}
+
+	if current < latest {
+		_, err = tx.ExecContext(ctx, `DELETE FROM schema_version`)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_version (version) VALUES ($1)`, latest)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLDB) purgeExpired() {
+	ticker := time.NewTicker(expiredPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		purgedAt := now()
+		_, err := s.db.Exec(`DELETE FROM connector_state WHERE expires_at <= $1`, purgedAt)
+		if err != nil {
+			log.Warn("could not purge the expired connector state: ", err)
+		}
+		_, err = s.db.Exec(`DELETE FROM processed_events WHERE expires_at <= $1`, purgedAt)
+		if err != nil {
+			log.Warn("could not purge the expired processed events: ", err)
+		}
+		_, err = s.db.Exec(`DELETE FROM leases WHERE expires_at <= $1`, purgedAt)
+		if err != nil {
+			log.Warn("could not purge the expired leases: ", err)
+		}
+	}
+}
+
+func (s *SQLDB) UpdateAWSIoTCoreConfig(ctx context.Context, newConfig interface{}, ttl time.Duration) error {
+	return s.setValue(ctx, AWSConfig, newConfig, ttl)
+}
+
+func (s *SQLDB) GetAWSIoTCoreConfig(ctx context.Context, config interface{}) (bool, error) {
+	return s.getValue(ctx, AWSConfig, config)
+}
+
+func (s *SQLDB) DeleteAWSIoTCoreConfig(ctx context.Context) error {
+	return s.deleteValue(ctx, AWSConfig)
+}
+
+func (s *SQLDB) GetAWSIoTCoreThingConfig(ctx context.Context, deviceID string, config interface{}) (bool, error) {
+	return s.getValue(ctx, AWSThingConfig(deviceID), config)
+}
+
+func (s *SQLDB) UpdateAWSIoTCoreThingConfig(ctx context.Context, deviceID string, newConfig interface{}, ttl time.Duration) error {
+	return s.setValue(ctx, AWSThingConfig(deviceID), newConfig, ttl)
+}
+
+func (s *SQLDB) DeleteAWSIoTCoreThingConfig(ctx context.Context, deviceID string) error {
+	return s.deleteValue(ctx, AWSThingConfig(deviceID))
+}
+
+func (s *SQLDB) DeleteAWSIoTCoreThingConfigs(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM connector_state WHERE key LIKE $1 ESCAPE '\'`, likePrefix(awsThingConfigPrefix))
+	return err
+}
+
+func (s *SQLDB) GetDeviceShadowActionCompletions(ctx context.Context, deviceID string) ([]api.ShadowActionCompletion, error) {
+	completions := []api.ShadowActionCompletion{}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT action, shadow_version, completed_at FROM device_shadow_action_completions WHERE device_id = $1 ORDER BY id`, deviceID)
+	if err != nil {
+		return completions, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var completion api.ShadowActionCompletion
+		err = rows.Scan(&completion.Action, &completion.ShadowVersion, &completion.CompletedAt)
+		if err != nil {
+			return completions, err
+		}
+		completions = append(completions, completion)
+	}
+
+	return completions, rows.Err()
+}
+
+func (s *SQLDB) AddDeviceShadowActionCompletion(ctx context.Context, deviceID string, completion api.ShadowActionCompletion) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO device_shadow_action_completions (device_id, action, shadow_version, completed_at) VALUES ($1, $2, $3, $4)`,
+		deviceID, string(completion.Action), completion.ShadowVersion, completion.CompletedAt.UTC())
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM device_shadow_action_completions WHERE device_id = $1 AND id NOT IN (
+		SELECT id FROM device_shadow_action_completions WHERE device_id = $1 ORDER BY id DESC LIMIT $2
+	)`, deviceID, maxDeviceShadowActionCompletions)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLDB) GetDMSAWSSettings(ctx context.Context, dmsName string) (*api.DMSAWSSettings, error) {
+	var settings *api.DMSAWSSettings
+	_, err := s.getValue(ctx, DMSAWSSettings(dmsName), &settings)
+	return settings, err
+}
+
+func (s *SQLDB) ListDMSAWSSettings(ctx context.Context) ([]api.DMSAWSSettings, error) {
+	settingsList := []api.DMSAWSSettings{}
+	err := s.listValues(ctx, dmsAWSSettingsPrefix, func(value []byte) error {
+		var settings api.DMSAWSSettings
+		err := json.Unmarshal(value, &settings)
+		settingsList = append(settingsList, settings)
+		return err
+	})
+	return settingsList, err
+}
+
+func (s *SQLDB) UpdateDMSAWSSettings(ctx context.Context, settings api.DMSAWSSettings) error {
+	return s.setValue(ctx, DMSAWSSettings(settings.DMSName), settings, 0)
+}
+
+func (s *SQLDB) GetDMSShadowLocation(ctx context.Context, dmsName string) (*api.ShadowLocation, error) {
+	var location *api.ShadowLocation
+	_, err := s.getValue(ctx, DMSShadowLocation(dmsName), &location)
+	return location, err
+}
+
+func (s *SQLDB) UpdateDMSShadowLocation(ctx context.Context, dmsName string, location api.ShadowLocation) error {
+	return s.setValue(ctx, DMSShadowLocation(dmsName), location, 0)
+}
+
+func (s *SQLDB) GetDMSShadowMigration(ctx context.Context, dmsName string) (*api.ShadowMigration, error) {
+	var migration *api.ShadowMigration
+	_, err := s.getValue(ctx, DMSShadowMigration(dmsName), &migration)
+	return migration, err
+}
+
+func (s *SQLDB) UpdateDMSShadowMigration(ctx context.Context, migration api.ShadowMigration) error {
+	return s.setValue(ctx, DMSShadowMigration(migration.DMSName), migration, 0)
+}
+
+func (s *SQLDB) ListDMSShadowMigrations(ctx context.Context) ([]api.ShadowMigration, error) {
+	migrations := []api.ShadowMigration{}
+	err := s.listValues(ctx, dmsShadowMigrationPrefix, func(value []byte) error {
+		var migration api.ShadowMigration
+		err := json.Unmarshal(value, &migration)
+		migrations = append(migrations, migration)
+		return err
+	})
+	return migrations, err
+}
+
+func (s *SQLDB) GetDMSCABundleState(ctx context.Context, dmsName string) (*api.CABundleState, error) {
+	var state *api.CABundleState
+	_, err := s.getValue(ctx, DMSCABundleState(dmsName), &state)
+	return state, err
+}
+
+func (s *SQLDB) UpdateDMSCABundleState(ctx context.Context, state api.CABundleState) error {
+	return s.setValue(ctx, DMSCABundleState(state.DMSName), state, 0)
+}
+
+func (s *SQLDB) DeleteDMSCABundleState(ctx context.Context, dmsName string) error {
+	return s.deleteValue(ctx, DMSCABundleState(dmsName))
+}
+
+func (s *SQLDB) GetReconciliationReport(ctx context.Context) (*api.ReconciliationReport, error) {
+	var report *api.ReconciliationReport
+	_, err := s.getValue(ctx, ReconciliationReport, &report)
+	return report, err
+}
+
+func (s *SQLDB) UpdateReconciliationReport(ctx context.Context, report api.ReconciliationReport) error {
+	return s.setValue(ctx, ReconciliationReport, report, 0)
+}
+
+func (s *SQLDB) GetThingGroupOwnership(ctx context.Context, thingGroup string) (*api.ThingGroupOwnership, error) {
+	var ownership *api.ThingGroupOwnership
+	_, err := s.getValue(ctx, ThingGroupOwnership(thingGroup), &ownership)
+	return ownership, err
+}
+
+func (s *SQLDB) ListThingGroupOwnerships(ctx context.Context) ([]api.ThingGroupOwnership, error) {
+	ownerships := []api.ThingGroupOwnership{}
+	err := s.listValues(ctx, thingGroupOwnershipPrefix, func(value []byte) error {
+		var ownership api.ThingGroupOwnership
+		err := json.Unmarshal(value, &ownership)
+		ownerships = append(ownerships, ownership)
+		return err
+	})
+	return ownerships, err
+}
+
+func (s *SQLDB) UpdateThingGroupOwnership(ctx context.Context, ownership api.ThingGroupOwnership) error {
+	return s.setValue(ctx, ThingGroupOwnership(ownership.ThingGroup), ownership, 0)
+}
+
+func (s *SQLDB) ListFlaggedDrifts(ctx context.Context) ([]api.FlaggedDrift, error) {
+	drifts := []api.FlaggedDrift{}
+	err := s.listValues(ctx, flaggedDriftPrefix, func(value []byte) error {
+		var drift api.FlaggedDrift
+		err := json.Unmarshal(value, &drift)
+		drifts = append(drifts, drift)
+		return err
+	})
+	return drifts, err
+}
+
+func (s *SQLDB) UpdateFlaggedDrift(ctx context.Context, drift api.FlaggedDrift) error {
+	return s.setValue(ctx, FlaggedDrift(drift.Kind, drift.Resource), drift, 0)
+}
+
+func (s *SQLDB) DeleteFlaggedDrift(ctx context.Context, kind api.DriftKind, resource string) error {
+	return s.deleteValue(ctx, FlaggedDrift(kind, resource))
+}
+
+func (s *SQLDB) GetShadowFanOutReports(ctx context.Context, dmsName string) ([]api.ShadowFanOutReport, error) {
+	reports := []api.ShadowFanOutReport{}
+	err := s.listValues(ctx, shadowFanOutReportPrefix(dmsName), func(value []byte) error {
+		var report api.ShadowFanOutReport
+		err := json.Unmarshal(value, &report)
+		reports = append(reports, report)
+		return err
+	})
+	if err != nil {
+		return reports, err
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].StartedAt.After(reports[j].StartedAt)
+	})
+
+	return reports, nil
+}
+
+func (s *SQLDB) UpdateShadowFanOutReport(ctx context.Context, report api.ShadowFanOutReport) error {
+	return s.setValue(ctx, ShadowFanOutReport(report.DMSName, report.ID), report, shadowFanOutReportTTL)
+}
+
+func (s *SQLDB) GetFleetImport(ctx context.Context, importID string) (*api.FleetImport, error) {
+	var fleetImport *api.FleetImport
+	_, err := s.getValue(ctx, FleetImport(importID), &fleetImport)
+	return fleetImport, err
+}
+
+func (s *SQLDB) GetFleetImports(ctx context.Context) ([]api.FleetImport, error) {
+	imports := []api.FleetImport{}
+	err := s.listValues(ctx, fleetImportPrefix, func(value []byte) error {
+		var fleetImport api.FleetImport
+		err := json.Unmarshal(value, &fleetImport)
+		imports = append(imports, fleetImport)
+		return err
+	})
+	if err != nil {
+		return imports, err
+	}
+
+	sort.Slice(imports, func(i, j int) bool {
+		return imports[i].StartedAt.After(imports[j].StartedAt)
+	})
+
+	return imports, nil
+}
+
+func (s *SQLDB) UpdateFleetImport(ctx context.Context, fleetImport api.FleetImport) error {
+	return s.setValue(ctx, FleetImport(fleetImport.ID), fleetImport, 0)
+}
+
+func (s *SQLDB) GetAWSCAMapping(ctx context.Context, caName string) (*api.AWSCAMapping, error) {
+	return s.getAWSCAMapping(ctx, `SELECT ca_name, aws_certificate_id, aws_certificate_arn FROM aws_ca_mappings WHERE ca_name = $1`, caName)
+}
+
+func (s *SQLDB) GetAWSCAMappingByAWSID(ctx context.Context, awsCertificateID string) (*api.AWSCAMapping, error) {
+	return s.getAWSCAMapping(ctx, `SELECT ca_name, aws_certificate_id, aws_certificate_arn FROM aws_ca_mappings WHERE aws_certificate_id = $1 LIMIT 1`, awsCertificateID)
+}
+
+func (s *SQLDB) getAWSCAMapping(ctx context.Context, query string, arg string) (*api.AWSCAMapping, error) {
+	var mapping api.AWSCAMapping
+	err := s.db.QueryRowContext(ctx, query, arg).Scan(&mapping.CAName, &mapping.AWSCertificateID, &mapping.AWSCertificateArn)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &mapping, nil
+}
+
+func (s *SQLDB) UpdateAWSCAMapping(ctx context.Context, mapping api.AWSCAMapping) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO aws_ca_mappings (ca_name, aws_certificate_id, aws_certificate_arn) VALUES ($1, $2, $3)
+		ON CONFLICT (ca_name) DO UPDATE SET aws_certificate_id = EXCLUDED.aws_certificate_id, aws_certificate_arn = EXCLUDED.aws_certificate_arn`,
+		mapping.CAName, mapping.AWSCertificateID, mapping.AWSCertificateArn)
+	return err
+}
+
+func (s *SQLDB) DeleteAWSCAMapping(ctx context.Context, caName string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM aws_ca_mappings WHERE ca_name = $1`, caName)
+	return err
+}
+
+func (s *SQLDB) GetCertificateMapping(ctx context.Context, caName string, serialNumber string) (*api.CertificateMapping, error) {
+	return s.getCertificateMapping(ctx, `SELECT ca_name, serial_number, aws_certificate_id, aws_certificate_arn FROM certificate_mappings WHERE ca_name = $1 AND serial_number = $2`, caName, serialNumber)
+}
+
+func (s *SQLDB) GetCertificateMappingByAWSID(ctx context.Context, awsCertificateID string) (*api.CertificateMapping, error) {
+	return s.getCertificateMapping(ctx, `SELECT ca_name, serial_number, aws_certificate_id, aws_certificate_arn FROM certificate_mappings WHERE aws_certificate_id = $1 LIMIT 1`, awsCertificateID)
+}
+
+func (s *SQLDB) getCertificateMapping(ctx context.Context, query string, args ...interface{}) (*api.CertificateMapping, error) {
+	var mapping api.CertificateMapping
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&mapping.CAName, &mapping.SerialNumber, &mapping.AWSCertificateID, &mapping.AWSCertificateArn)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &mapping, nil
+}
+
+func (s *SQLDB) UpdateCertificateMapping(ctx context.Context, mapping api.CertificateMapping) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO certificate_mappings (ca_name, serial_number, aws_certificate_id, aws_certificate_arn) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (ca_name, serial_number) DO UPDATE SET aws_certificate_id = EXCLUDED.aws_certificate_id, aws_certificate_arn = EXCLUDED.aws_certificate_arn`,
+		mapping.CAName, mapping.SerialNumber, mapping.AWSCertificateID, mapping.AWSCertificateArn)
+	return err
+}
+
+func (s *SQLDB) DeleteCertificateMapping(ctx context.Context, caName string, serialNumber string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM certificate_mappings WHERE ca_name = $1 AND serial_number = $2`, caName, serialNumber)
+	return err
+}
+
+func (s *SQLDB) IsEventProcessed(ctx context.Context, eventID string) (bool, error) {
+	var processed bool
+	err := s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM processed_events WHERE event_id = $1 AND expires_at > $2)`, eventID, now()).Scan(&processed)
+	return processed, err
+}
+
+func (s *SQLDB) MarkEventProcessed(ctx context.Context, eventID string) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO processed_events (event_id, expires_at) VALUES ($1, $2)
+		ON CONFLICT (event_id) DO UPDATE SET expires_at = EXCLUDED.expires_at`, eventID, now().Add(processedEventTTL))
+	return err
+}
+
+func (s *SQLDB) AddPendingStatusChange(ctx context.Context, change api.PendingStatusChange, ttl time.Duration) error {
+	return s.setValue(ctx, PendingStatusChange(change.Resource, change.AWSCertificateID, change.Status), change, ttl)
+}
+
+func (s *SQLDB) TakePendingStatusChange(ctx context.Context, resource api.StatusChangeResource, awsCertificateID string, status string) (*api.PendingStatusChange, error) {
+	var raw string
+	err := s.db.QueryRowContext(ctx, `DELETE FROM connector_state WHERE key = $1 AND (expires_at IS NULL OR expires_at > $2) RETURNING value`,
+		PendingStatusChange(resource, awsCertificateID, status), now()).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var change api.PendingStatusChange
+	err = json.Unmarshal([]byte(raw), &change)
+	if err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
+func (s *SQLDB) GetCertificateExpiryNotice(ctx context.Context, awsCertificateID string) (*api.CertificateExpiryNotice, error) {
+	var notice *api.CertificateExpiryNotice
+	_, err := s.getValue(ctx, CertificateExpiryNotice(awsCertificateID), &notice)
+	return notice, err
+}
+
+func (s *SQLDB) UpdateCertificateExpiryNotice(ctx context.Context, notice api.CertificateExpiryNotice, ttl time.Duration) error {
+	return s.setValue(ctx, CertificateExpiryNotice(notice.AWSCertificateID), notice, ttl)
+}
+
+const outboxEntryColumns = `id, event_id, event_type, destination_type, destination_target, payload, status, attempts, last_error, created_at, next_attempt_at`
+
+func (s *SQLDB) AddOutboxEntry(ctx context.Context, entry api.OutboxEntry) (*api.OutboxEntry, error) {
+	err := s.db.QueryRowContext(ctx, `INSERT INTO outbox_entries (event_id, event_type, destination_type, destination_target, payload, status, attempts, last_error, created_at, next_attempt_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`,
+		entry.EventID, entry.EventType, string(entry.Destination.Type), entry.Destination.Target, string(entry.Payload), string(entry.Status), entry.Attempts, entry.LastError, entry.CreatedAt.UTC(), entry.NextAttemptAt.UTC()).Scan(&entry.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (s *SQLDB) GetOutboxEntry(ctx context.Context, id uint64) (*api.OutboxEntry, error) {
+	entry, err := scanOutboxEntry(s.db.QueryRowContext(ctx, `SELECT `+outboxEntryColumns+` FROM outbox_entries WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (s *SQLDB) ListOutboxEntries(ctx context.Context) ([]api.OutboxEntry, error) {
+	entries := []api.OutboxEntry{}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+outboxEntryColumns+` FROM outbox_entries ORDER BY id`)
+	if err != nil {
+		return entries, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry, err := scanOutboxEntry(rows)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, *entry)
+	}
+
+	return entries, rows.Err()
+}
+
+func (s *SQLDB) UpdateOutboxEntry(ctx context.Context, entry api.OutboxEntry) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE outbox_entries SET status = $2, attempts = $3, last_error = $4, next_attempt_at = $5 WHERE id = $1`,
+		entry.ID, string(entry.Status), entry.Attempts, entry.LastError, entry.NextAttemptAt.UTC())
+	return err
+}
+
+func (s *SQLDB) DeleteOutboxEntry(ctx context.Context, id uint64) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM outbox_entries WHERE id = $1`, id)
+	return err
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanOutboxEntry(row rowScanner) (*api.OutboxEntry, error) {
+	var entry api.OutboxEntry
+	var payload string
+	err := row.Scan(&entry.ID, &entry.EventID, &entry.EventType, &entry.Destination.Type, &entry.Destination.Target, &payload, &entry.Status, &entry.Attempts, &entry.LastError, &entry.CreatedAt, &entry.NextAttemptAt)
+	if err != nil {
+		return nil, err
+	}
+	entry.Payload = json.RawMessage(payload)
+	return &entry, nil
+}
+
+func (s *SQLDB) AcquireLease(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error) {
+	acquiredAt := now()
+	result, err := s.db.ExecContext(ctx, `INSERT INTO leases (name, owner, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (name) DO UPDATE SET owner = EXCLUDED.owner, expires_at = EXCLUDED.expires_at
+		WHERE leases.owner = EXCLUDED.owner OR leases.expires_at <= $4`, name, owner, acquiredAt.Add(ttl), acquiredAt)
+	if err != nil {
+		return false, err
+	}
+
+	acquired, err := result.RowsAffected()
+	return acquired == 1, err
+}
+
+func (s *SQLDB) ReleaseLease(ctx context.Context, name string, owner string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM leases WHERE name = $1 AND owner = $2`, name, owner)
+	return err
+}
+
+func (s *SQLDB) GetCacheGeneration(ctx context.Context) (uint64, error) {
+	var generation uint64
+	_, err := s.getValue(ctx, CacheGeneration, &generation)
+	return generation, err
+}
+
+func (s *SQLDB) BumpCacheGeneration(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO connector_state (key, value) VALUES ($1, '1')
+		ON CONFLICT (key) DO UPDATE SET value = CAST(CAST(connector_state.value AS BIGINT) + 1 AS TEXT)`, CacheGeneration)
+	return err
+}
+
+func (s *SQLDB) Close() error {
+	close(s.stop)
+	return s.db.Close()
+}
+
+// getValue decodes the unexpired JSON document stored under key into value, reporting
+// whether it was found.
+func (s *SQLDB) getValue(ctx context.Context, key string, value interface{}) (bool, error) {
+	var raw string
+	err := s.db.QueryRowContext(ctx, `SELECT value FROM connector_state WHERE key = $1 AND (expires_at IS NULL OR expires_at > $2)`, key, now()).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, json.Unmarshal([]byte(raw), value)
+}
+
+// setValue stores value under key as a JSON document, until ttl elapses if it is not 0.
+func (s *SQLDB) setValue(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	var expiresAt *time.Time
+	if ttl > 0 {
+		expiration := now().Add(ttl)
+		expiresAt = &expiration
+	}
+
+	_, err = s.db.ExecContext(ctx, `INSERT INTO connector_state (key, value, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, expires_at = EXCLUDED.expires_at`, key, string(bytes), expiresAt)
+	return err
+}
+
+func (s *SQLDB) deleteValue(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM connector_state WHERE key = $1`, key)
+	return err
+}
+
+// listValues calls decode with every unexpired document stored under a key starting with
+// prefix, in key order.
+func (s *SQLDB) listValues(ctx context.Context, prefix string, decode func(value []byte) error) error {
+	rows, err := s.db.QueryContext(ctx, `SELECT value FROM connector_state WHERE key LIKE $1 ESCAPE '\' AND (expires_at IS NULL OR expires_at > $2) ORDER BY key`, likePrefix(prefix), now())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var raw string
+		err = rows.Scan(&raw)
+		if err != nil {
+			return err
+		}
+
+		err = decode([]byte(raw))
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// likePrefix returns the LIKE pattern matching the keys starting with prefix. DMS and device
+// names may contain the LIKE wildcards.
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+}
+
+// now returns the current time in UTC. SQLite compares the timestamps as text, so every time
+// written or compared must be in the same location.
+func now() time.Time {
+	return time.Now().UTC()
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+
+	"github.com/lamassuiot/aws-connector/pkg/server/store"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations are applied in order to bring a SQLite database to the current schema. They
+// follow the PostgreSQL migrations in the SQLite dialect. Released migrations must never change.
+var sqliteMigrations = []sqlMigration{
+	{
+		version:     1,
+		description: "initial schema",
+		statements: []string{
+			`CREATE TABLE connector_state (
+				key        TEXT PRIMARY KEY,
+				value      TEXT NOT NULL,
+				expires_at TIMESTAMP
+			)`,
+			`CREATE TABLE aws_ca_mappings (
+				ca_name             TEXT PRIMARY KEY,
+				aws_certificate_id  TEXT NOT NULL,
+				aws_certificate_arn TEXT NOT NULL
+			)`,
+			`CREATE INDEX aws_ca_mappings_aws_certificate_id ON aws_ca_mappings (aws_certificate_id)`,
+			`CREATE TABLE certificate_mappings (
+				ca_name             TEXT NOT NULL,
+				serial_number       TEXT NOT NULL,
+				aws_certificate_id  TEXT NOT NULL,
+				aws_certificate_arn TEXT NOT NULL,
+				PRIMARY KEY (ca_name, serial_number)
+			)`,
+			`CREATE INDEX certificate_mappings_aws_certificate_id ON certificate_mappings (aws_certificate_id)`,
+			`CREATE TABLE processed_events (
+				event_id   TEXT PRIMARY KEY,
+				expires_at TIMESTAMP NOT NULL
+			)`,
+			`CREATE TABLE device_shadow_action_completions (
+				id             INTEGER PRIMARY KEY AUTOINCREMENT,
+				device_id      TEXT NOT NULL,
+				action         TEXT NOT NULL,
+				shadow_version BIGINT NOT NULL,
+				completed_at   TIMESTAMP NOT NULL
+			)`,
+			`CREATE INDEX device_shadow_action_completions_device_id ON device_shadow_action_completions (device_id, id)`,
+			`CREATE TABLE leases (
+				name       TEXT PRIMARY KEY,
+				owner      TEXT NOT NULL,
+				expires_at TIMESTAMP NOT NULL
+			)`,
+		},
+	},
+	{
+		version:     2,
+		description: "outbox",
+		statements: []string{
+			`CREATE TABLE outbox_entries (
+				id              INTEGER PRIMARY KEY AUTOINCREMENT,
+				event_id        TEXT NOT NULL,
+				event_type      TEXT NOT NULL,
+				payload         TEXT NOT NULL,
+				status          TEXT NOT NULL,
+				attempts        INTEGER NOT NULL,
+				last_error      TEXT NOT NULL,
+				created_at      TIMESTAMP NOT NULL,
+				next_attempt_at TIMESTAMP NOT NULL
+			)`,
+		},
+	},
+	{
+		version:     3,
+		description: "outbox destinations",
+		statements: []string{
+			`ALTER TABLE outbox_entries ADD COLUMN destination_type TEXT NOT NULL DEFAULT 'SQS'`,
+			`ALTER TABLE outbox_entries ADD COLUMN destination_target TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version:     4,
+		description: "fan-out reports count the succeeded and skipped devices",
+		statements: []string{
+			`UPDATE connector_state SET value = json_set(value,
+				'$.succeeded', json_array_length(value, '$.succeeded'),
+				'$.skipped', json_array_length(value, '$.skipped'))
+			WHERE key LIKE 'SHADOW\_FANOUT\_REPORT\_%' ESCAPE '\'
+				AND json_type(value, '$.succeeded') = 'array'
+				AND json_type(value, '$.skipped') = 'array'`,
+		},
+	},
+}
+
+// NewSQLiteDB opens the SQLite database file at path, creating or upgrading its schema if
+// needed. SQLite is meant for local and development setups: it keeps the state of a single
+// replica only.
+func NewSQLiteDB(path string) (store.DB, error) {
+	// Key prefixes are matched with LIKE, which SQLite compares case insensitively by default.
+	dsn := "file:" + (&url.URL{Path: path}).EscapedPath() + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=case_sensitive_like(1)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// The pragmas apply to each connection, and SQLite serializes the writes anyway.
+	db.SetMaxOpenConns(1)
+
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	err = migrateSQL(context.Background(), db, sqliteMigrations, "")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return newSQLDB(db), nil
+}
@@ -0,0 +1,598 @@
+package db
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	"github.com/google/uuid"
+	api "github.com/lamassuiot/aws-connector/pkg/common"
+	"github.com/lamassuiot/aws-connector/pkg/server/store"
+)
+
+// storeBackends opens every store backend for a test. PostgreSQL is only tested when
+// STORE_TEST_POSTGRES_DSN points to a database the tests may write to.
+func storeBackends(t *testing.T) map[string]store.DB {
+	t.Helper()
+
+	backends := map[string]store.DB{}
+
+	badgerDB, err := NewInMemoryDB()
+	if err != nil {
+		t.Fatalf("could not open the Badger store: %s", err)
+	}
+	backends["badger"] = badgerDB
+
+	sqliteDB, err := NewSQLiteDB(filepath.Join(t.TempDir(), "connector.db"))
+	if err != nil {
+		t.Fatalf("could not open the SQLite store: %s", err)
+	}
+	backends["sqlite"] = sqliteDB
+
+	if dsn := os.Getenv("STORE_TEST_POSTGRES_DSN"); dsn != "" {
+		postgresDB, err := NewPostgresDB(dsn)
+		if err != nil {
+			t.Fatalf("could not open the PostgreSQL store: %s", err)
+		}
+		backends["postgres"] = postgresDB
+	}
+
+	t.Cleanup(func() {
+		for _, db := range backends {
+			db.Close()
+		}
+	})
+
+	return backends
+}
+
+// uniqueName keeps the tests apart in a PostgreSQL database that outlives them.
+func uniqueName(name string) string {
+	return name + "-" + uuid.NewString()
+}
+
+func TestCachedConfigurations(t *testing.T) {
+	for name, db := range storeBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			deviceID := uniqueName("device")
+
+			var config map[string]string
+			found, err := db.GetAWSIoTCoreThingConfig(ctx, deviceID, &config)
+			if err != nil || found {
+				t.Fatalf("expected no cached configuration, got found=%t err=%v", found, err)
+			}
+
+			err = db.UpdateAWSIoTCoreThingConfig(ctx, deviceID, map[string]string{"thing": deviceID}, time.Hour)
+			if err != nil {
+				t.Fatalf("could not cache the configuration: %s", err)
+			}
+
+			found, err = db.GetAWSIoTCoreThingConfig(ctx, deviceID, &config)
+			if err != nil || !found || config["thing"] != deviceID {
+				t.Fatalf("expected the cached configuration, got %v found=%t err=%v", config, found, err)
+			}
+
+			err = db.DeleteAWSIoTCoreThingConfigs(ctx)
+			if err != nil {
+				t.Fatalf("could not delete the cached configurations: %s", err)
+			}
+
+			found, err = db.GetAWSIoTCoreThingConfig(ctx, deviceID, &config)
+			if err != nil || found {
+				t.Fatalf("expected the configuration to be deleted, got found=%t err=%v", found, err)
+			}
+		})
+	}
+}
+
+func TestCachedConfigurationsExpire(t *testing.T) {
+	for name, db := range storeBackends(t) {
+		db := db
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			deviceID := uniqueName("device")
+
+			err := db.UpdateAWSIoTCoreThingConfig(ctx, deviceID, map[string]string{"thing": deviceID}, time.Second)
+			if err != nil {
+				t.Fatalf("could not cache the configuration: %s", err)
+			}
+
+			// Badger expires its keys with a granularity of seconds.
+			time.Sleep(2100 * time.Millisecond)
+
+			var config map[string]string
+			found, err := db.GetAWSIoTCoreThingConfig(ctx, deviceID, &config)
+			if err != nil || found {
+				t.Fatalf("expected the configuration to expire, got found=%t err=%v", found, err)
+			}
+		})
+	}
+}
+
+func TestFanOutReportsAreListedByDMS(t *testing.T) {
+	for name, db := range storeBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			// The LIKE wildcard in the name must not match the other DMS, nor must the case differ.
+			dmsName := uniqueName("dms_a")
+			others := []string{
+				dmsName[:3] + "x" + dmsName[4:],
+				"DMS_A" + dmsName[5:],
+			}
+
+			started := time.Now()
+			for i, report := range []api.ShadowFanOutReport{
+				{ID: "older", DMSName: dmsName, Status: api.ShadowFanOutStatusCompleted, StartedAt: started},
+				{ID: "newer", DMSName: dmsName, Status: api.ShadowFanOutStatusRunning, StartedAt: started.Add(time.Minute)},
+				{ID: "other", DMSName: others[0], StartedAt: started},
+				{ID: "upper", DMSName: others[1], StartedAt: started},
+			} {
+				err := db.UpdateShadowFanOutReport(ctx, report)
+				if err != nil {
+					t.Fatalf("could not store report %d: %s", i, err)
+				}
+			}
+
+			reports, err := db.GetShadowFanOutReports(ctx, dmsName)
+			if err != nil {
+				t.Fatalf("could not list the reports: %s", err)
+			}
+			if len(reports) != 2 || reports[0].ID != "newer" || reports[1].ID != "older" {
+				t.Fatalf("expected the reports of the DMS, newest first, got %+v", reports)
+			}
+		})
+	}
+}
+
+func TestMappings(t *testing.T) {
+	for name, db := range storeBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			caName := uniqueName("ca")
+			awsID := uniqueName("aws-certificate")
+
+			mapping := api.CertificateMapping{
+				CAName:            caName,
+				SerialNumber:      "01-02",
+				AWSCertificateID:  awsID,
+				AWSCertificateArn: "arn:aws:iot:eu-west-1:123456789012:cert/" + awsID,
+			}
+			err := db.UpdateCertificateMapping(ctx, mapping)
+			if err != nil {
+				t.Fatalf("could not store the mapping: %s", err)
+			}
+
+			bySerial, err := db.GetCertificateMapping(ctx, caName, "01-02")
+			if err != nil || bySerial == nil || *bySerial != mapping {
+				t.Fatalf("expected the mapping by serial number, got %+v err=%v", bySerial, err)
+			}
+			byAWSID, err := db.GetCertificateMappingByAWSID(ctx, awsID)
+			if err != nil || byAWSID == nil || *byAWSID != mapping {
+				t.Fatalf("expected the mapping by AWS ID, got %+v err=%v", byAWSID, err)
+			}
+
+			err = db.DeleteCertificateMapping(ctx, caName, "01-02")
+			if err != nil {
+				t.Fatalf("could not delete the mapping: %s", err)
+			}
+
+			bySerial, err = db.GetCertificateMapping(ctx, caName, "01-02")
+			if err != nil || bySerial != nil {
+				t.Fatalf("expected no mapping by serial number, got %+v err=%v", bySerial, err)
+			}
+			byAWSID, err = db.GetCertificateMappingByAWSID(ctx, awsID)
+			if err != nil || byAWSID != nil {
+				t.Fatalf("expected no mapping by AWS ID, got %+v err=%v", byAWSID, err)
+			}
+		})
+	}
+}
+
+func TestFlaggedDriftsAreKeptByKindAndResource(t *testing.T) {
+	for name, db := range storeBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			caName := uniqueName("ca")
+
+			flag := func(kind api.DriftKind, eventID string) {
+				err := db.UpdateFlaggedDrift(ctx, api.FlaggedDrift{
+					Drift:     api.Drift{Kind: kind, Resource: caName, Action: api.ReconcileActionReport},
+					FlaggedAt: time.Now().UTC().Truncate(time.Second),
+					EventID:   eventID,
+				})
+				if err != nil {
+					t.Fatalf("could not flag the drift: %s", err)
+				}
+			}
+			flagged := func() map[api.DriftKind]string {
+				drifts, err := db.ListFlaggedDrifts(ctx)
+				if err != nil {
+					t.Fatalf("could not list the flagged drifts: %s", err)
+				}
+				events := map[api.DriftKind]string{}
+				for _, drift := range drifts {
+					if drift.Resource == caName {
+						events[drift.Kind] = drift.EventID
+					}
+				}
+				return events
+			}
+
+			flag(api.DriftCAStatus, "event-1")
+			flag(api.DriftCAStatus, "event-2")
+			flag(api.DriftCAInactiveInAWS, "event-3")
+			events := flagged()
+			if len(events) != 2 || events[api.DriftCAStatus] != "event-2" || events[api.DriftCAInactiveInAWS] != "event-3" {
+				t.Fatalf("expected the last flag of each kind, got %v", events)
+			}
+
+			err := db.DeleteFlaggedDrift(ctx, api.DriftCAStatus, caName)
+			if err != nil {
+				t.Fatalf("could not delete the flagged drift: %s", err)
+			}
+			events = flagged()
+			if len(events) != 1 || events[api.DriftCAInactiveInAWS] != "event-3" {
+				t.Fatalf("expected only the other kind to remain flagged, got %v", events)
+			}
+
+			// Clearing a drift that is not flagged is not an error.
+			err = db.DeleteFlaggedDrift(ctx, api.DriftCAStatus, caName)
+			if err != nil {
+				t.Fatalf("could not delete a missing flagged drift: %s", err)
+			}
+		})
+	}
+}
+
+func TestThingGroupOwnerships(t *testing.T) {
+	for name, db := range storeBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			group := uniqueName("group")
+
+			ownership, err := db.GetThingGroupOwnership(ctx, group)
+			if err != nil || ownership != nil {
+				t.Fatalf("expected no ownership, got %+v err=%v", ownership, err)
+			}
+
+			err = db.UpdateThingGroupOwnership(ctx, api.ThingGroupOwnership{ThingGroup: group, Created: true, AttachedPolicies: []string{"policy-1"}})
+			if err != nil {
+				t.Fatalf("could not record the ownership: %s", err)
+			}
+			err = db.UpdateThingGroupOwnership(ctx, api.ThingGroupOwnership{ThingGroup: group, Created: true, AttachedPolicies: []string{"policy-2"}})
+			if err != nil {
+				t.Fatalf("could not record the ownership: %s", err)
+			}
+
+			ownership, err = db.GetThingGroupOwnership(ctx, group)
+			if err != nil || ownership == nil || !ownership.Created || len(ownership.AttachedPolicies) != 1 || ownership.AttachedPolicies[0] != "policy-2" {
+				t.Fatalf("expected the last ownership, got %+v err=%v", ownership, err)
+			}
+
+			ownerships, err := db.ListThingGroupOwnerships(ctx)
+			if err != nil {
+				t.Fatalf("could not list the ownerships: %s", err)
+			}
+			found := 0
+			for _, listed := range ownerships {
+				if listed.ThingGroup == group {
+					found++
+				}
+			}
+			if found != 1 {
+				t.Fatalf("expected the group to be listed once, got %d", found)
+			}
+		})
+	}
+}
+
+func TestProcessedEvents(t *testing.T) {
+	for name, db := range storeBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			eventID := uniqueName("event")
+
+			processed, err := db.IsEventProcessed(ctx, eventID)
+			if err != nil || processed {
+				t.Fatalf("expected a new event, got processed=%t err=%v", processed, err)
+			}
+
+			err = db.MarkEventProcessed(ctx, eventID)
+			if err != nil {
+				t.Fatalf("could not mark the event: %s", err)
+			}
+			err = db.MarkEventProcessed(ctx, eventID)
+			if err != nil {
+				t.Fatalf("could not mark the event twice: %s", err)
+			}
+
+			processed, err = db.IsEventProcessed(ctx, eventID)
+			if err != nil || !processed {
+				t.Fatalf("expected a processed event, got processed=%t err=%v", processed, err)
+			}
+		})
+	}
+}
+
+func TestPendingStatusChangesAreTakenOnce(t *testing.T) {
+	for name, db := range storeBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			change := api.PendingStatusChange{
+				CorrelationID:    uniqueName("correlation"),
+				Resource:         api.StatusChangeResourceCertificate,
+				AWSCertificateID: uniqueName("aws-certificate"),
+				Status:           "REVOKED",
+				CreatedAt:        time.Now(),
+			}
+
+			err := db.AddPendingStatusChange(ctx, change, time.Hour)
+			if err != nil {
+				t.Fatalf("could not add the change: %s", err)
+			}
+
+			other, err := db.TakePendingStatusChange(ctx, change.Resource, change.AWSCertificateID, "INACTIVE")
+			if err != nil || other != nil {
+				t.Fatalf("expected no change for another status, got %+v err=%v", other, err)
+			}
+
+			taken, err := db.TakePendingStatusChange(ctx, change.Resource, change.AWSCertificateID, change.Status)
+			if err != nil || taken == nil || taken.CorrelationID != change.CorrelationID {
+				t.Fatalf("expected the change, got %+v err=%v", taken, err)
+			}
+
+			taken, err = db.TakePendingStatusChange(ctx, change.Resource, change.AWSCertificateID, change.Status)
+			if err != nil || taken != nil {
+				t.Fatalf("expected the change to be taken once, got %+v err=%v", taken, err)
+			}
+		})
+	}
+}
+
+func TestShadowActionCompletionsAreBounded(t *testing.T) {
+	for name, db := range storeBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			deviceID := uniqueName("device")
+
+			for version := int64(1); version <= maxDeviceShadowActionCompletions+5; version++ {
+				err := db.AddDeviceShadowActionCompletion(ctx, deviceID, api.ShadowActionCompletion{
+					Action:        api.ShadowActionUpdateCACerts,
+					ShadowVersion: version,
+					CompletedAt:   time.Now(),
+				})
+				if err != nil {
+					t.Fatalf("could not add completion %d: %s", version, err)
+				}
+			}
+
+			completions, err := db.GetDeviceShadowActionCompletions(ctx, deviceID)
+			if err != nil {
+				t.Fatalf("could not list the completions: %s", err)
+			}
+			if len(completions) != maxDeviceShadowActionCompletions {
+				t.Fatalf("expected %d completions, got %d", maxDeviceShadowActionCompletions, len(completions))
+			}
+			if completions[0].ShadowVersion != 6 || completions[len(completions)-1].ShadowVersion != maxDeviceShadowActionCompletions+5 {
+				t.Fatalf("expected the latest completions in order, got versions %d to %d", completions[0].ShadowVersion, completions[len(completions)-1].ShadowVersion)
+			}
+		})
+	}
+}
+
+func TestOutboxEntriesAreListedInOrder(t *testing.T) {
+	for name, db := range storeBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			eventIDs := []string{uniqueName("first"), uniqueName("second"), uniqueName("third")}
+
+			ids := []uint64{}
+			for _, eventID := range eventIDs {
+				entry, err := db.AddOutboxEntry(ctx, api.OutboxEntry{
+					EventID:       eventID,
+					EventType:     "io.lamassuiot.certificate.update",
+					Destination:   api.EventDestination{Type: api.EventDestinationSQS},
+					Payload:       []byte(`{"id":"` + eventID + `"}`),
+					Status:        api.OutboxEntryStatusPending,
+					CreatedAt:     time.Now(),
+					NextAttemptAt: time.Now(),
+				})
+				if err != nil {
+					t.Fatalf("could not add entry %s: %s", eventID, err)
+				}
+				if entry.ID == 0 || (len(ids) > 0 && entry.ID <= ids[len(ids)-1]) {
+					t.Fatalf("expected increasing IDs, got %d after %v", entry.ID, ids)
+				}
+				ids = append(ids, entry.ID)
+			}
+
+			second, err := db.GetOutboxEntry(ctx, ids[1])
+			if err != nil || second == nil {
+				t.Fatalf("expected the second entry, got %+v err=%v", second, err)
+			}
+			second.Status = api.OutboxEntryStatusFailed
+			second.Attempts = 3
+			second.LastError = "queue not found"
+			err = db.UpdateOutboxEntry(ctx, *second)
+			if err != nil {
+				t.Fatalf("could not update the entry: %s", err)
+			}
+
+			err = db.DeleteOutboxEntry(ctx, ids[0])
+			if err != nil {
+				t.Fatalf("could not delete the entry: %s", err)
+			}
+
+			entries, err := db.ListOutboxEntries(ctx)
+			if err != nil {
+				t.Fatalf("could not list the entries: %s", err)
+			}
+			listed := []api.OutboxEntry{}
+			for _, entry := range entries {
+				if entry.ID >= ids[0] {
+					listed = append(listed, entry)
+				}
+			}
+			if len(listed) != 2 || listed[0].EventID != eventIDs[1] || listed[1].EventID != eventIDs[2] {
+				t.Fatalf("expected the second and third entries, got %+v", listed)
+			}
+			if listed[0].Status != api.OutboxEntryStatusFailed || listed[0].Attempts != 3 || listed[0].LastError != "queue not found" {
+				t.Fatalf("expected the update to be stored, got %+v", listed[0])
+			}
+			if string(listed[1].Payload) != `{"id":"`+eventIDs[2]+`"}` {
+				t.Fatalf("expected the payload to be kept, got %s", listed[1].Payload)
+			}
+		})
+	}
+}
+
+func TestLeases(t *testing.T) {
+	for name, db := range storeBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			lease := uniqueName("job")
+
+			acquired, err := db.AcquireLease(ctx, lease, "replica-a", time.Minute)
+			if err != nil || !acquired {
+				t.Fatalf("expected replica-a to acquire the lease, got %t err=%v", acquired, err)
+			}
+
+			acquired, err = db.AcquireLease(ctx, lease, "replica-b", time.Minute)
+			if err != nil || acquired {
+				t.Fatalf("expected replica-b not to acquire a held lease, got %t err=%v", acquired, err)
+			}
+
+			acquired, err = db.AcquireLease(ctx, lease, "replica-a", time.Minute)
+			if err != nil || !acquired {
+				t.Fatalf("expected replica-a to renew its lease, got %t err=%v", acquired, err)
+			}
+
+			err = db.ReleaseLease(ctx, lease, "replica-b")
+			if err != nil {
+				t.Fatalf("could not release the lease of another owner: %s", err)
+			}
+			acquired, err = db.AcquireLease(ctx, lease, "replica-b", time.Minute)
+			if err != nil || acquired {
+				t.Fatalf("expected the lease to be kept when another owner releases it, got %t err=%v", acquired, err)
+			}
+
+			err = db.ReleaseLease(ctx, lease, "replica-a")
+			if err != nil {
+				t.Fatalf("could not release the lease: %s", err)
+			}
+			acquired, err = db.AcquireLease(ctx, lease, "replica-b", 50*time.Millisecond)
+			if err != nil || !acquired {
+				t.Fatalf("expected replica-b to acquire a released lease, got %t err=%v", acquired, err)
+			}
+
+			time.Sleep(100 * time.Millisecond)
+			acquired, err = db.AcquireLease(ctx, lease, "replica-a", time.Minute)
+			if err != nil || !acquired {
+				t.Fatalf("expected replica-a to acquire an expired lease, got %t err=%v", acquired, err)
+			}
+		})
+	}
+}
+
+func TestCacheGeneration(t *testing.T) {
+	for name, db := range storeBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			before, err := db.GetCacheGeneration(ctx)
+			if err != nil {
+				t.Fatalf("could not read the generation: %s", err)
+			}
+
+			for i := 0; i < 2; i++ {
+				err = db.BumpCacheGeneration(ctx)
+				if err != nil {
+					t.Fatalf("could not bump the generation: %s", err)
+				}
+			}
+
+			after, err := db.GetCacheGeneration(ctx)
+			if err != nil || after != before+2 {
+				t.Fatalf("expected generation %d, got %d err=%v", before+2, after, err)
+			}
+		})
+	}
+}
+
+func TestBadgerMigratesTheFanOutReports(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// A store at schema version 1 whose first report is already in the current layout, so
+	// the older ones after it must still be migrated.
+	badgerDB, err := badger.Open(badger.DefaultOptions(filepath.Join(dir, "badger")).WithLogger(nil))
+	if err != nil {
+		t.Fatalf("could not create the store: %s", err)
+	}
+	err = badgerDB.Update(func(txn *badger.Txn) error {
+		for key, value := range map[string]string{
+			SchemaVersion:                  `1`,
+			ShadowFanOutReport("dms", "a"): `{"id":"a","dms_name":"dms","succeeded":3,"skipped":0,"failed":[]}`,
+			ShadowFanOutReport("dms", "b"): `{"id":"b","dms_name":"dms","succeeded":["d1","d2"],"skipped":["d3"],"failed":[]}`,
+		} {
+			err := txn.Set([]byte(key), []byte(value))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	badgerDB.Close()
+	if err != nil {
+		t.Fatalf("could not store the reports: %s", err)
+	}
+
+	db, err := NewPersistentDB(dir)
+	if err != nil {
+		t.Fatalf("could not migrate the store: %s", err)
+	}
+	defer db.Close()
+
+	reports, err := db.GetShadowFanOutReports(ctx, "dms")
+	if err != nil {
+		t.Fatalf("could not list the reports: %s", err)
+	}
+	counts := map[string][2]int{}
+	for _, report := range reports {
+		counts[report.ID] = [2]int{report.Succeeded, report.Skipped}
+	}
+	if counts["a"] != [2]int{3, 0} || counts["b"] != [2]int{2, 1} {
+		t.Fatalf("expected the devices of every report to be counted, got %+v", reports)
+	}
+}
+
+func TestSQLiteKeepsTheStateAcrossRestarts(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "connector.db")
+
+	db, err := NewSQLiteDB(path)
+	if err != nil {
+		t.Fatalf("could not create the store: %s", err)
+	}
+	err = db.UpdateAWSCAMapping(ctx, api.AWSCAMapping{CAName: "ca", AWSCertificateID: "aws-ca", AWSCertificateArn: "arn"})
+	if err != nil {
+		t.Fatalf("could not store the mapping: %s", err)
+	}
+	db.Close()
+
+	db, err = NewSQLiteDB(path)
+	if err != nil {
+		t.Fatalf("could not reopen the store: %s", err)
+	}
+	defer db.Close()
+
+	mapping, err := db.GetAWSCAMappingByAWSID(ctx, "aws-ca")
+	if err != nil || mapping == nil || mapping.CAName != "ca" {
+		t.Fatalf("expected the mapping to be kept, got %+v err=%v", mapping, err)
+	}
+}
@@ -2,14 +2,104 @@ package store
 
 import (
 	"context"
+	"time"
+
+	api "github.com/lamassuiot/aws-connector/pkg/common"
 )
 
 type DB interface {
-	GetAWSIoTCoreConfig(ctx context.Context) (map[string]interface{}, error)
-	UpdateAWSIoTCoreConfig(ctx context.Context, newConfig interface{}) error
+	// The cached configurations are decoded into config, the getters report whether an
+	// unexpired entry was found.
+	GetAWSIoTCoreConfig(ctx context.Context, config interface{}) (bool, error)
+	UpdateAWSIoTCoreConfig(ctx context.Context, newConfig interface{}, ttl time.Duration) error
 	DeleteAWSIoTCoreConfig(ctx context.Context) error
 
-	GetAWSIoTCoreThingConfig(ctx context.Context, deviceID string) (interface{}, error)
-	UpdateAWSIoTCoreThingConfig(ctx context.Context, deviceID string, newConfig interface{}) error
+	GetAWSIoTCoreThingConfig(ctx context.Context, deviceID string, config interface{}) (bool, error)
+	UpdateAWSIoTCoreThingConfig(ctx context.Context, deviceID string, newConfig interface{}, ttl time.Duration) error
 	DeleteAWSIoTCoreThingConfig(ctx context.Context, deviceID string) error
+	DeleteAWSIoTCoreThingConfigs(ctx context.Context) error
+
+	GetDeviceShadowActionCompletions(ctx context.Context, deviceID string) ([]api.ShadowActionCompletion, error)
+	AddDeviceShadowActionCompletion(ctx context.Context, deviceID string, completion api.ShadowActionCompletion) error
+
+	// The getters return nil when nothing has been stored for the DMS yet.
+	GetDMSAWSSettings(ctx context.Context, dmsName string) (*api.DMSAWSSettings, error)
+	ListDMSAWSSettings(ctx context.Context) ([]api.DMSAWSSettings, error)
+	UpdateDMSAWSSettings(ctx context.Context, settings api.DMSAWSSettings) error
+
+	GetDMSShadowLocation(ctx context.Context, dmsName string) (*api.ShadowLocation, error)
+	UpdateDMSShadowLocation(ctx context.Context, dmsName string, location api.ShadowLocation) error
+
+	GetDMSShadowMigration(ctx context.Context, dmsName string) (*api.ShadowMigration, error)
+	UpdateDMSShadowMigration(ctx context.Context, migration api.ShadowMigration) error
+
+	GetDMSCABundleState(ctx context.Context, dmsName string) (*api.CABundleState, error)
+	UpdateDMSCABundleState(ctx context.Context, state api.CABundleState) error
+	DeleteDMSCABundleState(ctx context.Context, dmsName string) error
+
+	// The getter returns nil for the thing groups the connector never changed.
+	GetThingGroupOwnership(ctx context.Context, thingGroup string) (*api.ThingGroupOwnership, error)
+	ListThingGroupOwnerships(ctx context.Context) ([]api.ThingGroupOwnership, error)
+	UpdateThingGroupOwnership(ctx context.Context, ownership api.ThingGroupOwnership) error
+
+	GetReconciliationReport(ctx context.Context) (*api.ReconciliationReport, error)
+	UpdateReconciliationReport(ctx context.Context, report api.ReconciliationReport) error
+
+	// Flagged drifts are kept by kind and resource, a new flag replaces the previous one.
+	ListFlaggedDrifts(ctx context.Context) ([]api.FlaggedDrift, error)
+	UpdateFlaggedDrift(ctx context.Context, drift api.FlaggedDrift) error
+	DeleteFlaggedDrift(ctx context.Context, kind api.DriftKind, resource string) error
+
+	GetShadowFanOutReports(ctx context.Context, dmsName string) ([]api.ShadowFanOutReport, error)
+	UpdateShadowFanOutReport(ctx context.Context, report api.ShadowFanOutReport) error
+
+	GetFleetImport(ctx context.Context, importID string) (*api.FleetImport, error)
+	GetFleetImports(ctx context.Context) ([]api.FleetImport, error)
+	UpdateFleetImport(ctx context.Context, fleetImport api.FleetImport) error
+
+	ListDMSShadowMigrations(ctx context.Context) ([]api.ShadowMigration, error)
+
+	// Mappings are kept in both directions, the getters return nil for unknown resources.
+	GetAWSCAMapping(ctx context.Context, caName string) (*api.AWSCAMapping, error)
+	GetAWSCAMappingByAWSID(ctx context.Context, awsCertificateID string) (*api.AWSCAMapping, error)
+	UpdateAWSCAMapping(ctx context.Context, mapping api.AWSCAMapping) error
+	DeleteAWSCAMapping(ctx context.Context, caName string) error
+
+	GetCertificateMapping(ctx context.Context, caName string, serialNumber string) (*api.CertificateMapping, error)
+	GetCertificateMappingByAWSID(ctx context.Context, awsCertificateID string) (*api.CertificateMapping, error)
+	UpdateCertificateMapping(ctx context.Context, mapping api.CertificateMapping) error
+	DeleteCertificateMapping(ctx context.Context, caName string, serialNumber string) error
+
+	IsEventProcessed(ctx context.Context, eventID string) (bool, error)
+	MarkEventProcessed(ctx context.Context, eventID string) error
+
+	// Pending status changes expire after ttl. TakePendingStatusChange removes the change and
+	// returns it, or nil when there is none.
+	AddPendingStatusChange(ctx context.Context, change api.PendingStatusChange, ttl time.Duration) error
+	TakePendingStatusChange(ctx context.Context, resource api.StatusChangeResource, awsCertificateID string, status string) (*api.PendingStatusChange, error)
+
+	// Expiry notices expire after ttl. The getter returns nil when the certificate has no
+	// notice.
+	GetCertificateExpiryNotice(ctx context.Context, awsCertificateID string) (*api.CertificateExpiryNotice, error)
+	UpdateCertificateExpiryNotice(ctx context.Context, notice api.CertificateExpiryNotice, ttl time.Duration) error
+
+	// Outbox entries are listed in delivery order. AddOutboxEntry assigns the ID of the entry.
+	AddOutboxEntry(ctx context.Context, entry api.OutboxEntry) (*api.OutboxEntry, error)
+	GetOutboxEntry(ctx context.Context, id uint64) (*api.OutboxEntry, error)
+	ListOutboxEntries(ctx context.Context) ([]api.OutboxEntry, error)
+	UpdateOutboxEntry(ctx context.Context, entry api.OutboxEntry) error
+	DeleteOutboxEntry(ctx context.Context, id uint64) error
+
+	// Leases keep a job or a workflow from running more than once at a time, even across
+	// replicas. AcquireLease reports whether owner holds the lease of name until ttl elapses:
+	// it renews the lease owner already holds and fails while another owner holds it.
+	AcquireLease(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error)
+	ReleaseLease(ctx context.Context, name string, owner string) error
+
+	// The cache generation is bumped whenever the cached configurations are invalidated, so
+	// that no replica caches a configuration read before the invalidation.
+	GetCacheGeneration(ctx context.Context) (uint64, error)
+	BumpCacheGeneration(ctx context.Context) error
+
+	Close() error
 }